@@ -0,0 +1,166 @@
+/*
+Copyright © 2025 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/archive"
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+// archiveCmd represents the archive command
+var archiveCmd = &cobra.Command{
+	Use:   "archive",
+	Short: "Manages the reciever's archive of deleted files",
+	Long: `Every file deleted on the sender is kept by the reciever as a timestamped
+version in the archive, <file-root>/.archive unless --archive-dir is set.
+Run these commands on the reciever host.`,
+}
+
+var archiveListCmd = &cobra.Command{
+	Use:   "list [path]",
+	Short: "Lists the archived versions",
+	Long: `List the archived versions of all files, or of the files under path.
+
+file-replicator archive list --file-root /replica
+file-replicator archive list --archive-dir /var/lib/file-replicator/archive --file-root /replica reports/ --json
+	`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		fileArchive, err := archiveConfig(cmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid archive configuration: %v\n", err)
+			os.Exit(1)
+		}
+		prefix := ""
+		if len(args) > 0 {
+			prefix = args[0]
+		}
+
+		versions, err := fileArchive.List(prefix)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list the archive: %v\n", err)
+			os.Exit(1)
+		}
+
+		if jsonOutput, _ := cmd.Flags().GetBool("json"); jsonOutput {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			encoder.Encode(versions)
+			return
+		}
+		var total int64
+		for _, version := range versions {
+			fmt.Printf("%s  %12d  %s  %s\n", version.ArchivedAt.Local().Format(time.DateTime), version.Size, version.Version, version.Path)
+			total += version.Size
+		}
+		fmt.Printf("%d versions, %d bytes\n", len(versions), total)
+	},
+}
+
+var archivePurgeCmd = &cobra.Command{
+	Use:   "purge [path]",
+	Short: "Removes archived versions",
+	Long: `Remove the archived versions of the files under path, or of all files with
+--all, optionally only the ones older than --older-than. Without --older-than
+all their versions are removed. With --retention, the retention flags are
+applied instead, as the reciever's pruner would.
+
+file-replicator archive purge --file-root /replica --older-than 90d --all
+file-replicator archive purge --file-root /replica reports/old/
+file-replicator archive purge --file-root /replica --retention --archive-keep-versions 5
+	`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		fileArchive, err := archiveConfig(cmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid archive configuration: %v\n", err)
+			os.Exit(1)
+		}
+		all, _ := cmd.Flags().GetBool("all")
+		retention, _ := cmd.Flags().GetBool("retention")
+		olderThanFlag, _ := cmd.Flags().GetString("older-than")
+
+		var result archive.PruneResult
+		if retention {
+			result, err = fileArchive.Prune()
+		} else {
+			olderThan, parseErr := archive.ParseAge(olderThanFlag)
+			if parseErr != nil {
+				fmt.Fprintf(os.Stderr, "Invalid --older-than: %v\n", parseErr)
+				os.Exit(1)
+			}
+			if len(args) == 0 && !all {
+				fmt.Fprintln(os.Stderr, "Give a path, or --all to purge the whole archive")
+				os.Exit(1)
+			}
+			prefix := ""
+			if len(args) > 0 {
+				prefix = args[0]
+			}
+			result, err = fileArchive.Purge(prefix, olderThan)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to purge the archive: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Removed %d versions, freed %d bytes\n", result.Removed, result.Freed)
+	},
+}
+
+// archiveConfig builds the archive from the --archive-* flags.
+func archiveConfig(cmd *cobra.Command) (*archive.Archive, error) {
+	fileRoot, _ := cmd.Flags().GetString("file-root")
+	archiveDir, _ := cmd.Flags().GetString("archive-dir")
+	keepVersions, _ := cmd.Flags().GetInt("archive-keep-versions")
+	maxAgeFlag, _ := cmd.Flags().GetString("archive-max-age")
+	maxSizeFlag, _ := cmd.Flags().GetString("archive-max-size")
+
+	if archiveDir == "" {
+		archiveDir = filepath.Join(fileRoot, ".archive")
+	}
+	maxAge, err := archive.ParseAge(maxAgeFlag)
+	if err != nil {
+		return nil, err
+	}
+	maxSize, err := client.ParseByteSize(maxSizeFlag)
+	if err != nil {
+		return nil, err
+	}
+	if keepVersions < 0 {
+		return nil, fmt.Errorf("--archive-keep-versions can not be negative")
+	}
+	return archive.New(archiveDir, archive.Retention{
+		KeepVersions: keepVersions,
+		MaxAge:       maxAge,
+		MaxSize:      int64(maxSize),
+	}), nil
+}
+
+func addArchiveFlags(cmd *cobra.Command) {
+	cmd.Flags().String("archive-dir", "", "Directory to keep deleted files in, preferably outside --file-root. Defaults to <file-root>/.archive")
+	cmd.Flags().Int("archive-keep-versions", 0, "Archived versions to keep per file. No limit when 0")
+	cmd.Flags().String("archive-max-age", "0", "Remove archived versions older than this, e.g. 30d or 12h. No limit when 0")
+	cmd.Flags().String("archive-max-size", "0", "Maximum total size of the archive, e.g. 50G, the oldest versions go first. No limit when 0")
+}
+
+func init() {
+	rootCmd.AddCommand(archiveCmd)
+	archiveCmd.AddCommand(archiveListCmd)
+	archiveCmd.AddCommand(archivePurgeCmd)
+
+	addArchiveFlags(archiveListCmd)
+	archiveListCmd.Flags().Bool("json", false, "Print the versions as JSON")
+
+	addArchiveFlags(archivePurgeCmd)
+	archivePurgeCmd.Flags().Bool("all", false, "Purge the whole archive when no path is given")
+	archivePurgeCmd.Flags().String("older-than", "0", "Only remove versions archived longer ago, e.g. 90d")
+	archivePurgeCmd.Flags().Bool("retention", false, "Apply the --archive-keep-versions, --archive-max-age and --archive-max-size rules")
+}
@@ -0,0 +1,199 @@
+/*
+Copyright © 2025 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/pkg/files"
+	"github.com/kosalaat/file-replicator/pkg/server"
+	"github.com/kosalaat/file-replicator/pkg/versions"
+	"github.com/spf13/cobra"
+)
+
+// bisyncCmd represents the bisync command
+var bisyncCmd = &cobra.Command{
+	Use:   "bisync",
+	Short: "Keeps two sites in sync in both directions",
+	Long: `Run file-replicator as sender and reciever at once, replicating local edits to
+the peer and applying the peer's edits locally. Run the same command on both
+sites, each with its own --site-id and pointing --peer at the other one:
+
+file-replicator bisync --site-id a --address 0.0.0.0:50051 --peer site-b:50051 --file-root /data --state-file /var/lib/file-replicator/a.json
+file-replicator bisync --site-id b --address 0.0.0.0:50051 --peer site-a:50051 --file-root /data --state-file /var/lib/file-replicator/b.json
+
+Files edited on both sites before they synced are resolved by --conflict-policy:
+
+  newest       the copy with the latest modification time wins (default)
+  keep-both    the newest copy wins, the other one is kept as <name>.<site>.conflict
+  prefer-site  the copy last written by --prefer-site wins
+
+Every conflict is appended as a JSON line to --conflict-report.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		address, _ := cmd.Flags().GetString("address")
+		fileRoot, _ := cmd.Flags().GetString("file-root")
+		blockSize, _ := cmd.Flags().GetInt("block-size")
+		parallelism, _ := cmd.Flags().GetInt("parallelism")
+		peer, _ := cmd.Flags().GetString("peer")
+		siteID, _ := cmd.Flags().GetString("site-id")
+		stateFile, _ := cmd.Flags().GetString("state-file")
+		saveInterval, _ := cmd.Flags().GetDuration("state-save-interval")
+		staged, _ := cmd.Flags().GetBool("staged")
+
+		if peer == "" {
+			panic("--peer is required")
+		}
+		if siteID == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				panic(fmt.Sprintf("Failed to default --site-id to the hostname: %v", err))
+			}
+			siteID = hostname
+		}
+
+		resolver, err := conflictResolver(cmd)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid conflict policy: %v", err))
+		}
+
+		store, err := versions.NewStore(siteID, stateFile)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to load the version state: %v", err))
+		}
+		go store.Run(context.Background(), saveInterval)
+
+		replicationServer := server.NewReplicationServer()
+		replicationServer.Versions = store
+		replicationServer.Conflicts = resolver
+		fileArchive, err := archiveConfig(cmd)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid archive configuration: %v", err))
+		}
+		replicationServer.Archive = fileArchive
+		if interval, _ := cmd.Flags().GetDuration("archive-prune-interval"); interval > 0 {
+			go fileArchive.Run(context.Background(), interval)
+		}
+		replicationServer.HashAlgorithms, _ = cmd.Flags().GetStringSlice("hash-algorithms")
+		if replicationServer.Quota, err = quotaConfig(cmd); err != nil {
+			panic(fmt.Sprintf("Invalid quota: %v", err))
+		}
+		if report, _ := cmd.Flags().GetString("verify-report"); report != "" {
+			replicationServer.Verifications = &server.VerificationReport{Path: report}
+		}
+		if snapshots, _ := cmd.Flags().GetBool("snapshots"); snapshots {
+			replicationServer.Snapshots = snapshotConfig(cmd)
+			if interval, _ := cmd.Flags().GetDuration("snapshot-interval"); interval > 0 {
+				go replicationServer.RunSnapshots(context.Background(), interval)
+			}
+		}
+		if reverseDeltas, _ := cmd.Flags().GetBool("reverse-deltas"); reverseDeltas {
+			journal, err := deltasConfig(cmd)
+			if err != nil {
+				panic(fmt.Sprintf("Invalid reverse delta configuration: %v", err))
+			}
+			replicationServer.Deltas = journal
+			defer journal.Close()
+			if interval, _ := cmd.Flags().GetDuration("archive-prune-interval"); interval > 0 {
+				go journal.Run(context.Background(), interval)
+			}
+		}
+		if replicationServer.Credentials, err = serverCredentials(cmd); err != nil {
+			panic(fmt.Sprintf("Invalid TLS configuration: %v", err))
+		}
+		if replicationServer.Policy, err = authPolicy(cmd); err != nil {
+			panic(fmt.Sprintf("Invalid authorization policy: %v", err))
+		}
+		go func() {
+			if err := replicationServer.StartListening(address, fileRoot); err != nil {
+				panic(fmt.Sprintf("Failed to start the replication server: %v", err))
+			}
+		}()
+		defer replicationServer.StopListening()
+
+		throttle, err := newThrottle(cmd)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid bandwidth limit: %v", err))
+		}
+		wireOptions, negotiate, err := wireConfig(cmd)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid wire configuration: %v", err))
+		}
+		transport, err := transportOptions(cmd)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid TLS configuration: %v", err))
+		}
+		wireOptions = append(wireOptions, transport...)
+		replicationClient, err := client.NewReplicatorClient(peer, fileRoot, uint64(parallelism), append(wireOptions, client.WithThrottle(throttle))...)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to create replication client: %v", err))
+		}
+		if negotiate {
+			if err := replicationClient.Negotiate(context.Background()); err != nil {
+				panic(fmt.Sprintf("Failed to negotiate with the peer: %v", err))
+			}
+		}
+
+		fileReplicator := &files.FileReplicator{
+			ReplicatorClient: *replicationClient,
+			Name:             peer,
+			Versions:         store,
+			Staged:           staged,
+		}
+		if err := fileReplicator.SetupFileWatcher(fileRoot, uint64(blockSize)); err != nil {
+			panic(fmt.Sprintf("Failed to start monitoring: %v", err))
+		}
+	},
+}
+
+func conflictResolver(cmd *cobra.Command) (*versions.Resolver, error) {
+	policyFlag, _ := cmd.Flags().GetString("conflict-policy")
+	preferSite, _ := cmd.Flags().GetString("prefer-site")
+	report, _ := cmd.Flags().GetString("conflict-report")
+
+	policy, err := versions.ParsePolicy(policyFlag)
+	if err != nil {
+		return nil, err
+	}
+	if policy == versions.PreferSite && preferSite == "" {
+		return nil, fmt.Errorf("--prefer-site is required with the %s policy", policy)
+	}
+	return &versions.Resolver{
+		Policy:        policy,
+		PreferredSite: preferSite,
+		ReportPath:    report,
+	}, nil
+}
+
+func init() {
+	rootCmd.AddCommand(bisyncCmd)
+
+	bisyncCmd.Flags().String("peer", "", "Address of the other site")
+	bisyncCmd.Flags().String("site-id", "", "Unique name of this site, defaults to the hostname")
+	addWireFlags(bisyncCmd)
+	bisyncCmd.Flags().StringSlice("hash-algorithms", nil, "Block hashes accepted from the peer. Any supported one when empty")
+	bisyncCmd.Flags().Bool("staged", true, "Stage every new file version on the peer, verify its whole-file digest and make it live at once when complete. Peers without staging are sent the chunks directly")
+	bisyncCmd.Flags().String("conflict-policy", "newest", "How to resolve concurrent edits: newest, keep-both or prefer-site")
+	bisyncCmd.Flags().String("prefer-site", "", "Site whose edits win with the prefer-site policy")
+	bisyncCmd.Flags().String("state-file", "", "File to keep the version vectors in, outside the file root. Kept in memory only when empty")
+	bisyncCmd.Flags().Duration("state-save-interval", 10*time.Second, "Interval to save the version state")
+	bisyncCmd.Flags().String("conflict-report", "", "File to append the resolved conflicts to as JSON lines")
+	bisyncCmd.Flags().String("bwlimit", "0", "Bandwidth limit towards the peer, e.g. 10M. 0 means unlimited")
+	bisyncCmd.Flags().String("bwlimit-schedule", "", "Bandwidth limits by time of day, e.g. 08:00-18:00=10M,*=0")
+	addArchiveFlags(bisyncCmd)
+	bisyncCmd.Flags().Duration("archive-prune-interval", time.Hour, "Interval to apply the archive and reverse delta retention rules. Disabled when 0")
+	bisyncCmd.Flags().Bool("reverse-deltas", false, "Save the blocks every batch overwrites, so files can be rebuilt as they were before it")
+	addDeltasFlags(bisyncCmd)
+	addQuotaFlags(bisyncCmd)
+	bisyncCmd.Flags().String("auth-policy", "", "JSON file with the identities allowed to call the reciever and the paths they may touch")
+	bisyncCmd.Flags().String("verify-report", "", "File to append the digest checks of the committed file versions to as JSON lines")
+	bisyncCmd.Flags().Bool("snapshots", false, "Take snapshots of the file root on a schedule or when the sender asks")
+	bisyncCmd.Flags().Duration("snapshot-interval", 0, "Interval to take snapshots at. Only on request when 0")
+	addSnapshotFlags(bisyncCmd)
+	bisyncCmd.Flags().String("bwlimit-schedule-file", "", "File with the bandwidth schedule, re-read on SIGHUP")
+}
@@ -0,0 +1,173 @@
+/*
+Copyright © 2025 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/archive"
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/pkg/deltas"
+	"github.com/spf13/cobra"
+)
+
+// deltasCmd represents the deltas command
+var deltasCmd = &cobra.Command{
+	Use:   "deltas",
+	Short: "Reads the reverse deltas the reciever keeps of overwritten blocks",
+	Long: `With --reverse-deltas the reciever saves the blocks every replication batch
+overwrites, so a file can be rebuilt as it was before any batch, within the
+retention limits. Run these commands on the reciever host.`,
+}
+
+var deltasListCmd = &cobra.Command{
+	Use:   "list [path]",
+	Short: "Lists the batches that can be undone",
+	Long: `List the batches of all files, or of the files under path.
+
+file-replicator deltas list --file-root /replica reports/q3.xlsx
+	`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		journal, err := deltasConfig(cmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid reverse delta configuration: %v\n", err)
+			os.Exit(1)
+		}
+		prefix := ""
+		if len(args) > 0 {
+			prefix = args[0]
+		}
+
+		batches, err := journal.List(prefix)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list the reverse deltas: %v\n", err)
+			os.Exit(1)
+		}
+
+		if jsonOutput, _ := cmd.Flags().GetBool("json"); jsonOutput {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			encoder.Encode(batches)
+			return
+		}
+		for _, batch := range batches {
+			before := fmt.Sprintf("%d bytes, %v", batch.FileSize, batch.FileMode.Perm())
+			if !batch.Existed {
+				before = "created"
+			}
+			fmt.Printf("%s  %s  %10d  %-24s  %s\n", batch.CreatedAt.Local().Format(time.DateTime), batch.Version, batch.Size, before, batch.Path)
+		}
+		fmt.Printf("%d batches\n", len(batches))
+	},
+}
+
+var deltasRestoreCmd = &cobra.Command{
+	Use:   "restore <path> <version>",
+	Short: "Rebuilds a file as it was before a batch",
+	Long: `Rebuild the file as it was before the batch with the given version, undoing
+that batch and every later one, and write it to --output. For a file that has
+since been deleted, give the archived version it was deleted as with
+--archive-version.
+
+file-replicator deltas restore --file-root /replica reports/q3.xlsx 20250301T120000.000000000Z --output /tmp/q3.xlsx
+	`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		journal, err := deltasConfig(cmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid reverse delta configuration: %v\n", err)
+			os.Exit(1)
+		}
+		fileRoot, _ := cmd.Flags().GetString("file-root")
+		output, _ := cmd.Flags().GetString("output")
+		archiveVersion, _ := cmd.Flags().GetString("archive-version")
+		if output == "" {
+			fmt.Fprintln(os.Stderr, "--output is required")
+			os.Exit(1)
+		}
+
+		relativePath := filepath.Clean(args[0])
+		basePath := filepath.Join(fileRoot, relativePath)
+		if archiveVersion != "" {
+			fileArchive, err := archiveConfig(cmd)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid archive configuration: %v\n", err)
+				os.Exit(1)
+			}
+			version, err := fileArchive.Find(relativePath, archiveVersion)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to find the archived version: %v\n", err)
+				os.Exit(1)
+			}
+			basePath = filepath.Join(fileArchive.Root, version.Name())
+			relativePath = version.Name()
+		}
+
+		if err := journal.Reconstruct(basePath, relativePath, args[1], output); err != nil {
+			if errors.Is(err, deltas.ErrNotExisted) {
+				fmt.Fprintf(os.Stderr, "%s was created by batch %s\n", args[0], args[1])
+			} else {
+				fmt.Fprintf(os.Stderr, "Failed to rebuild %s: %v\n", args[0], err)
+			}
+			os.Exit(1)
+		}
+		fmt.Printf("Wrote %s as it was before %s to %s\n", args[0], args[1], output)
+	},
+}
+
+// deltasConfig builds the reverse delta journal from the --deltas-* flags.
+func deltasConfig(cmd *cobra.Command) (*deltas.Journal, error) {
+	fileRoot, _ := cmd.Flags().GetString("file-root")
+	deltasDir, _ := cmd.Flags().GetString("deltas-dir")
+	keepVersions, _ := cmd.Flags().GetInt("deltas-keep-versions")
+	maxAgeFlag, _ := cmd.Flags().GetString("deltas-max-age")
+	maxSizeFlag, _ := cmd.Flags().GetString("deltas-max-size")
+
+	if deltasDir == "" {
+		deltasDir = filepath.Join(fileRoot, ".deltas")
+	}
+	maxAge, err := archive.ParseAge(maxAgeFlag)
+	if err != nil {
+		return nil, err
+	}
+	maxSize, err := client.ParseByteSize(maxSizeFlag)
+	if err != nil {
+		return nil, err
+	}
+	if keepVersions < 0 {
+		return nil, fmt.Errorf("--deltas-keep-versions can not be negative")
+	}
+	return deltas.New(deltasDir, archive.Retention{
+		KeepVersions: keepVersions,
+		MaxAge:       maxAge,
+		MaxSize:      int64(maxSize),
+	}), nil
+}
+
+func addDeltasFlags(cmd *cobra.Command) {
+	cmd.Flags().String("deltas-dir", "", "Directory to keep the reverse deltas in, preferably outside --file-root. Defaults to <file-root>/.deltas")
+	cmd.Flags().Int("deltas-keep-versions", 0, "Batches to keep per file. No limit when 0")
+	cmd.Flags().String("deltas-max-age", "0", "Remove reverse deltas older than this, e.g. 14d. No limit when 0")
+	cmd.Flags().String("deltas-max-size", "0", "Maximum total size of the reverse deltas, e.g. 20G, the oldest go first. No limit when 0")
+}
+
+func init() {
+	rootCmd.AddCommand(deltasCmd)
+	deltasCmd.AddCommand(deltasListCmd)
+	deltasCmd.AddCommand(deltasRestoreCmd)
+
+	addDeltasFlags(deltasListCmd)
+	deltasListCmd.Flags().Bool("json", false, "Print the batches as JSON")
+
+	addDeltasFlags(deltasRestoreCmd)
+	addArchiveFlags(deltasRestoreCmd)
+	deltasRestoreCmd.Flags().String("output", "", "File to write the rebuilt file to")
+	deltasRestoreCmd.Flags().String("archive-version", "", "Archived version of a deleted file to start from")
+}
@@ -0,0 +1,86 @@
+/*
+Copyright © 2025 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/pkg/files"
+	"github.com/spf13/cobra"
+)
+
+// diffCmd represents the diff command
+var diffCmd = &cobra.Command{
+	Use:   "diff <path>",
+	Short: "Shows the block map of a file on the sender and the reciever",
+	Long: `Compare the block hashes of a single file on the sender with the reciever's
+copy on disk and in its cached index, to find out why the file keeps being
+resent. The path is relative to --file-root. For example:
+
+file-replicator diff --address dr.example.com:50051 --file-root /data reports/q3.xlsx
+file-replicator diff --address dr.example.com:50051 --file-root /data reports/q3.xlsx --all --json
+	`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		address, _ := cmd.Flags().GetString("address")
+		fileRoot, _ := cmd.Flags().GetString("file-root")
+		blockSize, _ := cmd.Flags().GetInt("block-size")
+		parallelism, _ := cmd.Flags().GetInt("parallelism")
+		all, _ := cmd.Flags().GetBool("all")
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+
+		file := args[0]
+		if filepath.IsAbs(file) {
+			relativePath, err := filepath.Rel(fileRoot, file)
+			if err != nil || strings.HasPrefix(relativePath, "..") {
+				fmt.Fprintf(os.Stderr, "%s is not under %s\n", file, fileRoot)
+				os.Exit(1)
+			}
+			file = relativePath
+		}
+
+		transport, err := transportOptions(cmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid TLS configuration: %v\n", err)
+			os.Exit(1)
+		}
+
+		replicationClient, err := client.NewReplicatorClient(address, fileRoot, uint64(parallelism), transport...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create replication client: %v\n", err)
+			os.Exit(1)
+		}
+		target := &files.FileReplicator{
+			ReplicatorClient: *replicationClient,
+			Name:             address,
+		}
+
+		ctx, cancelFunc := context.WithTimeout(context.Background(), time.Minute)
+		defer cancelFunc()
+		diff, err := target.BlockDiff(ctx, file, uint64(blockSize))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to compare %s: %v\n", file, err)
+			os.Exit(1)
+		}
+
+		if jsonOutput {
+			diff.WriteJSON(os.Stdout)
+		} else {
+			diff.WriteText(os.Stdout, all)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+
+	diffCmd.Flags().Bool("all", false, "List every block, not only the ones that differ")
+	diffCmd.Flags().Bool("json", false, "Print the block map as JSON")
+}
@@ -0,0 +1,130 @@
+/*
+Copyright © 2025 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/pkg/encryption"
+	"github.com/spf13/cobra"
+)
+
+// keysCmd represents the keys command
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manages the keys files are sealed with before they are sent",
+	Long: `With --key-file, sender, sync and restore seal the chunk data, and with
+--encrypt-names the file names, before anything leaves the sender, so the
+reciever only ever holds ciphertext. Keep the key file on the sender hosts, and
+a copy away from the reciever: the files can not be restored without it.
+Run these commands on the sender host.`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		// the key file is all the keys commands work on
+		cmd.Flags().SetAnnotation("file-root", cobra.BashCompOneRequiredFlag, []string{"false"})
+	},
+}
+
+var keysGenerateCmd = &cobra.Command{
+	Use:   "generate <key-file>",
+	Short: "Creates a key file",
+	Long: `Create a key file with a new random key. An existing key file is never
+overwritten.
+
+file-replicator keys generate /etc/file-replicator/keys.json
+	`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		keyring, err := encryption.GenerateKeyring(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to generate key file: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Generated %s with key %d\n", args[0], keyring.Current)
+	},
+}
+
+var keysRotateCmd = &cobra.Command{
+	Use:   "rotate <key-file>",
+	Short: "Adds a key and seals new chunks with it",
+	Long: `Add a new key to the key file and make it current. The older keys are kept,
+the files sealed with them can still be restored. The next sync moves the
+sealed file names on the reciever to the new key and sends every file again in
+full, sealed with the new key.
+
+file-replicator keys rotate /etc/file-replicator/keys.json
+	`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		keyring, err := encryption.LoadKeyring(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load key file: %v\n", err)
+			os.Exit(1)
+		}
+		id, err := keyring.Rotate(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to rotate key file: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Rotated %s to key %d\n", args[0], id)
+	},
+}
+
+var keysListCmd = &cobra.Command{
+	Use:   "list <key-file>",
+	Short: "Lists the keys of a key file",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		keyring, err := encryption.LoadKeyring(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load key file: %v\n", err)
+			os.Exit(1)
+		}
+		for _, key := range keyring.Keys {
+			current := ""
+			if key.ID == keyring.Current {
+				current = "  current"
+			}
+			fmt.Printf("%4d  %s%s\n", key.ID, key.Created.Local().Format(time.DateTime), current)
+		}
+	},
+}
+
+// cipherConfig seals the files with the keys of --key-file, in blocks of
+// --block-size. The files are sent in the clear without it.
+func cipherConfig(cmd *cobra.Command) ([]client.ClientOption, error) {
+	keyFile, _ := cmd.Flags().GetString("key-file")
+	encryptNames, _ := cmd.Flags().GetBool("encrypt-names")
+	blockSize, _ := cmd.Flags().GetInt("block-size")
+	if keyFile == "" {
+		if encryptNames {
+			return nil, fmt.Errorf("--encrypt-names needs --key-file")
+		}
+		return nil, nil
+	}
+
+	keyring, err := encryption.LoadKeyring(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cipher, err := encryption.NewCipher(keyring, uint64(blockSize), encryptNames)
+	if err != nil {
+		return nil, err
+	}
+	return []client.ClientOption{client.WithCipher(cipher)}, nil
+}
+
+func addCipherFlags(cmd *cobra.Command) {
+	cmd.Flags().String("key-file", "", "Seal the chunk data with the keys of this file before it is sent, see keys generate. Restore with the same --block-size")
+	cmd.Flags().Bool("encrypt-names", false, "Seal the file names too. Long names may exceed the name limit of the reciever once sealed")
+}
+
+func init() {
+	rootCmd.AddCommand(keysCmd)
+	keysCmd.AddCommand(keysGenerateCmd)
+	keysCmd.AddCommand(keysRotateCmd)
+	keysCmd.AddCommand(keysListCmd)
+}
@@ -0,0 +1,96 @@
+/*
+Copyright © 2025 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/pkg/files"
+	"github.com/spf13/cobra"
+)
+
+// planCmd represents the plan command
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Shows what the sender would replicate to a reciever",
+	Long: `Compare the file root with the reciever and print which files would be
+created, updated (with the changed blocks and bytes), archived or left alone.
+Nothing is replicated, renamed or deleted. For example:
+
+file-replicator plan --address dr.example.com:50051 --file-root /data
+file-replicator plan --address dr.example.com:50051 --file-root /data --output json
+
+Same as sender --dry-run.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		address, _ := cmd.Flags().GetString("address")
+		fileRoot, _ := cmd.Flags().GetString("file-root")
+		blockSize, _ := cmd.Flags().GetInt("block-size")
+		parallelism, _ := cmd.Flags().GetInt("parallelism")
+
+		transport, err := transportOptions(cmd)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid TLS configuration: %v", err))
+		}
+
+		replicationClient, err := client.NewReplicatorClient(address, fileRoot, uint64(parallelism), transport...)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to create replication client: %v", err))
+		}
+		target := &files.FileReplicator{
+			ReplicatorClient: *replicationClient,
+			Name:             address,
+		}
+		if err := printPlans(cmd, []*files.FileReplicator{target}, uint64(blockSize)); err != nil {
+			panic(fmt.Sprintf("Failed to build the replication plan: %v", err))
+		}
+	},
+}
+
+// printPlans builds the plan for every target and prints it in the format
+// picked by --output. JSON output is a single plan for one target and a list
+// of plans otherwise.
+func printPlans(cmd *cobra.Command, targets []*files.FileReplicator, blockSize uint64) error {
+	output, _ := cmd.Flags().GetString("output")
+	verbose, _ := cmd.Flags().GetBool("verbose")
+	if output != "text" && output != "json" {
+		return fmt.Errorf("unknown output format %q", output)
+	}
+
+	var plans []*files.Plan
+	for _, target := range targets {
+		plan, err := target.BuildPlan(context.Background(), blockSize)
+		if err != nil {
+			return fmt.Errorf("%s: %w", target.TargetName(), err)
+		}
+		plans = append(plans, plan)
+	}
+
+	if output == "json" {
+		if len(plans) == 1 {
+			return plans[0].WriteJSON(os.Stdout)
+		}
+		return files.WritePlansJSON(os.Stdout, plans)
+	}
+	for _, plan := range plans {
+		if err := plan.WriteText(os.Stdout, verbose); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addPlanFlags(cmd *cobra.Command) {
+	cmd.Flags().String("output", "text", "Format of the plan: text or json")
+	cmd.Flags().Bool("verbose", false, "Also list the unchanged files in the text plan")
+}
+
+func init() {
+	rootCmd.AddCommand(planCmd)
+
+	addPlanFlags(planCmd)
+}
@@ -4,6 +4,13 @@ Copyright © 2025 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/archive"
+	"github.com/kosalaat/file-replicator/pkg/client"
 	"github.com/kosalaat/file-replicator/pkg/server"
 	"github.com/spf13/cobra"
 )
@@ -15,6 +22,35 @@ var recieverCmd = &cobra.Command{
 	Long: `Setup file-replicator as the reciever. For example:
 
 file-replicator reciever --address localhost:50051 --file-root /path/to/receive/files
+
+Forward every applied change to the next site (A -> B -> C):
+
+file-replicator reciever --address 0.0.0.0:50051 --file-root /replica --forward-to site-c.example.com:50051
+
+Serve TLS and only accept senders with a client certificate of the CA. The
+certificates are reloaded when their files change:
+
+file-replicator reciever --address 0.0.0.0:50051 --file-root /replica --tls-cert /etc/file-replicator/tls.crt --tls-key /etc/file-replicator/tls.key --tls-ca /etc/file-replicator/ca.crt
+file-replicator sender --address dr.example.com:50051 --file-root /data --tls-cert /etc/file-replicator/client.crt --tls-key /etc/file-replicator/client.key --tls-ca /etc/file-replicator/ca.crt
+
+Only let the senders of a policy in, each under its own paths:
+
+file-replicator reciever --address 0.0.0.0:50051 --file-root /replica --tls-cert /etc/file-replicator/tls.crt --tls-key /etc/file-replicator/tls.key --auth-policy /etc/file-replicator/policy.json
+file-replicator sender --address dr.example.com:50051 --file-root /data/site-a --tls --token-file /etc/file-replicator/site-a.token
+
+with a policy.json like:
+
+{"identities": [{"name": "site-a", "token": "...", "rules": [{"prefix": "site-a", "operations": ["read", "write", "metadata", "rename", "delete"]}]}]}
+
+Give every sender its own namespace, isolated in its own file root:
+
+file-replicator reciever --address 0.0.0.0:50051 --file-root /replica --tls-cert /etc/file-replicator/tls.crt --tls-key /etc/file-replicator/tls.key --auth-policy /etc/file-replicator/policy.json --namespaces site-a=/srv/site-a,site-b=/srv/site-b
+file-replicator sender --address dr.example.com:50051 --file-root /data --tls --token-file /etc/file-replicator/site-a.token --namespace site-a
+
+Cap what the senders can store and keep space free on the volume. Senders
+defer the files refused and send them again on their next rescan:
+
+file-replicator reciever --address 0.0.0.0:50051 --file-root /replica --quota-bytes 500G --quota-files 1000000 --min-free 10G
 	`,
 	Run: func(cmd *cobra.Command, args []string) {
 		address, _ := cmd.Flags().GetString("address")
@@ -22,6 +58,85 @@ file-replicator reciever --address localhost:50051 --file-root /path/to/receive/
 
 		replicationServer := server.NewReplicationServer()
 
+		fileArchive, err := archiveConfig(cmd)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid archive configuration: %v", err))
+		}
+		replicationServer.Archive = fileArchive
+		if interval, _ := cmd.Flags().GetDuration("archive-prune-interval"); interval > 0 {
+			go fileArchive.Run(context.Background(), interval)
+		}
+		replicationServer.HashAlgorithms, _ = cmd.Flags().GetStringSlice("hash-algorithms")
+		if replicationServer.Quota, err = quotaConfig(cmd); err != nil {
+			panic(fmt.Sprintf("Invalid quota: %v", err))
+		}
+		if report, _ := cmd.Flags().GetString("verify-report"); report != "" {
+			replicationServer.Verifications = &server.VerificationReport{Path: report}
+		}
+		namespaces, _ := cmd.Flags().GetStringToString("namespaces")
+		if len(namespaces) > 0 {
+			replicationServer.Namespaces = make(map[string]*server.ReplicationServer)
+		}
+		for name, namespaceRoot := range namespaces {
+			namespace := replicationServer.NewNamespace(namespaceRoot)
+			namespace.Verifications = replicationServer.Verifications.Namespace(name)
+			namespace.Archive = archive.New(filepath.Join(namespaceRoot, ".archive"), fileArchive.Retention)
+			if interval, _ := cmd.Flags().GetDuration("archive-prune-interval"); interval > 0 {
+				go namespace.Archive.Run(context.Background(), interval)
+			}
+			replicationServer.Namespaces[name] = namespace
+		}
+		if snapshots, _ := cmd.Flags().GetBool("snapshots"); snapshots {
+			replicationServer.Snapshots = snapshotConfig(cmd)
+			if interval, _ := cmd.Flags().GetDuration("snapshot-interval"); interval > 0 {
+				go replicationServer.RunSnapshots(context.Background(), interval)
+			}
+		}
+		if reverseDeltas, _ := cmd.Flags().GetBool("reverse-deltas"); reverseDeltas {
+			journal, err := deltasConfig(cmd)
+			if err != nil {
+				panic(fmt.Sprintf("Invalid reverse delta configuration: %v", err))
+			}
+			replicationServer.Deltas = journal
+			defer journal.Close()
+			if interval, _ := cmd.Flags().GetDuration("archive-prune-interval"); interval > 0 {
+				go journal.Run(context.Background(), interval)
+			}
+		}
+
+		if forwardTo, _ := cmd.Flags().GetString("forward-to"); forwardTo != "" {
+			parallelism, _ := cmd.Flags().GetInt("parallelism")
+			transport, err := transportOptions(cmd)
+			if err != nil {
+				panic(fmt.Sprintf("Invalid TLS configuration: %v", err))
+			}
+			nextHop, err := client.NewReplicatorClient(forwardTo, fileRoot, uint64(parallelism), transport...)
+			if err != nil {
+				panic(fmt.Sprintf("Failed to create the client for the next hop: %v", err))
+			}
+			replicationServer.Forwarder = server.NewForwarder(nextHop.FileReplicatorClient)
+			if forwardBuffer, _ := cmd.Flags().GetString("forward-buffer"); forwardBuffer != "" {
+				size, err := client.ParseByteSize(forwardBuffer)
+				if err != nil {
+					panic(fmt.Sprintf("Invalid forward buffer: %v", err))
+				}
+				replicationServer.Forwarder.MaxBuffered = int(size)
+			}
+			go replicationServer.Forwarder.Run(context.Background())
+			if interval, _ := cmd.Flags().GetDuration("forward-status-interval"); interval > 0 {
+				go replicationServer.Forwarder.LogStatus(interval)
+			}
+		}
+
+		if replicationServer.Credentials, err = serverCredentials(cmd); err != nil {
+			panic(fmt.Sprintf("Invalid TLS configuration: %v", err))
+		}
+		if replicationServer.Policy, err = authPolicy(cmd); err != nil {
+			panic(fmt.Sprintf("Invalid authorization policy: %v", err))
+		}
+		if err := replicationServer.CheckNamespaces(); err != nil {
+			panic(fmt.Sprintf("Invalid namespaces: %v", err))
+		}
 		if replicationServer.StartListening(address, fileRoot) != nil {
 			panic("Failed to start the replication server")
 		}
@@ -29,7 +144,53 @@ file-replicator reciever --address localhost:50051 --file-root /path/to/receive/
 	},
 }
 
+// quotaConfig limits the storage of the senders when any of the quota flags is
+// set.
+func quotaConfig(cmd *cobra.Command) (*server.Quota, error) {
+	maxBytesFlag, _ := cmd.Flags().GetString("quota-bytes")
+	maxFiles, _ := cmd.Flags().GetInt64("quota-files")
+	minFreeFlag, _ := cmd.Flags().GetString("min-free")
+
+	maxBytes, err := client.ParseByteSize(maxBytesFlag)
+	if err != nil {
+		return nil, err
+	}
+	minFree, err := client.ParseByteSize(minFreeFlag)
+	if err != nil {
+		return nil, err
+	}
+	if maxFiles < 0 {
+		return nil, fmt.Errorf("--quota-files can not be negative")
+	}
+	if maxBytes == 0 && maxFiles == 0 && minFree == 0 {
+		return nil, nil
+	}
+	return &server.Quota{MaxBytes: int64(maxBytes), MaxFiles: maxFiles, MinFree: int64(minFree)}, nil
+}
+
+func addQuotaFlags(cmd *cobra.Command) {
+	cmd.Flags().String("quota-bytes", "0", "Maximum total size of the replicated files, e.g. 500G, per namespace. No limit when 0")
+	cmd.Flags().Int64("quota-files", 0, "Maximum number of replicated files, per namespace. No limit when 0")
+	cmd.Flags().String("min-free", "0", "Space to keep free on the volume of the file root, e.g. 10G")
+}
+
 func init() {
 	rootCmd.AddCommand(recieverCmd)
 
+	recieverCmd.Flags().String("forward-to", "", "Address of the next reciever to forward the applied changes to")
+	recieverCmd.Flags().String("forward-buffer", "256M", "Chunk data to buffer for the next hop before applying back pressure")
+	recieverCmd.Flags().Duration("forward-status-interval", time.Minute, "Interval to log the forwarding lag. Disabled when 0")
+	addArchiveFlags(recieverCmd)
+	recieverCmd.Flags().Duration("archive-prune-interval", time.Hour, "Interval to apply the archive and reverse delta retention rules. Disabled when 0")
+	recieverCmd.Flags().Bool("reverse-deltas", false, "Save the blocks every batch overwrites, so files can be rebuilt as they were before it")
+	addDeltasFlags(recieverCmd)
+	recieverCmd.Flags().StringSlice("hash-algorithms", nil, "Block hashes accepted from senders, e.g. xxhash64,blake3. Any supported one when empty")
+	recieverCmd.Flags().StringToString("namespaces", nil, "Namespaces to serve from their own file roots, e.g. site-a=/srv/site-a,site-b=/srv/site-b. Needs --auth-policy and can not be combined with --forward-to, --snapshots or --reverse-deltas")
+	addQuotaFlags(recieverCmd)
+	recieverCmd.Flags().String("auth-policy", "", "JSON file with the identities allowed to call the reciever and the paths they may touch")
+	recieverCmd.Flags().String("verify-report", "", "File to append the digest checks of the committed file versions to as JSON lines")
+	recieverCmd.Flags().Bool("snapshots", false, "Take snapshots of the file root on a schedule or when the sender asks")
+	recieverCmd.Flags().Duration("snapshot-interval", 0, "Interval to take snapshots at. Only on request when 0")
+	addSnapshotFlags(recieverCmd)
+
 }
@@ -0,0 +1,102 @@
+/*
+Copyright © 2025 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/pkg/files"
+	"github.com/spf13/cobra"
+)
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore [path...]",
+	Short: "Pulls files back from the reciever",
+	Long: `Restore files or subtrees from the reciever into --file-root, everything when
+no path is given. Existing local copies are patched block by block, and the
+mode and ownership held by the reciever are applied. For example:
+
+file-replicator restore --address dr.example.com:50051 --file-root /data
+file-replicator restore --address dr.example.com:50051 --file-root /data reports/ config/app.yaml
+
+Restore deleted files from the reciever's archive:
+
+file-replicator restore --address dr.example.com:50051 --file-root /data --from-archive reports/q3.xlsx
+file-replicator restore --address dr.example.com:50051 --file-root /data --archive-version 20250102T101500.000000000Z reports/q3.xlsx
+
+Files sent with --key-file are restored with the same key file, --encrypt-names
+and --block-size:
+
+file-replicator restore --address dr.example.com:50051 --file-root /data --key-file /etc/file-replicator/keys.json --encrypt-names
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		address, _ := cmd.Flags().GetString("address")
+		fileRoot, _ := cmd.Flags().GetString("file-root")
+		blockSize, _ := cmd.Flags().GetInt("block-size")
+		parallelism, _ := cmd.Flags().GetInt("parallelism")
+		fromArchive, _ := cmd.Flags().GetBool("from-archive")
+		archiveVersion, _ := cmd.Flags().GetString("archive-version")
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+
+		if err := os.MkdirAll(fileRoot, 0750); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create %s: %v\n", fileRoot, err)
+			os.Exit(1)
+		}
+
+		cipherOptions, err := cipherConfig(cmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid encryption configuration: %v\n", err)
+			os.Exit(1)
+		}
+
+		transport, err := transportOptions(cmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid TLS configuration: %v\n", err)
+			os.Exit(1)
+		}
+
+		replicationClient, err := client.NewReplicatorClient(address, fileRoot, uint64(parallelism), append(cipherOptions, transport...)...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create replication client: %v\n", err)
+			os.Exit(1)
+		}
+		target := &files.FileReplicator{
+			ReplicatorClient: *replicationClient,
+			Name:             address,
+		}
+
+		summary, err := target.Restore(context.Background(), files.RestoreOptions{
+			Paths:     args,
+			Archive:   fromArchive || archiveVersion != "",
+			Version:   archiveVersion,
+			BlockSize: uint64(blockSize),
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to restore from %s: %v\n", address, err)
+			os.Exit(1)
+		}
+
+		if jsonOutput {
+			summary.WriteJSON(os.Stdout)
+		} else {
+			summary.WriteText(os.Stdout)
+		}
+		if len(summary.Errors) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+
+	restoreCmd.Flags().Bool("from-archive", false, "Restore from the reciever's archive of deleted files")
+	restoreCmd.Flags().String("archive-version", "", "Archived version to restore, as listed by archive list. Implies --from-archive")
+	addCipherFlags(restoreCmd)
+	restoreCmd.Flags().Bool("json", false, "Print the summary as JSON")
+}
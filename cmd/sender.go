@@ -4,9 +4,15 @@ Copyright © 2025 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/pkg/controller"
 	"github.com/kosalaat/file-replicator/pkg/files"
 	"github.com/spf13/cobra"
 )
@@ -17,7 +23,28 @@ var senderCmd = &cobra.Command{
 	Short: "Configures the sender of the replication",
 	Long: `Setup file-replicator as the sender (source data). For example:
 
-file-replicator reciever --address localhost:50051 --file-root /path/to/monitor/ --block-size 8192 --parallelism 10
+file-replicator sender --address localhost:50051 --file-root /path/to/monitor/ --block-size 8192 --parallelism 10
+
+Limit the bandwidth to 10MB/s during business hours, unlimited otherwise:
+
+file-replicator sender --address localhost:50051 --file-root /path/to/monitor/ --bwlimit-schedule "08:00-18:00=10M"
+
+When --bwlimit-schedule-file is used, the schedule is re-read on SIGHUP.
+
+Work is scheduled by priority class, metadata changes, renames and deletes go
+ahead of data and small files ahead of large ones:
+
+file-replicator sender --file-root /data --priority-class urgent=32 --priority-class bulk=1 --priority-rule "urgent:pattern=*.conf"
+
+Replicate to a local standby and an off-site DR reciever at once, publishing
+the per target status on http://localhost:8080/status:
+
+file-replicator sender --file-root /data --target standby=10.0.0.2:50051 --target dr=dr.example.com:50051 --status-address localhost:8080
+
+Print what would be created, updated or archived on the reciever without
+changing anything on it:
+
+file-replicator sender --file-root /data --address dr.example.com:50051 --dry-run --output json
 	`,
 	Run: func(cmd *cobra.Command, args []string) {
 		address, _ := cmd.Flags().GetString("address")
@@ -26,16 +53,78 @@ file-replicator reciever --address localhost:50051 --file-root /path/to/monitor/
 		parallelism, _ := cmd.Flags().GetInt("parallelism")
 		// fullSyncInterval, _ := cmd.Flags().GetInt("full-sync-interval")
 
-		replicationClient, err := client.NewReplicatorClient(address, fileRoot, uint64(parallelism))
+		throttle, err := newThrottle(cmd)
 		if err != nil {
-			panic(fmt.Sprintf("Failed to create replication client: %v", err))
+			panic(fmt.Sprintf("Invalid bandwidth limit: %v", err))
 		}
 
-		fileReplicator := &files.FileReplicator{
-			ReplicatorClient: *replicationClient,
+		priorityClasses, priorityRules, err := priorityConfig(cmd)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid priority configuration: %v", err))
 		}
 
-		if err := fileReplicator.SetupFileWatcher(fileRoot, uint64(blockSize)); err != nil {
+		staged, _ := cmd.Flags().GetBool("staged")
+
+		wireOptions, negotiate, err := wireConfig(cmd)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid wire configuration: %v", err))
+		}
+		cipherOptions, err := cipherConfig(cmd)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid encryption configuration: %v", err))
+		}
+		wireOptions = append(wireOptions, cipherOptions...)
+		transport, err := transportOptions(cmd)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid TLS configuration: %v", err))
+		}
+		wireOptions = append(wireOptions, transport...)
+
+		targets, err := targetConfig(cmd, address)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid target: %v", err))
+		}
+
+		fanOut := &files.FanOut{}
+		for _, target := range targets {
+			replicationClient, err := client.NewReplicatorClient(target.address, fileRoot, uint64(parallelism), append(wireOptions, client.WithThrottle(throttle))...)
+			if err != nil {
+				panic(fmt.Sprintf("Failed to create replication client: %v", err))
+			}
+			if negotiate {
+				if err := replicationClient.Negotiate(context.Background()); err != nil {
+					panic(fmt.Sprintf("Failed to negotiate with the reciever: %v", err))
+				}
+			}
+
+			fanOut.Targets = append(fanOut.Targets, &files.FileReplicator{
+				ReplicatorClient: *replicationClient,
+				Name:             target.name,
+				PriorityClasses:  priorityClasses,
+				PriorityRules:    priorityRules,
+				Staged:           staged,
+			})
+		}
+
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+			if err := printPlans(cmd, fanOut.Targets, uint64(blockSize)); err != nil {
+				panic(fmt.Sprintf("Failed to build the replication plan: %v", err))
+			}
+			return
+		}
+
+		if statusAddress, _ := cmd.Flags().GetString("status-address"); statusAddress != "" {
+			go func() {
+				if err := fanOut.ServeStatus(statusAddress); err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to serve target status: %v\n", err)
+				}
+			}()
+		}
+		if statusInterval, _ := cmd.Flags().GetDuration("status-interval"); statusInterval > 0 {
+			go fanOut.LogStatus(statusInterval)
+		}
+
+		if err := fanOut.SetupFileWatcher(fileRoot, uint64(blockSize)); err != nil {
 			panic(fmt.Sprintf("Failed to start monitoring: %v", err))
 		}
 
@@ -43,9 +132,158 @@ file-replicator reciever --address localhost:50051 --file-root /path/to/monitor/
 	},
 }
 
+type target struct {
+	name    string
+	address string
+}
+
+// targetConfig returns the receivers from the --target flags, falling back to
+// --address when none are given.
+func targetConfig(cmd *cobra.Command, address string) ([]target, error) {
+	targetFlags, _ := cmd.Flags().GetStringArray("target")
+	if len(targetFlags) == 0 {
+		return []target{{name: address, address: address}}, nil
+	}
+
+	var targets []target
+	for _, targetFlag := range targetFlags {
+		name, targetAddress, found := strings.Cut(targetFlag, "=")
+		if !found {
+			name, targetAddress = targetFlag, targetFlag
+		}
+		if targetAddress == "" {
+			return nil, fmt.Errorf("missing address in target %q", targetFlag)
+		}
+		targets = append(targets, target{name: name, address: targetAddress})
+	}
+	return targets, nil
+}
+
+func priorityConfig(cmd *cobra.Command) ([]files.PriorityClass, []files.PriorityRule, error) {
+	classFlags, _ := cmd.Flags().GetStringArray("priority-class")
+	ruleFlags, _ := cmd.Flags().GetStringArray("priority-rule")
+
+	var classes []files.PriorityClass
+	for _, classFlag := range classFlags {
+		class, err := files.ParsePriorityClass(classFlag)
+		if err != nil {
+			return nil, nil, err
+		}
+		classes = append(classes, class)
+	}
+
+	var rules []files.PriorityRule
+	for _, ruleFlag := range ruleFlags {
+		rule, err := files.ParsePriorityRule(ruleFlag)
+		if err != nil {
+			return nil, nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return classes, rules, nil
+}
+
+func loadBandwidthSchedule(cmd *cobra.Command) (client.BandwidthSchedule, error) {
+	bwLimit, _ := cmd.Flags().GetString("bwlimit")
+	schedule, _ := cmd.Flags().GetString("bwlimit-schedule")
+	scheduleFile, _ := cmd.Flags().GetString("bwlimit-schedule-file")
+
+	defaultRate, err := client.ParseBandwidthLimit(bwLimit)
+	if err != nil {
+		return client.BandwidthSchedule{}, err
+	}
+	if scheduleFile != "" {
+		content, err := os.ReadFile(scheduleFile)
+		if err != nil {
+			return client.BandwidthSchedule{}, err
+		}
+		schedule = string(content)
+	}
+	return client.ParseBandwidthSchedule(schedule, defaultRate)
+}
+
+// wireConfig picks the block hashes and the chunk compression from the
+// --hash-algorithm, --confirm-hash and --compress flags. They are negotiated
+// with the reciever when any differs from the default.
+func wireConfig(cmd *cobra.Command) ([]client.ClientOption, bool, error) {
+	algorithm, _ := cmd.Flags().GetString("hash-algorithm")
+	confirm, _ := cmd.Flags().GetString("confirm-hash")
+	compression, _ := cmd.Flags().GetString("compress")
+
+	if _, err := controller.LookupHash(algorithm); err != nil {
+		return nil, false, err
+	}
+	if confirm != "" {
+		confirmAlgorithm, err := controller.LookupHash(confirm)
+		if err != nil {
+			return nil, false, err
+		}
+		if !confirmAlgorithm.Strong {
+			return nil, false, fmt.Errorf("%s is not a strong hash", confirm)
+		}
+	}
+	if compression == "none" {
+		compression = ""
+	} else if _, err := controller.LookupCompression(compression); err != nil {
+		return nil, false, err
+	}
+	negotiate := confirm != "" || compression != "" || (algorithm != "" && algorithm != controller.DefaultHashAlgorithm)
+	return []client.ClientOption{client.WithHashAlgorithm(algorithm, confirm), client.WithCompression(compression)}, negotiate, nil
+}
+
+func addWireFlags(cmd *cobra.Command) {
+	cmd.Flags().String("hash-algorithm", controller.DefaultHashAlgorithm, "Block hash of the signatures: "+strings.Join(controller.HashAlgorithms(), ", "))
+	cmd.Flags().String("confirm-hash", "", "Strong hash the reciever confirms a block match with before skipping it, e.g. sha256 or blake3")
+	cmd.Flags().String("compress", "none", "Compress the chunk data on the wire when the reciever supports it: none, "+strings.Join(controller.Compressions(), ", "))
+}
+
+// newThrottle builds the bandwidth limiter from the flags, returning nil when
+// no limit is configured. With a schedule file the limiter is reloaded on SIGHUP.
+func newThrottle(cmd *cobra.Command) (*client.Throttle, error) {
+	schedule, err := loadBandwidthSchedule(cmd)
+	if err != nil {
+		return nil, err
+	}
+	scheduleFile, _ := cmd.Flags().GetString("bwlimit-schedule-file")
+	if schedule.Default == 0 && len(schedule.Windows) == 0 && scheduleFile == "" {
+		return nil, nil
+	}
+
+	throttle := client.NewThrottle(schedule)
+	if scheduleFile != "" {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				schedule, err := loadBandwidthSchedule(cmd)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to reload bandwidth schedule, keeping the current one: %v\n", err)
+					continue
+				}
+				throttle.SetSchedule(schedule)
+			}
+		}()
+	}
+	return throttle, nil
+}
+
 func init() {
 	rootCmd.AddCommand(senderCmd)
 
+	senderCmd.Flags().String("bwlimit", "0", "Bandwidth limit for data sent to the reciever, e.g. 512K, 10M. 0 means unlimited")
+	senderCmd.Flags().String("bwlimit-schedule", "", "Time of day bandwidth limits, e.g. \"08:00-18:00=10M,*=0\". Outside the windows --bwlimit applies")
+	senderCmd.Flags().StringArray("target", nil, "Reciever to replicate to as name=address, repeatable. Defaults to --address")
+	senderCmd.Flags().String("status-address", "", "Address to serve the per target replication status on, e.g. localhost:8080")
+	senderCmd.Flags().Duration("status-interval", 0, "Interval to log the per target replication status, e.g. 1m. Disabled when 0")
+	senderCmd.Flags().StringArray("priority-class", nil, "Priority class as name=weight, repeatable. Defaults to metadata=64, interactive=8, bulk=1")
+	senderCmd.Flags().StringArray("priority-rule", nil, "Assign work to a priority class, e.g. \"interactive:pattern=*.conf\", \"bulk:min-size=1G\" or \"metadata:op=metadata|rename|delete\". Repeatable, first match wins")
+	senderCmd.Flags().String("bwlimit-schedule-file", "", "File holding the bandwidth schedule, one window per line. Re-read on SIGHUP")
+	senderCmd.Flags().Bool("staged", true, "Stage every new file version on the reciever, verify its whole-file digest and make it live at once when complete. Recievers without staging are sent the chunks directly")
+	addWireFlags(senderCmd)
+	addCipherFlags(senderCmd)
+	senderCmd.Flags().Bool("dry-run", false, "Print the replication plan for each target and exit without replicating")
+	addPlanFlags(senderCmd)
+
 	rootCmd.PersistentFlags().Int("block-size", 8192, "Size of the file blocks to be processed")
 	rootCmd.PersistentFlags().Int("parallelism", 10, "Number of parallel file processing operations")
 	rootCmd.PersistentFlags().Int("full-sync-interval", 0, "Interval to run a full sync in seconds. If not specified, full sync will not run periodically")
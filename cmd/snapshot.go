@@ -0,0 +1,198 @@
+/*
+Copyright © 2025 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/archive"
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/pkg/snapshot"
+	"github.com/spf13/cobra"
+)
+
+// snapshotCmd represents the snapshot command
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Takes and manages point-in-time snapshots of the reciever",
+	Long: `With --snapshots the reciever keeps snapshots of its file root in
+<file-root>/.snapshots, or --snapshot-dir. Every snapshot is a plain directory
+named after the time it was taken, that can be read or mounted as is:
+
+mount --bind -o ro /replica/.snapshots/20250301T120000.000000000Z /mnt/replica
+
+Unchanged files are hard links into the previous snapshot, so a snapshot costs
+the size of the files that changed since. Apart from take, run these commands
+on the reciever host.`,
+}
+
+var snapshotTakeCmd = &cobra.Command{
+	Use:   "take",
+	Short: "Asks the reciever for a snapshot",
+	Long: `Ask the reciever at --address for a snapshot, taken once the batches it is
+applying are done.
+
+file-replicator snapshot take --address dr.example.com:50051 --label before-upgrade
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		address, _ := cmd.Flags().GetString("address")
+		label, _ := cmd.Flags().GetString("label")
+		timeout, _ := cmd.Flags().GetDuration("quiesce-timeout")
+
+		transport, err := transportOptions(cmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid TLS configuration: %v\n", err)
+			os.Exit(1)
+		}
+
+		replicationClient, err := client.NewReplicatorClient(address, "", 1, transport...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create replication client: %v\n", err)
+			os.Exit(1)
+		}
+		info, err := replicationClient.Snapshot(context.Background(), label, timeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to take the snapshot: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Snapshot %s: %d files, %d linked, %d copied, %d bytes\n", info.Name, info.Files, info.Linked, info.Copied, info.Bytes)
+	},
+}
+
+var snapshotListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the snapshots",
+	Run: func(cmd *cobra.Command, args []string) {
+		manager := snapshotConfig(cmd)
+		snapshots, err := manager.List()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list the snapshots: %v\n", err)
+			os.Exit(1)
+		}
+
+		if jsonOutput, _ := cmd.Flags().GetBool("json"); jsonOutput {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			encoder.Encode(snapshots)
+			return
+		}
+		for _, taken := range snapshots {
+			quiescent := ""
+			if !taken.Quiescent {
+				quiescent = "  (not quiescent)"
+			}
+			fmt.Printf("%s  %-12s  %8d files  %s%s\n", taken.CreatedAt.Local().Format(time.DateTime), taken.Label, taken.Files, taken.Path, quiescent)
+		}
+		fmt.Printf("%d snapshots\n", len(snapshots))
+	},
+}
+
+var snapshotRestoreCmd = &cobra.Command{
+	Use:   "restore <name> [path...]",
+	Short: "Copies files back from a snapshot",
+	Long: `Copy the given files or directories of a snapshot, everything when none are
+given, into --target, the file root unless set.
+
+file-replicator snapshot restore --file-root /replica 20250301T120000.000000000Z reports/
+file-replicator snapshot restore --file-root /replica 20250301T120000.000000000Z --target /tmp/replica-0301
+	`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		manager := snapshotConfig(cmd)
+		target, _ := cmd.Flags().GetString("target")
+		if target == "" {
+			target = manager.FileRoot
+		}
+		restored, err := manager.Restore(args[0], args[1:], target)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to restore from snapshot %s: %v\n", args[0], err)
+			os.Exit(1)
+		}
+		fmt.Printf("Restored %d files from snapshot %s into %s\n", restored, args[0], target)
+	},
+}
+
+var snapshotDeleteCmd = &cobra.Command{
+	Use:   "delete <name>...",
+	Short: "Removes snapshots",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		manager := snapshotConfig(cmd)
+		for _, name := range args {
+			if err := manager.Delete(name); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to remove snapshot %s: %v\n", name, err)
+				os.Exit(1)
+			}
+			fmt.Printf("Removed snapshot %s\n", name)
+		}
+	},
+}
+
+var snapshotPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Removes the snapshots past the retention rules",
+	Long: `Remove the snapshots past --snapshot-keep and --snapshot-max-age, as the
+reciever does after every scheduled snapshot. The newest one is always kept.
+
+file-replicator snapshot prune --file-root /replica --snapshot-keep 7
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		removed, err := snapshotConfig(cmd).Prune()
+		for _, name := range removed {
+			fmt.Printf("Removed snapshot %s\n", name)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to prune the snapshots: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// snapshotConfig builds the snapshot manager from the --snapshot-* flags.
+func snapshotConfig(cmd *cobra.Command) *snapshot.Manager {
+	fileRoot, _ := cmd.Flags().GetString("file-root")
+	snapshotDir, _ := cmd.Flags().GetString("snapshot-dir")
+	keep, _ := cmd.Flags().GetInt("snapshot-keep")
+	maxAgeFlag, _ := cmd.Flags().GetString("snapshot-max-age")
+
+	if snapshotDir == "" {
+		snapshotDir = filepath.Join(fileRoot, ".snapshots")
+	}
+	maxAge, err := archive.ParseAge(maxAgeFlag)
+	if err != nil || keep < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid snapshot retention: --snapshot-keep %d, --snapshot-max-age %q\n", keep, maxAgeFlag)
+		os.Exit(1)
+	}
+	return snapshot.New(snapshotDir, fileRoot, archive.Retention{KeepVersions: keep, MaxAge: maxAge})
+}
+
+func addSnapshotFlags(cmd *cobra.Command) {
+	cmd.Flags().String("snapshot-dir", "", "Directory to keep the snapshots in, on the same file system as --file-root. Defaults to <file-root>/.snapshots")
+	cmd.Flags().Int("snapshot-keep", 0, "Snapshots to keep. No limit when 0")
+	cmd.Flags().String("snapshot-max-age", "0", "Remove snapshots older than this, e.g. 30d. No limit when 0")
+}
+
+func init() {
+	rootCmd.AddCommand(snapshotCmd)
+	snapshotCmd.AddCommand(snapshotTakeCmd)
+	snapshotCmd.AddCommand(snapshotListCmd)
+	snapshotCmd.AddCommand(snapshotRestoreCmd)
+	snapshotCmd.AddCommand(snapshotDeleteCmd)
+	snapshotCmd.AddCommand(snapshotPruneCmd)
+
+	snapshotTakeCmd.Flags().String("label", "", "Label to keep with the snapshot")
+	snapshotTakeCmd.Flags().Duration("quiesce-timeout", 0, "How long to wait for the batches in flight before the snapshot fails, the reciever's default when 0")
+
+	addSnapshotFlags(snapshotListCmd)
+	snapshotListCmd.Flags().Bool("json", false, "Print the snapshots as JSON")
+	addSnapshotFlags(snapshotRestoreCmd)
+	snapshotRestoreCmd.Flags().String("target", "", "Directory to restore into, the file root when empty")
+	addSnapshotFlags(snapshotDeleteCmd)
+	addSnapshotFlags(snapshotPruneCmd)
+}
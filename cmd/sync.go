@@ -0,0 +1,148 @@
+/*
+Copyright © 2025 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/pkg/files"
+	"github.com/spf13/cobra"
+)
+
+// Exit codes of the sync command.
+const (
+	exitInSync         = 0
+	exitErrors         = 1
+	exitChangesApplied = 2
+)
+
+// syncCmd represents the sync command
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Reconciles the reciever with the file root once and exits",
+	Long: `Replicate every difference between the file root and the reciever, wait for
+the reciever to acknowledge it, print a summary and exit. Suited for cron and CI:
+
+file-replicator sync --address dr.example.com:50051 --file-root /data --timeout 1h --json
+file-replicator sync --address dr.example.com:50051 --file-root /data --snapshot nightly
+
+Exit codes:
+
+  0  the reciever was already in sync
+  1  errors, some files may not have been replicated
+  2  changes were applied and the reciever is now in sync
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		address, _ := cmd.Flags().GetString("address")
+		fileRoot, _ := cmd.Flags().GetString("file-root")
+		blockSize, _ := cmd.Flags().GetInt("block-size")
+		parallelism, _ := cmd.Flags().GetInt("parallelism")
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+		staged, _ := cmd.Flags().GetBool("staged")
+
+		wireOptions, negotiate, err := wireConfig(cmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid wire configuration: %v\n", err)
+			os.Exit(exitErrors)
+		}
+		cipherOptions, err := cipherConfig(cmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid encryption configuration: %v\n", err)
+			os.Exit(exitErrors)
+		}
+		wireOptions = append(wireOptions, cipherOptions...)
+		transport, err := transportOptions(cmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid TLS configuration: %v\n", err)
+			os.Exit(exitErrors)
+		}
+		wireOptions = append(wireOptions, transport...)
+
+		replicationClient, err := client.NewReplicatorClient(address, fileRoot, uint64(parallelism), wireOptions...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create replication client: %v\n", err)
+			os.Exit(exitErrors)
+		}
+		target := &files.FileReplicator{
+			ReplicatorClient: *replicationClient,
+			Name:             address,
+			Staged:           staged,
+		}
+
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancelFunc context.CancelFunc
+			ctx, cancelFunc = context.WithTimeout(ctx, timeout)
+			defer cancelFunc()
+		}
+		if negotiate {
+			if err := target.ReplicatorClient.Negotiate(ctx); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to negotiate with the reciever: %v\n", err)
+				os.Exit(exitErrors)
+			}
+		}
+
+		summary, err := target.Sync(ctx, fileRoot, uint64(blockSize))
+		if err != nil {
+			summary = &files.SyncSummary{
+				Target: address,
+				Result: files.SyncFailed.String(),
+				Errors: []string{err.Error()},
+			}
+		}
+
+		if label, _ := cmd.Flags().GetString("snapshot"); label != "" && summary.SyncResult() != files.SyncFailed {
+			if info, err := replicationClient.Snapshot(ctx, label, 0); err != nil {
+				summary.Errors = append(summary.Errors, fmt.Sprintf("snapshot: %v", err))
+				summary.Result = files.SyncFailed.String()
+			} else {
+				summary.Snapshot = info.Name
+			}
+		}
+
+		if jsonOutput {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			encoder.Encode(summary)
+		} else {
+			fmt.Printf("Sync to %s: %s\n", summary.Target, summary.Result)
+			fmt.Printf("%d created, %d updated, %d archived, %d unchanged, %d chunks, %d bytes in %.1fs\n",
+				summary.Created, summary.Updated, summary.Archived, summary.Unchanged, summary.Chunks, summary.Bytes, summary.DurationSeconds)
+			if summary.Compression != nil {
+				fmt.Printf("Chunk data compressed %.1fx with %s\n", summary.Compression.Ratio, summary.Compression.Compression)
+			}
+			if summary.Snapshot != "" {
+				fmt.Printf("Reciever snapshot %s\n", summary.Snapshot)
+			}
+			if len(summary.Errors) > 0 {
+				fmt.Printf("Errors:\n  %s\n", strings.Join(summary.Errors, "\n  "))
+			}
+		}
+
+		switch summary.SyncResult() {
+		case files.SyncFailed:
+			os.Exit(exitErrors)
+		case files.ChangesApplied:
+			os.Exit(exitChangesApplied)
+		}
+		os.Exit(exitInSync)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(syncCmd)
+
+	syncCmd.Flags().Duration("timeout", 0, "Give up when the sync takes longer, e.g. 30m. No limit when 0")
+	syncCmd.Flags().Bool("staged", true, "Stage every new file version on the reciever, verify its whole-file digest and make it live at once when complete. Recievers without staging are sent the chunks directly")
+	addWireFlags(syncCmd)
+	addCipherFlags(syncCmd)
+	syncCmd.Flags().Bool("json", false, "Print the summary as JSON")
+	syncCmd.Flags().String("snapshot", "", "Ask the reciever for a snapshot with this label once the sync succeeded")
+}
@@ -0,0 +1,84 @@
+/*
+Copyright © 2025 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/pkg/server"
+	"github.com/kosalaat/file-replicator/pkg/transport"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc/credentials"
+)
+
+func transportConfig(cmd *cobra.Command) transport.Config {
+	certFile, _ := cmd.Flags().GetString("tls-cert")
+	keyFile, _ := cmd.Flags().GetString("tls-key")
+	caFile, _ := cmd.Flags().GetString("tls-ca")
+	serverName, _ := cmd.Flags().GetString("tls-server-name")
+	return transport.Config{CertFile: certFile, KeyFile: keyFile, CAFile: caFile, ServerName: serverName}
+}
+
+// transportOptions connects to the namespace of --namespace on the reciever,
+// with TLS when --tls or any of the certificate flags is set, and
+// authenticates with the token of --token-file.
+func transportOptions(cmd *cobra.Command) ([]client.ClientOption, error) {
+	var options []client.ClientOption
+	if namespace, _ := cmd.Flags().GetString("namespace"); namespace != "" {
+		options = append(options, client.WithNamespace(namespace))
+	}
+	config := transportConfig(cmd)
+	tokenFile, _ := cmd.Flags().GetString("token-file")
+	if enabled, _ := cmd.Flags().GetBool("tls"); !enabled && config.CertFile == "" && config.CAFile == "" {
+		if tokenFile != "" {
+			return nil, fmt.Errorf("--token-file requires TLS")
+		}
+		return options, nil
+	}
+	clientCredentials, err := transport.ClientCredentials(config)
+	if err != nil {
+		return nil, err
+	}
+	options = append(options, client.WithTransportCredentials(clientCredentials))
+	if tokenFile != "" {
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, client.WithToken(strings.TrimSpace(string(token))))
+	}
+	return options, nil
+}
+
+// serverCredentials serves TLS when --tls-cert is set, and mutual TLS when
+// --tls-ca is set too.
+func serverCredentials(cmd *cobra.Command) (credentials.TransportCredentials, error) {
+	config := transportConfig(cmd)
+	if config.CertFile == "" {
+		return nil, nil
+	}
+	return transport.ServerCredentials(config)
+}
+
+// authPolicy loads the policy of --auth-policy. Every caller is accepted when
+// it is not set.
+func authPolicy(cmd *cobra.Command) (*server.Policy, error) {
+	if policyFile, _ := cmd.Flags().GetString("auth-policy"); policyFile != "" {
+		return server.LoadPolicy(policyFile)
+	}
+	return nil, nil
+}
+
+func init() {
+	rootCmd.PersistentFlags().Bool("tls", false, "Connect to the reciever with TLS, verified against the system roots unless --tls-ca is set")
+	rootCmd.PersistentFlags().String("tls-cert", "", "Certificate to present: the server certificate of the reciever, the client certificate of the sender. Reloaded when the file changes")
+	rootCmd.PersistentFlags().String("tls-key", "", "Private key of --tls-cert")
+	rootCmd.PersistentFlags().String("tls-ca", "", "CA certificates to verify the peer with. On the reciever it requires client certificates signed by them")
+	rootCmd.PersistentFlags().String("tls-server-name", "", "Name to verify the reciever certificate against instead of the host of --address")
+	rootCmd.PersistentFlags().String("token-file", "", "File with the bearer token to authenticate to the reciever with. Requires TLS")
+	rootCmd.PersistentFlags().String("namespace", "", "Namespace of the reciever to replicate into. Its default file root when empty")
+}
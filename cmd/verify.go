@@ -0,0 +1,92 @@
+/*
+Copyright © 2025 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/pkg/files"
+	"github.com/spf13/cobra"
+)
+
+// exitMismatch is returned by verify when the reciever differs from the source.
+const exitMismatch = 3
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Compares the file root with the reciever end to end",
+	Long: `Hash every file on both sides with a strong hash and compare the hashes and
+the metadata. Lists the files missing on the reciever, extra files only the
+reciever holds, and files whose content or metadata differ. For example:
+
+file-replicator verify --address dr.example.com:50051 --file-root /data
+
+On very large trees, hash a random 5% of the files, at most 10000 of them:
+
+file-replicator verify --address dr.example.com:50051 --file-root /data --sample-rate 0.05 --max-files 10000 --json
+
+Exit codes:
+
+  0  the reciever matches the source
+  1  the verification could not be completed
+  3  differences were found
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		address, _ := cmd.Flags().GetString("address")
+		fileRoot, _ := cmd.Flags().GetString("file-root")
+		parallelism, _ := cmd.Flags().GetInt("parallelism")
+		sampleRate, _ := cmd.Flags().GetFloat64("sample-rate")
+		maxFiles, _ := cmd.Flags().GetInt("max-files")
+		seed, _ := cmd.Flags().GetInt64("seed")
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+
+		transport, err := transportOptions(cmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid TLS configuration: %v\n", err)
+			os.Exit(exitErrors)
+		}
+
+		replicationClient, err := client.NewReplicatorClient(address, fileRoot, uint64(parallelism), transport...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create replication client: %v\n", err)
+			os.Exit(exitErrors)
+		}
+		target := &files.FileReplicator{
+			ReplicatorClient: *replicationClient,
+			Name:             address,
+		}
+
+		report, err := target.Verify(context.Background(), files.VerifyOptions{
+			SampleRate: sampleRate,
+			MaxFiles:   maxFiles,
+			Seed:       seed,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to verify %s: %v\n", address, err)
+			os.Exit(exitErrors)
+		}
+
+		if jsonOutput {
+			report.WriteJSON(os.Stdout)
+		} else {
+			report.WriteText(os.Stdout)
+		}
+		if !report.Clean() {
+			os.Exit(exitMismatch)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().Float64("sample-rate", 0, "Fraction of the files to hash, e.g. 0.05. All files when 0")
+	verifyCmd.Flags().Int("max-files", 0, "Hash at most this many files. No limit when 0")
+	verifyCmd.Flags().Int64("seed", 0, "Seed picking the sampled files, the same seed checks the same files")
+	verifyCmd.Flags().Bool("json", false, "Print the report as JSON")
+}
@@ -0,0 +1,422 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/controller"
+	"github.com/rs/zerolog/log"
+)
+
+var archivelogger = log.With().Str("component", "archive").Logger()
+
+// versionSeparator splits the archived path from the time it was archived.
+const versionSeparator = "~"
+
+// VersionFormat is the timestamp appended to archived files. It sorts in the
+// same order as the times it encodes.
+const VersionFormat = "20060102T150405.000000000Z"
+
+// Retention limits what the pruner keeps. Zero values mean no limit.
+type Retention struct {
+	// KeepVersions is the number of versions kept per path.
+	KeepVersions int
+	// MaxAge drops versions archived longer ago.
+	MaxAge time.Duration
+	// MaxSize caps the total size of the archive, dropping the oldest
+	// versions first.
+	MaxSize int64
+}
+
+// Version is a single archived copy of a file.
+type Version struct {
+	Path       string    `json:"path"`
+	Version    string    `json:"version"`
+	ArchivedAt time.Time `json:"archived_at"`
+	Size       int64     `json:"size"`
+}
+
+func (v Version) Name() string {
+	return v.Path + versionSeparator + v.Version
+}
+
+type PruneResult struct {
+	Removed int   `json:"removed"`
+	Freed   int64 `json:"freed"`
+}
+
+// Archive keeps every deleted file as a timestamped version under Root, which
+// can live outside the file root of the reciever.
+type Archive struct {
+	Root      string
+	Retention Retention
+
+	now func() time.Time
+}
+
+func New(root string, retention Retention) *Archive {
+	return &Archive{
+		Root:      root,
+		Retention: retention,
+		now:       time.Now,
+	}
+}
+
+// Store moves the file name below source into the archive as a new version of
+// relativePath. Both sides are reached through their roots, so a symlink
+// swapped into either path can not lead the move out of them.
+func (a *Archive) Store(source *os.Root, name string, relativePath string) (Version, error) {
+	stat, err := source.Lstat(name)
+	if err != nil {
+		return Version{}, err
+	}
+
+	if err := os.MkdirAll(a.Root, 0750); err != nil {
+		archivelogger.Error().Err(err).Msgf("Failed to create archive directory %s", a.Root)
+		return Version{}, err
+	}
+	root, err := os.OpenRoot(a.Root)
+	if err != nil {
+		return Version{}, err
+	}
+	defer root.Close()
+
+	archivedAt := a.now().UTC()
+	version := Version{Path: relativePath, ArchivedAt: archivedAt, Size: stat.Size()}
+	for {
+		version.Version = archivedAt.Format(VersionFormat)
+		if _, err := root.Lstat(version.Name()); os.IsNotExist(err) {
+			break
+		}
+		archivedAt = archivedAt.Add(time.Nanosecond)
+		version.ArchivedAt = archivedAt
+	}
+
+	if err := controller.MkdirAllInRoot(root, filepath.Dir(version.Name()), 0750); err != nil {
+		archivelogger.Error().Err(err).Msgf("Failed to create archive directory %s", filepath.Dir(version.Name()))
+		return Version{}, err
+	}
+
+	archivelogger.Info().Msgf("Archiving %s as %s", name, version.Name())
+	if err := controller.RenameInRoot(source, name, root, version.Name()); err != nil {
+		if !errors.Is(err, syscall.EXDEV) {
+			return Version{}, err
+		}
+		// the archive is on another file system
+		if err := moveFile(source, name, root, version.Name()); err != nil {
+			archivelogger.Error().Err(err).Msgf("Failed to move %s to the archive", name)
+			return Version{}, err
+		}
+	}
+	return version, nil
+}
+
+func moveFile(sourceRoot *os.Root, sourceName string, destRoot *os.Root, destName string) error {
+	source, err := sourceRoot.Open(sourceName)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	stat, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	dest, err := destRoot.OpenFile(destName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, stat.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dest, source); err != nil {
+		dest.Close()
+		destRoot.Remove(destName)
+		return err
+	}
+	if err := dest.Sync(); err != nil {
+		dest.Close()
+		destRoot.Remove(destName)
+		return err
+	}
+	if err := dest.Close(); err != nil {
+		destRoot.Remove(destName)
+		return err
+	}
+	return sourceRoot.Remove(sourceName)
+}
+
+// parseVersion splits an archived file name into the original path and its
+// version, returning false for files that are not archive versions.
+func parseVersion(name string) (string, time.Time, string, bool) {
+	index := strings.LastIndex(name, versionSeparator)
+	if index <= 0 {
+		return "", time.Time{}, "", false
+	}
+	version := name[index+len(versionSeparator):]
+	archivedAt, err := time.Parse(VersionFormat, version)
+	if err != nil {
+		return "", time.Time{}, "", false
+	}
+	return name[:index], archivedAt, version, true
+}
+
+// List returns the archived versions of the files under prefix, oldest first.
+// An empty prefix lists the whole archive.
+func (a *Archive) List(prefix string) ([]Version, error) {
+	versions := make([]Version, 0)
+	err := filepath.WalkDir(a.Root, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && filePath == a.Root {
+				return nil
+			}
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		name, err := filepath.Rel(a.Root, filePath)
+		if err != nil {
+			return err
+		}
+		relativePath, archivedAt, version, ok := parseVersion(name)
+		if !ok || !matchesPrefix(relativePath, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		versions = append(versions, Version{
+			Path:       relativePath,
+			Version:    version,
+			ArchivedAt: archivedAt,
+			Size:       info.Size(),
+		})
+		return nil
+	})
+	sort.Slice(versions, func(i, j int) bool {
+		if !versions[i].ArchivedAt.Equal(versions[j].ArchivedAt) {
+			return versions[i].ArchivedAt.Before(versions[j].ArchivedAt)
+		}
+		return versions[i].Path < versions[j].Path
+	})
+	return versions, err
+}
+
+func matchesPrefix(relativePath string, prefix string) bool {
+	prefix = strings.TrimSuffix(filepath.Clean(prefix), string(filepath.Separator))
+	if prefix == "" || prefix == "." {
+		return true
+	}
+	return relativePath == prefix || strings.HasPrefix(relativePath, prefix+string(filepath.Separator))
+}
+
+// Latest returns the latest version of every archived file under prefix.
+func (a *Archive) Latest(prefix string) ([]Version, error) {
+	versions, err := a.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]Version)
+	for _, version := range versions {
+		latest[version.Path] = version
+	}
+	result := make([]Version, 0, len(latest))
+	for _, version := range latest {
+		result = append(result, version)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+	return result, nil
+}
+
+// ErrInvalidVersion is returned for a version not in VersionFormat or a path
+// leading out of the archive.
+var ErrInvalidVersion = errors.New("invalid archive version")
+
+// Find returns a version of relativePath, the latest one when version is
+// empty.
+func (a *Archive) Find(relativePath string, version string) (Version, error) {
+	if !filepath.IsLocal(relativePath) || strings.ContainsRune(relativePath, 0) {
+		return Version{}, fmt.Errorf("%w: %q is not below the archive", ErrInvalidVersion, relativePath)
+	}
+	if version != "" {
+		if strings.ContainsAny(version, "/\\\x00") || strings.Contains(version, "..") {
+			return Version{}, fmt.Errorf("%w: %q", ErrInvalidVersion, version)
+		}
+		archivedAt, err := time.Parse(VersionFormat, version)
+		if err != nil {
+			return Version{}, fmt.Errorf("%w: %q", ErrInvalidVersion, version)
+		}
+		found := Version{Path: relativePath, Version: version, ArchivedAt: archivedAt}
+		root, err := os.OpenRoot(a.Root)
+		if err != nil {
+			return Version{}, err
+		}
+		defer root.Close()
+		stat, err := root.Lstat(found.Name())
+		if err != nil {
+			return Version{}, err
+		}
+		found.Size = stat.Size()
+		return found, nil
+	}
+
+	versions, err := a.List(relativePath)
+	if err != nil {
+		return Version{}, err
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Path == relativePath {
+			return versions[i], nil
+		}
+	}
+	return Version{}, &fs.PathError{Op: "open", Path: relativePath, Err: fs.ErrNotExist}
+}
+
+// Open opens a version of relativePath for reading, the latest one when
+// version is empty. It is opened through the root of the archive, which
+// refuses to leave it.
+func (a *Archive) Open(relativePath string, version string) (*os.File, error) {
+	found, err := a.Find(relativePath, version)
+	if err != nil {
+		return nil, err
+	}
+	root, err := os.OpenRoot(a.Root)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	return root.Open(found.Name())
+}
+
+func (a *Archive) remove(version Version, result *PruneResult) error {
+	filePath := filepath.Join(a.Root, version.Name())
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		archivelogger.Error().Err(err).Msgf("Failed to remove archived %s", filePath)
+		return err
+	}
+	result.Removed++
+	result.Freed += version.Size
+
+	// drop the directories the version leaves empty
+	for dir := filepath.Dir(filePath); dir != a.Root && strings.HasPrefix(dir, a.Root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// Prune enforces the retention rules: the number of versions per path first,
+// then their age, then the total size, removing the oldest versions first.
+func (a *Archive) Prune() (PruneResult, error) {
+	var result PruneResult
+	versions, err := a.List("")
+	if err != nil {
+		return result, err
+	}
+
+	kept := make([]Version, 0, len(versions))
+	perPath := make(map[string]int)
+	cutoff := a.now().Add(-a.Retention.MaxAge)
+	// newest first, so the versions past KeepVersions are the old ones
+	for i := len(versions) - 1; i >= 0; i-- {
+		version := versions[i]
+		perPath[version.Path]++
+		expired := a.Retention.MaxAge > 0 && version.ArchivedAt.Before(cutoff)
+		if expired || (a.Retention.KeepVersions > 0 && perPath[version.Path] > a.Retention.KeepVersions) {
+			if err := a.remove(version, &result); err != nil {
+				return result, err
+			}
+			continue
+		}
+		kept = append(kept, version)
+	}
+
+	if a.Retention.MaxSize > 0 {
+		var total int64
+		for _, version := range kept {
+			total += version.Size
+		}
+		// kept is newest first
+		for i := len(kept) - 1; i >= 0 && total > a.Retention.MaxSize; i-- {
+			if err := a.remove(kept[i], &result); err != nil {
+				return result, err
+			}
+			total -= kept[i].Size
+		}
+	}
+
+	if result.Removed > 0 {
+		archivelogger.Info().Msgf("Pruned %d archived versions, freed %d bytes", result.Removed, result.Freed)
+	}
+	return result, nil
+}
+
+// Purge removes the versions under prefix archived more than olderThan ago,
+// all of them when olderThan is 0.
+func (a *Archive) Purge(prefix string, olderThan time.Duration) (PruneResult, error) {
+	var result PruneResult
+	versions, err := a.List(prefix)
+	if err != nil {
+		return result, err
+	}
+	cutoff := a.now().Add(-olderThan)
+	for _, version := range versions {
+		if olderThan > 0 && !version.ArchivedAt.Before(cutoff) {
+			continue
+		}
+		if err := a.remove(version, &result); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// Run prunes the archive at the given interval until the context is cancelled.
+func (a *Archive) Run(ctx context.Context, interval time.Duration) {
+	if a.Retention == (Retention{}) {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := a.Prune(); err != nil {
+			archivelogger.Error().Err(err).Msg("Failed to prune the archive")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ParseAge parses a duration that also accepts days, e.g. 30d or 12h.
+func ParseAge(age string) (time.Duration, error) {
+	if age == "" || age == "0" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(age, "d"); ok {
+		count, err := strconv.ParseFloat(days, 64)
+		if err != nil || count < 0 {
+			return 0, fmt.Errorf("invalid age %q", age)
+		}
+		return time.Duration(count * float64(24*time.Hour)), nil
+	}
+	duration, err := time.ParseDuration(age)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid age %q", age)
+	}
+	return duration, nil
+}
@@ -0,0 +1,274 @@
+package archive
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// clock returns a now function that advances by step on every call.
+func clock(start time.Time, step time.Duration) func() time.Time {
+	current := start
+	return func() time.Time {
+		now := current
+		current = current.Add(step)
+		return now
+	}
+}
+
+func storeFile(t *testing.T, a *Archive, root string, relativePath string, content string) Version {
+	t.Helper()
+	filePath := filepath.Join(root, relativePath)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, []byte(content), 0640); err != nil {
+		t.Fatal(err)
+	}
+	source, err := os.OpenRoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	version, err := a.Store(source, relativePath, relativePath)
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be moved into the archive", filePath)
+	}
+	return version
+}
+
+func TestStoreKeepsEveryVersion(t *testing.T) {
+	root := t.TempDir()
+	a := New(filepath.Join(t.TempDir(), "archive"), Retention{})
+	a.now = clock(time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC), time.Minute)
+
+	first := storeFile(t, a, root, "a/b.txt", "first")
+	second := storeFile(t, a, root, "a/b.txt", "second!")
+	storeFile(t, a, root, "c.txt", "other")
+
+	versions, err := a.List("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Version != first.Version || versions[1].Version != second.Version {
+		t.Fatalf("Expected both versions of a/b.txt oldest first, got %+v", versions)
+	}
+	if versions[1].Size != 7 {
+		t.Errorf("Expected size 7, got %d", versions[1].Size)
+	}
+
+	latest, err := a.Latest("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(latest) != 2 || latest[0].Path != "a/b.txt" || latest[0].Version != second.Version || latest[1].Path != "c.txt" {
+		t.Errorf("Unexpected latest versions %+v", latest)
+	}
+
+	latestFile, err := a.Open("a/b.txt", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer latestFile.Close()
+	if content, _ := io.ReadAll(latestFile); string(content) != "second!" {
+		t.Errorf("Expected the latest version, got %q", content)
+	}
+	firstFile, err := a.Open("a/b.txt", first.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer firstFile.Close()
+	if content, _ := io.ReadAll(firstFile); string(content) != "first" {
+		t.Errorf("Expected the first version, got %q", content)
+	}
+	if _, err := a.Open("missing.txt", ""); !os.IsNotExist(err) {
+		t.Errorf("Expected not exist for a file never archived, got %v", err)
+	}
+}
+
+func TestStoreSameInstant(t *testing.T) {
+	root := t.TempDir()
+	a := New(t.TempDir(), Retention{})
+	at := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return at }
+
+	first := storeFile(t, a, root, "x.txt", "1")
+	second := storeFile(t, a, root, "x.txt", "2")
+	if first.Version == second.Version {
+		t.Fatalf("Expected distinct versions, both are %s", first.Version)
+	}
+	if versions, _ := a.List(""); len(versions) != 2 {
+		t.Errorf("Expected 2 versions, got %d", len(versions))
+	}
+}
+
+func TestListMissingArchive(t *testing.T) {
+	a := New(filepath.Join(t.TempDir(), "none"), Retention{})
+	versions, err := a.List("")
+	if err != nil || len(versions) != 0 {
+		t.Errorf("Expected an empty list, got %v, %v", versions, err)
+	}
+}
+
+func TestPruneKeepVersions(t *testing.T) {
+	root := t.TempDir()
+	a := New(t.TempDir(), Retention{KeepVersions: 2})
+	a.now = clock(time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC), time.Minute)
+
+	for _, content := range []string{"1", "22", "333", "4444"} {
+		storeFile(t, a, root, "f.txt", content)
+	}
+	storeFile(t, a, root, "g.txt", "g")
+
+	result, err := a.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Removed != 2 || result.Freed != 3 {
+		t.Errorf("Expected 2 versions and 3 bytes removed, got %+v", result)
+	}
+	versions, _ := a.List("f.txt")
+	if len(versions) != 2 || versions[0].Size != 3 || versions[1].Size != 4 {
+		t.Errorf("Expected the 2 newest versions kept, got %+v", versions)
+	}
+	if versions, _ := a.List("g.txt"); len(versions) != 1 {
+		t.Errorf("Expected g.txt kept, got %+v", versions)
+	}
+}
+
+func TestPruneMaxAge(t *testing.T) {
+	root := t.TempDir()
+	a := New(t.TempDir(), Retention{MaxAge: 60 * time.Hour})
+	start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	a.now = clock(start, 24*time.Hour)
+
+	storeFile(t, a, root, "old/a.txt", "a")
+	storeFile(t, a, root, "old/b.txt", "b")
+	storeFile(t, a, root, "new.txt", "c")
+	// the prune runs a day after the last version, old/a.txt is 3 days old
+	result, err := a.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Removed != 1 {
+		t.Errorf("Expected 1 version removed, got %+v", result)
+	}
+	versions, _ := a.List("")
+	if len(versions) != 2 || versions[0].Path != "old/b.txt" {
+		t.Errorf("Unexpected versions after prune %+v", versions)
+	}
+}
+
+func TestPruneMaxSize(t *testing.T) {
+	root := t.TempDir()
+	a := New(t.TempDir(), Retention{MaxSize: 10})
+	a.now = clock(time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC), time.Minute)
+
+	storeFile(t, a, root, "a.txt", "aaaa")
+	storeFile(t, a, root, "b.txt", "bbbb")
+	storeFile(t, a, root, "c.txt", "cccc")
+
+	result, err := a.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Removed != 1 || result.Freed != 4 {
+		t.Errorf("Expected the oldest version removed, got %+v", result)
+	}
+	versions, _ := a.List("")
+	if len(versions) != 2 || versions[0].Path != "b.txt" {
+		t.Errorf("Unexpected versions after prune %+v", versions)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	root := t.TempDir()
+	archiveRoot := t.TempDir()
+	a := New(archiveRoot, Retention{})
+	a.now = clock(time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC), 24*time.Hour)
+
+	storeFile(t, a, root, "keep/a.txt", "a")
+	storeFile(t, a, root, "drop/b.txt", "b")
+	storeFile(t, a, root, "drop/c.txt", "c")
+
+	// drop/b.txt was archived 2 days before the purge, drop/c.txt 1 day
+	result, err := a.Purge("drop", 36*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Removed != 1 {
+		t.Errorf("Expected 1 version purged, got %+v", result)
+	}
+
+	result, err = a.Purge("drop/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Removed != 1 {
+		t.Errorf("Expected the rest of drop purged, got %+v", result)
+	}
+	if _, err := os.Stat(filepath.Join(archiveRoot, "drop")); !os.IsNotExist(err) {
+		t.Errorf("Expected the empty directory removed, got %v", err)
+	}
+	if versions, _ := a.List(""); len(versions) != 1 || versions[0].Path != "keep/a.txt" {
+		t.Errorf("Unexpected versions after purge %+v", versions)
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":    0,
+		"0":   0,
+		"30d": 30 * 24 * time.Hour,
+		"12h": 12 * time.Hour,
+		"90m": 90 * time.Minute,
+	}
+	for age, expected := range cases {
+		duration, err := ParseAge(age)
+		if err != nil || duration != expected {
+			t.Errorf("ParseAge(%q) = %v, %v, expected %v", age, duration, err, expected)
+		}
+	}
+	for _, age := range []string{"d", "-1d", "3w", "-5h"} {
+		if _, err := ParseAge(age); err == nil {
+			t.Errorf("Expected ParseAge(%q) to fail", age)
+		}
+	}
+}
+
+func TestOpenConfined(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600)
+	a := New(filepath.Join(t.TempDir(), "archive"), Retention{})
+	version := storeFile(t, a, root, "a", "data")
+	os.Symlink(filepath.Join(outside, "secret"), filepath.Join(a.Root, "link~"+version.Version))
+
+	relativeOutside, _ := filepath.Rel(a.Root, filepath.Join(outside, "secret"))
+	for _, test := range []struct{ path, version string }{
+		{"a", "x/../" + relativeOutside},
+		{"a", "../../" + relativeOutside},
+		{"a", version.Version + "/.."},
+		{"a", version.Version + "\x00"},
+		{"a", "latest"},
+		{"../a", version.Version},
+		{"/etc/passwd", ""},
+	} {
+		if file, err := a.Open(test.path, test.version); !errors.Is(err, ErrInvalidVersion) {
+			if file != nil {
+				file.Close()
+			}
+			t.Errorf("Expected version %q of %q to be refused, got %v", test.version, test.path, err)
+		}
+	}
+	if file, err := a.Open("link", version.Version); err == nil {
+		file.Close()
+		t.Errorf("Expected a link out of the archive not to be followed")
+	}
+}
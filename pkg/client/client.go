@@ -2,16 +2,23 @@ package client
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"os"
 	"path"
+	"slices"
 	"syscall"
+	"time"
 
 	"github.com/cespare/xxhash/v2"
+	"github.com/kosalaat/file-replicator/pkg/controller"
+	"github.com/kosalaat/file-replicator/pkg/encryption"
 	"github.com/kosalaat/file-replicator/replicator"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
 )
 
 var clientlogger = log.With().Str("component", "client").Logger()
@@ -20,33 +27,176 @@ type ReplicatorClient struct {
 	conn         grpc.ClientConnInterface
 	FileRoot     string
 	parallelRuns uint64
+	throttle     *Throttle
+	// hashAlgorithm hashes the blocks of the signatures, confirmAlgorithm
+	// additionally when set.
+	hashAlgorithm    string
+	confirmAlgorithm string
+	// compression is only used once the reciever accepted it.
+	compression string
+	compressing bool
+	compressed  *compressionCounter
+	// cipher seals the files before they are sent, when set.
+	cipher *encryption.Cipher
+	// credentials secure the channel, it is plain text when nil.
+	credentials credentials.TransportCredentials
+	// token authenticates the sender to the reciever, when set.
+	token string
+	// namespace of the reciever to replicate into, its default file root
+	// when empty.
+	namespace string
 	replicator.FileReplicatorClient
 }
 
-func NewReplicatorClient(address string, fileRoot string, parallelRuns uint64) (*ReplicatorClient, error) {
-	conn, err := grpc.NewClient(
-		address,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-	)
+type ClientOption func(*ReplicatorClient)
+
+// WithThrottle limits the bandwidth used for chunk data and signatures.
+func WithThrottle(throttle *Throttle) ClientOption {
+	return func(r *ReplicatorClient) {
+		r.throttle = throttle
+	}
+}
+
+// WithHashAlgorithm picks the block hash of the signatures and, when confirm is
+// set, a second hash the reciever checks a match against before skipping a
+// block.
+func WithHashAlgorithm(algorithm string, confirm string) ClientOption {
+	return func(r *ReplicatorClient) {
+		r.hashAlgorithm = algorithm
+		r.confirmAlgorithm = confirm
+	}
+}
+
+// WithTransportCredentials secures the channel to the reciever, e.g. with the
+// TLS credentials of the transport package.
+func WithTransportCredentials(credentials credentials.TransportCredentials) ClientOption {
+	return func(r *ReplicatorClient) {
+		r.credentials = credentials
+	}
+}
+
+// WithToken authenticates to the reciever with a bearer token. The token is
+// only sent over a secure channel.
+func WithToken(token string) ClientOption {
+	return func(r *ReplicatorClient) {
+		r.token = token
+	}
+}
+
+type bearerToken string
+
+func (t bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t bearerToken) RequireTransportSecurity() bool {
+	return true
+}
+
+// WithNamespace replicates into a namespace of the reciever, served from its
+// own file root.
+func WithNamespace(namespace string) ClientOption {
+	return func(r *ReplicatorClient) {
+		r.namespace = namespace
+	}
+}
+
+type namespaceName string
+
+func (n namespaceName) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"namespace": string(n)}, nil
+}
+
+func (n namespaceName) RequireTransportSecurity() bool {
+	return false
+}
+
+func NewReplicatorClient(address string, fileRoot string, parallelRuns uint64, opts ...ClientOption) (*ReplicatorClient, error) {
+	replicatorClient := &ReplicatorClient{parallelRuns: parallelRuns, FileRoot: fileRoot}
+	for _, opt := range opts {
+		opt(replicatorClient)
+	}
+	transportCredentials := replicatorClient.credentials
+	if transportCredentials == nil {
+		transportCredentials = insecure.NewCredentials()
+	}
+
+	dialOptions := []grpc.DialOption{grpc.WithTransportCredentials(transportCredentials)}
+	if replicatorClient.token != "" {
+		dialOptions = append(dialOptions, grpc.WithPerRPCCredentials(bearerToken(replicatorClient.token)))
+	}
+	if replicatorClient.namespace != "" {
+		dialOptions = append(dialOptions, grpc.WithPerRPCCredentials(namespaceName(replicatorClient.namespace)))
+	}
+
+	conn, err := grpc.NewClient(address, dialOptions...)
 	if err != nil {
 		clientlogger.Error().Err(err).Msg("Failed to connect to server")
 		return nil, err
 	}
 
-	client := replicator.NewFileReplicatorClient(conn)
+	replicatorClient.conn = conn
+	replicatorClient.FileReplicatorClient = replicator.NewFileReplicatorClient(conn)
 	clientlogger.Info().Msg("Connected to server successfully")
-	return &ReplicatorClient{conn: conn, FileReplicatorClient: client, parallelRuns: parallelRuns, FileRoot: fileRoot}, nil
+	return replicatorClient, nil
+}
+
+func (r *ReplicatorClient) Throttle() *Throttle {
+	return r.throttle
 }
 
+// Target returns the address of the receiver.
+func (r *ReplicatorClient) Target() string {
+	if conn, ok := r.conn.(*grpc.ClientConn); ok {
+		return conn.Target()
+	}
+	return ""
+}
+
+// State returns the connectivity state of the channel to the receiver, e.g.
+// READY or TRANSIENT_FAILURE.
+func (r *ReplicatorClient) State() string {
+	if conn, ok := r.conn.(*grpc.ClientConn); ok {
+		return conn.GetState().String()
+	}
+	return ""
+}
+
+// chunkAttempts is how often a chunk the reciever found corrupted is sent.
+const chunkAttempts = 3
+
+// ReplicateChunk sends a chunk with the hash of its data, which the reciever
+// checks before writing it. A chunk corrupted on the way is sent again.
 func (r *ReplicatorClient) ReplicateChunk(ctx context.Context, chunk *replicator.DataPayload) (*replicator.Confirmation, error) {
 	clientlogger.Info().Msg("Sending chunk to server...")
-	confirmation, err := r.FileReplicatorClient.Replicate(ctx, chunk)
-	if err != nil {
-		clientlogger.Error().Err(err).Msg("Failed to send chunk")
-		return nil, err
+	sealed := r.sealChunk(chunk)
+	if sealed.DataChunk != nil && len(sealed.Hash) == 0 {
+		algorithm, err := controller.LookupHash(r.hashAlgorithm)
+		if err != nil {
+			return nil, err
+		}
+		sealed.Hash = algorithm.Sum(sealed.DataChunk)
+		sealed.HashAlgorithm = algorithm.Name
+	}
+
+	wire := r.compressChunk(sealed)
+	for attempt := 1; ; attempt++ {
+		if err := r.throttle.Wait(ctx, proto.Size(wire)); err != nil {
+			clientlogger.Error().Err(err).Msg("Cancelled while waiting for bandwidth")
+			return nil, err
+		}
+		confirmation, err := r.FileReplicatorClient.Replicate(ctx, wire)
+		if err != nil {
+			clientlogger.Error().Err(err).Msg("Failed to send chunk")
+			return nil, err
+		}
+		if confirmation.Code == replicator.ConfirmationCode_CHUNK_CORRUPTED && attempt < chunkAttempts {
+			clientlogger.Warn().Msgf("Chunk %d of %s was corrupted, sending it again", chunk.ChunkID, chunk.RelativeFilePath)
+			continue
+		}
+		clientlogger.Info().Msgf("Chunk sent, confirmation code is: %s", confirmation.Code)
+		return confirmation, nil
 	}
-	clientlogger.Info().Msg("Chunk sent successfully")
-	return confirmation, nil
 }
 
 func (r *ReplicatorClient) CheckDuplicates(
@@ -56,6 +206,28 @@ func (r *ReplicatorClient) CheckDuplicates(
 ) (*replicator.Confirmation, error) {
 	clientlogger.Info().Msg("Checking for duplicates...")
 
+	response, err := r.BuildSignature(file, blockSize)
+	if err != nil {
+		if response == nil {
+			return nil, err
+		}
+		return &replicator.Confirmation{
+			Code: replicator.ConfirmationCode_FILE_NOT_READABLE,
+		}, err
+	}
+	return r.CheckSignature(ctx, response)
+}
+
+// BuildSignature reads the file and hashes it block by block. It also hashes
+// the whole file, which tells the versions store whether it really changed.
+// With a cipher the blocks are sealed first, so the signature is the one of the
+// file as held by the reciever.
+func (r *ReplicatorClient) BuildSignature(file string, blockSize uint64) (*replicator.DataSignature, error) {
+	if r.cipher != nil && blockSize != r.cipher.BlockSize() {
+		err := fmt.Errorf("files are sealed in blocks of %d bytes, not %d", r.cipher.BlockSize(), blockSize)
+		clientlogger.Error().Err(err).Msg("Failed to build the signature")
+		return nil, err
+	}
 	fileInfo, err := os.Open(path.Join(r.FileRoot, file))
 	if err != nil {
 		clientlogger.Error().Err(err).Msg("Failed to get file info")
@@ -64,6 +236,21 @@ func (r *ReplicatorClient) CheckDuplicates(
 
 	defer fileInfo.Close()
 
+	algorithm, err := controller.LookupHash(r.hashAlgorithm)
+	if err != nil {
+		clientlogger.Error().Err(err).Msg("Failed to pick the block hash")
+		return nil, err
+	}
+	var confirm *controller.HashAlgorithm
+	if r.confirmAlgorithm != "" {
+		confirmAlgorithm, err := controller.LookupHash(r.confirmAlgorithm)
+		if err != nil {
+			clientlogger.Error().Err(err).Msg("Failed to pick the confirming hash")
+			return nil, err
+		}
+		confirm = &confirmAlgorithm
+	}
+
 	buf := make([]byte, blockSize)
 
 	fileStat, err := fileInfo.Stat()
@@ -85,7 +272,18 @@ func (r *ReplicatorClient) CheckDuplicates(
 		FileMode:         uint32(fileStat.Mode()),
 		UID:              uint32(stat.Uid),
 		GID:              uint32(stat.Gid),
+		ModTime:          fileStat.ModTime().UnixNano(),
+		HashAlgorithm:    algorithm.Name,
+	}
+	if confirm != nil {
+		response.ConfirmAlgorithm = confirm.Name
+	}
+	if r.cipher != nil {
+		response.RelativeFilePath = r.cipher.SealPath(file)
+		response.BlockSize = r.cipher.SealedBlockSize()
+		response.FileSize = r.cipher.SealedSize(response.FileSize)
 	}
+	fileHash := xxhash.New()
 
 	var blockId uint64
 
@@ -94,39 +292,60 @@ func (r *ReplicatorClient) CheckDuplicates(
 		n, err := fileInfo.Read(buf)
 		if err != nil && err != io.EOF {
 			clientlogger.Error().Err(err).Msg("Failed to read file")
-			return &replicator.Confirmation{
-				Code: replicator.ConfirmationCode_FILE_NOT_READABLE,
-			}, err
+			return response, err
 		}
 		clientlogger.Info().Msgf("Read %d bytes from file, data: %s", n, string(buf[:n]))
+		block := buf[:n]
+		if r.cipher != nil && n > 0 {
+			block = r.cipher.Seal(file, blockId, block)
+		}
+		fileHash.Write(block)
 
 		if err == io.EOF {
 			if n == 0 {
 				clientlogger.Info().Msg("No more data to read from file")
 			} else {
 				clientlogger.Info().Msg("End of file reached, processing last chunk")
-				chunk := replicator.ChunkInfo{
-					Hash:      xxhash.Sum64(buf[:n]),
-					BlockSize: uint64(n),
-					ChunkID:   blockId,
-				}
-				response.Chunk = append(response.Chunk, &chunk)
+				response.Chunk = append(response.Chunk, chunkInfo(blockId, block, algorithm, confirm))
 			}
 			break
 		}
 		if n > 0 {
 			clientlogger.Info().Msgf("Read chunk %d", blockId)
-			chunk := replicator.ChunkInfo{
-				Hash:      xxhash.Sum64(buf[:n]),
-				BlockSize: uint64(n),
-				ChunkID:   blockId,
-			}
-			response.Chunk = append(response.Chunk, &chunk)
+			response.Chunk = append(response.Chunk, chunkInfo(blockId, block, algorithm, confirm))
 		}
 	}
 
+	response.FileHash = fileHash.Sum64()
+	return response, nil
+}
+
+// chunkInfo hashes one block for the signature. Hashes other than xxhash64 are
+// sent as bytes, with their first 8 bytes as the numeric hash.
+func chunkInfo(chunkID uint64, block []byte, algorithm controller.HashAlgorithm, confirm *controller.HashAlgorithm) *replicator.ChunkInfo {
+	digest := algorithm.Sum(block)
+	chunk := &replicator.ChunkInfo{
+		Hash:      controller.HashUint64(digest),
+		BlockSize: uint64(len(block)),
+		ChunkID:   chunkID,
+	}
+	if algorithm.Name != controller.HashXXHash64 {
+		chunk.Digest = digest
+	}
+	if confirm != nil {
+		chunk.Confirm = confirm.Sum(block)
+	}
+	return chunk
+}
+
+func (r *ReplicatorClient) CheckSignature(ctx context.Context, response *replicator.DataSignature) (*replicator.Confirmation, error) {
 	clientlogger.Info().Msgf("Sending %d chunks to server", len(response.Chunk))
 
+	if err := r.throttle.Wait(ctx, proto.Size(response)); err != nil {
+		clientlogger.Error().Err(err).Msg("Cancelled while waiting for bandwidth")
+		return nil, err
+	}
+
 	confirmation, err := r.FileReplicatorClient.CheckDuplicates(
 		ctx,
 		response,
@@ -136,17 +355,29 @@ func (r *ReplicatorClient) CheckDuplicates(
 		clientlogger.Error().Err(err).Msg("Failed to check duplicates")
 		return nil, err
 	}
+	if confirmation.Code == replicator.ConfirmationCode_HASH_UNSUPPORTED {
+		err := fmt.Errorf("reciever does not accept the %s block hash", response.HashAlgorithm)
+		clientlogger.Error().Err(err).Msg("Failed to check duplicates")
+		return confirmation, err
+	} else if confirmation.Code == replicator.ConfirmationCode_BLOCK_SIZE_ERROR {
+		err := fmt.Errorf("reciever does not accept blocks of %d bytes", response.BlockSize)
+		clientlogger.Error().Err(err).Msg("Failed to check duplicates")
+		return confirmation, err
+	}
 	clientlogger.Info().Msgf("Duplicate check completed successfully, found changes: %d", len(confirmation.Chunk))
 	return confirmation, nil
 }
 
 func (r *ReplicatorClient) RenameFile(ctx context.Context, oldPath, newPath string) (*replicator.Confirmation, error) {
 	clientlogger.Info().Msgf("Renaming file from %s to %s", oldPath, newPath)
+	if r.cipher != nil {
+		return nil, ErrSealedRename
+	}
 	confirmation, err := r.FileReplicatorClient.Rename(
 		ctx,
 		&replicator.FileOps{
-			RelativeFilePath:    oldPath,
-			NewRelativeFilePath: newPath,
+			RelativeFilePath:    r.SealPath(oldPath),
+			NewRelativeFilePath: r.SealPath(newPath),
 		},
 	)
 	if err != nil {
@@ -162,7 +393,7 @@ func (r *ReplicatorClient) DeleteFile(ctx context.Context, filePath string) (*re
 	confirmation, err := r.FileReplicatorClient.Delete(
 		ctx,
 		&replicator.FileOps{
-			RelativeFilePath: filePath,
+			RelativeFilePath: r.SealPath(filePath),
 		},
 	)
 	if err != nil {
@@ -182,3 +413,172 @@ func (r *ReplicatorClient) Ping(ctx context.Context, in *replicator.PingPong) *r
 		return pong
 	}
 }
+
+// Negotiate asks the reciever for the hash algorithms and compressions it
+// accepts. The block hash falls back to the default one, and the confirming
+// hash and the compression are dropped, when the reciever does not accept
+// them. Older recievers accept neither.
+func (r *ReplicatorClient) Negotiate(ctx context.Context) error {
+	wanted := []string{r.hashAlgorithm}
+	if r.confirmAlgorithm != "" {
+		wanted = append(wanted, r.confirmAlgorithm)
+	}
+	pong, err := r.FileReplicatorClient.Ping(ctx, &replicator.PingPong{HashAlgorithms: wanted}, grpc.WaitForReady(true))
+	if err != nil {
+		clientlogger.Error().Err(err).Msg("Failed to negotiate with the reciever")
+		return err
+	}
+
+	if r.hashAlgorithm != "" && !slices.Contains(pong.HashAlgorithms, r.hashAlgorithm) {
+		clientlogger.Warn().Msgf("Reciever does not accept %s, falling back to %s", r.hashAlgorithm, controller.DefaultHashAlgorithm)
+		r.hashAlgorithm = controller.DefaultHashAlgorithm
+	}
+	if r.confirmAlgorithm != "" && !slices.Contains(pong.HashAlgorithms, r.confirmAlgorithm) {
+		clientlogger.Warn().Msgf("Reciever does not accept %s, blocks are not confirmed", r.confirmAlgorithm)
+		r.confirmAlgorithm = ""
+	}
+	clientlogger.Info().Msgf("Hashing blocks with %s", r.HashAlgorithm())
+
+	if r.compression != "" {
+		r.compressing = slices.Contains(pong.Compressions, r.compression)
+		if r.compressing {
+			r.compressed = &compressionCounter{}
+			clientlogger.Info().Msgf("Compressing chunks with %s", r.compression)
+		} else {
+			clientlogger.Warn().Msgf("Reciever can not inflate %s, chunks are sent raw", r.compression)
+		}
+	}
+	return nil
+}
+
+// HashAlgorithm returns the block hash of the signatures.
+func (r *ReplicatorClient) HashAlgorithm() string {
+	if r.hashAlgorithm == "" {
+		return controller.DefaultHashAlgorithm
+	}
+	return r.hashAlgorithm
+}
+
+// ListFiles returns the files the reciever holds, keyed by relative path.
+func (r *ReplicatorClient) ListFiles(ctx context.Context) (map[string]*replicator.FileInfo, error) {
+	return r.ListTree(ctx, "", false)
+}
+
+// ListTree returns the files under relativePath on the reciever, or in its
+// archive when archive is set. Sealed names are opened, the sizes are left
+// those of the sealed files.
+func (r *ReplicatorClient) ListTree(ctx context.Context, relativePath string, archive bool) (map[string]*replicator.FileInfo, error) {
+	clientlogger.Info().Msgf("Listing files under %q on the reciever...", relativePath)
+	stream, err := r.FileReplicatorClient.List(
+		ctx,
+		&replicator.ListRequest{RelativePath: r.SealPath(relativePath), Archive: archive},
+		grpc.WaitForReady(true),
+	)
+	if err != nil {
+		clientlogger.Error().Err(err).Msg("Failed to list files")
+		return nil, err
+	}
+
+	remoteFiles := make(map[string]*replicator.FileInfo)
+	for {
+		fileInfo, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			clientlogger.Error().Err(err).Msg("Failed to list files")
+			return nil, err
+		}
+		if r.cipher != nil {
+			name, err := r.cipher.OpenPath(fileInfo.RelativeFilePath)
+			if err != nil {
+				clientlogger.Warn().Err(err).Msgf("Skipping %s, it was not sealed with this key file", fileInfo.RelativeFilePath)
+				continue
+			}
+			fileInfo.RelativeFilePath = name
+		}
+		remoteFiles[fileInfo.RelativeFilePath] = fileInfo
+	}
+	clientlogger.Info().Msgf("Reciever holds %d files", len(remoteFiles))
+	return remoteFiles, nil
+}
+
+// Digests asks the reciever for the strong hash of the given files.
+func (r *ReplicatorClient) Digests(ctx context.Context, files []string, algorithm string) ([]*replicator.FileDigest, error) {
+	stream, err := r.FileReplicatorClient.Digest(
+		ctx,
+		&replicator.DigestRequest{RelativeFilePath: files, Algorithm: algorithm},
+		grpc.WaitForReady(true),
+	)
+	if err != nil {
+		clientlogger.Error().Err(err).Msg("Failed to request digests")
+		return nil, err
+	}
+
+	digests := make([]*replicator.FileDigest, 0, len(files))
+	for {
+		fileDigest, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			clientlogger.Error().Err(err).Msg("Failed to receive digests")
+			return nil, err
+		}
+		digests = append(digests, fileDigest)
+	}
+	return digests, nil
+}
+
+// Snapshot asks the reciever to snapshot its file root once the batches in
+// flight are applied.
+func (r *ReplicatorClient) Snapshot(ctx context.Context, label string, quiesceTimeout time.Duration) (*replicator.SnapshotInfo, error) {
+	clientlogger.Info().Msgf("Requesting a snapshot %q from the reciever", label)
+	info, err := r.FileReplicatorClient.Snapshot(
+		ctx,
+		&replicator.SnapshotRequest{Label: label, QuiesceTimeout: quiesceTimeout.Milliseconds()},
+		grpc.WaitForReady(true),
+	)
+	if err != nil {
+		clientlogger.Error().Err(err).Msg("Failed to take the snapshot")
+		return info, err
+	}
+	clientlogger.Info().Msgf("Reciever took snapshot %s", info.Name)
+	return info, nil
+}
+
+// Begin opens a new version of the file on the reciever, the chunks sent for
+// it are only made live by Commit.
+func (r *ReplicatorClient) Begin(ctx context.Context, version *replicator.FileVersion) (*replicator.Confirmation, error) {
+	clientlogger.Info().Msgf("Beginning version %d of %s with %d chunks", version.Version, version.RelativeFilePath, len(version.Chunks))
+	confirmation, err := r.FileReplicatorClient.Begin(ctx, r.sealVersion(version))
+	if err != nil {
+		clientlogger.Error().Err(err).Msg("Failed to begin file version")
+		return confirmation, err
+	}
+	clientlogger.Info().Msgf("Begin completed. Confirmation code is: %s", confirmation.Code)
+	return confirmation, nil
+}
+
+// Commit tells the reciever that all the chunks of the version were sent, so
+// it can be checked and made live.
+func (r *ReplicatorClient) Commit(ctx context.Context, version *replicator.FileVersion) (*replicator.Confirmation, error) {
+	clientlogger.Info().Msgf("Committing version %d of %s", version.Version, version.RelativeFilePath)
+	confirmation, err := r.FileReplicatorClient.Commit(ctx, r.sealVersion(version))
+	if err != nil {
+		clientlogger.Error().Err(err).Msg("Failed to commit file version")
+		return confirmation, err
+	}
+	clientlogger.Info().Msgf("Commit completed. Confirmation code is: %s", confirmation.Code)
+	return confirmation, nil
+}
+
+// Abort drops a version on the reciever, leaving the live file as it is.
+func (r *ReplicatorClient) Abort(ctx context.Context, version *replicator.FileVersion) (*replicator.Confirmation, error) {
+	clientlogger.Info().Msgf("Aborting version %d of %s", version.Version, version.RelativeFilePath)
+	confirmation, err := r.FileReplicatorClient.Abort(ctx, r.sealVersion(version))
+	if err != nil {
+		clientlogger.Error().Err(err).Msg("Failed to abort file version")
+		return confirmation, err
+	}
+	clientlogger.Info().Msgf("Abort completed. Confirmation code is: %s", confirmation.Code)
+	return confirmation, nil
+}
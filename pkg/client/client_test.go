@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/kosalaat/file-replicator/pkg/server"
@@ -358,7 +359,7 @@ func TestClient_DeleteFile(t *testing.T) {
 
 	server.StopListening()
 
-	if _, err := os.Stat("/tmp/dest/.archive/first/second/test.txt"); err != nil {
+	if versions, _ := filepath.Glob("/tmp/dest/.archive/first/second/test.txt~*"); len(versions) != 1 {
 		t.Fatalf("Deleted file does not exists in archive destination")
 	} else {
 		t.Logf("Deleted file does exist in archive destination")
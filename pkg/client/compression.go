@@ -0,0 +1,89 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/kosalaat/file-replicator/pkg/controller"
+	"github.com/kosalaat/file-replicator/replicator"
+	"google.golang.org/protobuf/proto"
+)
+
+// CompressionStats counts the chunk data sent to the reciever before and after
+// compression.
+type CompressionStats struct {
+	Compression string `json:"compression"`
+	// Compressed chunks went out compressed, Skipped ones raw because they
+	// looked incompressible or did not shrink.
+	Compressed uint64  `json:"compressed"`
+	Skipped    uint64  `json:"skipped"`
+	RawBytes   uint64  `json:"raw_bytes"`
+	WireBytes  uint64  `json:"wire_bytes"`
+	Ratio      float64 `json:"ratio"`
+}
+
+type compressionCounter struct {
+	mu    sync.Mutex
+	stats CompressionStats
+}
+
+func (c *compressionCounter) add(raw int, wire int, compressed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if compressed {
+		c.stats.Compressed++
+	} else {
+		c.stats.Skipped++
+	}
+	c.stats.RawBytes += uint64(raw)
+	c.stats.WireBytes += uint64(wire)
+}
+
+// WithCompression compresses the chunk data once the reciever confirmed in
+// Negotiate that it can inflate it.
+func WithCompression(compression string) ClientOption {
+	return func(r *ReplicatorClient) {
+		r.compression = compression
+	}
+}
+
+// CompressionStats returns the compression ratio so far, nil when the chunks
+// are not compressed.
+func (r *ReplicatorClient) CompressionStats() *CompressionStats {
+	if !r.compressing {
+		return nil
+	}
+	r.compressed.mu.Lock()
+	defer r.compressed.mu.Unlock()
+	stats := r.compressed.stats
+	stats.Compression = r.compression
+	if stats.WireBytes > 0 {
+		stats.Ratio = float64(stats.RawBytes) / float64(stats.WireBytes)
+	}
+	return &stats
+}
+
+// compressChunk returns the chunk as sent on the wire. Data that looks
+// incompressible or does not shrink by compressing is sent as it is.
+func (r *ReplicatorClient) compressChunk(chunk *replicator.DataPayload) *replicator.DataPayload {
+	if !r.compressing || len(chunk.DataChunk) == 0 {
+		return chunk
+	}
+	if controller.Incompressible(chunk.DataChunk) {
+		r.compressed.add(len(chunk.DataChunk), len(chunk.DataChunk), false)
+		return chunk
+	}
+
+	compression, _ := controller.LookupCompression(r.compression)
+	data, err := compression.Compress(chunk.DataChunk)
+	if err != nil || len(data) >= len(chunk.DataChunk) {
+		r.compressed.add(len(chunk.DataChunk), len(chunk.DataChunk), false)
+		return chunk
+	}
+	r.compressed.add(len(chunk.DataChunk), len(data), true)
+
+	// the queued chunk stays raw for the other targets and the resends
+	wire := proto.Clone(chunk).(*replicator.DataPayload)
+	wire.DataChunk = data
+	wire.Compression = compression.Name
+	return wire
+}
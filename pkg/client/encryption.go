@@ -0,0 +1,129 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/kosalaat/file-replicator/pkg/encryption"
+	"github.com/kosalaat/file-replicator/replicator"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrSealedRename is returned for renames of sealed files, whose blocks are
+// bound to the path they were sealed for. The file is sent under its new name
+// instead.
+var ErrSealedRename = errors.New("sealed files can not be renamed on the reciever")
+
+// WithCipher seals the chunk data, and the file names if the cipher does,
+// before anything is sent to the reciever. The reciever stores, diffs and
+// deduplicates the sealed blocks without the keys.
+func WithCipher(cipher *encryption.Cipher) ClientOption {
+	return func(r *ReplicatorClient) {
+		r.cipher = cipher
+	}
+}
+
+// Cipher returns the cipher the files are sealed with, nil when they are sent
+// in the clear.
+func (r *ReplicatorClient) Cipher() *encryption.Cipher {
+	return r.cipher
+}
+
+// SealPath returns the path of the file on the reciever.
+func (r *ReplicatorClient) SealPath(relativePath string) string {
+	if r.cipher == nil {
+		return relativePath
+	}
+	return r.cipher.SealPath(relativePath)
+}
+
+// SealedPaths returns the names the file may have on the reciever, the one
+// under the current key first, for files sealed before a key rotation.
+func (r *ReplicatorClient) SealedPaths(relativePath string) []string {
+	if r.cipher == nil {
+		return []string{relativePath}
+	}
+	return r.cipher.SealedPaths(relativePath)
+}
+
+// MigrateNames renames the files the reciever holds under names sealed with an
+// older key to their names under the current key, so a file keeps diffing
+// against its copy after a rotation and the older keys can be retired. It
+// returns the number of files renamed.
+func (r *ReplicatorClient) MigrateNames(ctx context.Context) (int, error) {
+	if r.cipher == nil {
+		return 0, nil
+	}
+	stream, err := r.FileReplicatorClient.List(ctx, &replicator.ListRequest{}, grpc.WaitForReady(true))
+	if err != nil {
+		clientlogger.Error().Err(err).Msg("Failed to list the sealed names")
+		return 0, err
+	}
+	renames := make(map[string]string)
+	for {
+		fileInfo, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			clientlogger.Error().Err(err).Msg("Failed to list the sealed names")
+			return 0, err
+		}
+		name, err := r.cipher.OpenPath(fileInfo.RelativeFilePath)
+		if err != nil {
+			continue
+		}
+		if current := r.cipher.SealPath(name); current != fileInfo.RelativeFilePath {
+			renames[fileInfo.RelativeFilePath] = current
+		}
+	}
+
+	renamed := 0
+	for sealedPath, current := range renames {
+		confirmation, err := r.FileReplicatorClient.Rename(ctx, &replicator.FileOps{RelativeFilePath: sealedPath, NewRelativeFilePath: current})
+		if err != nil {
+			clientlogger.Error().Err(err).Msgf("Failed to move %s to the current key", sealedPath)
+			return renamed, err
+		} else if confirmation.Code != replicator.ConfirmationCode_OK {
+			clientlogger.Warn().Msgf("Reciever refused to move %s to the current key: %s", sealedPath, confirmation.Code)
+			continue
+		}
+		renamed++
+	}
+	if renamed > 0 {
+		clientlogger.Info().Msgf("Moved %d names to the current key", renamed)
+	}
+	return renamed, nil
+}
+
+// sealChunk returns the chunk as laid out on the reciever, with its data,
+// offsets and sizes those of the sealed blocks.
+func (r *ReplicatorClient) sealChunk(chunk *replicator.DataPayload) *replicator.DataPayload {
+	if r.cipher == nil {
+		return chunk
+	}
+	// the queued chunk stays plain for the resends
+	sealed := proto.Clone(chunk).(*replicator.DataPayload)
+	sealed.RelativeFilePath = r.cipher.SealPath(chunk.RelativeFilePath)
+	sealed.FileSize = r.cipher.SealedSize(chunk.FileSize)
+	if chunk.DataChunk != nil {
+		sealed.DataChunk = r.cipher.Seal(chunk.RelativeFilePath, chunk.ChunkID, chunk.DataChunk)
+		sealed.BlockSize = r.cipher.SealedBlockSize()
+		sealed.Length = r.cipher.SealedBlockSize()
+	}
+	return sealed
+}
+
+// sealVersion returns the file version as laid out on the reciever. Its hash
+// and digest are already those of the sealed content.
+func (r *ReplicatorClient) sealVersion(version *replicator.FileVersion) *replicator.FileVersion {
+	if r.cipher == nil {
+		return version
+	}
+	sealed := proto.Clone(version).(*replicator.FileVersion)
+	sealed.RelativeFilePath = r.cipher.SealPath(version.RelativeFilePath)
+	sealed.FileSize = r.cipher.SealedSize(version.FileSize)
+	sealed.BlockSize = r.cipher.SealedBlockSize()
+	return sealed
+}
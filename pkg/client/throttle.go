@@ -0,0 +1,231 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var throttlelogger = clientlogger.With().Str("sub-component", "throttle").Logger()
+
+// RateWindow applies Rate (bytes per second) between Start and End, both
+// measured from local midnight. A window whose End is before its Start wraps
+// around midnight.
+type RateWindow struct {
+	Start time.Duration
+	End   time.Duration
+	Rate  uint64
+}
+
+func (w RateWindow) contains(offset time.Duration) bool {
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// BandwidthSchedule is the rate applied outside of any window (Default) and
+// the time-of-day windows that override it. A rate of 0 means unlimited.
+type BandwidthSchedule struct {
+	Default uint64
+	Windows []RateWindow
+}
+
+func (s BandwidthSchedule) RateAt(t time.Time) uint64 {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	for _, window := range s.Windows {
+		if window.contains(offset) {
+			return window.Rate
+		}
+	}
+	return s.Default
+}
+
+// ParseBandwidthLimit parses a rate such as "512K", "10M", "1.5G" or "0".
+// An optional trailing "/s" is ignored.
+func ParseBandwidthLimit(limit string) (uint64, error) {
+	value := strings.ToUpper(strings.TrimSpace(limit))
+	if value == "UNLIMITED" {
+		return 0, nil
+	}
+	return ParseByteSize(strings.TrimSuffix(value, "/S"))
+}
+
+// ParseByteSize parses a size such as "512K", "10M" or "1.5G". Suffixes are
+// powers of 1024 and an optional trailing "B" is ignored.
+func ParseByteSize(size string) (uint64, error) {
+	value := strings.ToUpper(strings.TrimSpace(size))
+	value = strings.TrimSuffix(value, "B")
+	if value == "" || value == "0" {
+		return 0, nil
+	}
+
+	multiplier := 1.0
+	switch value[len(value)-1] {
+	case 'K':
+		multiplier = 1 << 10
+	case 'M':
+		multiplier = 1 << 20
+	case 'G':
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return uint64(rate * multiplier), nil
+}
+
+func parseClock(clock string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", strings.TrimSpace(clock))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", clock)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// ParseBandwidthSchedule parses a comma separated list of windows in the form
+// "HH:MM-HH:MM=RATE", e.g. "08:00-18:00=10M,18:00-20:00=50M". An entry
+// "*=RATE" sets the rate used outside of the windows, otherwise defaultRate is
+// used.
+func ParseBandwidthSchedule(schedule string, defaultRate uint64) (BandwidthSchedule, error) {
+	result := BandwidthSchedule{Default: defaultRate}
+
+	for _, entry := range strings.FieldsFunc(schedule, func(r rune) bool { return r == ',' || r == '\n' || r == ';' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		span, limit, found := strings.Cut(entry, "=")
+		if !found {
+			return BandwidthSchedule{}, fmt.Errorf("invalid schedule entry %q, expected HH:MM-HH:MM=RATE", entry)
+		}
+		rate, err := ParseBandwidthLimit(limit)
+		if err != nil {
+			return BandwidthSchedule{}, err
+		}
+		if strings.TrimSpace(span) == "*" {
+			result.Default = rate
+			continue
+		}
+		from, to, found := strings.Cut(span, "-")
+		if !found {
+			return BandwidthSchedule{}, fmt.Errorf("invalid schedule window %q, expected HH:MM-HH:MM", span)
+		}
+		start, err := parseClock(from)
+		if err != nil {
+			return BandwidthSchedule{}, err
+		}
+		end, err := parseClock(to)
+		if err != nil {
+			return BandwidthSchedule{}, err
+		}
+		result.Windows = append(result.Windows, RateWindow{Start: start, End: end, Rate: rate})
+	}
+	return result, nil
+}
+
+// Throttle is a token bucket limiting the bytes sent to the receiver. The
+// refill rate follows the configured schedule, so it changes with the time of
+// day, and the schedule itself can be replaced while the sender is running.
+type Throttle struct {
+	mu       sync.Mutex
+	schedule BandwidthSchedule
+	rate     uint64
+	tokens   float64
+	last     time.Time
+	now      func() time.Time
+	sleep    func(ctx context.Context, d time.Duration) error
+}
+
+func NewThrottle(schedule BandwidthSchedule) *Throttle {
+	return &Throttle{
+		schedule: schedule,
+		now:      time.Now,
+		sleep:    sleepContext,
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (t *Throttle) SetSchedule(schedule BandwidthSchedule) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.schedule = schedule
+	throttlelogger.Info().Msgf("Bandwidth schedule updated, current limit: %d bytes/s", schedule.RateAt(t.now()))
+}
+
+// Rate returns the limit in bytes per second that applies right now, 0 meaning
+// unlimited.
+func (t *Throttle) Rate() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.schedule.RateAt(t.now())
+}
+
+// reserve takes n bytes worth of tokens and returns how long the caller has to
+// wait before sending them. The bucket holds one second worth of tokens and is
+// allowed to go into debt so chunks larger than the bucket still get through.
+func (t *Throttle) reserve(n int) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	rate := t.schedule.RateAt(now)
+	if rate != t.rate {
+		throttlelogger.Info().Msgf("Bandwidth limit changed from %d to %d bytes/s", t.rate, rate)
+		t.rate = rate
+		if t.tokens > float64(rate) {
+			t.tokens = float64(rate)
+		}
+	}
+	if rate == 0 {
+		t.tokens = 0
+		t.last = now
+		return 0
+	}
+
+	if !t.last.IsZero() {
+		t.tokens += now.Sub(t.last).Seconds() * float64(rate)
+		if t.tokens > float64(rate) {
+			t.tokens = float64(rate)
+		}
+	}
+	t.last = now
+
+	t.tokens -= float64(n)
+	if t.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-t.tokens / float64(rate) * float64(time.Second))
+}
+
+// Wait blocks until n bytes may be sent. A nil Throttle never waits.
+func (t *Throttle) Wait(ctx context.Context, n int) error {
+	if t == nil || n <= 0 {
+		return nil
+	}
+	delay := t.reserve(n)
+	if delay <= 0 {
+		return nil
+	}
+	throttlelogger.Debug().Msgf("Throttling %d bytes for %v", n, delay)
+	return t.sleep(ctx, delay)
+}
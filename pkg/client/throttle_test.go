@@ -0,0 +1,121 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseBandwidthLimit(t *testing.T) {
+	cases := map[string]uint64{
+		"0":         0,
+		"":          0,
+		"unlimited": 0,
+		"1024":      1024,
+		"512K":      512 << 10,
+		"10M":       10 << 20,
+		"10MB/s":    10 << 20,
+		"1.5G":      3 << 29,
+	}
+	for input, expected := range cases {
+		rate, err := ParseBandwidthLimit(input)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", input, err)
+		}
+		if rate != expected {
+			t.Errorf("Expected %q to parse to %d, got %d", input, expected, rate)
+		}
+	}
+
+	if _, err := ParseBandwidthLimit("ten"); err == nil {
+		t.Errorf("Expected an error for an invalid limit")
+	}
+}
+
+func TestBandwidthSchedule_RateAt(t *testing.T) {
+	schedule, err := ParseBandwidthSchedule("08:00-18:00=10M, 22:00-02:00=1M", 0)
+	if err != nil {
+		t.Fatalf("Failed to parse schedule: %v", err)
+	}
+
+	day := time.Date(2025, 6, 2, 0, 0, 0, 0, time.Local)
+	cases := map[time.Duration]uint64{
+		7*time.Hour + 59*time.Minute:  0,
+		8 * time.Hour:                 10 << 20,
+		17*time.Hour + 59*time.Minute: 10 << 20,
+		18 * time.Hour:                0,
+		23 * time.Hour:                1 << 20,
+		1 * time.Hour:                 1 << 20,
+		2 * time.Hour:                 0,
+	}
+	for offset, expected := range cases {
+		if rate := schedule.RateAt(day.Add(offset)); rate != expected {
+			t.Errorf("Expected rate %d at %v, got %d", expected, offset, rate)
+		}
+	}
+
+	schedule, err = ParseBandwidthSchedule("08:00-18:00=0,*=2M", 5)
+	if err != nil {
+		t.Fatalf("Failed to parse schedule: %v", err)
+	}
+	if schedule.Default != 2<<20 {
+		t.Errorf("Expected default rate %d, got %d", 2<<20, schedule.Default)
+	}
+
+	if _, err := ParseBandwidthSchedule("08:00=10M", 0); err == nil {
+		t.Errorf("Expected an error for a window without an end")
+	}
+}
+
+func TestThrottle_Wait(t *testing.T) {
+	now := time.Date(2025, 6, 2, 9, 0, 0, 0, time.Local)
+	var slept time.Duration
+
+	throttle := NewThrottle(BandwidthSchedule{Default: 1000})
+	throttle.now = func() time.Time { return now }
+	throttle.sleep = func(ctx context.Context, d time.Duration) error {
+		slept += d
+		now = now.Add(d)
+		return nil
+	}
+
+	// The first call starts with an empty bucket and has to wait for a full second.
+	if err := throttle.Wait(context.TODO(), 1000); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if slept != time.Second {
+		t.Fatalf("Expected to wait 1s, waited %v", slept)
+	}
+
+	slept = 0
+	now = now.Add(500 * time.Millisecond)
+	if err := throttle.Wait(context.TODO(), 500); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if slept != 0 {
+		t.Fatalf("Expected the refilled bucket to cover 500 bytes, waited %v", slept)
+	}
+
+	throttle.SetSchedule(BandwidthSchedule{})
+	if err := throttle.Wait(context.TODO(), 1<<30); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if slept != 0 {
+		t.Fatalf("Expected no wait when unlimited, waited %v", slept)
+	}
+
+	var unset *Throttle
+	if err := unset.Wait(context.TODO(), 100); err != nil {
+		t.Fatalf("Expected a nil throttle to never wait: %v", err)
+	}
+}
+
+func TestThrottle_WaitCancelled(t *testing.T) {
+	throttle := NewThrottle(BandwidthSchedule{Default: 1})
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	cancelFunc()
+
+	if err := throttle.Wait(ctx, 1000); err == nil {
+		t.Fatalf("Expected a cancelled context to abort the wait")
+	}
+}
@@ -3,9 +3,8 @@ package controller
 import (
 	"io"
 	"os"
-	"path"
+	"time"
 
-	"github.com/cespare/xxhash/v2"
 	"github.com/rs/zerolog/log"
 )
 
@@ -16,43 +15,109 @@ type FileIndex struct {
 	fileName   string
 	blockCount uint64
 	blockSize  uint64
-	hashTable  []uint64
+	algorithm  HashAlgorithm
+	hashTable  [][]byte
+	fileSize   int64
+	modTime    time.Time
 }
 
 func NewFileIndex(fileRoot string, fileName string, blockSize uint64) FileIndex {
+	algorithm, _ := LookupHash(DefaultHashAlgorithm)
+	return NewHashedFileIndex(fileRoot, fileName, blockSize, algorithm)
+}
+
+// NewHashedFileIndex indexes the file with the given block hash.
+func NewHashedFileIndex(fileRoot string, fileName string, blockSize uint64, algorithm HashAlgorithm) FileIndex {
 	return FileIndex{
 		fileRoot:   fileRoot,
 		fileName:   fileName,
 		blockSize:  blockSize,
+		algorithm:  algorithm,
 		blockCount: 0,
-		hashTable:  []uint64{},
+		hashTable:  [][]byte{},
 	}
 }
 
+// LookupHashTable returns the xxhash64 of the block as a number.
 func (f *FileIndex) LookupHashTable(chunkId uint64) (uint64, bool) {
-	if chunkId < uint64(len(f.hashTable)) {
-		return f.hashTable[chunkId], true
+	if hash, ok := f.LookupDigest(chunkId); ok {
+		return HashUint64(hash), true
 	} else {
 		return 0, false
 	}
 }
 
+func (f *FileIndex) LookupDigest(chunkId uint64) ([]byte, bool) {
+	if chunkId < uint64(len(f.hashTable)) && f.hashTable[chunkId] != nil {
+		return f.hashTable[chunkId], true
+	} else {
+		return nil, false
+	}
+}
+
+// Hashes returns a copy of the block hashes as numbers, indexed by chunk ID.
+func (f *FileIndex) Hashes() []uint64 {
+	hashes := make([]uint64, len(f.hashTable))
+	for chunkId, hash := range f.hashTable {
+		hashes[chunkId] = HashUint64(hash)
+	}
+	return hashes
+}
+
+func (f *FileIndex) BlockSize() uint64 {
+	return f.blockSize
+}
+
+func (f *FileIndex) Algorithm() string {
+	return f.algorithm.Name
+}
+
+// IsCurrent reports whether the file is unchanged since the index was built,
+// judged by its size and modification time.
+func (f *FileIndex) IsCurrent() bool {
+	fileHandler, err := OpenInRoot(f.fileRoot, f.fileName)
+	if err != nil {
+		return false
+	}
+	defer fileHandler.Close()
+	stat, err := fileHandler.Stat()
+	if err != nil {
+		return false
+	}
+	return f.Matches(stat)
+}
+
+// Matches reports whether the index was built from the file as stat describes
+// it.
+func (f *FileIndex) Matches(stat os.FileInfo) bool {
+	return stat.Size() == f.fileSize && stat.ModTime().Equal(f.modTime)
+}
+
+// Refresh marks the index current for the file as stat describes it, once the
+// hashes of the blocks written since were updated.
+func (f *FileIndex) Refresh(stat os.FileInfo) {
+	f.fileSize = stat.Size()
+	f.modTime = stat.ModTime()
+}
+
 func (f *FileIndex) RegenerateFileIndex() error {
-	fileHandler, err := os.Open(path.Join(f.fileRoot, f.fileName))
+	fileHandler, err := OpenInRoot(f.fileRoot, f.fileName)
 	if err != nil {
 		cacheLogger.Error().Err(err).Msg("Failed to open file")
 		return err
 	}
 	defer fileHandler.Close()
 
+	if stat, err := fileHandler.Stat(); err == nil {
+		f.fileSize = stat.Size()
+		f.modTime = stat.ModTime()
+	}
+
 	buffer := make([]byte, f.blockSize)
 
 	for chunkId := 0; ; chunkId++ {
-		n, err := fileHandler.Read(buffer)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
+		n, err := io.ReadFull(fileHandler, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 			cacheLogger.Error().Err(err).Msg("Failed to read file")
 			return err
 		}
@@ -60,24 +125,45 @@ func (f *FileIndex) RegenerateFileIndex() error {
 			break
 		} else {
 			cacheLogger.Info().Msgf("Read %d bytes from file", n)
-			hash := xxhash.Sum64String(string(buffer))
-			f.hashTable = append(f.hashTable, hash)
+			f.hashTable = append(f.hashTable, f.algorithm.Sum(buffer[:n]))
 			f.blockCount++
 		}
 	}
 	return nil
 }
 
+// ConfirmChunk hashes the block on disk with another, usually strong,
+// algorithm.
+func (f *FileIndex) ConfirmChunk(chunkId uint64, algorithm HashAlgorithm) ([]byte, error) {
+	fileHandler, err := OpenInRoot(f.fileRoot, f.fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fileHandler.Close()
+
+	buffer := make([]byte, f.blockSize)
+	n, err := fileHandler.ReadAt(buffer, int64(chunkId*f.blockSize))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return algorithm.Sum(buffer[:n]), nil
+}
+
 func (f *FileIndex) UpdateChunckHash(chunkId uint64, hash uint64) {
+	f.UpdateChunkDigest(chunkId, Uint64Hash(hash))
+}
+
+func (f *FileIndex) UpdateChunkDigest(chunkId uint64, hash []byte) {
 	if chunkId < uint64(len(f.hashTable)) {
 		f.hashTable[chunkId] = hash
 	} else if chunkId == uint64(len(f.hashTable)) {
 		f.hashTable = append(f.hashTable, hash)
 		f.blockCount++
 	} else {
-		emptybuffer := make([]uint64, chunkId-uint64(len(f.hashTable)))
-		f.hashTable = append(f.hashTable, emptybuffer...)
-		f.hashTable = make([]uint64, hash)
+		// the blocks in between are unknown until indexed
+		f.hashTable = append(f.hashTable, make([][]byte, chunkId-uint64(len(f.hashTable)))...)
+		f.hashTable = append(f.hashTable, hash)
+		f.blockCount = uint64(len(f.hashTable))
 		cacheLogger.Info().Msgf("Extended hash table to %d entries", len(f.hashTable))
 	}
 }
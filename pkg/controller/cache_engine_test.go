@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"bytes"
 	"os"
 	"testing"
 )
@@ -84,3 +85,29 @@ func Test_UpdateHashTable(t *testing.T) {
 		t.Errorf("Expected hash 987654321, got %d", hash)
 	}
 }
+
+func Test_HashedFileIndex(t *testing.T) {
+	setup(t, "This is a test files")
+	defer teardown(t)
+	for _, name := range HashAlgorithms() {
+		algorithm, err := LookupHash(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache := NewHashedFileIndex("/tmp/src", "test.txt", 4, algorithm)
+		if err := cache.RegenerateFileIndex(); err != nil {
+			t.Fatal(err)
+		}
+		hash, ok := cache.LookupDigest(1)
+		if !ok || !bytes.Equal(hash, algorithm.Sum([]byte(" is "))) {
+			t.Errorf("Expected the %s hash of chunk 1, got %x", name, hash)
+		}
+		if len(hash) != algorithm.New().Size() {
+			t.Errorf("Expected a %d byte %s hash, got %d", algorithm.New().Size(), name, len(hash))
+		}
+	}
+
+	if _, err := LookupHash("md5"); err == nil {
+		t.Errorf("Expected an unknown algorithm to be refused")
+	}
+}
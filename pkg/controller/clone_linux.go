@@ -0,0 +1,13 @@
+package controller
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile shares the blocks of source with dest on copy-on-write file
+// systems.
+func cloneFile(dest *os.File, source *os.File) error {
+	return unix.IoctlFileClone(int(dest.Fd()), int(source.Fd()))
+}
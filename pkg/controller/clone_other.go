@@ -0,0 +1,12 @@
+//go:build !linux
+
+package controller
+
+import (
+	"errors"
+	"os"
+)
+
+func cloneFile(dest *os.File, source *os.File) error {
+	return errors.ErrUnsupported
+}
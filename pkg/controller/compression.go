@@ -0,0 +1,166 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+const (
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+	CompressionS2   = "s2"
+	CompressionLZ4  = "lz4"
+)
+
+const (
+	// entropySample is the amount of a chunk looked at to tell whether it is
+	// worth compressing.
+	entropySample = 4096
+	// maxEntropy is the bits per byte above which data is taken as already
+	// compressed or encrypted.
+	maxEntropy = 7.5
+	// maxInflated bounds the buffer a chunk is inflated into whatever block
+	// size the payload claims.
+	maxInflated = 256 << 20
+)
+
+// Compression compresses the data of the chunks on the wire. Decompress
+// refuses to inflate beyond limit bytes.
+type Compression struct {
+	Name       string
+	Compress   func(data []byte) ([]byte, error)
+	Decompress func(data []byte, limit uint64) ([]byte, error)
+}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecodeAllCapLimit(true))
+)
+
+var compressions = map[string]Compression{
+	CompressionZstd: {
+		Name: CompressionZstd,
+		Compress: func(data []byte) ([]byte, error) {
+			return zstdEncoder.EncodeAll(data, nil), nil
+		},
+		Decompress: func(data []byte, limit uint64) ([]byte, error) {
+			// the decoder stops at the capacity of the buffer
+			return zstdDecoder.DecodeAll(data, make([]byte, 0, min(limit, maxInflated)))
+		},
+	},
+	CompressionGzip: {
+		Name: CompressionGzip,
+		Compress: func(data []byte) ([]byte, error) {
+			var out bytes.Buffer
+			writer := gzip.NewWriter(&out)
+			if _, err := writer.Write(data); err != nil {
+				return nil, err
+			}
+			if err := writer.Close(); err != nil {
+				return nil, err
+			}
+			return out.Bytes(), nil
+		},
+		Decompress: func(data []byte, limit uint64) ([]byte, error) {
+			reader, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			defer reader.Close()
+			return readLimited(reader, CompressionGzip, limit)
+		},
+	},
+	CompressionLZ4: {
+		Name: CompressionLZ4,
+		Compress: func(data []byte) ([]byte, error) {
+			var out bytes.Buffer
+			writer := lz4.NewWriter(&out)
+			if _, err := writer.Write(data); err != nil {
+				return nil, err
+			}
+			if err := writer.Close(); err != nil {
+				return nil, err
+			}
+			return out.Bytes(), nil
+		},
+		Decompress: func(data []byte, limit uint64) ([]byte, error) {
+			return readLimited(lz4.NewReader(bytes.NewReader(data)), CompressionLZ4, limit)
+		},
+	},
+	CompressionS2: {
+		Name: CompressionS2,
+		Compress: func(data []byte) ([]byte, error) {
+			return s2.Encode(nil, data), nil
+		},
+		Decompress: func(data []byte, limit uint64) ([]byte, error) {
+			size, err := s2.DecodedLen(data)
+			if err != nil {
+				return nil, err
+			}
+			if uint64(size) > limit {
+				return nil, fmt.Errorf("s2 block inflates beyond %d bytes", limit)
+			}
+			return s2.Decode(nil, data)
+		},
+	},
+}
+
+// readLimited reads the inflated stream, refusing one beyond limit bytes.
+func readLimited(reader io.Reader, name string, limit uint64) ([]byte, error) {
+	out, err := io.ReadAll(io.LimitReader(reader, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(out)) > limit {
+		return nil, fmt.Errorf("%s stream inflates beyond %d bytes", name, limit)
+	}
+	return out, nil
+}
+
+// LookupCompression returns the registered compression.
+func LookupCompression(name string) (Compression, error) {
+	compression, ok := compressions[name]
+	if !ok {
+		return Compression{}, fmt.Errorf("unsupported compression %q", name)
+	}
+	return compression, nil
+}
+
+// Compressions lists the names of the registered compressions.
+func Compressions() []string {
+	names := make([]string, 0, len(compressions))
+	for name := range compressions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Incompressible guesses from the byte entropy of a sample whether the data is
+// already compressed or encrypted, so compressing it would only cost time.
+func Incompressible(data []byte) bool {
+	sample := data[:min(len(data), entropySample)]
+	if len(sample) == 0 {
+		return false
+	}
+	var counts [256]int
+	for _, b := range sample {
+		counts[b]++
+	}
+	entropy := 0.0
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / float64(len(sample))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy > maxEntropy
+}
@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCompressions(t *testing.T) {
+	data := bytes.Repeat([]byte("id,name,value\n1,test,42\n"), 100)
+	for _, name := range Compressions() {
+		compression, err := LookupCompression(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed, err := compression.Compress(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(compressed) >= len(data) {
+			t.Errorf("Expected %s to shrink the data, got %d bytes", name, len(compressed))
+		}
+		if inflated, err := compression.Decompress(compressed, uint64(len(data))); err != nil || !bytes.Equal(inflated, data) {
+			t.Errorf("Expected %s to inflate the data back, got %d bytes, %v", name, len(inflated), err)
+		}
+		if _, err := compression.Decompress(compressed, uint64(len(data))-1); err == nil {
+			t.Errorf("Expected %s to refuse inflating beyond the limit", name)
+		}
+	}
+
+	if _, err := LookupCompression("lzma"); err == nil {
+		t.Errorf("Expected an unknown compression to be refused")
+	}
+}
+
+func TestIncompressible(t *testing.T) {
+	random := make([]byte, 8192)
+	rand.Read(random)
+	if !Incompressible(random) {
+		t.Errorf("Expected random data to be taken as incompressible")
+	}
+	if Incompressible(bytes.Repeat([]byte("log line\n"), 1000)) {
+		t.Errorf("Expected text to be taken as compressible")
+	}
+}
@@ -0,0 +1,48 @@
+package controller
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// DefaultDigestAlgorithm is the strong hash used to compare whole files.
+const DefaultDigestAlgorithm = "sha256"
+
+// NewDigest returns the hash of the digest algorithm, the default one when
+// empty. Only the strong algorithms of the registry qualify.
+func NewDigest(algorithm string) (hash.Hash, string, error) {
+	if algorithm == "" {
+		algorithm = DefaultDigestAlgorithm
+	}
+	if registered, err := LookupHash(algorithm); err == nil && registered.Strong {
+		return registered.New(), algorithm, nil
+	}
+	return nil, algorithm, fmt.Errorf("unsupported digest algorithm %q", algorithm)
+}
+
+// FileDigest hashes the whole file with a collision resistant hash, unlike the
+// block hashes which only need to detect accidental changes.
+func FileDigest(filePath string, algorithm string) ([]byte, string, error) {
+	fileHandler, err := os.Open(filePath)
+	if err != nil {
+		cacheLogger.Error().Err(err).Msgf("Failed to open %s for hashing", filePath)
+		return nil, algorithm, err
+	}
+	defer fileHandler.Close()
+	return ReaderDigest(fileHandler, algorithm)
+}
+
+// ReaderDigest hashes everything read from reader as FileDigest does.
+func ReaderDigest(reader io.Reader, algorithm string) ([]byte, string, error) {
+	hash, algorithm, err := NewDigest(algorithm)
+	if err != nil {
+		return nil, algorithm, err
+	}
+	if _, err := io.Copy(hash, reader); err != nil {
+		cacheLogger.Error().Err(err).Msg("Failed to hash the file")
+		return nil, algorithm, err
+	}
+	return hash.Sum(nil), algorithm, nil
+}
@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"sort"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/zeebo/xxh3"
+	"lukechampine.com/blake3"
+)
+
+const (
+	HashXXHash64 = "xxhash64"
+	HashXXH3128  = "xxh3-128"
+	HashSHA256   = "sha256"
+	HashBLAKE3   = "blake3"
+)
+
+// DefaultHashAlgorithm hashes the blocks when the signature names none, as
+// done before the algorithm could be picked.
+const DefaultHashAlgorithm = HashXXHash64
+
+// HashAlgorithm is a block hash shared by the sender and the reciever. Strong
+// algorithms are collision resistant and can confirm a match of a weak one.
+type HashAlgorithm struct {
+	Name   string
+	Strong bool
+	New    func() hash.Hash
+}
+
+// Sum hashes a single block.
+func (a HashAlgorithm) Sum(data []byte) []byte {
+	hash := a.New()
+	hash.Write(data)
+	return hash.Sum(nil)
+}
+
+var hashAlgorithms = map[string]HashAlgorithm{
+	HashXXHash64: {Name: HashXXHash64, New: func() hash.Hash { return xxhash.New() }},
+	HashXXH3128:  {Name: HashXXH3128, New: func() hash.Hash { return &xxh3128{xxh3.New()} }},
+	HashSHA256:   {Name: HashSHA256, Strong: true, New: sha256.New},
+	HashBLAKE3:   {Name: HashBLAKE3, Strong: true, New: func() hash.Hash { return blake3.New(32, nil) }},
+}
+
+// LookupHash returns the registered algorithm, the default one when empty.
+func LookupHash(name string) (HashAlgorithm, error) {
+	if name == "" {
+		name = DefaultHashAlgorithm
+	}
+	algorithm, ok := hashAlgorithms[name]
+	if !ok {
+		return HashAlgorithm{}, fmt.Errorf("unsupported hash algorithm %q", name)
+	}
+	return algorithm, nil
+}
+
+// HashAlgorithms lists the names of the registered algorithms.
+func HashAlgorithms() []string {
+	names := make([]string, 0, len(hashAlgorithms))
+	for name := range hashAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HashUint64 and Uint64Hash convert between the xxhash64 sums the protocol
+// carries as numbers and their bytes.
+func HashUint64(sum []byte) uint64 {
+	if len(sum) < 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(sum)
+}
+
+func Uint64Hash(sum uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, sum)
+}
+
+// xxh3128 makes the 128 bit variant of xxh3 a hash.Hash.
+type xxh3128 struct {
+	*xxh3.Hasher
+}
+
+func (h *xxh3128) Size() int { return 16 }
+
+func (h *xxh3128) Sum(b []byte) []byte {
+	sum := h.Sum128().Bytes()
+	return append(b, sum[:]...)
+}
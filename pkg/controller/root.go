@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// OpenInRoot opens name below the directory root through an os.Root, which
+// refuses to follow a symlink out of it.
+func OpenInRoot(root string, name string) (*os.File, error) {
+	fileRoot, err := os.OpenRoot(root)
+	if err != nil {
+		return nil, err
+	}
+	defer fileRoot.Close()
+	return fileRoot.Open(name)
+}
+
+// RenameInRoot renames oldName below oldRoot to newName below newRoot. The
+// directories are opened through the roots and the names renamed relative to
+// them, so a symlink swapped in after the paths were checked can not lead the
+// rename out of the roots.
+func RenameInRoot(oldRoot *os.Root, oldName string, newRoot *os.Root, newName string) error {
+	oldDir, err := oldRoot.Open(filepath.Dir(oldName))
+	if err != nil {
+		return err
+	}
+	defer oldDir.Close()
+	newDir, err := newRoot.Open(filepath.Dir(newName))
+	if err != nil {
+		return err
+	}
+	defer newDir.Close()
+	if err := unix.Renameat(int(oldDir.Fd()), filepath.Base(oldName), int(newDir.Fd()), filepath.Base(newName)); err != nil {
+		return &os.LinkError{Op: "renameat", Old: oldName, New: newName, Err: err}
+	}
+	return nil
+}
+
+// MkdirAllInRoot creates dir and its missing parents below root.
+func MkdirAllInRoot(root *os.Root, dir string, perm os.FileMode) error {
+	walked := ""
+	for _, component := range strings.Split(filepath.Clean(dir), string(filepath.Separator)) {
+		if component == "" || component == "." {
+			continue
+		}
+		walked = filepath.Join(walked, component)
+		if err := root.Mkdir(walked, perm); err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+	}
+	return nil
+}
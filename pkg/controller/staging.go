@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// StagingSuffix ends the hidden files new file versions are assembled in
+// before they replace the live file.
+const StagingSuffix = ".replicator-staging"
+
+// StagingPath returns the staging file of filePath, .<name>.replicator-staging
+// in the same directory, so the commit is a rename on the same file system.
+func StagingPath(filePath string) string {
+	return filepath.Join(filepath.Dir(filePath), "."+filepath.Base(filePath)+StagingSuffix)
+}
+
+// IsStagingFile reports whether the path is a staging file, which is never
+// replicated or listed.
+func IsStagingFile(filePath string) bool {
+	name := filepath.Base(filePath)
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, StagingSuffix)
+}
+
+// SeedStaging creates the staging file as a copy of the live file, sharing its
+// blocks where the file system supports reflinks. Both are opened below root.
+// A missing live file leaves the staging file empty.
+func SeedStaging(root *os.Root, liveName string, stagingName string) error {
+	staging, err := root.OpenFile(stagingName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer staging.Close()
+
+	live, err := root.Open(liveName)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer live.Close()
+
+	if stat, err := live.Stat(); err == nil {
+		staging.Chmod(stat.Mode().Perm())
+	}
+	if cloneFile(staging, live) == nil {
+		return nil
+	}
+	_, err = io.Copy(staging, live)
+	return err
+}
@@ -0,0 +1,517 @@
+package deltas
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/archive"
+	"github.com/rs/zerolog/log"
+)
+
+var deltaslogger = log.With().Str("component", "deltas").Logger()
+
+// deltaSuffix marks the reverse delta files, named <path>~<version>.rdelta.
+const deltaSuffix = ".rdelta"
+
+// ErrNotExisted is returned when the file was created by the batch it is
+// reconstructed from, so there is no earlier content.
+var ErrNotExisted = errors.New("file did not exist before the batch")
+
+// Batch is the reverse delta of one replication batch of a file: the contents
+// the batch overwrote, and the size and mode the file had before it.
+type Batch struct {
+	Path      string      `json:"path"`
+	Version   string      `json:"version"`
+	CreatedAt time.Time   `json:"created_at"`
+	Existed   bool        `json:"existed"`
+	FileSize  int64       `json:"file_size"`
+	FileMode  fs.FileMode `json:"file_mode"`
+	// Size is the size of the delta itself.
+	Size int64 `json:"size"`
+}
+
+func (b Batch) name() string {
+	return b.Path + "~" + b.Version + deltaSuffix
+}
+
+// record is a range of the file as it was before the batch wrote over it.
+type record struct {
+	Offset int64  `json:"offset"`
+	Data   []byte `json:"data"`
+}
+
+type openBatch struct {
+	file  *os.File
+	saved map[int64]int
+}
+
+// Journal keeps reverse deltas of the files the reciever overwrites. The
+// deltas of a file are applied newest first on top of its current content to
+// get it back as it was before any of its batches.
+type Journal struct {
+	Root      string
+	Retention archive.Retention
+
+	mu   sync.Mutex
+	open map[string]*openBatch
+	now  func() time.Time
+}
+
+func New(root string, retention archive.Retention) *Journal {
+	return &Journal{
+		Root:      root,
+		Retention: retention,
+		open:      make(map[string]*openBatch),
+		now:       time.Now,
+	}
+}
+
+// begin returns the open batch of relativePath, starting a new one with the
+// current state of the file when there is none.
+func (j *Journal) begin(relativePath string, file *os.File, existed bool) (*openBatch, error) {
+	if batch, ok := j.open[relativePath]; ok {
+		return batch, nil
+	}
+
+	createdAt := j.now().UTC()
+	batch := Batch{Path: relativePath, CreatedAt: createdAt, Existed: existed}
+	if existed {
+		stat, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		batch.FileSize = stat.Size()
+		batch.FileMode = stat.Mode()
+	}
+	for {
+		batch.Version = createdAt.Format(archive.VersionFormat)
+		if _, err := os.Lstat(filepath.Join(j.Root, batch.name())); os.IsNotExist(err) {
+			break
+		}
+		createdAt = createdAt.Add(time.Nanosecond)
+		batch.CreatedAt = createdAt
+	}
+
+	deltaPath := filepath.Join(j.Root, batch.name())
+	if err := os.MkdirAll(filepath.Dir(deltaPath), 0750); err != nil {
+		deltaslogger.Error().Err(err).Msgf("Failed to create delta directory %s", filepath.Dir(deltaPath))
+		return nil, err
+	}
+	deltaFile, err := os.OpenFile(deltaPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	header, _ := json.Marshal(batch)
+	if _, err := deltaFile.Write(append(header, '\n')); err != nil {
+		deltaFile.Close()
+		return nil, err
+	}
+
+	deltaslogger.Info().Msgf("Started reverse delta %s", deltaPath)
+	open := &openBatch{file: deltaFile, saved: make(map[int64]int)}
+	j.open[relativePath] = open
+	return open, nil
+}
+
+// Created starts a batch for a file the reciever is about to create.
+func (j *Journal) Created(relativePath string) error {
+	relativePath = filepath.Clean(relativePath)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err := j.begin(relativePath, nil, false)
+	return err
+}
+
+// Preserve saves the range of the file that is about to be overwritten or
+// truncated away. The part of the range past the end of the file is skipped.
+func (j *Journal) Preserve(relativePath string, file *os.File, offset int64, length int64) error {
+	relativePath = filepath.Clean(relativePath)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	batch, err := j.begin(relativePath, file, true)
+	if err != nil {
+		return err
+	}
+	// only the content before the first write of the batch is needed
+	if saved, ok := batch.saved[offset]; ok && int64(saved) >= length {
+		return nil
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	length = min(length, stat.Size()-offset)
+	if length <= 0 {
+		return nil
+	}
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, offset); err != nil && err != io.EOF {
+		return err
+	}
+	line, _ := json.Marshal(record{Offset: offset, Data: data})
+	if _, err := batch.file.Write(append(line, '\n')); err != nil {
+		deltaslogger.Error().Err(err).Msgf("Failed to save the reverse delta of %s", relativePath)
+		return err
+	}
+	batch.saved[offset] = int(length)
+	return nil
+}
+
+// PreserveMode makes sure a batch holds the mode of the file before it is
+// changed.
+func (j *Journal) PreserveMode(relativePath string, file *os.File) error {
+	relativePath = filepath.Clean(relativePath)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err := j.begin(relativePath, file, true)
+	return err
+}
+
+// Seal ends the open batch of relativePath, the next change starts a new one.
+func (j *Journal) Seal(relativePath string) error {
+	relativePath = filepath.Clean(relativePath)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.seal(relativePath)
+}
+
+func (j *Journal) seal(relativePath string) error {
+	batch, ok := j.open[relativePath]
+	if !ok {
+		return nil
+	}
+	delete(j.open, relativePath)
+	if err := batch.file.Sync(); err != nil {
+		batch.file.Close()
+		return err
+	}
+	return batch.file.Close()
+}
+
+// Close seals every open batch.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var result error
+	for relativePath := range j.open {
+		if err := j.seal(relativePath); err != nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// Rename moves the deltas along with the file or directory.
+func (j *Journal) Rename(relativePath string, newRelativePath string) error {
+	return j.move(relativePath, newRelativePath)
+}
+
+// Retire moves the deltas of a deleted file under the name of its archived
+// version, so they apply on top of the archived copy.
+func (j *Journal) Retire(relativePath string, archived archive.Version) error {
+	return j.move(relativePath, archived.Name())
+}
+
+func (j *Journal) move(relativePath string, newRelativePath string) error {
+	relativePath = filepath.Clean(relativePath)
+	newRelativePath = filepath.Clean(newRelativePath)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	batches, err := j.list(relativePath)
+	if err != nil {
+		return err
+	}
+	for _, batch := range batches {
+		if err := j.seal(batch.Path); err != nil {
+			return err
+		}
+		moved := batch
+		moved.Path = newRelativePath + strings.TrimPrefix(batch.Path, relativePath)
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(j.Root, moved.name())), 0750); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(j.Root, batch.name()), filepath.Join(j.Root, moved.name())); err != nil {
+			deltaslogger.Error().Err(err).Msgf("Failed to move the reverse deltas of %s", batch.Path)
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns the batches of the files under prefix, oldest first.
+func (j *Journal) List(prefix string) ([]Batch, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.list(prefix)
+}
+
+func (j *Journal) list(prefix string) ([]Batch, error) {
+	prefix = filepath.Clean(prefix)
+	batches := make([]Batch, 0)
+	err := filepath.WalkDir(j.Root, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && filePath == j.Root {
+				return nil
+			}
+			return err
+		}
+		if !entry.Type().IsRegular() || !strings.HasSuffix(filePath, deltaSuffix) {
+			return nil
+		}
+		name, err := filepath.Rel(j.Root, filePath)
+		if err != nil {
+			return err
+		}
+		index := strings.LastIndex(name, "~")
+		if index <= 0 {
+			return nil
+		}
+		relativePath := name[:index]
+		if prefix != "." && relativePath != prefix && !strings.HasPrefix(relativePath, prefix+string(filepath.Separator)) {
+			return nil
+		}
+		batch, err := readHeader(filePath)
+		if err != nil {
+			deltaslogger.Warn().Err(err).Msgf("Skipping unreadable reverse delta %s", filePath)
+			return nil
+		}
+		batch.Path = relativePath
+		batch.Version = strings.TrimSuffix(name[index+1:], deltaSuffix)
+		if info, err := entry.Info(); err == nil {
+			batch.Size = info.Size()
+		}
+		batches = append(batches, batch)
+		return nil
+	})
+	sort.Slice(batches, func(a, b int) bool {
+		if !batches[a].CreatedAt.Equal(batches[b].CreatedAt) {
+			return batches[a].CreatedAt.Before(batches[b].CreatedAt)
+		}
+		return batches[a].Path < batches[b].Path
+	})
+	return batches, err
+}
+
+func readHeader(deltaPath string) (Batch, error) {
+	var batch Batch
+	deltaFile, err := os.Open(deltaPath)
+	if err != nil {
+		return batch, err
+	}
+	defer deltaFile.Close()
+	line, err := bufio.NewReader(deltaFile).ReadBytes('\n')
+	if err != nil {
+		return batch, err
+	}
+	err = json.Unmarshal(line, &batch)
+	return batch, err
+}
+
+// readRecords returns the saved ranges of a batch in the order they were
+// written. A torn last line, from a batch still being written, is dropped.
+func readRecords(deltaPath string) ([]record, error) {
+	deltaFile, err := os.Open(deltaPath)
+	if err != nil {
+		return nil, err
+	}
+	defer deltaFile.Close()
+
+	reader := bufio.NewReader(deltaFile)
+	if _, err := reader.ReadBytes('\n'); err != nil {
+		return nil, err
+	}
+	records := make([]record, 0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+		var saved record
+		if err := json.Unmarshal(line, &saved); err != nil {
+			return nil, err
+		}
+		records = append(records, saved)
+	}
+}
+
+// Reconstruct writes the file at relativePath, whose current content is at
+// basePath, to destPath as it was before the batch with the given version.
+func (j *Journal) Reconstruct(basePath string, relativePath string, version string, destPath string) error {
+	batches, err := j.List(relativePath)
+	if err != nil {
+		return err
+	}
+	chain := make([]Batch, 0)
+	found := false
+	for _, batch := range batches {
+		if batch.Path != relativePath {
+			continue
+		}
+		if batch.Version == version {
+			found = true
+		}
+		if found {
+			chain = append(chain, batch)
+		}
+	}
+	if !found {
+		return &fs.PathError{Op: "reconstruct", Path: relativePath + "~" + version, Err: fs.ErrNotExist}
+	}
+
+	if err := copyFile(basePath, destPath); err != nil {
+		return err
+	}
+	dest, err := os.OpenFile(destPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	// undo the newest batch first, and every batch in the reverse order of its writes
+	for i := len(chain) - 1; i >= 0; i-- {
+		batch := chain[i]
+		if !batch.Existed {
+			os.Remove(destPath)
+			return fmt.Errorf("%s: %w", relativePath, ErrNotExisted)
+		}
+		records, err := readRecords(filepath.Join(j.Root, batch.name()))
+		if err != nil {
+			return err
+		}
+		for k := len(records) - 1; k >= 0; k-- {
+			if _, err := dest.WriteAt(records[k].Data, records[k].Offset); err != nil {
+				return err
+			}
+		}
+		if err := dest.Truncate(batch.FileSize); err != nil {
+			return err
+		}
+		if err := dest.Chmod(batch.FileMode.Perm()); err != nil {
+			return err
+		}
+	}
+	deltaslogger.Info().Msgf("Reconstructed %s before %s, undoing %d batches", relativePath, version, len(chain))
+	return nil
+}
+
+func copyFile(sourcePath string, destPath string) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	dest, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dest, source); err != nil {
+		dest.Close()
+		return err
+	}
+	return dest.Close()
+}
+
+func (j *Journal) remove(batch Batch, result *archive.PruneResult) error {
+	deltaPath := filepath.Join(j.Root, batch.name())
+	if err := os.Remove(deltaPath); err != nil && !os.IsNotExist(err) {
+		deltaslogger.Error().Err(err).Msgf("Failed to remove reverse delta %s", deltaPath)
+		return err
+	}
+	result.Removed++
+	result.Freed += batch.Size
+	for dir := filepath.Dir(deltaPath); dir != j.Root && strings.HasPrefix(dir, j.Root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// Prune enforces the retention rules. Only the oldest batches of a file are
+// removed, the remaining ones still reconstruct every version they cover.
+func (j *Journal) Prune() (archive.PruneResult, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var result archive.PruneResult
+	batches, err := j.list("")
+	if err != nil {
+		return result, err
+	}
+
+	kept := make([]Batch, 0, len(batches))
+	perPath := make(map[string]int)
+	cutoff := j.now().Add(-j.Retention.MaxAge)
+	for i := len(batches) - 1; i >= 0; i-- {
+		batch := batches[i]
+		perPath[batch.Path]++
+		if _, open := j.open[batch.Path]; open && perPath[batch.Path] == 1 {
+			kept = append(kept, batch)
+			continue
+		}
+		expired := j.Retention.MaxAge > 0 && batch.CreatedAt.Before(cutoff)
+		if expired || (j.Retention.KeepVersions > 0 && perPath[batch.Path] > j.Retention.KeepVersions) {
+			if err := j.remove(batch, &result); err != nil {
+				return result, err
+			}
+			continue
+		}
+		kept = append(kept, batch)
+	}
+
+	if j.Retention.MaxSize > 0 {
+		var total int64
+		for _, batch := range kept {
+			total += batch.Size
+		}
+		for i := len(kept) - 1; i >= 0 && total > j.Retention.MaxSize; i-- {
+			if _, open := j.open[kept[i].Path]; open {
+				continue
+			}
+			if err := j.remove(kept[i], &result); err != nil {
+				return result, err
+			}
+			total -= kept[i].Size
+		}
+	}
+
+	if result.Removed > 0 {
+		deltaslogger.Info().Msgf("Pruned %d reverse deltas, freed %d bytes", result.Removed, result.Freed)
+	}
+	return result, nil
+}
+
+// Run prunes the deltas at the given interval until the context is cancelled.
+func (j *Journal) Run(ctx context.Context, interval time.Duration) {
+	if j.Retention == (archive.Retention{}) {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := j.Prune(); err != nil {
+			deltaslogger.Error().Err(err).Msg("Failed to prune the reverse deltas")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package deltas
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/archive"
+)
+
+func clock(start time.Time, step time.Duration) func() time.Time {
+	current := start
+	return func() time.Time {
+		now := current
+		current = current.Add(step)
+		return now
+	}
+}
+
+// overwrite applies a batch the way the reciever does: the range is preserved
+// before it is written, and the file truncated to its new size.
+func overwrite(t *testing.T, j *Journal, root string, relativePath string, offset int64, data string, size int64) {
+	t.Helper()
+	file, err := os.OpenFile(filepath.Join(root, relativePath), os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	stat, _ := file.Stat()
+	if stat.Size() > size {
+		if err := j.Preserve(relativePath, file, size, stat.Size()-size); err != nil {
+			t.Fatal(err)
+		}
+		file.Truncate(size)
+	}
+	if err := j.Preserve(relativePath, file, offset, int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]byte(data), offset); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func reconstruct(t *testing.T, j *Journal, root string, relativePath string, version string) string {
+	t.Helper()
+	dest := filepath.Join(t.TempDir(), "out")
+	if err := j.Reconstruct(filepath.Join(root, relativePath), relativePath, version, dest); err != nil {
+		t.Fatalf("Reconstruct before %s failed: %v", version, err)
+	}
+	content, _ := os.ReadFile(dest)
+	return string(content)
+}
+
+func TestReconstructBatches(t *testing.T) {
+	root := t.TempDir()
+	j := New(t.TempDir(), archive.Retention{})
+	j.now = clock(time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC), time.Minute)
+
+	os.WriteFile(filepath.Join(root, "f.txt"), []byte("aaaabbbbcccc"), 0640)
+
+	// shrink and overwrite the middle block
+	overwrite(t, j, root, "f.txt", 4, "XXXX", 10)
+	// the same block twice in one batch keeps the original content
+	overwrite(t, j, root, "f.txt", 4, "YYYY", 10)
+	j.Seal("f.txt")
+	// grow the file
+	overwrite(t, j, root, "f.txt", 8, "ZZZZzzzz", 16)
+	j.Seal("f.txt")
+
+	if content, _ := os.ReadFile(filepath.Join(root, "f.txt")); string(content) != "aaaaYYYYZZZZzzzz" {
+		t.Fatalf("Unexpected current content %q", content)
+	}
+
+	batches, err := j.List("f.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 2 || batches[0].FileSize != 12 || batches[1].FileSize != 10 {
+		t.Fatalf("Expected 2 batches, got %+v", batches)
+	}
+
+	if content := reconstruct(t, j, root, "f.txt", batches[1].Version); content != "aaaaYYYYcc" {
+		t.Errorf("Expected the content before the second batch, got %q", content)
+	}
+	if content := reconstruct(t, j, root, "f.txt", batches[0].Version); content != "aaaabbbbcccc" {
+		t.Errorf("Expected the original content, got %q", content)
+	}
+}
+
+func TestReconstructCreated(t *testing.T) {
+	root := t.TempDir()
+	j := New(t.TempDir(), archive.Retention{})
+
+	if err := j.Created("new.txt"); err != nil {
+		t.Fatal(err)
+	}
+	overwrite(t, j, root, "new.txt", 0, "data", 4)
+	j.Seal("new.txt")
+
+	batches, _ := j.List("")
+	if len(batches) != 1 || batches[0].Existed {
+		t.Fatalf("Expected a batch that created the file, got %+v", batches)
+	}
+	err := j.Reconstruct(filepath.Join(root, "new.txt"), "new.txt", batches[0].Version, filepath.Join(t.TempDir(), "out"))
+	if !errors.Is(err, ErrNotExisted) {
+		t.Errorf("Expected ErrNotExisted, got %v", err)
+	}
+	if err := j.Reconstruct(filepath.Join(root, "new.txt"), "new.txt", "missing", filepath.Join(t.TempDir(), "out")); !os.IsNotExist(err) {
+		t.Errorf("Expected not exist for an unknown batch, got %v", err)
+	}
+}
+
+func TestRenameAndRetire(t *testing.T) {
+	root := t.TempDir()
+	j := New(t.TempDir(), archive.Retention{})
+
+	os.MkdirAll(filepath.Join(root, "dir"), 0750)
+	os.WriteFile(filepath.Join(root, "dir/f.txt"), []byte("1234"), 0640)
+	overwrite(t, j, root, "dir/f.txt", 0, "abcd", 4)
+
+	if err := j.Rename("dir", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	os.Rename(filepath.Join(root, "dir"), filepath.Join(root, "moved"))
+	batches, _ := j.List("moved")
+	if len(batches) != 1 || batches[0].Path != "moved/f.txt" {
+		t.Fatalf("Expected the batch to move with the directory, got %+v", batches)
+	}
+	if content := reconstruct(t, j, root, "moved/f.txt", batches[0].Version); content != "1234" {
+		t.Errorf("Expected the original content, got %q", content)
+	}
+
+	archived := archive.Version{Path: "moved/f.txt", Version: "20250301T120000.000000000Z"}
+	if err := j.Retire("moved/f.txt", archived); err != nil {
+		t.Fatal(err)
+	}
+	if batches, _ := j.List(archived.Name()); len(batches) != 1 {
+		t.Errorf("Expected the batch under the archived version, got %+v", batches)
+	}
+	if batches, _ := j.List("moved/f.txt"); len(batches) != 0 {
+		t.Errorf("Expected no batches left for the deleted file, got %+v", batches)
+	}
+}
+
+func TestPruneKeepsNewestBatches(t *testing.T) {
+	root := t.TempDir()
+	j := New(t.TempDir(), archive.Retention{KeepVersions: 1})
+	j.now = clock(time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC), time.Minute)
+
+	os.WriteFile(filepath.Join(root, "f.txt"), []byte("0000"), 0640)
+	for _, data := range []string{"1111", "2222", "3333"} {
+		overwrite(t, j, root, "f.txt", 0, data, 4)
+		j.Seal("f.txt")
+	}
+
+	result, err := j.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Removed != 2 {
+		t.Errorf("Expected 2 batches pruned, got %+v", result)
+	}
+	batches, _ := j.List("")
+	if len(batches) != 1 {
+		t.Fatalf("Expected 1 batch left, got %+v", batches)
+	}
+	if content := reconstruct(t, j, root, "f.txt", batches[0].Version); content != "2222" {
+		t.Errorf("Expected the content before the last batch, got %q", content)
+	}
+}
@@ -0,0 +1,255 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+)
+
+const (
+	keyIDSize = 4
+	nonceSize = 12
+	tagSize   = 16
+	// Overhead is what sealing adds to every block: the key ID, the nonce and
+	// the authentication tag.
+	Overhead = keyIDSize + nonceSize + tagSize
+)
+
+var ErrUnknownKey = errors.New("sealed with a key missing from the key file")
+
+type blockKey struct {
+	aead  cipher.AEAD
+	nonce []byte
+}
+
+// Cipher seals the blocks of the files with AES-256-GCM before they leave the
+// sender, and optionally the names of the files.
+//
+// Sealing is deterministic: the nonce is a keyed hash of the block, the file
+// and its position, so an unchanged block seals to the same bytes. The
+// reciever diffs and deduplicates the sealed blocks as it does plain ones,
+// without learning more than which blocks are unchanged. A block is bound to
+// the plain path of its file, so a block moved to another file, or a file
+// renamed on the reciever, fails to open. A sealed file is laid out in sealed
+// blocks of the block size plus Overhead, so a file has to be restored with
+// the block size it was sent with.
+type Cipher struct {
+	blockSize uint64
+	current   uint32
+	keys      map[uint32]blockKey
+	// names is nil when the file names are sent in the clear.
+	names map[uint32]blockKey
+}
+
+// NewCipher derives the keys from the key file. The names are sealed with the
+// current key, and open with any key of the key file, so the names sealed
+// before a rotation can be looked up and moved to the current key.
+func NewCipher(keyring *Keyring, blockSize uint64, sealNames bool) (*Cipher, error) {
+	if blockSize == 0 {
+		return nil, errors.New("block size must not be 0")
+	}
+	c := &Cipher{blockSize: blockSize, current: keyring.Current, keys: make(map[uint32]blockKey)}
+	if sealNames {
+		c.names = make(map[uint32]blockKey)
+	}
+	for _, key := range keyring.Keys {
+		derived, err := deriveKey(key.Key, "blocks")
+		if err != nil {
+			return nil, err
+		}
+		c.keys[key.ID] = derived
+		if sealNames {
+			if c.names[key.ID], err = deriveKey(key.Key, "names"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if _, ok := c.keys[c.current]; !ok {
+		return nil, fmt.Errorf("no current key %d", c.current)
+	}
+	return c, nil
+}
+
+func deriveKey(master []byte, purpose string) (blockKey, error) {
+	block, err := aes.NewCipher(keyedHash(master, []byte(purpose+" key")))
+	if err != nil {
+		return blockKey{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return blockKey{}, err
+	}
+	return blockKey{aead: aead, nonce: keyedHash(master, []byte(purpose+" nonce"))}, nil
+}
+
+func keyedHash(key []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+// binding is what ties a sealed block to its place: the plain path of the
+// file and the position of the block in it.
+func binding(file string, chunkID uint64) []byte {
+	file = path.Clean(file)
+	bound := binary.BigEndian.AppendUint64(nil, uint64(len(file)))
+	bound = append(bound, file...)
+	return binary.BigEndian.AppendUint64(bound, chunkID)
+}
+
+// Seal encrypts the block at chunkID of file with the current key.
+func (c *Cipher) Seal(file string, chunkID uint64, block []byte) []byte {
+	key := c.keys[c.current]
+	bound := binding(file, chunkID)
+	nonce := keyedHash(key.nonce, bound, block)[:nonceSize]
+
+	sealed := make([]byte, keyIDSize, len(block)+Overhead)
+	binary.BigEndian.PutUint32(sealed, c.current)
+	sealed = append(sealed, nonce...)
+	return key.aead.Seal(sealed, nonce, block, bound)
+}
+
+// Open decrypts a sealed block, checking it was sealed for chunkID of file.
+func (c *Cipher) Open(file string, chunkID uint64, sealed []byte) ([]byte, error) {
+	if len(sealed) < Overhead {
+		return nil, fmt.Errorf("sealed block of %d bytes is too short", len(sealed))
+	}
+	key, ok := c.keys[binary.BigEndian.Uint32(sealed)]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	nonce := sealed[keyIDSize : keyIDSize+nonceSize]
+	return key.aead.Open(nil, nonce, sealed[keyIDSize+nonceSize:], binding(file, chunkID))
+}
+
+// BlockSize is the size of the blocks before they are sealed.
+func (c *Cipher) BlockSize() uint64 {
+	return c.blockSize
+}
+
+// SealedBlockSize is the size of a sealed full block.
+func (c *Cipher) SealedBlockSize() uint64 {
+	return c.blockSize + Overhead
+}
+
+// SealedSize is the size of a file once its blocks are sealed.
+func (c *Cipher) SealedSize(size uint64) uint64 {
+	sealed := size / c.blockSize * c.SealedBlockSize()
+	if tail := size % c.blockSize; tail > 0 {
+		sealed += tail + Overhead
+	}
+	return sealed
+}
+
+// PlainSize is the size of a file before its blocks were sealed.
+func (c *Cipher) PlainSize(sealed uint64) uint64 {
+	size := sealed / c.SealedBlockSize() * c.blockSize
+	if tail := sealed % c.SealedBlockSize(); tail > Overhead {
+		size += tail - Overhead
+	}
+	return size
+}
+
+// SealStream writes the sealed blocks of file, read from src, to dst as they
+// are laid out on the reciever.
+func (c *Cipher) SealStream(file string, src io.Reader, dst io.Writer) error {
+	buffer := make([]byte, c.blockSize)
+	for chunkID := uint64(0); ; chunkID++ {
+		n, err := io.ReadFull(src, buffer)
+		if n > 0 {
+			if _, err := dst.Write(c.Seal(file, chunkID, buffer[:n])); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// SealPath seals every component of a relative path with the current key, or
+// returns it as it is when the names are sent in the clear.
+func (c *Cipher) SealPath(relativePath string) string {
+	return c.sealPathWith(c.current, relativePath)
+}
+
+// SealedPaths returns the names the path may have on the reciever, sealed with
+// the current key first and then with the older ones.
+func (c *Cipher) SealedPaths(relativePath string) []string {
+	if c.names == nil {
+		return []string{relativePath}
+	}
+	ids := make([]uint32, 0, len(c.names))
+	for id := range c.names {
+		if id != c.current {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	sealedPaths := []string{c.SealPath(relativePath)}
+	for i := len(ids) - 1; i >= 0; i-- {
+		sealedPaths = append(sealedPaths, c.sealPathWith(ids[i], relativePath))
+	}
+	return sealedPaths
+}
+
+func (c *Cipher) sealPathWith(id uint32, relativePath string) string {
+	if c.names == nil || relativePath == "" {
+		return relativePath
+	}
+	key := c.names[id]
+	components := strings.Split(relativePath, "/")
+	for i, component := range components {
+		if component == "" || component == "." {
+			continue
+		}
+		nonce := keyedHash(key.nonce, []byte(component))[:nonceSize]
+		sealed := binary.BigEndian.AppendUint32(make([]byte, 0, keyIDSize+nonceSize+len(component)+tagSize), id)
+		sealed = append(sealed, nonce...)
+		sealed = key.aead.Seal(sealed, nonce, []byte(component), nil)
+		components[i] = base64.RawURLEncoding.EncodeToString(sealed)
+	}
+	return strings.Join(components, "/")
+}
+
+// OpenPath reverses SealPath, whichever key of the key file the names were
+// sealed with.
+func (c *Cipher) OpenPath(sealedPath string) (string, error) {
+	if c.names == nil || sealedPath == "" {
+		return sealedPath, nil
+	}
+	components := strings.Split(sealedPath, "/")
+	for i, component := range components {
+		if component == "" || component == "." {
+			continue
+		}
+		sealed, err := base64.RawURLEncoding.DecodeString(component)
+		if err != nil || len(sealed) < keyIDSize+nonceSize {
+			return "", fmt.Errorf("%s is not a sealed name", component)
+		}
+		key, ok := c.names[binary.BigEndian.Uint32(sealed)]
+		if !ok {
+			return "", fmt.Errorf("%s: %w", component, ErrUnknownKey)
+		}
+		nonce := sealed[keyIDSize : keyIDSize+nonceSize]
+		name, err := key.aead.Open(nil, nonce, sealed[keyIDSize+nonceSize:], nil)
+		if err != nil {
+			return "", fmt.Errorf("%s is not a sealed name: %w", component, err)
+		}
+		components[i] = string(name)
+	}
+	return strings.Join(components, "/"), nil
+}
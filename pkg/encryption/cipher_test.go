@@ -0,0 +1,161 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testCipher(t *testing.T, sealNames bool) (*Cipher, *Keyring, string) {
+	t.Helper()
+	keyFile := filepath.Join(t.TempDir(), "keys.json")
+	keyring, err := GenerateKeyring(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCipher(keyring, 16, sealNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, keyring, keyFile
+}
+
+func TestSeal(t *testing.T) {
+	c, _, _ := testCipher(t, false)
+	block := []byte("0123456789abcdef")
+
+	sealed := c.Seal("reports/q3.xlsx", 3, block)
+	if uint64(len(sealed)) != c.SealedBlockSize() {
+		t.Errorf("Expected a sealed block of %d bytes, got %d", c.SealedBlockSize(), len(sealed))
+	}
+	if bytes.Contains(sealed, block) {
+		t.Errorf("Expected the block not to be readable once sealed")
+	}
+	if !bytes.Equal(c.Seal("reports/q3.xlsx", 3, block), sealed) {
+		t.Errorf("Expected an unchanged block to seal to the same bytes")
+	}
+	if bytes.Equal(c.Seal("reports/q3.xlsx", 4, block), sealed) {
+		t.Errorf("Expected the same block at another position to seal differently")
+	}
+	if bytes.Equal(c.Seal("reports/q4.xlsx", 3, block), sealed) {
+		t.Errorf("Expected the same block in another file to seal differently")
+	}
+
+	if opened, err := c.Open("reports/q3.xlsx", 3, sealed); err != nil || !bytes.Equal(opened, block) {
+		t.Errorf("Expected the block back, got %q, %v", opened, err)
+	}
+	if _, err := c.Open("reports/q3.xlsx", 4, sealed); err == nil {
+		t.Errorf("Expected a block moved to another position to be refused")
+	}
+	if _, err := c.Open("reports/q4.xlsx", 3, sealed); err == nil {
+		t.Errorf("Expected a block moved to another file to be refused")
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := c.Open("reports/q3.xlsx", 3, sealed); err == nil {
+		t.Errorf("Expected a tampered block to be refused")
+	}
+}
+
+func TestSealedSize(t *testing.T) {
+	c, _, _ := testCipher(t, false)
+	for _, size := range []uint64{0, 1, 15, 16, 17, 40} {
+		data := bytes.Repeat([]byte{'x'}, int(size))
+		var sealed bytes.Buffer
+		if err := c.SealStream("data.bin", bytes.NewReader(data), &sealed); err != nil {
+			t.Fatal(err)
+		}
+		if uint64(sealed.Len()) != c.SealedSize(size) {
+			t.Errorf("Expected %d bytes to seal to %d, got %d", size, c.SealedSize(size), sealed.Len())
+		}
+		if plain := c.PlainSize(c.SealedSize(size)); plain != size {
+			t.Errorf("Expected the plain size of %d bytes back, got %d", size, plain)
+		}
+	}
+}
+
+func TestRotate(t *testing.T) {
+	c, keyring, keyFile := testCipher(t, true)
+	block := []byte("before rotation")
+	sealed := c.Seal("reports/q3.xlsx", 0, block)
+	name := c.SealPath("reports/q3.xlsx")
+
+	if id, err := keyring.Rotate(keyFile); err != nil || id != 2 {
+		t.Fatalf("Expected to rotate to key 2, got %d, %v", id, err)
+	}
+	keyring, err := LoadKeyring(keyFile)
+	if err != nil || keyring.Current != 2 || len(keyring.Keys) != 2 {
+		t.Fatalf("Expected the rotated key file back, got %+v, %v", keyring, err)
+	}
+	rotated, err := NewCipher(keyring, 16, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opened, err := rotated.Open("reports/q3.xlsx", 0, sealed); err != nil || !bytes.Equal(opened, block) {
+		t.Errorf("Expected blocks sealed with the old key to open, got %q, %v", opened, err)
+	}
+	if bytes.Equal(rotated.Seal("reports/q3.xlsx", 0, block), sealed) {
+		t.Errorf("Expected blocks to be sealed with the new key")
+	}
+	if rotated.SealPath("reports/q3.xlsx") == name {
+		t.Errorf("Expected the names to be sealed with the new key")
+	}
+	if opened, err := rotated.OpenPath(name); err != nil || opened != "reports/q3.xlsx" {
+		t.Errorf("Expected names sealed with the old key to open, got %s, %v", opened, err)
+	}
+	if sealedPaths := rotated.SealedPaths("reports/q3.xlsx"); len(sealedPaths) != 2 || sealedPaths[0] != rotated.SealPath("reports/q3.xlsx") || sealedPaths[1] != name {
+		t.Errorf("Expected the current name first and the old one after it, got %v", sealedPaths)
+	}
+
+	keyring.Keys = keyring.Keys[1:]
+	dropped, err := NewCipher(keyring, 16, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dropped.Open("reports/q3.xlsx", 0, sealed); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected a dropped key to be reported, got %v", err)
+	}
+}
+
+func TestSealPath(t *testing.T) {
+	c, _, _ := testCipher(t, true)
+	sealed := c.SealPath("reports/2025/q3.xlsx")
+	if strings.Contains(sealed, "reports") || strings.Count(sealed, "/") != 2 {
+		t.Errorf("Expected every component to be sealed, got %s", sealed)
+	}
+	if c.SealPath("reports/2025/q3.xlsx") != sealed {
+		t.Errorf("Expected a name to always seal the same")
+	}
+	if !strings.HasPrefix(sealed, c.SealPath("reports")+"/") {
+		t.Errorf("Expected the directories to keep their sealed names")
+	}
+	if opened, err := c.OpenPath(sealed); err != nil || opened != "reports/2025/q3.xlsx" {
+		t.Errorf("Expected the path back, got %s, %v", opened, err)
+	}
+	if _, err := c.OpenPath("reports/q3.xlsx"); err == nil {
+		t.Errorf("Expected a plain name to be refused")
+	}
+
+	plain, _, _ := testCipher(t, false)
+	if plain.SealPath("reports/q3.xlsx") != "reports/q3.xlsx" {
+		t.Errorf("Expected the names to be kept in the clear")
+	}
+}
+
+func TestGenerateKeyring(t *testing.T) {
+	_, _, keyFile := testCipher(t, false)
+	if _, err := GenerateKeyring(keyFile); err == nil {
+		t.Errorf("Expected an existing key file not to be overwritten")
+	}
+	if stat, err := os.Stat(keyFile); err != nil || stat.Mode().Perm() != 0600 {
+		t.Errorf("Expected the key file to be private, got %v, %v", stat.Mode(), err)
+	}
+
+	os.WriteFile(keyFile, []byte(`{"current": 2, "keys": [{"id": 1, "key": "c2hvcnQ="}]}`), 0600)
+	if _, err := LoadKeyring(keyFile); err == nil {
+		t.Errorf("Expected a key file without its current key to be refused")
+	}
+}
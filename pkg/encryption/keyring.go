@@ -0,0 +1,127 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var encryptionlogger = log.With().Str("component", "encryption").Logger()
+
+// KeySize is the size of the master keys, the block and name keys are derived
+// from them.
+const KeySize = 32
+
+// Key is a master key of the key file.
+type Key struct {
+	ID      uint32    `json:"id"`
+	Key     []byte    `json:"key"`
+	Created time.Time `json:"created"`
+}
+
+// Keyring is the content of a key file. New chunks are sealed with the
+// current key, the older keys are kept so the data sealed with them can still
+// be opened. The reciever never sees any of them.
+type Keyring struct {
+	Current uint32 `json:"current"`
+	Keys    []Key  `json:"keys"`
+}
+
+// GenerateKeyring creates a key file with a single key. An existing key file
+// is never overwritten.
+func GenerateKeyring(path string) (*Keyring, error) {
+	keyring := &Keyring{}
+	if _, err := keyring.addKey(); err != nil {
+		return nil, err
+	}
+	content, err := json.MarshalIndent(keyring, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	keyFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer keyFile.Close()
+	if _, err := keyFile.Write(content); err != nil {
+		return nil, err
+	}
+	encryptionlogger.Info().Msgf("Generated key file %s", path)
+	return keyring, keyFile.Sync()
+}
+
+// LoadKeyring reads a key file.
+func LoadKeyring(path string) (*Keyring, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keyring := &Keyring{}
+	if err := json.Unmarshal(content, keyring); err != nil {
+		return nil, fmt.Errorf("invalid key file %s: %w", path, err)
+	}
+	if _, ok := keyring.key(keyring.Current); !ok {
+		return nil, fmt.Errorf("key file %s has no current key %d", path, keyring.Current)
+	}
+	for _, key := range keyring.Keys {
+		if len(key.Key) != KeySize {
+			return nil, fmt.Errorf("key %d of %s is not %d bytes", key.ID, path, KeySize)
+		}
+	}
+	return keyring, nil
+}
+
+// Rotate adds a key and makes it current, then saves the key file. Chunks are
+// sealed with the new key from then on, and as no sealed block matches any
+// more, every file is sent again in full the next time it is synced.
+func (k *Keyring) Rotate(path string) (uint32, error) {
+	id, err := k.addKey()
+	if err != nil {
+		return 0, err
+	}
+	if err := k.Save(path); err != nil {
+		return 0, err
+	}
+	encryptionlogger.Info().Msgf("Rotated %s to key %d", path, id)
+	return id, nil
+}
+
+// Save replaces the key file.
+func (k *Keyring) Save(path string) error {
+	content, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := os.WriteFile(tmpPath, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func (k *Keyring) addKey() (uint32, error) {
+	key := Key{ID: 1, Key: make([]byte, KeySize), Created: time.Now().UTC()}
+	for _, existing := range k.Keys {
+		key.ID = max(key.ID, existing.ID+1)
+	}
+	if _, err := rand.Read(key.Key); err != nil {
+		return 0, err
+	}
+	k.Keys = append(k.Keys, key)
+	k.Current = key.ID
+	return key.ID, nil
+}
+
+func (k *Keyring) key(id uint32) (Key, bool) {
+	for _, key := range k.Keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
@@ -0,0 +1,178 @@
+package files
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/kosalaat/file-replicator/replicator"
+)
+
+type BlockState string
+
+const (
+	BlockSame BlockState = "same"
+	// BlockDiffers means the sender and reciever hold different data.
+	BlockDiffers BlockState = "differs"
+	// BlockStale means the data is the same on disk, but the cached index
+	// disagrees, so the block is resent anyway.
+	BlockStale         BlockState = "stale-cache"
+	BlockSenderOnly    BlockState = "sender-only"
+	BlockRecieverOnly  BlockState = "reciever-only"
+	BlockCacheMismatch BlockState = "cache-mismatch"
+)
+
+// BlockRow compares one block of the file. Hashes are nil where the side does
+// not have the block.
+type BlockRow struct {
+	ChunkID    uint64     `json:"chunk_id"`
+	Sender     *uint64    `json:"sender,omitempty"`
+	Disk       *uint64    `json:"reciever_disk,omitempty"`
+	Cached     *uint64    `json:"reciever_cache,omitempty"`
+	State      BlockState `json:"state"`
+	WouldSend  bool       `json:"would_send"`
+	SenderSize uint64     `json:"sender_size,omitempty"`
+}
+
+type BlockDiff struct {
+	Path               string     `json:"path"`
+	Target             string     `json:"target"`
+	SenderBlockSize    uint64     `json:"sender_block_size"`
+	SenderFileSize     uint64     `json:"sender_file_size"`
+	RecieverCode       string     `json:"reciever_code"`
+	RecieverFileSize   uint64     `json:"reciever_file_size"`
+	Cached             bool       `json:"cached"`
+	CachedBlockSize    uint64     `json:"cached_block_size,omitempty"`
+	CacheCurrent       bool       `json:"cache_current"`
+	CacheUsed          bool       `json:"cache_used"`
+	Blocks             []BlockRow `json:"blocks"`
+	DifferentBlocks    int        `json:"different_blocks"`
+	StaleCacheBlocks   int        `json:"stale_cache_blocks"`
+	BlocksToSend       int        `json:"blocks_to_send"`
+	RecieverOnlyBlocks int        `json:"reciever_only_blocks"`
+}
+
+// BlockDiff compares the block map of a file on the sender with the one on the
+// reciever, on disk and in its cached index. It shows why CheckDuplicates
+// reports a block as changed without sending or changing anything.
+func (f *FileReplicator) BlockDiff(ctx context.Context, file string, blockSize uint64) (*BlockDiff, error) {
+	signature, err := f.ReplicatorClient.BuildSignature(file, blockSize)
+	if err != nil {
+		return nil, err
+	}
+
+	blockMap, err := f.ReplicatorClient.FileReplicatorClient.BlockMap(ctx, &replicator.BlockMapRequest{
+		RelativeFilePath: file,
+		BlockSize:        blockSize,
+	})
+	if err != nil {
+		fopslogger.Error().Err(err).Msgf("Failed to get the block map of %s", file)
+		return nil, err
+	}
+
+	diff := &BlockDiff{
+		Path:             file,
+		Target:           f.TargetName(),
+		SenderBlockSize:  blockSize,
+		SenderFileSize:   signature.FileSize,
+		RecieverCode:     blockMap.Code.String(),
+		RecieverFileSize: blockMap.FileSize,
+		Cached:           blockMap.Cached,
+		CachedBlockSize:  blockMap.CachedBlockSize,
+		CacheCurrent:     blockMap.CacheCurrent,
+		Blocks:           make([]BlockRow, 0),
+	}
+	// the same rule the reciever applies when it picks the index to compare with
+	diff.CacheUsed = blockMap.Cached && blockMap.CacheCurrent && blockMap.CachedBlockSize == blockSize
+	effective := blockMap.DiskHash
+	if diff.CacheUsed {
+		effective = blockMap.CachedHash
+	}
+
+	blocks := max(len(signature.Chunk), len(blockMap.DiskHash), len(blockMap.CachedHash))
+	for chunkID := 0; chunkID < blocks; chunkID++ {
+		row := BlockRow{ChunkID: uint64(chunkID)}
+		if chunkID < len(signature.Chunk) {
+			row.Sender = &signature.Chunk[chunkID].Hash
+			row.SenderSize = signature.Chunk[chunkID].BlockSize
+		}
+		if chunkID < len(blockMap.DiskHash) {
+			row.Disk = &blockMap.DiskHash[chunkID]
+		}
+		if chunkID < len(blockMap.CachedHash) && blockMap.CachedBlockSize == blockSize {
+			row.Cached = &blockMap.CachedHash[chunkID]
+		}
+		row.WouldSend = row.Sender != nil && (chunkID >= len(effective) || effective[chunkID] != *row.Sender)
+
+		switch {
+		case row.Sender == nil && row.Disk == nil:
+			row.State = BlockCacheMismatch
+		case row.Sender == nil:
+			row.State = BlockRecieverOnly
+			diff.RecieverOnlyBlocks++
+		case row.Disk == nil:
+			row.State = BlockSenderOnly
+			diff.DifferentBlocks++
+		case *row.Sender != *row.Disk:
+			row.State = BlockDiffers
+			diff.DifferentBlocks++
+		case row.WouldSend:
+			row.State = BlockStale
+			diff.StaleCacheBlocks++
+		case row.Cached != nil && *row.Cached != *row.Disk:
+			row.State = BlockCacheMismatch
+		default:
+			row.State = BlockSame
+		}
+		if row.WouldSend {
+			diff.BlocksToSend++
+		}
+		diff.Blocks = append(diff.Blocks, row)
+	}
+	return diff, nil
+}
+
+func formatHash(hash *uint64) string {
+	if hash == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%016x", *hash)
+}
+
+// WriteText prints the block map as a table. Unless all is set, only the
+// blocks that are not the same everywhere are listed.
+func (d *BlockDiff) WriteText(w io.Writer, all bool) error {
+	fmt.Fprintf(w, "Block map of %s on %s\n", d.Path, d.Target)
+	fmt.Fprintf(w, "  sender:   %d bytes, block size %d\n", d.SenderFileSize, d.SenderBlockSize)
+	fmt.Fprintf(w, "  reciever: %d bytes, %s\n", d.RecieverFileSize, d.RecieverCode)
+	switch {
+	case !d.Cached:
+		fmt.Fprintf(w, "  cache:    no index cached, compared with the file on disk\n")
+	case d.CacheUsed:
+		fmt.Fprintf(w, "  cache:    current, block size %d, used for the comparison\n", d.CachedBlockSize)
+	default:
+		fmt.Fprintf(w, "  cache:    block size %d, current %v, not used for the comparison\n", d.CachedBlockSize, d.CacheCurrent)
+	}
+
+	fmt.Fprintf(w, "  %8s  %-16s  %-16s  %-16s  %-14s  %s\n", "block", "sender", "reciever disk", "reciever cache", "state", "send")
+	for _, row := range d.Blocks {
+		if !all && row.State == BlockSame {
+			continue
+		}
+		send := ""
+		if row.WouldSend {
+			send = "yes"
+		}
+		fmt.Fprintf(w, "  %8d  %-16s  %-16s  %-16s  %-14s  %s\n", row.ChunkID, formatHash(row.Sender), formatHash(row.Disk), formatHash(row.Cached), row.State, send)
+	}
+	_, err := fmt.Fprintf(w, "%d blocks, %d differ, %d resent because of a stale cache, %d only on the reciever, %d would be sent\n",
+		len(d.Blocks), d.DifferentBlocks, d.StaleCacheBlocks, d.RecieverOnlyBlocks, d.BlocksToSend)
+	return err
+}
+
+func (d *BlockDiff) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(d)
+}
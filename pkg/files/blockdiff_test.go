@@ -0,0 +1,77 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/pkg/server"
+	"github.com/phayes/freeport"
+)
+
+func TestBlockDiff(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "test.txt"), []byte("abc1def2ghi3jkl4"), 0644); err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dest, "test.txt"), []byte("abc1XXXXghi3"), 0644); err != nil {
+		t.Fatalf("Failed to create destination file: %v", err)
+	}
+
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	server := server.NewReplicationServer()
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	go func() {
+		server.StartListening(address, dest)
+	}()
+	defer server.StopListening()
+
+	replicationClient, err := client.NewReplicatorClient(address, src, 10)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	fileReplicator := &FileReplicator{ReplicatorClient: *replicationClient}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFunc()
+
+	diff, err := fileReplicator.BlockDiff(ctx, "test.txt", 4)
+	if err != nil {
+		t.Fatalf("BlockDiff failed: %v", err)
+	}
+	expected := []BlockState{BlockSame, BlockDiffers, BlockSame, BlockSenderOnly}
+	if len(diff.Blocks) != len(expected) || diff.Cached || diff.BlocksToSend != 2 {
+		t.Fatalf("Unexpected block diff: %+v", diff)
+	}
+	for i, row := range diff.Blocks {
+		if row.State != expected[i] {
+			t.Errorf("Block %d: expected %s, got %s", i, expected[i], row.State)
+		}
+	}
+
+	// cache the index, then fix the file behind its back keeping size and
+	// modification time, so the cache looks current
+	if _, err := fileReplicator.ReplicatorClient.CheckDuplicates(ctx, "test.txt", 4); err != nil {
+		t.Fatalf("CheckDuplicates failed: %v", err)
+	}
+	destFile := filepath.Join(dest, "test.txt")
+	stat, _ := os.Stat(destFile)
+	os.WriteFile(destFile, []byte("abc1def2ghi3"), 0644)
+	os.Chtimes(destFile, stat.ModTime(), stat.ModTime())
+
+	diff, err = fileReplicator.BlockDiff(ctx, "test.txt", 4)
+	if err != nil {
+		t.Fatalf("BlockDiff failed: %v", err)
+	}
+	if !diff.Cached || !diff.CacheUsed || diff.StaleCacheBlocks != 1 || diff.Blocks[1].State != BlockStale {
+		t.Fatalf("Expected the stale cache to show up: %+v", diff)
+	}
+}
@@ -0,0 +1,283 @@
+package files
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var fanoutlogger = log.With().Str("component", "fan-out").Logger()
+
+const (
+	initialBackoff = 500 * time.Millisecond
+	maxBackoff     = time.Minute
+	maxAttempts    = 5
+	rescanInterval = 30 * time.Second
+)
+
+// FanOut replicates one source tree to several receivers. Every target is a
+// FileReplicator with its own diff state, queue and retry state.
+type FanOut struct {
+	Targets []*FileReplicator
+	watcher *fsnotify.Watcher
+}
+
+// TargetStatus is the replication state of a single receiver.
+type TargetStatus struct {
+	Name          string    `json:"name"`
+	Address       string    `json:"address"`
+	Connection    string    `json:"connection"`
+	Retrying      bool      `json:"retrying"`
+	QueuedItems   int       `json:"queued_items"`
+	QueuedBytes   int64     `json:"queued_bytes"`
+	LagSeconds    float64   `json:"lag_seconds"`
+	DeferredFiles int       `json:"deferred_files"`
+	Sent          uint64    `json:"sent"`
+	Failed        uint64    `json:"failed"`
+	Retries       uint64    `json:"retries"`
+	Dropped       uint64    `json:"dropped"`
+	LastError     string    `json:"last_error,omitempty"`
+	LastErrorAt   time.Time `json:"last_error_at,omitempty"`
+	LastSuccessAt time.Time `json:"last_success_at,omitempty"`
+	// StorageFull is the code the reciever refused to store more with, while
+	// the replication to it is paused.
+	StorageFull string `json:"storage_full,omitempty"`
+	// Compression is the ratio the chunk data was compressed at, if it is.
+	Compression *client.CompressionStats `json:"compression,omitempty"`
+}
+
+type targetState struct {
+	mu          sync.Mutex
+	sent        uint64
+	failed      uint64
+	retries     uint64
+	dropped     uint64
+	retrying    bool
+	lastError   string
+	lastErrorAt time.Time
+	lastSuccess time.Time
+	deferred    map[string]struct{}
+	torn        map[string]uint64
+	resends     map[string]int
+	storageFull string
+	// unstaged is set once the reciever turned out to predate staged
+	// versions, they are sent as plain chunks from then on.
+	unstaged bool
+}
+
+func (s *targetState) recordSuccess() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent++
+	s.retrying = false
+	s.lastSuccess = time.Now()
+}
+
+func (s *targetState) recordFailure(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed++
+	s.lastError = err.Error()
+	s.lastErrorAt = time.Now()
+}
+
+func (s *targetState) recordRetry() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retries++
+	s.retrying = true
+}
+
+// pause records that the reciever is out of storage, it reports whether it
+// just ran out.
+func (s *targetState) pause(code string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paused := s.storageFull == ""
+	s.storageFull = code
+	return paused
+}
+
+// resume clears the storage condition, it reports whether there was one.
+func (s *targetState) resume() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paused := s.storageFull != ""
+	s.storageFull = ""
+	return paused
+}
+
+// stagingUnsupported reports whether the reciever can not stage versions.
+func (s *targetState) stagingUnsupported() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.unstaged
+}
+
+// disableStaging records that the reciever can not stage versions, it
+// reports whether that was not known yet.
+func (s *targetState) disableStaging() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	disabled := !s.unstaged
+	s.unstaged = true
+	return disabled
+}
+
+func (s *targetState) recordDrop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropped++
+}
+
+// tear records that the begin or a chunk of the version of the file was
+// dropped, so the version is aborted instead of committed.
+func (s *targetState) tear(fileName string, version uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.torn == nil {
+		s.torn = make(map[string]uint64)
+	}
+	s.torn[fileName] = version
+}
+
+func (s *targetState) takeTorn(fileName string, version uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if torn, ok := s.torn[fileName]; ok && torn == version {
+		delete(s.torn, fileName)
+		return true
+	}
+	return false
+}
+
+// resent counts the whole-file resends of the file since it last committed.
+func (s *targetState) resent(fileName string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.resends == nil {
+		s.resends = make(map[string]int)
+	}
+	s.resends[fileName]++
+	return s.resends[fileName]
+}
+
+func (s *targetState) committed(fileName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.resends, fileName)
+}
+
+func (s *targetState) deferFile(fileName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.deferred == nil {
+		s.deferred = make(map[string]struct{})
+	}
+	s.deferred[fileName] = struct{}{}
+}
+
+func (s *targetState) takeDeferred() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := make([]string, 0, len(s.deferred))
+	for fileName := range s.deferred {
+		files = append(files, fileName)
+	}
+	s.deferred = nil
+	return files
+}
+
+// retryable reports whether the error means the receiver could not be reached,
+// as opposed to the receiver rejecting the request.
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted, codes.Canceled:
+		return true
+	}
+	return false
+}
+
+func (f *FileReplicator) TargetName() string {
+	if f.Name != "" {
+		return f.Name
+	}
+	return f.ReplicatorClient.Target()
+}
+
+func (f *FileReplicator) Status() TargetStatus {
+	f.state.mu.Lock()
+	result := TargetStatus{
+		Name:          f.TargetName(),
+		Address:       f.ReplicatorClient.Target(),
+		Connection:    f.ReplicatorClient.State(),
+		Retrying:      f.state.retrying,
+		DeferredFiles: len(f.state.deferred),
+		Sent:          f.state.sent,
+		Failed:        f.state.failed,
+		Retries:       f.state.retries,
+		Dropped:       f.state.dropped,
+		LastError:     f.state.lastError,
+		LastErrorAt:   f.state.lastErrorAt,
+		LastSuccessAt: f.state.lastSuccess,
+		StorageFull:   f.state.storageFull,
+		Compression:   f.ReplicatorClient.CompressionStats(),
+	}
+	f.state.mu.Unlock()
+
+	if f.transferQueue != nil {
+		stats := f.transferQueue.Stats()
+		result.QueuedItems = stats.Items
+		result.QueuedBytes = stats.Bytes
+		if !stats.Oldest.IsZero() {
+			result.LagSeconds = time.Since(stats.Oldest).Seconds()
+		}
+	}
+	return result
+}
+
+func (m *FanOut) Status() []TargetStatus {
+	result := make([]TargetStatus, 0, len(m.Targets))
+	for _, target := range m.Targets {
+		result = append(result, target.Status())
+	}
+	return result
+}
+
+// ServeStatus publishes the per target status as JSON on /status.
+func (m *FanOut) ServeStatus(address string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(m.Status()); err != nil {
+			fanoutlogger.Error().Err(err).Msg("Failed to write status")
+		}
+	})
+	fanoutlogger.Info().Msgf("Serving target status on %s/status", address)
+	return http.ListenAndServe(address, mux)
+}
+
+// LogStatus logs the status of every target at the given interval.
+func (m *FanOut) LogStatus(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, status := range m.Status() {
+			event := fanoutlogger.Info().
+				Str("target", status.Name).
+				Str("connection", status.Connection).
+				Int("queued_items", status.QueuedItems).
+				Float64("lag_seconds", status.LagSeconds).
+				Uint64("retries", status.Retries)
+			if status.Compression != nil {
+				event = event.Float64("compression_ratio", status.Compression.Ratio)
+			}
+			event.Msg("Target status")
+		}
+	}
+}
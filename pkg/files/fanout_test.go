@@ -0,0 +1,76 @@
+package files
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/pkg/server"
+	"github.com/phayes/freeport"
+)
+
+func TestFanOut_UnreachableTargetDoesNotBlock(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "test.txt"), []byte("abc1def2ghi3jkl4"), 0644); err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dest, "test.txt"), nil, 0644); err != nil {
+		t.Fatalf("Failed to create destination file: %v", err)
+	}
+
+	ports, err := freeport.GetFreePorts(2)
+	if err != nil {
+		t.Fatalf("Failed to get free ports: %v", err)
+	}
+	server := server.NewReplicationServer()
+	address := fmt.Sprintf("127.0.0.1:%d", ports[0])
+	go func() {
+		server.StartListening(address, dest)
+	}()
+	defer server.StopListening()
+
+	standby, err := client.NewReplicatorClient(address, src, 10)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	// Nothing listens on the second port.
+	offsite, err := client.NewReplicatorClient(fmt.Sprintf("127.0.0.1:%d", ports[1]), src, 10)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	fanOut := &FanOut{
+		Targets: []*FileReplicator{
+			{ReplicatorClient: *standby, Name: "standby"},
+			{ReplicatorClient: *offsite, Name: "offsite"},
+		},
+	}
+	go fanOut.SetupFileWatcher(src, 4)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		content, _ := os.ReadFile(filepath.Join(dest, "test.txt"))
+		if string(content) == "abc1def2ghi3jkl4" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Reachable target was not updated, content: %q", string(content))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	status := fanOut.Status()
+	if len(status) != 2 {
+		t.Fatalf("Expected status for 2 targets, got %d", len(status))
+	}
+	if status[0].Name != "standby" || status[0].Sent == 0 {
+		t.Fatalf("Expected the standby target to have sent chunks, got %+v", status[0])
+	}
+	if status[1].Name != "offsite" || status[1].Connection == "READY" {
+		t.Fatalf("Expected the offsite target to be disconnected, got %+v", status[1])
+	}
+}
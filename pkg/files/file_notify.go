@@ -2,6 +2,8 @@ package files
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"time"
@@ -9,6 +11,8 @@ import (
 	"github.com/fsnotify/fsnotify"
 	"github.com/kosalaat/file-replicator/replicator"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var fnotifylogger = log.With().Str("component", "file-notify").Logger()
@@ -32,65 +36,293 @@ func (f *FileReplicator) SyncSource(fileRoot string, blockSize uint64) error {
 	return nil
 }
 
-func (f *FileReplicator) SetupFileWatcher(fileRoot string, blockSize uint64) error {
-	f.FileRoot = fileRoot
-	f.transferQueue = make(chan *replicator.DataPayload, 1000)
+// processTransferQueue sends the queued work to the receiver until the queue
+// is closed. Failed items are retried with a backoff, indefinitely while the
+// receiver is unreachable and up to maxAttempts for other errors, so a target
+// that is down only holds up its own queue. Items the receiver has no room for
+// are not retried, their file is sent again on the next rescan.
+func (f *FileReplicator) processTransferQueue(ctx context.Context) {
+	for {
+		item, ok := f.transferQueue.Pop()
+		if !ok {
+			return
+		}
+		backoff := initialBackoff
+		for attempt := 1; ; attempt++ {
+			err := f.transfer(ctx, item)
+			if err == nil {
+				if f.state.resume() {
+					fnotifylogger.Info().Msgf("Target %s accepts files again, resuming", f.TargetName())
+				}
+				f.state.recordSuccess()
+				break
+			}
+			f.state.recordFailure(err)
+			if errors.Is(err, errStorageFull) {
+				break
+			}
+			if !retryable(err) && attempt >= maxAttempts {
+				fnotifylogger.Error().Err(err).Msgf("Giving up on %s for %s after %d attempts", item.Op, item.Path, attempt)
+				f.state.recordDrop()
+				if item.Op == OpData && item.Payload.StagingVersion > 0 {
+					f.state.tear(item.Path, item.Payload.StagingVersion)
+				} else if item.Op == OpBegin {
+					f.state.tear(item.Path, item.Version.Version)
+				}
+				break
+			}
+			f.state.recordRetry()
+			fnotifylogger.Warn().Err(err).Msgf("Retrying %s for %s on target %s in %v", item.Op, item.Path, f.TargetName(), backoff)
+			select {
+			case <-ctx.Done():
+				f.transferQueue.Done()
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, maxBackoff)
+		}
+		f.transferQueue.Done()
+	}
+}
 
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
+func (f *FileReplicator) transfer(ctx context.Context, item *TransferItem) error {
+	switch item.Op {
+	case OpData, OpMetadata:
+		if item.Payload.StagingVersion > 0 && f.state.stagingUnsupported() {
+			item.Payload.StagingVersion = 0
+		}
+		if confirmation, err := f.ReplicatorClient.ReplicateChunk(ctx, item.Payload); err != nil {
+			fnotifylogger.Error().Err(err).Msgf("Failed to replicate chunk: %d", item.Payload.ChunkID)
+			return err
+		} else if storageFull(confirmation.Code) {
+			return f.pause(item, confirmation.Code)
+		} else if confirmation.Code == replicator.ConfirmationCode_CHUNK_CORRUPTED {
+			// the file is diffed again once the link recovers
+			fnotifylogger.Error().Msgf("Chunk %d of %s kept arriving corrupted", item.Payload.ChunkID, item.Path)
+			f.state.deferFile(item.Path)
+			if item.Payload.StagingVersion > 0 {
+				f.state.tear(item.Path, item.Payload.StagingVersion)
+			}
+		} else {
+			fnotifylogger.Info().Msgf("Successfully replicated chunk: %d", item.Payload.ChunkID)
+		}
+	case OpBegin:
+		if f.state.stagingUnsupported() {
+			return nil
+		}
+		if confirmation, err := f.ReplicatorClient.Begin(ctx, item.Version); status.Code(err) == codes.Unimplemented {
+			// a reciever built before staged versions writes the chunks directly
+			if f.state.disableStaging() {
+				fnotifylogger.Warn().Msgf("Target %s can not stage versions, sending the files directly", f.TargetName())
+			}
+		} else if err != nil {
+			fnotifylogger.Error().Err(err).Msgf("Failed to begin version of file: %s", item.Path)
+			return err
+		} else if storageFull(confirmation.Code) {
+			return f.pause(item, confirmation.Code)
+		} else if confirmation.Code != replicator.ConfirmationCode_OK {
+			// its chunks and commit are refused, the file is sent again
+			fnotifylogger.Warn().Msgf("Begin of %s failed with code: %s", item.Path, confirmation.Code)
+			f.state.tear(item.Path, item.Version.Version)
+		}
+	case OpCommit:
+		if f.state.stagingUnsupported() {
+			return f.commitUnstaged(ctx, item)
+		}
+		if f.state.takeTorn(item.Path, item.Version.Version) {
+			fnotifylogger.Warn().Msgf("Chunks of %s were dropped, aborting version %d", item.Path, item.Version.Version)
+			f.state.deferFile(item.Path)
+			_, err := f.ReplicatorClient.Abort(ctx, item.Version)
+			return err
+		}
+		if confirmation, err := f.ReplicatorClient.Commit(ctx, item.Version); err != nil {
+			fnotifylogger.Error().Err(err).Msgf("Failed to commit file: %s", item.Path)
+			return err
+		} else if confirmation.Code == replicator.ConfirmationCode_CHECKSUM_MISMATCH {
+			fnotifylogger.Warn().Msgf("Version %d of %s does not match on the reciever", item.Version.Version, item.Path)
+			// queued aside, the worker can not wait for room in the queue it empties
+			go func(version *replicator.FileVersion) {
+				if resent, err := f.resendFile(version); err != nil || !resent {
+					f.state.deferFile(version.RelativeFilePath)
+				}
+			}(item.Version)
+		} else if confirmation.Code != replicator.ConfirmationCode_OK {
+			fnotifylogger.Warn().Msgf("Commit of %s failed with code: %s, aborting version %d", item.Path, confirmation.Code, item.Version.Version)
+			f.state.deferFile(item.Path)
+			if _, err := f.ReplicatorClient.Abort(ctx, item.Version); err != nil {
+				return err
+			}
+		} else {
+			fnotifylogger.Info().Msgf("File committed: %s", item.Path)
+			f.state.committed(item.Path)
+		}
+	case OpRename:
+		if err := f.RenameFile(item.Path, item.NewPath); err != nil {
+			fnotifylogger.Info().Msgf("Failed to rename file: %s", item.Path)
+			return err
+		} else {
+			fnotifylogger.Info().Msgf("File renamed: %s -> %s", item.Path, item.NewPath)
+		}
+	case OpDelete:
+		if err := f.DeleteFile(item.Path); err != nil {
+			fnotifylogger.Info().Msgf("Failed to remove file: %s", item.Path)
+			return err
+		} else {
+			fnotifylogger.Info().Msgf("File removed: %s", item.Path)
+		}
+	}
+	return nil
+}
+
+// commitUnstaged ends a version on a reciever that can not stage it. Its chunks
+// were written directly, so the size and metadata of the version are sent as
+// the last payload of the file, as for a file that is not staged.
+func (f *FileReplicator) commitUnstaged(ctx context.Context, item *TransferItem) error {
+	if f.state.takeTorn(item.Path, item.Version.Version) {
+		fnotifylogger.Warn().Msgf("Chunks of %s were dropped, sending it again", item.Path)
+		f.state.deferFile(item.Path)
+		return nil
+	}
+	payload := &replicator.DataPayload{
+		RelativeFilePath: item.Version.RelativeFilePath,
+		BlockSize:        item.Version.BlockSize,
+		FileSize:         item.Version.FileSize,
+		FileMode:         item.Version.FileMode,
+		UID:              item.Version.UID,
+		GID:              item.Version.GID,
+	}
+	if confirmation, err := f.ReplicatorClient.ReplicateChunk(ctx, payload); err != nil {
+		fnotifylogger.Error().Err(err).Msgf("Failed to update the metadata of %s", item.Path)
 		return err
+	} else if storageFull(confirmation.Code) {
+		return f.pause(item, confirmation.Code)
+	} else if confirmation.Code != replicator.ConfirmationCode_OK {
+		fnotifylogger.Warn().Msgf("Metadata update of %s failed with code: %s", item.Path, confirmation.Code)
+		f.state.deferFile(item.Path)
 	} else {
-		f.watcher = watcher
+		fnotifylogger.Info().Msgf("File replicated: %s", item.Path)
+		f.state.committed(item.Path)
 	}
+	return nil
+}
 
-	err = f.watcher.Add(fileRoot)
-	if err != nil {
-		return err
+func storageFull(code replicator.ConfirmationCode) bool {
+	return code == replicator.ConfirmationCode_QUOTA_EXCEEDED || code == replicator.ConfirmationCode_NO_SPACE
+}
+
+// errStorageFull ends the transfers of a file the reciever has no room for.
+var errStorageFull = errors.New("the reciever is out of storage")
+
+// pause stops sending a file while the reciever is out of storage. Retrying
+// the item would only be refused again, so the file is deferred to the next
+// rescan and its staged version torn. The condition is alerted once until a
+// transfer succeeds again.
+func (f *FileReplicator) pause(item *TransferItem, code replicator.ConfirmationCode) error {
+	if f.state.pause(code.String()) {
+		fnotifylogger.Error().Msgf("Target %s is out of storage (%s), deferring %s until it has room", f.TargetName(), code, item.Path)
+	}
+	f.state.deferFile(item.Path)
+	if item.Op == OpBegin {
+		f.state.tear(item.Path, item.Version.Version)
+	} else if item.Payload != nil && item.Payload.StagingVersion > 0 {
+		f.state.tear(item.Path, item.Payload.StagingVersion)
 	}
+	return fmt.Errorf("%s refused %s with %s: %w", f.TargetName(), item.Path, code, errStorageFull)
+}
+
+// start prepares the target for replicating fileRoot and starts sending its
+// queue and rescanning the files it failed to diff.
+func (f *FileReplicator) start(ctx context.Context, fileRoot string, blockSize uint64) {
+	f.FileRoot = fileRoot
+	f.transferQueue = NewTransferQueue(f.PriorityClasses, f.PriorityRules)
 
 	//Start the transferQueue reader
-	go func(chan *replicator.DataPayload) {
-		var dataPayload *replicator.DataPayload
-		// ctx, cancelFunc := context.WithTimeout(context.Background(), time.Duration(time.Millisecond*100))
-		// defer cancelFunc()
-		ctx := context.Background()
+	go f.processTransferQueue(ctx)
+	go f.retryPendingFiles(ctx, blockSize)
+}
 
-		for {
-			select {
-			case dataPayload = <-f.transferQueue:
-				if _, err := f.ReplicatorClient.ReplicateChunk(ctx, dataPayload); err != nil {
-					fnotifylogger.Error().Err(err).Msgf("Failed to replicate chunk: %d", dataPayload.ChunkID)
-				} else {
-					fnotifylogger.Info().Msgf("Successfully replicated chunk: %d", dataPayload.ChunkID)
-				}
-				// Handle value from ch1
-			default:
-				time.Sleep(100 * time.Millisecond)
+// initialSync scans the whole tree for this target.
+func (f *FileReplicator) initialSync(fileRoot string, blockSize uint64) {
+	fnotifylogger.Info().Msgf("Starting initial sync for directory: %s to %s", fileRoot, f.TargetName())
+	if _, err := f.ReplicatorClient.MigrateNames(context.Background()); err != nil {
+		fnotifylogger.Error().Err(err).Msgf("Failed to move the names on %s to the current key", f.TargetName())
+	}
+
+	err := filepath.Walk(
+		fileRoot,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
 			}
+			referencePath, _ := filepath.Rel(fileRoot, path)
+			if !info.IsDir() {
+				f.processFileOrDefer(referencePath, blockSize, true)
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		fnotifylogger.Error().Err(err).Msgf("Failed to walk directory: %s", fileRoot)
+	}
+}
+
+// processFileOrDefer diffs and queues the file, remembering it for a later
+// rescan when the target could not be reached.
+func (f *FileReplicator) processFileOrDefer(fileName string, blockSize uint64, rescan bool) {
+	if err := f.processFile(fileName, blockSize, rescan); err != nil {
+		fnotifylogger.Info().Msgf("Failed to process file: %s", fileName)
+		if _, statErr := os.Stat(filepath.Join(f.FileRoot, fileName)); statErr == nil {
+			f.state.deferFile(fileName)
 		}
-	}(f.transferQueue)
+	}
+}
 
-	// Scan for the initial sync
+func (f *FileReplicator) retryPendingFiles(ctx context.Context, blockSize uint64) {
+	ticker := time.NewTicker(rescanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, fileName := range f.state.takeDeferred() {
+				fnotifylogger.Info().Msgf("Rescanning %s for target %s", fileName, f.TargetName())
+				f.processFileOrDefer(fileName, blockSize, true)
+			}
+		}
+	}
+}
 
-	go func(fileRoot string, blockSize uint64) {
-		fnotifylogger.Info().Msgf("Starting initial sync for directory: %s", fileRoot)
+func (f *FileReplicator) SetupFileWatcher(fileRoot string, blockSize uint64) error {
+	fanOut := &FanOut{Targets: []*FileReplicator{f}}
+	return fanOut.SetupFileWatcher(fileRoot, blockSize)
+}
 
-		err := filepath.Walk(
-			fileRoot,
-			func(path string, info os.FileInfo, err error) error {
-				referencePath, _ := filepath.Rel(fileRoot, path)
-				if !info.IsDir() {
-					f.ProcessFile(referencePath, blockSize)
-				}
-				return nil
-			},
-		)
-		if err != nil {
-			fnotifylogger.Error().Err(err).Msgf("Failed to walk directory: %s", fileRoot)
-		}
-	}(f.FileRoot, blockSize)
+// SetupFileWatcher watches fileRoot and replicates every change to all the
+// targets. Each target diffs, queues and retries independently.
+func (m *FanOut) SetupFileWatcher(fileRoot string, blockSize uint64) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	} else {
+		m.watcher = watcher
+	}
+
+	err = m.watcher.Add(fileRoot)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	for _, target := range m.Targets {
+		target.start(ctx, fileRoot, blockSize)
+	}
+
+	// Scan for the initial sync
+	for _, target := range m.Targets {
+		go target.initialSync(fileRoot, blockSize)
+	}
 
-	// go func() {
 	for {
 		select {
 		case event, ok := <-watcher.Events:
@@ -102,34 +334,17 @@ func (f *FileReplicator) SetupFileWatcher(fileRoot string, blockSize uint64) err
 				fnotifylogger.Error().Err(err).Msgf("Failed to get relative path for event: %s", event.Name)
 			}
 			fnotifylogger.Info().Msgf("File event: %s, Operation: %s", fileName, event.Op)
-			switch event.Op {
-			case fsnotify.Create, fsnotify.Write:
-				go func(fileName string, blockSize uint64) {
-					if f.ProcessFile(fileName, blockSize) != nil {
-						fnotifylogger.Info().Msgf("Failed to process file: %s", fileName)
-
-					}
-				}(fileName, blockSize)
-			case fsnotify.Chmod:
-				go func(fileName string) {
-					if f.UpdateOwnership(fileName) != nil {
+			for _, target := range m.Targets {
+				switch event.Op {
+				case fsnotify.Create, fsnotify.Write:
+					go target.processFileOrDefer(fileName, blockSize, false)
+				case fsnotify.Chmod:
+					if target.QueueOwnership(fileName) != nil {
 						fnotifylogger.Info().Msgf("Failed to update permissions for file: %s", fileName)
 					}
-				}(fileName)
-			case fsnotify.Remove:
-				go func(fileName string) {
-					if f.DeleteFile(fileName) != nil {
-						fnotifylogger.Info().Msgf("Failed to remove file: %s", fileName)
-					} else {
-						fnotifylogger.Info().Msgf("File removed: %s", fileName)
-					}
-				}(fileName)
-				// case fsnotify.Rename:
-				// 	if f.RenameFile(event.Name, event.) != nil {
-				// 		log.Info().Msgf("Failed to rename file: %s", event.Name)
-				// 	} else {
-				// 		log.Info().Msgf("File renamed: %s", event.Name)
-				// 	}
+				case fsnotify.Remove:
+					target.QueueDelete(fileName)
+				}
 			}
 		case err, ok := <-watcher.Errors:
 			if !ok {
@@ -140,6 +355,4 @@ func (f *FileReplicator) SetupFileWatcher(fileRoot string, blockSize uint64) err
 			}
 		}
 	}
-	// }()
-
 }
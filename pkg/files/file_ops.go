@@ -9,28 +9,66 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
+	"github.com/cespare/xxhash/v2"
 	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/pkg/controller"
+	"github.com/kosalaat/file-replicator/pkg/versions"
 	"github.com/kosalaat/file-replicator/replicator"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/proto"
 )
 
 type FileReplicator struct {
 	client.ReplicatorClient
-	transferQueue chan *replicator.DataPayload
-	watcher       *fsnotify.Watcher
+	Name            string
+	PriorityClasses []PriorityClass
+	PriorityRules   []PriorityRule
+	Versions        *versions.Store
+	// Staged sends every new version of a file as a transaction, assembled
+	// on the receiver and made live once it is complete. A receiver built
+	// before staged versions is sent the chunks directly instead.
+	Staged        bool
+	transferQueue *TransferQueue
+	state         targetState
 }
 
 var fopslogger = log.With().Str("component", "file-ops").Logger()
 
 func (f *FileReplicator) ProcessFile(file string, blockSize uint64) error {
+	return f.processFile(file, blockSize, false)
+}
+
+// processFile diffs the file against the receiver and queues the changed
+// chunks. When versions are tracked, files whose content did not change are
+// only offered to the receiver on a rescan, and echoes of changes received
+// from the peer are never sent back.
+func (f *FileReplicator) processFile(file string, blockSize uint64, rescan bool) error {
 	fopslogger.Info().Msgf("Processing file: %s", file)
+	if controller.IsStagingFile(file) {
+		return nil
+	}
 
 	// define the context with a timeout
 	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancelFunc()
 
-	change, err := f.ReplicatorClient.CheckDuplicates(ctx, file, blockSize)
+	signature, err := f.ReplicatorClient.BuildSignature(file, blockSize)
+	if err != nil {
+		fopslogger.Error().Err(err).Msg("Failed to check for duplicates")
+		return err
+	}
+
+	if f.Versions != nil {
+		vector, changed := f.Versions.LocalChange(file, signature.FileHash, signature.ModTime)
+		if vector == nil || (!changed && !rescan) {
+			fopslogger.Info().Msgf("No local change to %s, skipping", file)
+			return nil
+		}
+		signature.VersionVector = vector
+		signature.SiteID = f.Versions.SiteID
+	}
+
+	change, err := f.ReplicatorClient.CheckSignature(ctx, signature)
 
 	if err != nil {
 		fopslogger.Error().Err(err).Msg("Failed to check for duplicates")
@@ -39,6 +77,22 @@ func (f *FileReplicator) ProcessFile(file string, blockSize uint64) error {
 		fopslogger.Info().Msgf("Change count: %v", len(change.Chunk))
 	}
 
+	if f.Versions != nil {
+		switch change.Code {
+		case replicator.ConfirmationCode_CONFLICT, replicator.ConfirmationCode_VERSION_OUTDATED:
+			fopslogger.Warn().Msgf("Reciever kept its version of %s: %s", file, change.Code)
+			return nil
+		}
+		f.Versions.Merge(file, change.VersionVector)
+	}
+
+	return f.queueChunks(file, blockSize, change.Chunk)
+}
+
+// queueChunks reads the given chunks of the file and queues them for the
+// receiver. Staged versions read the whole file in one pass, hashing it for the
+// receiver to verify on commit while the changed chunks are queued.
+func (f *FileReplicator) queueChunks(file string, blockSize uint64, chunks []*replicator.ChunkInfo) error {
 	fileHandle, err := os.Open(path.Join(f.ReplicatorClient.FileRoot, file))
 	if err != nil {
 		fopslogger.Error().Err(err).Msgf("Failed to open file: %s", file)
@@ -46,8 +100,16 @@ func (f *FileReplicator) ProcessFile(file string, blockSize uint64) error {
 	}
 	defer fileHandle.Close()
 
-	// if len(change.Chunk) > 0 {
-	for _, chunk := range change.Chunk {
+	fileStat, err := fileHandle.Stat()
+	if err != nil {
+		fopslogger.Error().Err(err).Msgf("Failed to stat file: %s", file)
+		return err
+	}
+	if f.Staged && !f.state.stagingUnsupported() && len(chunks) > 0 {
+		return f.queueVersion(file, fileHandle, fileStat, blockSize, chunks)
+	}
+
+	for _, chunk := range chunks {
 		fopslogger.Info().Msgf("Processing chunk: %d", chunk.ChunkID)
 
 		_, err := fileHandle.Seek(int64(chunk.ChunkID*blockSize), io.SeekStart)
@@ -70,73 +132,172 @@ func (f *FileReplicator) ProcessFile(file string, blockSize uint64) error {
 		}
 
 		fopslogger.Info().Msgf("Read chunk %d with size %d", chunk.ChunkID, n)
+		f.transferQueue.Push(&TransferItem{Op: OpData, Payload: chunkPayload(file, fileStat, blockSize, chunk.ChunkID, buf[:n], 0)})
+		fopslogger.Info().Msgf("Chunk %d replicated successfully", chunk.ChunkID)
+	}
+	return nil
+}
+
+func chunkPayload(file string, fileStat os.FileInfo, blockSize uint64, chunkID uint64, data []byte, version uint64) *replicator.DataPayload {
+	return &replicator.DataPayload{
+		DataChunk:        data,
+		ChunkID:          chunkID,
+		BlockSize:        blockSize,
+		FileMode:         uint32(fileStat.Mode()),
+		FileSize:         uint64(fileStat.Size()),
+		Length:           blockSize,
+		UID:              uint32(fileStat.Sys().(*syscall.Stat_t).Uid),
+		GID:              uint32(fileStat.Sys().(*syscall.Stat_t).Gid),
+		RelativeFilePath: file,
+		StagingVersion:   version,
+	}
+}
 
-		fileStat, _ := fileHandle.Stat()
-
-		f.transferQueue <- &replicator.DataPayload{
-			DataChunk:        buf[:n],
-			ChunkID:          chunk.ChunkID,
-			BlockSize:        uint64(blockSize),
-			FileMode:         uint32(fileStat.Mode()),
-			FileSize:         uint64(fileStat.Size()),
-			Length:           uint64(blockSize),
-			UID:              uint32(fileStat.Sys().(*syscall.Stat_t).Uid),
-			GID:              uint32(fileStat.Sys().(*syscall.Stat_t).Gid),
-			RelativeFilePath: file,
+// queueVersion queues the chunks as a new version of the file. Its xxhash64
+// and strong digest are taken from the same read as the chunks and sent with
+// the commit; sealed files are hashed as the receiver holds them. A read
+// failing half way tears the version, so the receiver aborts it.
+func (f *FileReplicator) queueVersion(file string, fileHandle *os.File, fileStat os.FileInfo, blockSize uint64, chunks []*replicator.ChunkInfo) error {
+	digest, algorithm, err := controller.NewDigest("")
+	if err != nil {
+		return err
+	}
+	version := &replicator.FileVersion{
+		RelativeFilePath: file,
+		Version:          uint64(time.Now().UnixNano()),
+		FileSize:         uint64(fileStat.Size()),
+		FileMode:         uint32(fileStat.Mode()),
+		UID:              fileStat.Sys().(*syscall.Stat_t).Uid,
+		GID:              fileStat.Sys().(*syscall.Stat_t).Gid,
+		BlockSize:        blockSize,
+	}
+	changed := make(map[uint64]bool, len(chunks))
+	for _, chunk := range chunks {
+		version.Chunks = append(version.Chunks, chunk.ChunkID)
+		changed[chunk.ChunkID] = true
+	}
+	f.transferQueue.Push(&TransferItem{Op: OpBegin, Version: version})
+
+	fileHash := xxhash.New()
+	hashed := io.MultiWriter(fileHash, digest)
+	cipher := f.ReplicatorClient.Cipher()
+	for chunkID := uint64(0); ; chunkID++ {
+		buf := make([]byte, blockSize)
+		n, err := io.ReadFull(fileHandle, buf)
+		if n > 0 {
+			if cipher != nil {
+				hashed.Write(cipher.Seal(file, chunkID, buf[:n]))
+			} else {
+				hashed.Write(buf[:n])
+			}
+			if changed[chunkID] {
+				f.transferQueue.Push(&TransferItem{Op: OpData, Payload: chunkPayload(file, fileStat, blockSize, chunkID, buf[:n], version.Version)})
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			fopslogger.Error().Err(err).Msgf("Failed to read chunk %d of %s, aborting version %d", chunkID, file, version.Version)
+			f.state.tear(file, version.Version)
+			f.transferQueue.Push(&TransferItem{Op: OpCommit, Version: version})
+			return err
 		}
+	}
 
-		// if confirmation, err := f.ReplicatorClient.ReplicateChunk(
-		// 	ctx,
-		// 	&replicator.DataPayload{
-		// 		DataChunk:        buf[:n],
-		// 		ChunkID:          chunk.ChunkID,
-		// 		BlockSize:        uint64(blockSize),
-		// 		FileMode:         uint32(fileStat.Mode()),
-		// 		FileSize:         uint64(fileStat.Size()),
-		// 		Length:           uint64(blockSize),
-		// 		UID:              uint32(fileStat.Sys().(*syscall.Stat_t).Uid),
-		// 		GID:              uint32(fileStat.Sys().(*syscall.Stat_t).Gid),
-		// 		RelativeFilePath: file,
-		// 	},
-		// ); err != nil {
-		// 	fopslogger.Error().Err(err).Msg("Failed to replicate chunk")
-		// 	return err
-		// } else if confirmation.Code != replicator.ConfirmationCode_OK {
-		// 	fopslogger.Error().Msgf("Replication failed with code: %s", confirmation.Code)
-		// }
-		fopslogger.Info().Msgf("Chunk %d replicated successfully", chunk.ChunkID)
+	commit := proto.Clone(version).(*replicator.FileVersion)
+	commit.FileHash = fileHash.Sum64()
+	commit.Digest = digest.Sum(nil)
+	commit.DigestAlgorithm = algorithm
+	f.transferQueue.Push(&TransferItem{Op: OpCommit, Version: commit})
+	return nil
+}
+
+// resendFile queues every chunk of the file, for when the version did not
+// assemble to the content of the sender on the receiver: either the chunks
+// diffed against the receiver or the file changing while it was read. It
+// reports false once the file was resent maxAttempts times without a match.
+func (f *FileReplicator) resendFile(version *replicator.FileVersion) (bool, error) {
+	if version.BlockSize == 0 {
+		return false, nil
+	}
+	if f.state.resent(version.RelativeFilePath) > maxAttempts {
+		fopslogger.Error().Msgf("%s still does not match on the reciever after %d resends", version.RelativeFilePath, maxAttempts)
+		return false, nil
 	}
-	// } else {
-	// 	log.Info().Msg("No chunks to replicate, processing ownership/access change.")
-	// }
 
+	stat, err := os.Stat(path.Join(f.FileRoot, version.RelativeFilePath))
+	if err != nil {
+		return false, err
+	}
+	chunks := make([]*replicator.ChunkInfo, 0, (uint64(stat.Size())+version.BlockSize-1)/version.BlockSize)
+	for chunkID := uint64(0); chunkID*version.BlockSize < uint64(stat.Size()); chunkID++ {
+		chunks = append(chunks, &replicator.ChunkInfo{ChunkID: chunkID})
+	}
+	fopslogger.Warn().Msgf("Resending all %d chunks of %s", len(chunks), version.RelativeFilePath)
+	return true, f.queueChunks(version.RelativeFilePath, version.BlockSize, chunks)
+}
+
+func (f *FileReplicator) ownershipPayload(relativePath string) (*replicator.DataPayload, error) {
+	stat, err := os.Stat(path.Join(f.FileRoot, relativePath))
+	if err != nil {
+		fopslogger.Error().Err(err).Msgf("Failed to stat file root: %s", relativePath)
+		return nil, err
+	}
+
+	return &replicator.DataPayload{
+		DataChunk:        nil,
+		FileMode:         uint32(stat.Mode()),
+		FileSize:         uint64(stat.Size()),
+		UID:              uint32(stat.Sys().(*syscall.Stat_t).Uid),
+		GID:              uint32(stat.Sys().(*syscall.Stat_t).Gid),
+		RelativeFilePath: relativePath,
+	}, nil
+}
+
+// QueueOwnership schedules a mode/ownership update through the transfer queue.
+func (f *FileReplicator) QueueOwnership(relativePath string) error {
+	payload, err := f.ownershipPayload(relativePath)
+	if err != nil {
+		return err
+	}
+	f.transferQueue.Push(&TransferItem{Op: OpMetadata, Payload: payload})
 	return nil
 }
 
+// QueueRename schedules a rename. Sealed files are bound to their path, so
+// they are archived under the old name and sent again under the new one.
+func (f *FileReplicator) QueueRename(relativePath string, newRelativePath string) {
+	if cipher := f.ReplicatorClient.Cipher(); cipher != nil {
+		f.QueueDelete(relativePath)
+		f.processFileOrDefer(newRelativePath, cipher.BlockSize(), true)
+		return
+	}
+	f.transferQueue.Push(&TransferItem{Op: OpRename, Path: relativePath, NewPath: newRelativePath})
+}
+
+func (f *FileReplicator) QueueDelete(relativePath string) {
+	if f.Versions != nil {
+		if version, ok := f.Versions.Get(relativePath); ok && version.Deleted {
+			fopslogger.Info().Msgf("%s was deleted by the peer, skipping", relativePath)
+			return
+		}
+	}
+	f.transferQueue.Push(&TransferItem{Op: OpDelete, Path: relativePath})
+}
+
 func (f *FileReplicator) UpdateOwnership(relativePath string) error {
 	// define the context with a timeout
 	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancelFunc()
 
-	stat, err := os.Stat(path.Join(f.FileRoot, relativePath))
+	payload, err := f.ownershipPayload(relativePath)
 	if err != nil {
-		fopslogger.Error().Err(err).Msgf("Failed to stat file root: %s", relativePath)
 		return err
 	}
 
-	mode := stat.Mode()
-	UID := uint32(stat.Sys().(*syscall.Stat_t).Uid)
-	GID := uint32(stat.Sys().(*syscall.Stat_t).Gid)
-
 	if confirmation, err := f.ReplicatorClient.ReplicateChunk(
 		ctx,
-		&replicator.DataPayload{
-			DataChunk:        nil,
-			FileMode:         uint32(mode),
-			UID:              UID,
-			GID:              GID,
-			RelativeFilePath: relativePath,
-		},
+		payload,
 	); err != nil {
 		fopslogger.Error().Err(err).Msg("Failed to replicate ownership change")
 		return err
@@ -171,6 +332,10 @@ func (f *FileReplicator) DeleteFile(relativePath string) error {
 	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancelFunc()
 
+	if f.Versions != nil {
+		return f.deleteVersion(ctx, relativePath)
+	}
+
 	if confirmation, err := f.ReplicatorClient.DeleteFile(
 		ctx,
 		relativePath,
@@ -183,3 +348,32 @@ func (f *FileReplicator) DeleteFile(relativePath string) error {
 	}
 	return nil
 }
+
+func (f *FileReplicator) deleteVersion(ctx context.Context, relativePath string) error {
+	vector, changed := f.Versions.LocalDelete(relativePath)
+	if !changed {
+		return nil
+	}
+
+	confirmation, err := f.ReplicatorClient.FileReplicatorClient.Delete(
+		ctx,
+		&replicator.FileOps{
+			RelativeFilePath: f.ReplicatorClient.SealPath(relativePath),
+			VersionVector:    vector,
+			SiteID:           f.Versions.SiteID,
+		},
+	)
+	if err != nil {
+		fopslogger.Error().Err(err).Msg("Failed to delete file")
+		return err
+	}
+	switch confirmation.Code {
+	case replicator.ConfirmationCode_OK, replicator.ConfirmationCode_FILE_NOT_FOUND:
+		return nil
+	case replicator.ConfirmationCode_CONFLICT:
+		fopslogger.Warn().Msgf("Reciever kept %s, it was changed there", relativePath)
+		return nil
+	}
+	fopslogger.Error().Msgf("Delete failed with code: %s", confirmation.Code)
+	return errors.New("delete failed")
+}
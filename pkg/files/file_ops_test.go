@@ -4,10 +4,12 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/kosalaat/file-replicator/pkg/client"
 	"github.com/kosalaat/file-replicator/pkg/server"
 	"github.com/kosalaat/file-replicator/replicator"
@@ -74,34 +76,19 @@ func TestFileReplicator_ProcessFile(t *testing.T) {
 	fileReplicator := &FileReplicator{
 		ReplicatorClient: *replicatorClient,
 	}
-	fileReplicator.transferQueue = make(chan *replicator.DataPayload, 100)
-
-	go func(transferQueue chan *replicator.DataPayload) {
-		var dataPayload *replicator.DataPayload
-		ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancelFunc()
-
-		for {
-			select {
-			case dataPayload = <-transferQueue:
-				if _, err := fileReplicator.ReplicatorClient.ReplicateChunk(ctx, dataPayload); err != nil {
-					fnotifylogger.Error().Err(err).Msgf("Failed to replicate chunk: %d", dataPayload.ChunkID)
-				} else {
-					fnotifylogger.Info().Msgf("Successfully replicated chunk: %d", dataPayload.ChunkID)
-				}
-				// Handle value from ch1
-			default:
-				time.Sleep(100 * time.Millisecond)
-			}
-		}
-	}(fileReplicator.transferQueue)
+	fileReplicator.transferQueue = NewTransferQueue(nil, nil)
+	defer fileReplicator.transferQueue.Close()
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFunc()
+	go fileReplicator.processTransferQueue(ctx)
 
 	err = fileReplicator.ProcessFile("test.txt", 10)
 	if err != nil {
 		t.Fatalf("ProcessFile failed: %v", err)
 	}
 
-	for len(fileReplicator.transferQueue) > 0 {
+	for !fileReplicator.transferQueue.Idle() {
 		time.Sleep(100 * time.Millisecond)
 	}
 
@@ -157,34 +144,19 @@ func TestFileReplicator_ProcessFileEmptyFile(t *testing.T) {
 	fileReplicator := &FileReplicator{
 		ReplicatorClient: *replicatorClient,
 	}
-	fileReplicator.transferQueue = make(chan *replicator.DataPayload, 100)
-
-	go func(transferQueue chan *replicator.DataPayload) {
-		var dataPayload *replicator.DataPayload
-		ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancelFunc()
-
-		for {
-			select {
-			case dataPayload = <-transferQueue:
-				if _, err := fileReplicator.ReplicatorClient.ReplicateChunk(ctx, dataPayload); err != nil {
-					fnotifylogger.Error().Err(err).Msgf("Failed to replicate chunk: %d", dataPayload.ChunkID)
-				} else {
-					fnotifylogger.Info().Msgf("Successfully replicated chunk: %d", dataPayload.ChunkID)
-				}
-				// Handle value from ch1
-			default:
-				time.Sleep(100 * time.Millisecond)
-			}
-		}
-	}(fileReplicator.transferQueue)
+	fileReplicator.transferQueue = NewTransferQueue(nil, nil)
+	defer fileReplicator.transferQueue.Close()
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFunc()
+	go fileReplicator.processTransferQueue(ctx)
 
 	err = fileReplicator.ProcessFile("test.txt", 10)
 	if err != nil {
 		t.Fatalf("ProcessFile failed: %v", err)
 	}
 
-	for len(fileReplicator.transferQueue) > 0 {
+	for !fileReplicator.transferQueue.Idle() {
 		time.Sleep(100 * time.Millisecond)
 	}
 
@@ -337,10 +309,50 @@ func TestDeleteFile(t *testing.T) {
 	}
 
 	fileReplicator.DeleteFile("first/second/test.txt")
-	if _, err := os.Stat("/tmp/dest/.archive/first/second/test.txt"); err != nil {
-		t.Fatalf("Failed to find archived file in destination: %v", err)
+	if versions, err := filepath.Glob("/tmp/dest/.archive/first/second/test.txt~*"); len(versions) != 1 {
+		t.Fatalf("Failed to find archived file in destination: %v, %v", versions, err)
 	} else {
 		t.Logf("Deleted file exist in archive destination")
 	}
 	server.StopListening()
 }
+
+func TestResendFile_WholeFile(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "test.txt"), []byte("abc1def2ghi3"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileReplicator := &FileReplicator{Staged: true}
+	fileReplicator.FileRoot = src
+	fileReplicator.transferQueue = NewTransferQueue(nil, nil)
+	defer fileReplicator.transferQueue.Close()
+
+	// the mismatching version already held every chunk
+	version := &replicator.FileVersion{RelativeFilePath: "test.txt", FileSize: 12, BlockSize: 4, Chunks: []uint64{0, 1, 2}}
+	if resent, err := fileReplicator.resendFile(version); err != nil || !resent {
+		t.Fatalf("Expected the whole file to be resent, got %v, %v", resent, err)
+	}
+	ops := make([]Operation, 0)
+	var commit *replicator.FileVersion
+	for stats := fileReplicator.transferQueue.Stats(); stats.Items > 0; stats = fileReplicator.transferQueue.Stats() {
+		item, _ := fileReplicator.transferQueue.Pop()
+		fileReplicator.transferQueue.Done()
+		ops = append(ops, item.Op)
+		if item.Op == OpCommit {
+			commit = item.Version
+		}
+	}
+	if len(ops) != 5 || ops[0] != OpBegin || ops[4] != OpCommit {
+		t.Fatalf("Expected a begin, 3 chunks and a commit, got %v", ops)
+	}
+	if commit.FileHash != xxhash.Sum64String("abc1def2ghi3") || len(commit.Digest) == 0 {
+		t.Errorf("Expected the commit to carry the hashes of the read, got %x, %x", commit.FileHash, commit.Digest)
+	}
+
+	for attempt := 2; attempt <= maxAttempts; attempt++ {
+		fileReplicator.resendFile(version)
+	}
+	if resent, _ := fileReplicator.resendFile(version); resent {
+		t.Errorf("Expected the resends to stop after %d attempts", maxAttempts)
+	}
+}
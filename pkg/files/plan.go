@@ -0,0 +1,202 @@
+package files
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/controller"
+	"github.com/kosalaat/file-replicator/replicator"
+)
+
+type PlanAction string
+
+const (
+	PlanCreate    PlanAction = "create"
+	PlanUpdate    PlanAction = "update"
+	PlanArchive   PlanAction = "archive"
+	PlanUnchanged PlanAction = "unchanged"
+)
+
+// PlanEntry is what replicating a single file would do to the reciever.
+type PlanEntry struct {
+	Path          string     `json:"path"`
+	Action        PlanAction `json:"action"`
+	ChangedBlocks int        `json:"changed_blocks,omitempty"`
+	TotalBlocks   int        `json:"total_blocks,omitempty"`
+	Bytes         uint64     `json:"bytes,omitempty"`
+	Metadata      bool       `json:"metadata,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+type PlanSummary struct {
+	Create    int    `json:"create"`
+	Update    int    `json:"update"`
+	Archive   int    `json:"archive"`
+	Unchanged int    `json:"unchanged"`
+	Errors    int    `json:"errors"`
+	Bytes     uint64 `json:"bytes"`
+}
+
+// Plan is the outcome of a dry run against one reciever.
+type Plan struct {
+	Target  string      `json:"target"`
+	Files   []PlanEntry `json:"files"`
+	Summary PlanSummary `json:"summary"`
+}
+
+// BuildPlan walks the file root and compares every file with the reciever the
+// same way the sender does, without replicating, renaming or deleting
+// anything. Files only the reciever holds would be archived.
+func (f *FileReplicator) BuildPlan(ctx context.Context, blockSize uint64) (*Plan, error) {
+	plan := &Plan{Target: f.TargetName(), Files: make([]PlanEntry, 0)}
+	err := f.compare(ctx, blockSize, func(entry PlanEntry, _ []*replicator.ChunkInfo) {
+		plan.add(entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(plan.Files, func(i, j int) bool {
+		return plan.Files[i].Path < plan.Files[j].Path
+	})
+	return plan, nil
+}
+
+// compare calls visit with the plan entry and the changed chunks of every file
+// under the file root, then with the files only the reciever holds.
+func (f *FileReplicator) compare(ctx context.Context, blockSize uint64, visit func(PlanEntry, []*replicator.ChunkInfo)) error {
+	remoteFiles, err := f.ReplicatorClient.ListFiles(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = filepath.Walk(
+		f.FileRoot,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || controller.IsStagingFile(path) {
+				return nil
+			}
+			referencePath, _ := filepath.Rel(f.FileRoot, path)
+			remoteFile := remoteFiles[referencePath]
+			delete(remoteFiles, referencePath)
+
+			visit(f.planFile(ctx, referencePath, blockSize, remoteFile))
+			return ctx.Err()
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	for referencePath := range remoteFiles {
+		visit(PlanEntry{Path: referencePath, Action: PlanArchive}, nil)
+	}
+	return nil
+}
+
+func (f *FileReplicator) planFile(ctx context.Context, file string, blockSize uint64, remoteFile *replicator.FileInfo) (PlanEntry, []*replicator.ChunkInfo) {
+	entry := PlanEntry{Path: file}
+
+	signature, err := f.ReplicatorClient.BuildSignature(file, blockSize)
+	if err != nil {
+		entry.Error = err.Error()
+		return entry, nil
+	}
+	entry.TotalBlocks = len(signature.Chunk)
+
+	if remoteFile == nil {
+		entry.Action = PlanCreate
+		entry.ChangedBlocks = entry.TotalBlocks
+		entry.Bytes = signature.FileSize
+		return entry, signature.Chunk
+	}
+
+	checkCtx, cancelFunc := context.WithTimeout(ctx, 10*time.Second)
+	defer cancelFunc()
+	change, err := f.ReplicatorClient.CheckSignature(checkCtx, signature)
+	if err != nil {
+		entry.Error = err.Error()
+		return entry, nil
+	}
+
+	entry.ChangedBlocks = len(change.Chunk)
+	for _, chunk := range change.Chunk {
+		entry.Bytes += chunk.BlockSize
+	}
+	entry.Metadata = os.FileMode(remoteFile.FileMode).Perm() != os.FileMode(signature.FileMode).Perm()
+
+	if entry.ChangedBlocks > 0 || entry.Metadata || remoteFile.FileSize != signature.FileSize {
+		entry.Action = PlanUpdate
+	} else {
+		entry.Action = PlanUnchanged
+	}
+	return entry, change.Chunk
+}
+
+func (p *Plan) add(entry PlanEntry) {
+	p.Files = append(p.Files, entry)
+	switch {
+	case entry.Error != "":
+		p.Summary.Errors++
+	case entry.Action == PlanCreate:
+		p.Summary.Create++
+	case entry.Action == PlanUpdate:
+		p.Summary.Update++
+	case entry.Action == PlanArchive:
+		p.Summary.Archive++
+	case entry.Action == PlanUnchanged:
+		p.Summary.Unchanged++
+	}
+	p.Summary.Bytes += entry.Bytes
+}
+
+// WriteText prints the plan one file per line, followed by a summary.
+// Unchanged files are only listed when verbose is set.
+func (p *Plan) WriteText(w io.Writer, verbose bool) error {
+	if _, err := fmt.Fprintf(w, "Plan for %s:\n", p.Target); err != nil {
+		return err
+	}
+	for _, entry := range p.Files {
+		var line string
+		switch {
+		case entry.Error != "":
+			line = fmt.Sprintf("  error     %s: %s", entry.Path, entry.Error)
+		case entry.Action == PlanCreate:
+			line = fmt.Sprintf("  create    %s (%d blocks, %d bytes)", entry.Path, entry.ChangedBlocks, entry.Bytes)
+		case entry.Action == PlanUpdate:
+			line = fmt.Sprintf("  update    %s (%d/%d blocks, %d bytes)", entry.Path, entry.ChangedBlocks, entry.TotalBlocks, entry.Bytes)
+			if entry.Metadata {
+				line += " +metadata"
+			}
+		case entry.Action == PlanArchive:
+			line = fmt.Sprintf("  archive   %s", entry.Path)
+		case verbose:
+			line = fmt.Sprintf("  unchanged %s", entry.Path)
+		default:
+			continue
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d to create, %d to update, %d to archive, %d unchanged, %d errors, %d bytes to send\n",
+		p.Summary.Create, p.Summary.Update, p.Summary.Archive, p.Summary.Unchanged, p.Summary.Errors, p.Summary.Bytes)
+	return err
+}
+
+func (p *Plan) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(p)
+}
+
+func WritePlansJSON(w io.Writer, plans []*Plan) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(plans)
+}
@@ -0,0 +1,111 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/pkg/server"
+	"github.com/phayes/freeport"
+)
+
+func TestBuildPlan(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+
+	srcFiles := map[string]string{
+		"new.txt":           "abc1def2",
+		"changed.txt":       "abc1XXXXghi3",
+		"same.txt":          "abc1def2",
+		"dir/truncated.txt": "abc1",
+	}
+	destFiles := map[string]string{
+		"changed.txt":       "abc1def2ghi3",
+		"same.txt":          "abc1def2",
+		"dir/truncated.txt": "abc1def2",
+		"gone.txt":          "abc1",
+		".archive/old.txt":  "abc1",
+	}
+	for root, rootFiles := range map[string]map[string]string{src: srcFiles, dest: destFiles} {
+		for name, content := range rootFiles {
+			os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755)
+			if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+				t.Fatalf("Failed to create file: %v", err)
+			}
+		}
+	}
+
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	server := server.NewReplicationServer()
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	go func() {
+		server.StartListening(address, dest)
+	}()
+	defer server.StopListening()
+
+	replicationClient, err := client.NewReplicatorClient(address, src, 10)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	fileReplicator := &FileReplicator{ReplicatorClient: *replicationClient, Name: "dr"}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFunc()
+	plan, err := fileReplicator.BuildPlan(ctx, 4)
+	if err != nil {
+		t.Fatalf("Failed to build plan: %v", err)
+	}
+
+	expected := []PlanEntry{
+		{Path: "changed.txt", Action: PlanUpdate, ChangedBlocks: 1, TotalBlocks: 3, Bytes: 4},
+		{Path: "dir/truncated.txt", Action: PlanUpdate, TotalBlocks: 1},
+		{Path: "gone.txt", Action: PlanArchive},
+		{Path: "new.txt", Action: PlanCreate, ChangedBlocks: 2, TotalBlocks: 2, Bytes: 8},
+		{Path: "same.txt", Action: PlanUnchanged, TotalBlocks: 2},
+	}
+	if len(plan.Files) != len(expected) {
+		t.Fatalf("Expected %d entries, got %+v", len(expected), plan.Files)
+	}
+	for i, entry := range plan.Files {
+		if entry != expected[i] {
+			t.Errorf("Entry %d: expected %+v, got %+v", i, expected[i], entry)
+		}
+	}
+	if summary := plan.Summary; summary.Create != 1 || summary.Update != 2 || summary.Archive != 1 || summary.Unchanged != 1 || summary.Bytes != 12 {
+		t.Errorf("Unexpected summary: %+v", summary)
+	}
+
+	// nothing was replicated
+	if content, _ := os.ReadFile(filepath.Join(dest, "changed.txt")); string(content) != "abc1def2ghi3" {
+		t.Errorf("Dry run changed the reciever: %s", content)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "new.txt")); !os.IsNotExist(err) {
+		t.Errorf("Dry run created a file on the reciever")
+	}
+
+	var output bytes.Buffer
+	if err := plan.WriteJSON(&output); err != nil {
+		t.Fatalf("Failed to write JSON: %v", err)
+	}
+	var decoded Plan
+	if err := json.Unmarshal(output.Bytes(), &decoded); err != nil || decoded.Summary != plan.Summary {
+		t.Errorf("JSON plan does not round trip: %v, %+v", err, decoded.Summary)
+	}
+
+	output.Reset()
+	if err := plan.WriteText(&output, false); err != nil {
+		t.Fatalf("Failed to write text: %v", err)
+	}
+	if text := output.String(); !bytes.Contains(output.Bytes(), []byte("update    changed.txt (1/3 blocks, 4 bytes)")) || bytes.Contains(output.Bytes(), []byte("same.txt")) {
+		t.Errorf("Unexpected text plan:\n%s", text)
+	}
+}
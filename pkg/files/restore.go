@@ -0,0 +1,227 @@
+package files
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kosalaat/file-replicator/pkg/controller"
+	"github.com/kosalaat/file-replicator/replicator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type RestoreOptions struct {
+	// Paths are the files or subtrees to restore, everything when empty.
+	Paths []string
+	// Archive restores from the reciever's archive instead of its live copy.
+	Archive bool
+	// Version picks an archived version, the latest one when empty.
+	Version   string
+	BlockSize uint64
+}
+
+type RestoreSummary struct {
+	Target    string   `json:"target"`
+	Restored  int      `json:"restored"`
+	Unchanged int      `json:"unchanged"`
+	Chunks    uint64   `json:"chunks"`
+	Bytes     uint64   `json:"bytes"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+// Restore pulls files back from the reciever into the file root. Files that
+// already exist locally are patched, only the blocks that differ are
+// transferred, and the mode and ownership recorded on the reciever are applied.
+func (f *FileReplicator) Restore(ctx context.Context, options RestoreOptions) (*RestoreSummary, error) {
+	summary := &RestoreSummary{Target: f.TargetName()}
+
+	paths := options.Paths
+	if len(paths) == 0 {
+		paths = []string{""}
+	}
+
+	var files []string
+	for _, relativePath := range paths {
+		remoteFiles, err := f.ReplicatorClient.ListTree(ctx, relativePath, options.Archive)
+		if err != nil {
+			return nil, err
+		}
+		if len(remoteFiles) == 0 {
+			summary.Errors = append(summary.Errors, fmt.Sprintf("%s: not found on the reciever", relativePath))
+		}
+		for file := range remoteFiles {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		restored, chunks, bytes, err := f.restoreFile(ctx, file, options)
+		if err != nil {
+			fopslogger.Error().Err(err).Msgf("Failed to restore %s", file)
+			summary.Errors = append(summary.Errors, fmt.Sprintf("%s: %v", file, err))
+			continue
+		}
+		if restored {
+			summary.Restored++
+		} else {
+			summary.Unchanged++
+		}
+		summary.Chunks += chunks
+		summary.Bytes += bytes
+	}
+	return summary, nil
+}
+
+// restoreFile returns whether the local copy had to be created or patched,
+// along with the chunks and bytes transferred. Sealed files are read in sealed
+// blocks and opened before they are written.
+func (f *FileReplicator) restoreFile(ctx context.Context, file string, options RestoreOptions) (bool, uint64, uint64, error) {
+	localName, err := restoreName(file)
+	if err != nil {
+		return false, 0, 0, err
+	}
+	cipher := f.ReplicatorClient.Cipher()
+
+	request := &replicator.ReadRequest{
+		BlockSize: options.BlockSize,
+		Archive:   options.Archive,
+		Version:   options.Version,
+	}
+	if cipher != nil {
+		request.BlockSize = cipher.SealedBlockSize()
+	}
+	signature, err := f.ReplicatorClient.BuildSignature(file, options.BlockSize)
+	if err == nil {
+		request.Have = signature.Chunk
+	} else if !os.IsNotExist(err) {
+		return false, 0, 0, err
+	}
+
+	// files archived before a key rotation keep the names of the older key
+	var stream replicator.FileReplicator_ReadClient
+	var payload *replicator.DataPayload
+	var received error
+	for _, sealedPath := range f.ReplicatorClient.SealedPaths(file) {
+		request.RelativeFilePath = sealedPath
+		if stream, err = f.ReplicatorClient.FileReplicatorClient.Read(ctx, request); err != nil {
+			return false, 0, 0, err
+		}
+		if payload, received = stream.Recv(); status.Code(received) != codes.NotFound {
+			break
+		}
+	}
+
+	var outFile *os.File
+	var chunks, bytes uint64
+	for ; ; payload, received = stream.Recv() {
+		if received == io.EOF {
+			return false, 0, 0, fmt.Errorf("reciever ended the stream without the file metadata")
+		} else if received != nil {
+			return false, 0, 0, received
+		}
+		if outFile == nil {
+			// nothing is created for a file the reciever does not send
+			if outFile, err = f.openRestored(localName); err != nil {
+				return false, 0, 0, err
+			}
+			defer outFile.Close()
+		}
+
+		if payload.DataChunk != nil {
+			data, offset := payload.DataChunk, payload.ChunkID*payload.BlockSize
+			if cipher != nil {
+				if data, err = cipher.Open(file, payload.ChunkID, payload.DataChunk); err != nil {
+					return false, 0, 0, fmt.Errorf("chunk %d: %w", payload.ChunkID, err)
+				}
+				offset = payload.ChunkID * cipher.BlockSize()
+			}
+			if _, err := outFile.WriteAt(data, int64(offset)); err != nil {
+				return false, 0, 0, err
+			}
+			chunks++
+			bytes += uint64(len(payload.DataChunk))
+			continue
+		}
+
+		// the payload without data is the last one
+		fileSize := payload.FileSize
+		if cipher != nil {
+			fileSize = cipher.PlainSize(payload.FileSize)
+		}
+		if err := outFile.Truncate(int64(fileSize)); err != nil {
+			return false, 0, 0, err
+		}
+		if err := outFile.Chmod(os.FileMode(payload.FileMode).Perm()); err != nil {
+			return false, 0, 0, err
+		}
+		if err := outFile.Chown(int(payload.UID), int(payload.GID)); err != nil {
+			fopslogger.Warn().Err(err).Msgf("Failed to restore ownership %d:%d of %s", payload.UID, payload.GID, file)
+		}
+		fopslogger.Info().Msgf("Restored %s, %d chunks", file, chunks)
+		restored := signature == nil || chunks > 0 || signature.FileSize != payload.FileSize ||
+			os.FileMode(signature.FileMode).Perm() != os.FileMode(payload.FileMode).Perm()
+		return restored, chunks, bytes, nil
+	}
+}
+
+// restoreName checks a name the reciever listed before it is written below the
+// file root. Absolute names and names climbing out of their folder are refused,
+// the reciever is not trusted with the paths of the sender.
+func restoreName(file string) (string, error) {
+	if strings.ContainsRune(file, 0) || filepath.IsAbs(file) || path.IsAbs(file) {
+		return "", fmt.Errorf("the reciever listed %q, which is not a relative path", file)
+	}
+	for _, component := range strings.Split(filepath.ToSlash(file), "/") {
+		if component == ".." {
+			return "", fmt.Errorf("the reciever listed %q, which climbs out of the file root", file)
+		}
+	}
+	localName := filepath.Clean(file)
+	if localName == "." {
+		return "", fmt.Errorf("the reciever listed %q, which is the file root", file)
+	}
+	return localName, nil
+}
+
+// openRestored opens a restored file below the file root, creating it and its
+// folders through the root, which refuses to follow a symlink out of it.
+func (f *FileReplicator) openRestored(localName string) (*os.File, error) {
+	if err := os.MkdirAll(f.FileRoot, 0750); err != nil {
+		return nil, err
+	}
+	root, err := os.OpenRoot(f.FileRoot)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	if err := controller.MkdirAllInRoot(root, filepath.Dir(localName), 0750); err != nil {
+		return nil, err
+	}
+	return root.OpenFile(localName, os.O_WRONLY|os.O_CREATE, 0600)
+}
+
+func (s *RestoreSummary) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "Restore from %s: %d restored, %d unchanged, %d chunks, %d bytes\n",
+		s.Target, s.Restored, s.Unchanged, s.Chunks, s.Bytes)
+	for _, restoreError := range s.Errors {
+		fmt.Fprintf(w, "  error %s\n", restoreError)
+	}
+	return nil
+}
+
+func (s *RestoreSummary) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(s)
+}
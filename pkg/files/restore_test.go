@@ -0,0 +1,174 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/pkg/server"
+	"github.com/kosalaat/file-replicator/replicator"
+	"github.com/phayes/freeport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRestore(t *testing.T) {
+	dest := t.TempDir()
+	restoreRoot := t.TempDir()
+
+	for name, content := range map[string]string{
+		"new.txt":           "abc1def2g",
+		"dir/patched.txt":   "abc1def2ghi3",
+		"dir/truncated.txt": "abc1",
+		"other/skip.txt":    "abc1",
+		".archive/old.txt~20250101T000000.000000000Z": "old1",
+		".archive/old.txt~20250102T000000.000000000Z": "old2",
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(dest, name)), 0755)
+		if err := os.WriteFile(filepath.Join(dest, name), []byte(content), 0640); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+	os.MkdirAll(filepath.Join(restoreRoot, "dir"), 0755)
+	os.WriteFile(filepath.Join(restoreRoot, "dir/patched.txt"), []byte("abc1XXXXghi3"), 0644)
+	os.WriteFile(filepath.Join(restoreRoot, "dir/truncated.txt"), []byte("abc1def2"), 0644)
+
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	server := server.NewReplicationServer()
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	go func() {
+		server.StartListening(address, dest)
+	}()
+	defer server.StopListening()
+
+	replicationClient, err := client.NewReplicatorClient(address, restoreRoot, 10)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	fileReplicator := &FileReplicator{ReplicatorClient: *replicationClient}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFunc()
+
+	summary, err := fileReplicator.Restore(ctx, RestoreOptions{Paths: []string{"dir", "new.txt"}, BlockSize: 4})
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	// 3 blocks of new.txt and the changed block of patched.txt
+	if summary.Restored != 3 || summary.Chunks != 4 || len(summary.Errors) != 0 {
+		t.Fatalf("Unexpected summary: %+v", summary)
+	}
+	for name, expected := range map[string]string{
+		"new.txt":           "abc1def2g",
+		"dir/patched.txt":   "abc1def2ghi3",
+		"dir/truncated.txt": "abc1",
+	} {
+		content, err := os.ReadFile(filepath.Join(restoreRoot, name))
+		if err != nil || string(content) != expected {
+			t.Errorf("%s: expected %q, got %q, %v", name, expected, content, err)
+		}
+		if stat, _ := os.Stat(filepath.Join(restoreRoot, name)); stat.Mode().Perm() != 0640 {
+			t.Errorf("%s: expected mode 0640, got %v", name, stat.Mode().Perm())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(restoreRoot, "other")); !os.IsNotExist(err) {
+		t.Errorf("Only the requested paths should be restored")
+	}
+
+	summary, err = fileReplicator.Restore(ctx, RestoreOptions{Paths: []string{"old.txt"}, Archive: true, BlockSize: 4})
+	if err != nil || summary.Restored != 1 {
+		t.Fatalf("Failed to restore from the archive: %+v, %v", summary, err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(restoreRoot, "old.txt")); string(content) != "old2" {
+		t.Errorf("Expected the latest archived version, got %q", content)
+	}
+	summary, err = fileReplicator.Restore(ctx, RestoreOptions{Paths: []string{"old.txt"}, Archive: true, Version: "20250101T000000.000000000Z", BlockSize: 4})
+	if err != nil || summary.Restored != 1 {
+		t.Fatalf("Failed to restore an archived version: %+v, %v", summary, err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(restoreRoot, "old.txt")); string(content) != "old1" {
+		t.Errorf("Expected the requested archived version, got %q", content)
+	}
+
+	summary, err = fileReplicator.Restore(ctx, RestoreOptions{Paths: []string{"../etc"}, BlockSize: 4})
+	if err == nil {
+		t.Fatalf("Expected paths outside the file root to be refused: %+v", summary)
+	}
+}
+
+// hostileReciever lists names out of the file root and sends data for any of
+// them, or nothing for the missing one.
+type hostileReciever struct {
+	replicator.UnimplementedFileReplicatorServer
+	names []string
+}
+
+func (r *hostileReciever) List(in *replicator.ListRequest, stream replicator.FileReplicator_ListServer) error {
+	for _, name := range r.names {
+		if err := stream.Send(&replicator.FileInfo{RelativeFilePath: name, FileSize: 4}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *hostileReciever) Read(in *replicator.ReadRequest, stream replicator.FileReplicator_ReadServer) error {
+	if in.RelativeFilePath == "missing" {
+		return status.Errorf(codes.NotFound, "%s does not exist", in.RelativeFilePath)
+	}
+	if err := stream.Send(&replicator.DataPayload{RelativeFilePath: in.RelativeFilePath, BlockSize: 4, DataChunk: []byte("evil")}); err != nil {
+		return err
+	}
+	return stream.Send(&replicator.DataPayload{RelativeFilePath: in.RelativeFilePath, BlockSize: 4, FileSize: 4, FileMode: 0644})
+}
+
+func TestRestore_HostileReciever(t *testing.T) {
+	outside := t.TempDir()
+	restoreRoot := t.TempDir()
+	os.Symlink(outside, filepath.Join(restoreRoot, "link"))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	replicator.RegisterFileReplicatorServer(grpcServer, &hostileReciever{names: []string{
+		"../" + filepath.Base(outside) + "/escaped",
+		filepath.Join(outside, "absolute"),
+		"link/planted",
+		"missing",
+	}})
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	replicationClient, err := client.NewReplicatorClient(listener.Addr().String(), restoreRoot, 10)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	fileReplicator := &FileReplicator{ReplicatorClient: *replicationClient}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFunc()
+
+	summary, err := fileReplicator.Restore(ctx, RestoreOptions{BlockSize: 4})
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if summary.Restored != 0 || len(summary.Errors) != 4 {
+		t.Errorf("Expected every name to be refused: %+v", summary)
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("Expected nothing written outside the file root, got %v", entries)
+	}
+	if _, err := os.Lstat(filepath.Join(restoreRoot, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Expected no file left behind for a failed lookup: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/replicator"
+)
+
+// SyncResult is the outcome of a one-shot reconciliation.
+type SyncResult int
+
+const (
+	InSync SyncResult = iota
+	ChangesApplied
+	SyncFailed
+)
+
+func (r SyncResult) String() string {
+	switch r {
+	case InSync:
+		return "in-sync"
+	case ChangesApplied:
+		return "changes-applied"
+	}
+	return "failed"
+}
+
+type SyncSummary struct {
+	Target          string   `json:"target"`
+	Result          string   `json:"result"`
+	Created         int      `json:"created"`
+	Updated         int      `json:"updated"`
+	Archived        int      `json:"archived"`
+	Unchanged       int      `json:"unchanged"`
+	Chunks          uint64   `json:"chunks"`
+	Bytes           uint64   `json:"bytes"`
+	Errors          []string `json:"errors,omitempty"`
+	DurationSeconds float64  `json:"duration_seconds"`
+	// Snapshot is the reciever snapshot taken after the sync, if requested.
+	Snapshot string `json:"snapshot,omitempty"`
+	// Compression is the ratio the chunk data was compressed at, if it was.
+	Compression *client.CompressionStats `json:"compression,omitempty"`
+}
+
+func (s *SyncSummary) SyncResult() SyncResult {
+	switch {
+	case len(s.Errors) > 0:
+		return SyncFailed
+	case s.Created+s.Updated+s.Archived > 0:
+		return ChangesApplied
+	}
+	return InSync
+}
+
+// Sync reconciles the reciever with fileRoot once: it creates and updates the
+// files that differ, archives the ones only the reciever holds and returns
+// after every queued item was acknowledged or given up on.
+func (f *FileReplicator) Sync(ctx context.Context, fileRoot string, blockSize uint64) (*SyncSummary, error) {
+	started := time.Now()
+	summary := &SyncSummary{Target: f.TargetName()}
+
+	f.FileRoot = fileRoot
+	f.transferQueue = NewTransferQueue(f.PriorityClasses, f.PriorityRules)
+	defer f.transferQueue.Close()
+	go f.processTransferQueue(ctx)
+
+	if _, err := f.ReplicatorClient.MigrateNames(ctx); err != nil {
+		return nil, err
+	}
+	err := f.compare(ctx, blockSize, func(entry PlanEntry, chunks []*replicator.ChunkInfo) {
+		if entry.Error != "" {
+			summary.Errors = append(summary.Errors, fmt.Sprintf("%s: %s", entry.Path, entry.Error))
+			return
+		}
+
+		switch entry.Action {
+		case PlanUnchanged:
+			summary.Unchanged++
+			return
+		case PlanArchive:
+			summary.Archived++
+			f.QueueDelete(entry.Path)
+			return
+		case PlanCreate:
+			summary.Created++
+		case PlanUpdate:
+			summary.Updated++
+		}
+
+		if err := f.queueChunks(entry.Path, blockSize, chunks); err != nil {
+			summary.Errors = append(summary.Errors, fmt.Sprintf("%s: %v", entry.Path, err))
+			return
+		}
+		// empty files, truncation and mode changes are only carried by the
+		// metadata update
+		if len(chunks) == 0 || entry.Metadata {
+			if err := f.QueueOwnership(entry.Path); err != nil {
+				summary.Errors = append(summary.Errors, fmt.Sprintf("%s: %v", entry.Path, err))
+				return
+			}
+		}
+		summary.Chunks += uint64(len(chunks))
+		summary.Bytes += entry.Bytes
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for !f.transferQueue.Idle() {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	status := f.Status()
+	if status.Dropped > 0 {
+		summary.Errors = append(summary.Errors, fmt.Sprintf("%d transfers failed, last error: %s", status.Dropped, status.LastError))
+	}
+	if status.StorageFull != "" {
+		summary.Errors = append(summary.Errors, fmt.Sprintf("%s is out of storage (%s), %d files are deferred", summary.Target, status.StorageFull, status.DeferredFiles))
+	}
+	summary.Compression = f.ReplicatorClient.CompressionStats()
+	summary.Result = summary.SyncResult().String()
+	summary.DurationSeconds = time.Since(started).Seconds()
+	return summary, nil
+}
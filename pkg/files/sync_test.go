@@ -0,0 +1,399 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/pkg/controller"
+	"github.com/kosalaat/file-replicator/pkg/encryption"
+	"github.com/kosalaat/file-replicator/pkg/server"
+	"github.com/kosalaat/file-replicator/replicator"
+	"github.com/phayes/freeport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSync(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+
+	srcFiles := map[string]string{
+		"new.txt":           "abc1def2g",
+		"empty.txt":         "",
+		"changed.txt":       "abc1XXXXghi3",
+		"dir/truncated.txt": "abc1",
+	}
+	destFiles := map[string]string{
+		"changed.txt":       "abc1def2ghi3",
+		"dir/truncated.txt": "abc1def2",
+		"gone.txt":          "abc1",
+	}
+	for root, rootFiles := range map[string]map[string]string{src: srcFiles, dest: destFiles} {
+		for name, content := range rootFiles {
+			os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755)
+			if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+				t.Fatalf("Failed to create file: %v", err)
+			}
+		}
+	}
+
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	server := server.NewReplicationServer()
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	go func() {
+		server.StartListening(address, dest)
+	}()
+	defer server.StopListening()
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFunc()
+
+	sync := func() *SyncSummary {
+		replicationClient, err := client.NewReplicatorClient(address, src, 10)
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		fileReplicator := &FileReplicator{ReplicatorClient: *replicationClient}
+		summary, err := fileReplicator.Sync(ctx, src, 4)
+		if err != nil {
+			t.Fatalf("Sync failed: %v", err)
+		}
+		return summary
+	}
+
+	summary := sync()
+	if summary.SyncResult() != ChangesApplied || summary.Created != 2 || summary.Updated != 2 || summary.Archived != 1 {
+		t.Fatalf("Unexpected summary: %+v", summary)
+	}
+	for name, expected := range srcFiles {
+		content, err := os.ReadFile(filepath.Join(dest, name))
+		if err != nil || string(content) != expected {
+			t.Errorf("%s: expected %q, got %q, %v", name, expected, content, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dest, "gone.txt")); !os.IsNotExist(err) {
+		t.Errorf("gone.txt should have been archived")
+	}
+
+	if summary := sync(); summary.SyncResult() != InSync || summary.Unchanged != len(srcFiles) {
+		t.Fatalf("Expected the second sync to find nothing to do: %+v", summary)
+	}
+}
+
+func TestSync_Staged(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "changed.txt"), []byte("abc1XXXXghi3"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dest, "changed.txt"), []byte("abc1def2ghi3jkl4"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	server := server.NewReplicationServer()
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	go func() {
+		server.StartListening(address, dest)
+	}()
+	defer server.StopListening()
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFunc()
+
+	replicationClient, err := client.NewReplicatorClient(address, src, 10)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	fileReplicator := &FileReplicator{ReplicatorClient: *replicationClient, Staged: true}
+	summary, err := fileReplicator.Sync(ctx, src, 4)
+	if err != nil || summary.SyncResult() != ChangesApplied {
+		t.Fatalf("Sync failed: %+v, %v", summary, err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dest, "changed.txt"))
+	if err != nil || string(content) != "abc1XXXXghi3" {
+		t.Errorf("Expected the staged version to be committed, got %q, %v", content, err)
+	}
+	entries, _ := os.ReadDir(dest)
+	if len(entries) != 1 {
+		t.Errorf("Expected no staging file to be left, got %v", entries)
+	}
+}
+
+// unstagedReciever is a reciever built before staged versions.
+type unstagedReciever struct {
+	*server.ReplicationServer
+}
+
+func (r *unstagedReciever) Begin(ctx context.Context, in *replicator.FileVersion) (*replicator.Confirmation, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Begin not implemented")
+}
+
+func (r *unstagedReciever) Commit(ctx context.Context, in *replicator.FileVersion) (*replicator.Confirmation, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Commit not implemented")
+}
+
+func (r *unstagedReciever) Abort(ctx context.Context, in *replicator.FileVersion) (*replicator.Confirmation, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Abort not implemented")
+}
+
+func TestSync_UnstagedReciever(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	srcFiles := map[string]string{
+		"changed.txt": "abc1XXXXghi3",
+		"new.txt":     "abc1def2g",
+	}
+	for name, content := range srcFiles {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dest, "changed.txt"), []byte("abc1def2ghi3jkl4"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replicationServer := server.NewReplicationServer()
+	replicationServer.FileRoot = dest
+	grpcServer := grpc.NewServer()
+	replicator.RegisterFileReplicatorServer(grpcServer, &unstagedReciever{replicationServer})
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFunc()
+
+	replicationClient, err := client.NewReplicatorClient(listener.Addr().String(), src, 10)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	fileReplicator := &FileReplicator{ReplicatorClient: *replicationClient, Staged: true}
+	summary, err := fileReplicator.Sync(ctx, src, 4)
+	if err != nil || summary.SyncResult() != ChangesApplied || len(summary.Errors) != 0 {
+		t.Fatalf("Sync failed: %+v, %v", summary, err)
+	}
+	if !fileReplicator.state.stagingUnsupported() {
+		t.Errorf("Expected the target to be remembered as unable to stage")
+	}
+	if status := fileReplicator.Status(); status.Dropped != 0 || status.DeferredFiles != 0 {
+		t.Errorf("Expected the files to be sent directly, not given up on: %+v", status)
+	}
+	for name, expected := range srcFiles {
+		content, err := os.ReadFile(filepath.Join(dest, name))
+		if err != nil || string(content) != expected {
+			t.Errorf("%s: expected %q, got %q, %v", name, expected, content, err)
+		}
+		if stat, _ := os.Stat(filepath.Join(dest, name)); stat.Mode().Perm() != 0640 {
+			t.Errorf("%s: expected mode 0640, got %v", name, stat.Mode().Perm())
+		}
+	}
+}
+
+func TestSync_Compressed(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	logLine := bytes.Repeat([]byte("2025-01-01T00:00:00Z INFO request served\n"), 200)[:8192]
+	if err := os.WriteFile(filepath.Join(src, "app.log"), logLine, 0644); err != nil {
+		t.Fatal(err)
+	}
+	random := make([]byte, 4096)
+	rand.Read(random)
+	if err := os.WriteFile(filepath.Join(src, "random.bin"), random, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	server := server.NewReplicationServer()
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	go func() {
+		server.StartListening(address, dest)
+	}()
+	defer server.StopListening()
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFunc()
+
+	replicationClient, err := client.NewReplicatorClient(address, src, 10, client.WithCompression(controller.CompressionZstd))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := replicationClient.Negotiate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	fileReplicator := &FileReplicator{ReplicatorClient: *replicationClient}
+	summary, err := fileReplicator.Sync(ctx, src, 4096)
+	if err != nil || summary.SyncResult() != ChangesApplied {
+		t.Fatalf("Sync failed: %+v, %v", summary, err)
+	}
+
+	for name, expected := range map[string][]byte{"app.log": logLine, "random.bin": random} {
+		if content, err := os.ReadFile(filepath.Join(dest, name)); err != nil || !bytes.Equal(content, expected) {
+			t.Errorf("Expected %s to be replicated, got %d bytes, %v", name, len(content), err)
+		}
+	}
+	stats := summary.Compression
+	if stats == nil || stats.Compressed != 2 || stats.Skipped != 1 || stats.Ratio <= 1 {
+		t.Errorf("Expected the log to be compressed and the random data sent raw, got %+v", stats)
+	}
+}
+
+func TestSync_Encrypted(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	restoreRoot := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "q3.txt"), []byte("abc1def2ghi3jk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "keys.json")
+	keyring, err := encryption.GenerateKeyring(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := encryption.NewCipher(keyring, 4, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	server := server.NewReplicationServer()
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	go func() {
+		server.StartListening(address, dest)
+	}()
+	defer server.StopListening()
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFunc()
+
+	replicationClient, err := client.NewReplicatorClient(address, src, 10, client.WithCipher(cipher))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	fileReplicator := &FileReplicator{ReplicatorClient: *replicationClient, Staged: true}
+	summary, err := fileReplicator.Sync(ctx, src, 4)
+	if err != nil || summary.SyncResult() != ChangesApplied {
+		t.Fatalf("Sync failed: %+v, %v", summary, err)
+	}
+
+	sealedPath := filepath.Join(dest, cipher.SealPath("q3.txt"))
+	sealed, err := os.ReadFile(sealedPath)
+	if err != nil || uint64(len(sealed)) != cipher.SealedSize(14) || bytes.Contains(sealed, []byte("abc1")) {
+		t.Fatalf("Expected the reciever to hold the sealed file only, got %d bytes, %v", len(sealed), err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "q3.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected the names to be sealed on the reciever")
+	}
+
+	if summary, err := fileReplicator.Sync(ctx, src, 4); err != nil || summary.SyncResult() != InSync {
+		t.Fatalf("Expected the sealed blocks to diff as unchanged: %+v, %v", summary, err)
+	}
+	os.WriteFile(filepath.Join(src, "q3.txt"), []byte("abc1XXXXghi3jk"), 0644)
+	if summary, err := fileReplicator.Sync(ctx, src, 4); err != nil || summary.Updated != 1 || summary.Chunks != 1 {
+		t.Fatalf("Expected only the changed block to be sent: %+v, %v", summary, err)
+	}
+
+	restoreClient, err := client.NewReplicatorClient(address, restoreRoot, 10, client.WithCipher(cipher))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	restorer := &FileReplicator{ReplicatorClient: *restoreClient}
+	restored, err := restorer.Restore(ctx, RestoreOptions{BlockSize: 4})
+	if err != nil || restored.Restored != 1 || len(restored.Errors) != 0 {
+		t.Fatalf("Restore failed: %+v, %v", restored, err)
+	}
+	if content, err := os.ReadFile(filepath.Join(restoreRoot, "q3.txt")); err != nil || string(content) != "abc1XXXXghi3jk" {
+		t.Errorf("Expected the file to be opened on restore, got %q, %v", content, err)
+	}
+
+	if _, err := keyring.Rotate(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := encryption.NewCipher(keyring, 4, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotatedClient, err := client.NewReplicatorClient(address, src, 10, client.WithCipher(rotated))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	rotatedReplicator := &FileReplicator{ReplicatorClient: *rotatedClient, Staged: true}
+	if summary, err := rotatedReplicator.Sync(ctx, src, 4); err != nil || summary.Created != 0 {
+		t.Fatalf("Expected the file to be kept across the rotation: %+v, %v", summary, err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, rotated.SealPath("q3.txt"))); err != nil {
+		t.Errorf("Expected the name to be moved to the current key: %v", err)
+	}
+	if _, err := os.Stat(sealedPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the name under the old key to be gone, got %v", err)
+	}
+}
+
+func TestSync_StorageFull(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "large.txt"), []byte("abc1def2ghi3"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	replicationServer := server.NewReplicationServer()
+	replicationServer.Quota = &server.Quota{MaxBytes: 8}
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	go func() {
+		replicationServer.StartListening(address, dest)
+	}()
+	defer replicationServer.StopListening()
+
+	replicationClient, err := client.NewReplicatorClient(address, src, 10)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	fileReplicator := &FileReplicator{ReplicatorClient: *replicationClient}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+	summary, err := fileReplicator.Sync(ctx, src, 4)
+	if err != nil {
+		t.Fatalf("Expected the sync to finish without retrying the refused file: %v", err)
+	}
+	if len(summary.Errors) == 0 {
+		t.Errorf("Expected the refused file to be reported: %+v", summary)
+	}
+
+	status := fileReplicator.Status()
+	if status.StorageFull != "QUOTA_EXCEEDED" || status.Retries != 0 || status.Dropped != 0 || status.DeferredFiles != 1 {
+		t.Errorf("Expected the file to be deferred, not retried or given up on: %+v", status)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "large.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected the file over the quota not to be written: %v", err)
+	}
+}
@@ -0,0 +1,485 @@
+package files
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/replicator"
+	"github.com/rs/zerolog/log"
+)
+
+var queuelogger = log.With().Str("component", "transfer-queue").Logger()
+
+type Operation int
+
+const (
+	OpData Operation = iota
+	OpMetadata
+	OpRename
+	OpDelete
+	OpBegin
+	OpCommit
+)
+
+func (o Operation) String() string {
+	switch o {
+	case OpData:
+		return "data"
+	case OpMetadata:
+		return "metadata"
+	case OpRename:
+		return "rename"
+	case OpDelete:
+		return "delete"
+	case OpBegin:
+		return "begin"
+	case OpCommit:
+		return "commit"
+	}
+	return fmt.Sprintf("operation(%d)", int(o))
+}
+
+func ParseOperation(op string) (Operation, error) {
+	switch strings.ToLower(strings.TrimSpace(op)) {
+	case "data", "write":
+		return OpData, nil
+	case "metadata", "chmod", "chown":
+		return OpMetadata, nil
+	case "rename":
+		return OpRename, nil
+	case "delete", "remove":
+		return OpDelete, nil
+	case "begin":
+		return OpBegin, nil
+	case "commit":
+		return OpCommit, nil
+	}
+	return 0, fmt.Errorf("unknown operation %q", op)
+}
+
+// TransferItem is a unit of work for the receiver. Data and metadata items
+// carry the payload to replicate, renames and deletes only the paths. Begin
+// and commit carry the version of the file the data items between them build.
+type TransferItem struct {
+	Op       Operation
+	Payload  *replicator.DataPayload
+	Version  *replicator.FileVersion
+	Path     string
+	NewPath  string
+	FileSize uint64
+	class    int
+	enqueued time.Time
+}
+
+func (i *TransferItem) fillFromPayload() {
+	if i.Payload != nil && i.Path == "" {
+		i.Path = i.Payload.RelativeFilePath
+	}
+	if i.Payload != nil && i.FileSize == 0 {
+		i.FileSize = i.Payload.FileSize
+	}
+	if i.Version != nil && i.Path == "" {
+		i.Path = i.Version.RelativeFilePath
+	}
+	if i.Version != nil && i.FileSize == 0 {
+		i.FileSize = i.Version.FileSize
+	}
+}
+
+// cost is what the item is charged against its class when scheduled, the
+// number of bytes it puts on the wire.
+func (i *TransferItem) cost() int64 {
+	if i.Payload != nil && len(i.Payload.DataChunk) > 0 {
+		return int64(len(i.Payload.DataChunk))
+	}
+	return 1
+}
+
+// PriorityClass is a scheduling class. Each time the scheduler visits a class
+// it may send up to Weight * quantum bytes from it, so a class with weight 8
+// gets eight times the bandwidth of a class with weight 1 while both are busy.
+type PriorityClass struct {
+	Name   string
+	Weight uint64
+}
+
+const (
+	ClassMetadata    = "metadata"
+	ClassInteractive = "interactive"
+	ClassBulk        = "bulk"
+)
+
+func DefaultPriorityClasses() []PriorityClass {
+	return []PriorityClass{
+		{Name: ClassMetadata, Weight: 64},
+		{Name: ClassInteractive, Weight: 8},
+		{Name: ClassBulk, Weight: 1},
+	}
+}
+
+// DefaultPriorityRules sends metadata, renames and deletes ahead of data and
+// files up to 1MiB ahead of larger ones.
+func DefaultPriorityRules() []PriorityRule {
+	return []PriorityRule{
+		{Class: ClassMetadata, Ops: []Operation{OpMetadata, OpRename, OpDelete}},
+		{Class: ClassInteractive, MaxSize: 1 << 20},
+	}
+}
+
+// PriorityRule assigns items to a class. All the set conditions have to match:
+// Pattern is matched against the relative path and the base name, the size
+// bounds against the file size and Ops against the operation type.
+type PriorityRule struct {
+	Class   string
+	Pattern string
+	MinSize uint64
+	MaxSize uint64
+	Ops     []Operation
+}
+
+func (p PriorityRule) matches(item *TransferItem) bool {
+	if len(p.Ops) > 0 {
+		found := false
+		for _, op := range p.Ops {
+			if op == item.Op {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if p.Pattern != "" {
+		matchPath, _ := filepath.Match(p.Pattern, item.Path)
+		matchBase, _ := filepath.Match(p.Pattern, filepath.Base(item.Path))
+		if !matchPath && !matchBase {
+			return false
+		}
+	}
+	if p.MinSize > 0 && item.FileSize < p.MinSize {
+		return false
+	}
+	if p.MaxSize > 0 && item.FileSize > p.MaxSize {
+		return false
+	}
+	return true
+}
+
+// ParsePriorityRule parses "class:key=value,..." where the keys are pattern,
+// min-size, max-size and op, e.g. "interactive:pattern=*.conf" or
+// "metadata:op=metadata|rename|delete".
+func ParsePriorityRule(rule string) (PriorityRule, error) {
+	class, conditions, found := strings.Cut(rule, ":")
+	if !found || strings.TrimSpace(class) == "" {
+		return PriorityRule{}, fmt.Errorf("invalid priority rule %q, expected class:key=value,...", rule)
+	}
+	result := PriorityRule{Class: strings.TrimSpace(class)}
+
+	for _, condition := range strings.Split(conditions, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(condition), "=")
+		if !found {
+			return PriorityRule{}, fmt.Errorf("invalid priority rule condition %q", condition)
+		}
+		switch strings.TrimSpace(key) {
+		case "pattern", "path":
+			result.Pattern = value
+		case "min-size":
+			size, err := client.ParseByteSize(value)
+			if err != nil {
+				return PriorityRule{}, err
+			}
+			result.MinSize = size
+		case "max-size":
+			size, err := client.ParseByteSize(value)
+			if err != nil {
+				return PriorityRule{}, err
+			}
+			result.MaxSize = size
+		case "op":
+			for _, op := range strings.Split(value, "|") {
+				operation, err := ParseOperation(op)
+				if err != nil {
+					return PriorityRule{}, err
+				}
+				result.Ops = append(result.Ops, operation)
+			}
+		default:
+			return PriorityRule{}, fmt.Errorf("unknown priority rule condition %q", key)
+		}
+	}
+	return result, nil
+}
+
+// ParsePriorityClass parses "name=weight".
+func ParsePriorityClass(class string) (PriorityClass, error) {
+	name, weight, found := strings.Cut(class, "=")
+	if !found || strings.TrimSpace(name) == "" {
+		return PriorityClass{}, fmt.Errorf("invalid priority class %q, expected name=weight", class)
+	}
+	var value uint64
+	if _, err := fmt.Sscanf(strings.TrimSpace(weight), "%d", &value); err != nil || value == 0 {
+		return PriorityClass{}, fmt.Errorf("invalid weight for priority class %q", class)
+	}
+	return PriorityClass{Name: strings.TrimSpace(name), Weight: value}, nil
+}
+
+type classQueue struct {
+	PriorityClass
+	items   []*TransferItem
+	deficit int64
+	bytes   int64
+}
+
+// quantum is the number of bytes a class with weight 1 may send per round.
+const quantum = 64 * 1024
+
+// ClassCapacity is the number of bytes a class may hold before Push waits for
+// the receiver to catch up, so a large file is read as fast as it is sent
+// rather than into memory.
+const ClassCapacity = 64 << 20
+
+// TransferQueue schedules the work for the receiver with deficit round robin
+// across the priority classes. Items of the same class are sent in order.
+type TransferQueue struct {
+	mu           sync.Mutex
+	cond         *sync.Cond
+	space        *sync.Cond
+	capacity     int64
+	classes      []*classQueue
+	rules        []PriorityRule
+	defaultClass int
+	current      int
+	visited      bool
+	length       int
+	inflight     int
+	inflightAt   time.Time
+	closed       bool
+}
+
+type QueueStats struct {
+	Items  int
+	Bytes  int64
+	Oldest time.Time
+}
+
+func NewTransferQueue(classes []PriorityClass, rules []PriorityRule) *TransferQueue {
+	if len(classes) == 0 {
+		classes = DefaultPriorityClasses()
+	}
+	if rules == nil {
+		rules = DefaultPriorityRules()
+	}
+	q := &TransferQueue{rules: rules, capacity: ClassCapacity}
+	q.cond = sync.NewCond(&q.mu)
+	q.space = sync.NewCond(&q.mu)
+	for _, class := range classes {
+		if class.Weight == 0 {
+			class.Weight = 1
+		}
+		q.classes = append(q.classes, &classQueue{PriorityClass: class})
+	}
+	// Unmatched items go to the lowest weighted class.
+	for i, class := range q.classes {
+		if class.Weight < q.classes[q.defaultClass].Weight {
+			q.defaultClass = i
+		}
+	}
+	return q
+}
+
+func (q *TransferQueue) classIndex(name string) (int, bool) {
+	for i, class := range q.classes {
+		if class.Name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// ClassOf returns the name of the class the item would be scheduled in.
+func (q *TransferQueue) ClassOf(item *TransferItem) string {
+	item.fillFromPayload()
+	return q.classes[q.classify(item)].Name
+}
+
+func (q *TransferQueue) classify(item *TransferItem) int {
+	if item.Op == OpBegin || item.Op == OpCommit {
+		// The chunks of a version have to be sent between its begin and
+		// commit, which holds within a class.
+		data := *item
+		data.Op = OpData
+		item = &data
+	}
+	for _, rule := range q.rules {
+		if rule.matches(item) {
+			if index, ok := q.classIndex(rule.Class); ok {
+				return index
+			}
+			queuelogger.Warn().Msgf("Priority rule refers to unknown class %s, ignoring", rule.Class)
+		}
+	}
+	return q.defaultClass
+}
+
+// Push queues the item, waiting while its class holds ClassCapacity bytes. An
+// item larger than the capacity is queued once its class is empty. Nothing is
+// queued once the queue is closed.
+func (q *TransferQueue) Push(item *TransferItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	item.fillFromPayload()
+	item.class = q.classify(item)
+	class := q.classes[item.class]
+	for class.bytes > 0 && class.bytes+item.cost() > q.capacity && !q.closed {
+		q.space.Wait()
+	}
+	if q.closed {
+		return
+	}
+
+	switch item.Op {
+	case OpDelete:
+		// Pending writes would recreate the file after the delete overtook them.
+		q.dropPath(item.Path)
+	case OpRename:
+		q.retargetPath(item.Path, item.NewPath)
+	}
+
+	item.enqueued = time.Now()
+	class.items = append(class.items, item)
+	class.bytes += item.cost()
+	q.length++
+	queuelogger.Debug().Msgf("Queued %s for %s in class %s", item.Op, item.Path, class.Name)
+	q.cond.Signal()
+}
+
+func (q *TransferQueue) dropPath(filePath string) {
+	for _, class := range q.classes {
+		kept := class.items[:0]
+		for _, queued := range class.items {
+			if queued.Path == filePath && queued.Op != OpRename && queued.Op != OpDelete {
+				q.length--
+				class.bytes -= queued.cost()
+				continue
+			}
+			kept = append(kept, queued)
+		}
+		class.items = kept
+	}
+	q.space.Broadcast()
+}
+
+func (q *TransferQueue) retargetPath(oldPath string, newPath string) {
+	for _, class := range q.classes {
+		for _, queued := range class.items {
+			if queued.Path == oldPath && queued.Op != OpRename && queued.Op != OpDelete {
+				queued.Path = newPath
+				if queued.Payload != nil {
+					queued.Payload.RelativeFilePath = newPath
+				}
+				if queued.Version != nil {
+					queued.Version.RelativeFilePath = newPath
+				}
+			}
+		}
+	}
+}
+
+// Pop blocks until an item is available and returns false once the queue is
+// closed. Every popped item has to be acknowledged with Done.
+func (q *TransferQueue) Pop() (*TransferItem, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.length == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return nil, false
+	}
+
+	for {
+		class := q.classes[q.current]
+		if len(class.items) == 0 {
+			class.deficit = 0
+			q.advance()
+			continue
+		}
+		if !q.visited {
+			class.deficit += int64(class.Weight) * quantum
+			q.visited = true
+		}
+		head := class.items[0]
+		if head.cost() <= class.deficit {
+			class.deficit -= head.cost()
+			class.items = class.items[1:]
+			class.bytes -= head.cost()
+			q.length--
+			q.space.Broadcast()
+			if q.inflight == 0 {
+				q.inflightAt = head.enqueued
+			}
+			q.inflight++
+			return head, true
+		}
+		q.advance()
+	}
+}
+
+func (q *TransferQueue) advance() {
+	q.current = (q.current + 1) % len(q.classes)
+	q.visited = false
+}
+
+func (q *TransferQueue) Done() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.inflight--
+	q.cond.Broadcast()
+}
+
+// Stats reports what is waiting to be sent, including the items being sent.
+// Oldest is the time the longest waiting item was queued.
+func (q *TransferQueue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := QueueStats{Items: q.length + q.inflight}
+	if q.inflight > 0 {
+		stats.Oldest = q.inflightAt
+	}
+	for _, class := range q.classes {
+		stats.Bytes += class.bytes
+		if len(class.items) > 0 && (stats.Oldest.IsZero() || class.items[0].enqueued.Before(stats.Oldest)) {
+			stats.Oldest = class.items[0].enqueued
+		}
+	}
+	return stats
+}
+
+func (q *TransferQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.length
+}
+
+// Idle reports whether nothing is queued or being sent.
+func (q *TransferQueue) Idle() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.length == 0 && q.inflight == 0
+}
+
+func (q *TransferQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.space.Broadcast()
+}
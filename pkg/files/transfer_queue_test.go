@@ -0,0 +1,196 @@
+package files
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kosalaat/file-replicator/replicator"
+)
+
+func dataItem(path string, fileSize uint64, chunkID uint64, size int) *TransferItem {
+	return &TransferItem{
+		Op: OpData,
+		Payload: &replicator.DataPayload{
+			RelativeFilePath: path,
+			FileSize:         fileSize,
+			ChunkID:          chunkID,
+			DataChunk:        make([]byte, size),
+		},
+	}
+}
+
+func TestTransferQueue_MetadataJumpsAhead(t *testing.T) {
+	queue := NewTransferQueue(nil, nil)
+
+	for i := 0; i < 10; i++ {
+		queue.Push(dataItem("images/disk.img", 50<<30, uint64(i), 8192))
+	}
+	queue.Push(&TransferItem{Op: OpRename, Path: "a.conf", NewPath: "b.conf"})
+	queue.Push(dataItem("app.conf", 2048, 0, 2048))
+
+	item, _ := queue.Pop()
+	queue.Done()
+	if item.Op != OpRename {
+		t.Fatalf("Expected the rename to be sent first, got %s for %s", item.Op, item.Path)
+	}
+	item, _ = queue.Pop()
+	queue.Done()
+	if item.Path != "app.conf" {
+		t.Fatalf("Expected the small file to be sent before the bulk data, got %s", item.Path)
+	}
+	if queue.Len() != 10 {
+		t.Fatalf("Expected 10 items left in the queue, got %d", queue.Len())
+	}
+}
+
+func TestTransferQueue_NoStarvation(t *testing.T) {
+	queue := NewTransferQueue(nil, nil)
+
+	queue.Push(dataItem("disk.img", 50<<30, 0, 8192))
+	for i := 0; i < 1000; i++ {
+		queue.Push(dataItem("small.txt", 8192, uint64(i), 8192))
+	}
+
+	// The interactive class gets 8 quanta per round, so the bulk chunk has to
+	// go out within the first two rounds.
+	for i := 0; i < 2*8*quantum/8192+1; i++ {
+		item, ok := queue.Pop()
+		if !ok {
+			t.Fatalf("Queue closed unexpectedly")
+		}
+		queue.Done()
+		if item.Path == "disk.img" {
+			return
+		}
+	}
+	t.Fatalf("Bulk item was starved by the interactive class")
+}
+
+func TestTransferQueue_SameClassInOrder(t *testing.T) {
+	queue := NewTransferQueue(nil, nil)
+	for i := 0; i < 5; i++ {
+		queue.Push(dataItem("file.txt", 100, uint64(i), 20))
+	}
+	for i := 0; i < 5; i++ {
+		item, _ := queue.Pop()
+		queue.Done()
+		if item.Payload.ChunkID != uint64(i) {
+			t.Fatalf("Expected chunk %d, got %d", i, item.Payload.ChunkID)
+		}
+	}
+	if !queue.Idle() {
+		t.Fatalf("Expected the queue to be idle")
+	}
+}
+
+func TestTransferQueue_Backpressure(t *testing.T) {
+	queue := NewTransferQueue(nil, nil)
+	queue.capacity = 3 * 8192
+
+	pushed := make(chan int)
+	go func() {
+		for i := 0; i < 5; i++ {
+			queue.Push(dataItem("disk.img", 50<<30, uint64(i), 8192))
+			pushed <- i
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		<-pushed
+	}
+	select {
+	case i := <-pushed:
+		t.Fatalf("Expected the push of chunk %d to wait for room in the class", i)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	queue.Pop()
+	queue.Done()
+	if i := <-pushed; i != 3 {
+		t.Fatalf("Expected chunk 3 to be queued once a chunk was sent, got %d", i)
+	}
+	if queue.Push(&TransferItem{Op: OpRename, Path: "a.conf", NewPath: "b.conf"}); queue.Len() != 4 {
+		t.Fatalf("Expected the rename not to wait for the bulk class, got %d items", queue.Len())
+	}
+
+	queue.Close()
+	<-pushed
+}
+
+func TestTransferQueue_VersionKeepsItsChunks(t *testing.T) {
+	queue := NewTransferQueue(nil, nil)
+	version := &replicator.FileVersion{RelativeFilePath: "disk.img", FileSize: 50 << 30}
+	queue.Push(&TransferItem{Op: OpBegin, Version: version})
+	for i := 0; i < 3; i++ {
+		queue.Push(dataItem("disk.img", 50<<30, uint64(i), 8192))
+	}
+	queue.Push(&TransferItem{Op: OpCommit, Version: version})
+	queue.Push(&TransferItem{Op: OpRename, Path: "a.conf", NewPath: "b.conf"})
+
+	var ops []Operation
+	for !queue.Idle() {
+		item, _ := queue.Pop()
+		queue.Done()
+		if item.Path == "disk.img" {
+			ops = append(ops, item.Op)
+		}
+	}
+	if len(ops) != 5 || ops[0] != OpBegin || ops[4] != OpCommit {
+		t.Fatalf("Expected the chunks of the file between the begin and the commit, got %v", ops)
+	}
+}
+
+func TestTransferQueue_DeleteDropsPendingWrites(t *testing.T) {
+	queue := NewTransferQueue(nil, nil)
+	queue.Push(dataItem("gone.txt", 100, 0, 20))
+	queue.Push(dataItem("kept.txt", 100, 0, 20))
+	queue.Push(&TransferItem{Op: OpDelete, Path: "gone.txt"})
+
+	if queue.Len() != 2 {
+		t.Fatalf("Expected 2 items in the queue, got %d", queue.Len())
+	}
+	first, _ := queue.Pop()
+	second, _ := queue.Pop()
+	if first.Op != OpDelete || second.Path != "kept.txt" {
+		t.Fatalf("Unexpected items: %s %s, %s %s", first.Op, first.Path, second.Op, second.Path)
+	}
+}
+
+func TestTransferQueue_RenameRetargetsPendingWrites(t *testing.T) {
+	queue := NewTransferQueue(nil, nil)
+	queue.Push(dataItem("old.txt", 100, 0, 20))
+	queue.Push(&TransferItem{Op: OpRename, Path: "old.txt", NewPath: "new.txt"})
+
+	queue.Pop()
+	item, _ := queue.Pop()
+	if item.Path != "new.txt" || item.Payload.RelativeFilePath != "new.txt" {
+		t.Fatalf("Expected the pending write to follow the rename, got %s", item.Path)
+	}
+}
+
+func TestParsePriorityRule(t *testing.T) {
+	rule, err := ParsePriorityRule("interactive:pattern=*.conf,max-size=1M,op=data|metadata")
+	if err != nil {
+		t.Fatalf("Failed to parse rule: %v", err)
+	}
+	if rule.Class != "interactive" || rule.Pattern != "*.conf" || rule.MaxSize != 1<<20 || len(rule.Ops) != 2 {
+		t.Fatalf("Unexpected rule: %+v", rule)
+	}
+
+	queue := NewTransferQueue(
+		[]PriorityClass{{Name: "fast", Weight: 10}, {Name: "slow", Weight: 1}},
+		[]PriorityRule{{Class: "fast", Pattern: "etc/*.conf"}},
+	)
+	if class := queue.ClassOf(dataItem("etc/app.conf", 10, 0, 10)); class != "fast" {
+		t.Fatalf("Expected class fast, got %s", class)
+	}
+	if class := queue.ClassOf(dataItem("var/app.log", 10, 0, 10)); class != "slow" {
+		t.Fatalf("Expected class slow, got %s", class)
+	}
+
+	if _, err := ParsePriorityRule("interactive"); err == nil {
+		t.Fatalf("Expected an error for a rule without conditions")
+	}
+	if _, err := ParsePriorityClass("bulk=0"); err == nil {
+		t.Fatalf("Expected an error for a zero weight")
+	}
+}
@@ -0,0 +1,229 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/kosalaat/file-replicator/pkg/controller"
+	"github.com/kosalaat/file-replicator/replicator"
+)
+
+// digestBatch is the number of files asked for in one Digest call.
+const digestBatch = 64
+
+// VerifyOptions limit the content comparison of large trees. Missing and extra
+// files are always reported, only the files hashed on both sides are sampled.
+type VerifyOptions struct {
+	// SampleRate is the fraction of the files to hash, all of them when 0.
+	SampleRate float64
+	// MaxFiles caps the number of files to hash, no cap when 0.
+	MaxFiles int
+	// Seed picks the sample, the same seed verifies the same files.
+	Seed      int64
+	Algorithm string
+}
+
+type VerifyMismatch struct {
+	Path   string `json:"path"`
+	Detail string `json:"detail"`
+}
+
+type VerifyReport struct {
+	Target           string           `json:"target"`
+	Algorithm        string           `json:"algorithm"`
+	SourceFiles      int              `json:"source_files"`
+	RecieverFiles    int              `json:"reciever_files"`
+	Hashed           int              `json:"hashed"`
+	Missing          []string         `json:"missing"`
+	Extra            []string         `json:"extra"`
+	ContentMismatch  []VerifyMismatch `json:"content_mismatch"`
+	MetadataMismatch []VerifyMismatch `json:"metadata_mismatch"`
+	Errors           []VerifyMismatch `json:"errors"`
+}
+
+// Clean reports whether the reciever matched the source on everything checked.
+func (r *VerifyReport) Clean() bool {
+	return len(r.Missing)+len(r.Extra)+len(r.ContentMismatch)+len(r.MetadataMismatch)+len(r.Errors) == 0
+}
+
+type localFile struct {
+	size uint64
+	mode uint32
+	uid  uint32
+	gid  uint32
+}
+
+// Verify compares the file root with the reciever: which files are missing or
+// extra, and for the sampled files whose strong hash or metadata differ.
+func (f *FileReplicator) Verify(ctx context.Context, options VerifyOptions) (*VerifyReport, error) {
+	if options.Algorithm == "" {
+		options.Algorithm = controller.DefaultDigestAlgorithm
+	}
+	report := &VerifyReport{
+		Target:           f.TargetName(),
+		Algorithm:        options.Algorithm,
+		Missing:          make([]string, 0),
+		Extra:            make([]string, 0),
+		ContentMismatch:  make([]VerifyMismatch, 0),
+		MetadataMismatch: make([]VerifyMismatch, 0),
+		Errors:           make([]VerifyMismatch, 0),
+	}
+
+	remoteFiles, err := f.ReplicatorClient.ListFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report.RecieverFiles = len(remoteFiles)
+
+	localFiles := make(map[string]localFile)
+	err = filepath.Walk(
+		f.FileRoot,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() || controller.IsStagingFile(path) {
+				return nil
+			}
+			referencePath, _ := filepath.Rel(f.FileRoot, path)
+			file := localFile{size: uint64(info.Size()), mode: uint32(info.Mode())}
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+				file.uid, file.gid = stat.Uid, stat.Gid
+			}
+			localFiles[referencePath] = file
+			return ctx.Err()
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	report.SourceFiles = len(localFiles)
+
+	var common []string
+	for referencePath := range localFiles {
+		if _, ok := remoteFiles[referencePath]; ok {
+			common = append(common, referencePath)
+		} else {
+			report.Missing = append(report.Missing, referencePath)
+		}
+	}
+	for referencePath := range remoteFiles {
+		if _, ok := localFiles[referencePath]; !ok {
+			report.Extra = append(report.Extra, referencePath)
+		}
+	}
+	sort.Strings(common)
+	sort.Strings(report.Missing)
+	sort.Strings(report.Extra)
+
+	sample := sampleFiles(common, options)
+	report.Hashed = len(sample)
+
+	for start := 0; start < len(sample); start += digestBatch {
+		batch := sample[start:min(start+digestBatch, len(sample))]
+		digests, err := f.ReplicatorClient.Digests(ctx, batch, options.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+		for _, remote := range digests {
+			f.verifyFile(report, localFiles[remote.RelativeFilePath], remote, options.Algorithm)
+		}
+	}
+	return report, nil
+}
+
+func (f *FileReplicator) verifyFile(report *VerifyReport, local localFile, remote *replicator.FileDigest, algorithm string) {
+	referencePath := remote.RelativeFilePath
+	if remote.Code != replicator.ConfirmationCode_OK {
+		report.Errors = append(report.Errors, VerifyMismatch{Path: referencePath, Detail: "reciever: " + remote.Code.String()})
+		return
+	}
+
+	digest, _, err := controller.FileDigest(filepath.Join(f.FileRoot, referencePath), algorithm)
+	if err != nil {
+		report.Errors = append(report.Errors, VerifyMismatch{Path: referencePath, Detail: "source: " + err.Error()})
+		return
+	}
+	if !bytes.Equal(digest, remote.Digest) {
+		report.ContentMismatch = append(report.ContentMismatch, VerifyMismatch{
+			Path:   referencePath,
+			Detail: fmt.Sprintf("%s %x != %x", algorithm, digest, remote.Digest),
+		})
+	}
+
+	var differences []string
+	if local.size != remote.FileSize {
+		differences = append(differences, fmt.Sprintf("size %d != %d", local.size, remote.FileSize))
+	}
+	if localMode, remoteMode := os.FileMode(local.mode).Perm(), os.FileMode(remote.FileMode).Perm(); localMode != remoteMode {
+		differences = append(differences, fmt.Sprintf("mode %v != %v", localMode, remoteMode))
+	}
+	if local.uid != remote.UID || local.gid != remote.GID {
+		differences = append(differences, fmt.Sprintf("owner %d:%d != %d:%d", local.uid, local.gid, remote.UID, remote.GID))
+	}
+	if len(differences) > 0 {
+		report.MetadataMismatch = append(report.MetadataMismatch, VerifyMismatch{
+			Path:   referencePath,
+			Detail: strings.Join(differences, ", "),
+		})
+	}
+}
+
+// sampleFiles picks the files to hash. The result is sorted, so the digests
+// stream back in a stable order.
+func sampleFiles(files []string, options VerifyOptions) []string {
+	sample := files
+	if options.SampleRate > 0 && options.SampleRate < 1 {
+		random := rand.New(rand.NewSource(options.Seed))
+		sample = make([]string, 0, int(float64(len(files))*options.SampleRate)+1)
+		for _, file := range files {
+			if random.Float64() < options.SampleRate {
+				sample = append(sample, file)
+			}
+		}
+	}
+	if options.MaxFiles > 0 && len(sample) > options.MaxFiles {
+		random := rand.New(rand.NewSource(options.Seed))
+		shuffled := append([]string(nil), sample...)
+		random.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		sample = shuffled[:options.MaxFiles]
+		sort.Strings(sample)
+	}
+	return sample
+}
+
+func (r *VerifyReport) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "Verify of %s (%s):\n", r.Target, r.Algorithm)
+	for _, path := range r.Missing {
+		fmt.Fprintf(w, "  missing   %s\n", path)
+	}
+	for _, path := range r.Extra {
+		fmt.Fprintf(w, "  extra     %s\n", path)
+	}
+	for _, mismatch := range r.ContentMismatch {
+		fmt.Fprintf(w, "  content   %s: %s\n", mismatch.Path, mismatch.Detail)
+	}
+	for _, mismatch := range r.MetadataMismatch {
+		fmt.Fprintf(w, "  metadata  %s: %s\n", mismatch.Path, mismatch.Detail)
+	}
+	for _, mismatch := range r.Errors {
+		fmt.Fprintf(w, "  error     %s: %s\n", mismatch.Path, mismatch.Detail)
+	}
+	_, err := fmt.Fprintf(w, "%d source files, %d reciever files, %d hashed: %d missing, %d extra, %d content, %d metadata mismatches, %d errors\n",
+		r.SourceFiles, r.RecieverFiles, r.Hashed, len(r.Missing), len(r.Extra), len(r.ContentMismatch), len(r.MetadataMismatch), len(r.Errors))
+	return err
+}
+
+func (r *VerifyReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
@@ -0,0 +1,111 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/pkg/server"
+	"github.com/phayes/freeport"
+)
+
+func TestVerify(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+
+	for _, file := range []struct {
+		root    string
+		name    string
+		content string
+		mode    os.FileMode
+	}{
+		{src, "same.txt", "abc1def2", 0644},
+		{dest, "same.txt", "abc1def2", 0644},
+		{src, "dir/content.txt", "abc1def2", 0644},
+		{dest, "dir/content.txt", "abc1XXX2", 0644},
+		{src, "mode.txt", "abc1", 0644},
+		{dest, "mode.txt", "abc1", 0600},
+		{src, "missing.txt", "abc1", 0644},
+		{dest, "extra.txt", "abc1", 0644},
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(file.root, file.name)), 0755)
+		if err := os.WriteFile(filepath.Join(file.root, file.name), []byte(file.content), file.mode); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		os.Chmod(filepath.Join(file.root, file.name), file.mode)
+	}
+
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	server := server.NewReplicationServer()
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	go func() {
+		server.StartListening(address, dest)
+	}()
+	defer server.StopListening()
+
+	replicationClient, err := client.NewReplicatorClient(address, src, 10)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	fileReplicator := &FileReplicator{ReplicatorClient: *replicationClient}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFunc()
+	report, err := fileReplicator.Verify(ctx, VerifyOptions{})
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+
+	if report.Clean() || report.Hashed != 3 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+	if len(report.Missing) != 1 || report.Missing[0] != "missing.txt" {
+		t.Errorf("Unexpected missing files: %v", report.Missing)
+	}
+	if len(report.Extra) != 1 || report.Extra[0] != "extra.txt" {
+		t.Errorf("Unexpected extra files: %v", report.Extra)
+	}
+	if len(report.ContentMismatch) != 1 || report.ContentMismatch[0].Path != "dir/content.txt" {
+		t.Errorf("Unexpected content mismatches: %v", report.ContentMismatch)
+	}
+	if len(report.MetadataMismatch) != 1 || report.MetadataMismatch[0].Path != "mode.txt" {
+		t.Errorf("Unexpected metadata mismatches: %v", report.MetadataMismatch)
+	}
+	if len(report.Errors) != 0 {
+		t.Errorf("Unexpected errors: %v", report.Errors)
+	}
+
+	report, err = fileReplicator.Verify(ctx, VerifyOptions{MaxFiles: 1, Seed: 1})
+	if err != nil || report.Hashed != 1 {
+		t.Fatalf("Expected a single sampled file, got %+v, %v", report, err)
+	}
+}
+
+func TestSampleFiles(t *testing.T) {
+	var files []string
+	for i := 0; i < 1000; i++ {
+		files = append(files, fmt.Sprintf("file%04d", i))
+	}
+
+	if sample := sampleFiles(files, VerifyOptions{}); len(sample) != len(files) {
+		t.Errorf("Expected all files without sampling, got %d", len(sample))
+	}
+	sample := sampleFiles(files, VerifyOptions{SampleRate: 0.1, Seed: 42})
+	if len(sample) < 50 || len(sample) > 150 {
+		t.Errorf("Expected about 100 sampled files, got %d", len(sample))
+	}
+	again := sampleFiles(files, VerifyOptions{SampleRate: 0.1, Seed: 42})
+	if fmt.Sprint(sample) != fmt.Sprint(again) {
+		t.Errorf("The same seed should pick the same files")
+	}
+	if sample := sampleFiles(files, VerifyOptions{SampleRate: 0.5, MaxFiles: 10}); len(sample) != 10 {
+		t.Errorf("Expected the sample to be capped at 10, got %d", len(sample))
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// VerificationRecord is a line of the verification report, the outcome of
+// checking a committed version against the digest of the sender.
+type VerificationRecord struct {
+	Time      time.Time `json:"time"`
+	Namespace string    `json:"namespace,omitempty"`
+	Path      string    `json:"path"`
+	Version   uint64    `json:"version"`
+	Algorithm string    `json:"algorithm"`
+	Expected  string    `json:"expected"`
+	Actual    string    `json:"actual"`
+	Verified  bool      `json:"verified"`
+}
+
+// VerificationReport appends the verification records to a file as JSON
+// lines, for auditing what the reciever accepted.
+type VerificationReport struct {
+	Path string
+
+	mu        sync.Mutex
+	namespace string
+	// shared is the report the namespace writes to.
+	shared *VerificationReport
+}
+
+// Namespace returns the report of a namespace, written to the same file with
+// the records labeled with the namespace.
+func (r *VerificationReport) Namespace(name string) *VerificationReport {
+	if r == nil {
+		return nil
+	}
+	return &VerificationReport{Path: r.Path, namespace: name, shared: r}
+}
+
+func (r *VerificationReport) record(relativePath string, version uint64, algorithm string, expected []byte, actual []byte) {
+	record := VerificationRecord{
+		Time:      time.Now(),
+		Namespace: r.namespaceName(),
+		Path:      relativePath,
+		Version:   version,
+		Algorithm: algorithm,
+		Expected:  hex.EncodeToString(expected),
+		Actual:    hex.EncodeToString(actual),
+		Verified:  string(expected) == string(actual),
+	}
+	if record.Verified {
+		serverlogger.Info().Msgf("Verified version %d of %s with %s", version, relativePath, algorithm)
+	} else {
+		serverlogger.Error().Msgf("Version %d of %s does not match the %s digest of the sender", version, relativePath, algorithm)
+	}
+	if r == nil || r.Path == "" {
+		return
+	}
+
+	lock := &r.mu
+	if r.shared != nil {
+		lock = &r.shared.mu
+	}
+	lock.Lock()
+	defer lock.Unlock()
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		serverlogger.Error().Err(err).Msg("Failed to encode verification record")
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(r.Path), 0750); err != nil {
+		serverlogger.Error().Err(err).Msgf("Failed to create verification report directory")
+		return
+	}
+	report, err := os.OpenFile(r.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		serverlogger.Error().Err(err).Msgf("Failed to open verification report %s", r.Path)
+		return
+	}
+	defer report.Close()
+	if _, err := report.Write(append(line, '\n')); err != nil {
+		serverlogger.Error().Err(err).Msgf("Failed to write verification report %s", r.Path)
+	}
+}
+
+func (r *VerificationReport) namespaceName() string {
+	if r == nil {
+		return ""
+	}
+	return r.namespace
+}
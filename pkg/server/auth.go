@@ -0,0 +1,266 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/kosalaat/file-replicator/replicator"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Operations an identity can be allowed on a path prefix.
+const (
+	OpRead     = "read"
+	OpWrite    = "write"
+	OpMetadata = "metadata"
+	OpRename   = "rename"
+	OpDelete   = "delete"
+	OpSnapshot = "snapshot"
+)
+
+// Rule allows operations on the paths under Prefix, every path when it is
+// empty, in a namespace, the default file root when it is empty.
+type Rule struct {
+	Namespace  string   `json:"namespace,omitempty"`
+	Prefix     string   `json:"prefix"`
+	Operations []string `json:"operations"`
+}
+
+// Identity is a sender, authenticated by a bearer token or by the subject of
+// its client certificate.
+type Identity struct {
+	Name string `json:"name"`
+	// Token is sent by the sender as "authorization: Bearer <token>".
+	Token string `json:"token,omitempty"`
+	// Subjects are the common names or DNS names of the verified client
+	// certificates of the identity.
+	Subjects []string `json:"subjects,omitempty"`
+	Rules    []Rule   `json:"rules"`
+}
+
+// Policy authenticates the callers of the reciever and restricts every
+// identity to its rules. Anything not allowed by a rule is denied.
+type Policy struct {
+	Identities []Identity `json:"identities"`
+
+	// lstat finds the file a metadata update applies to, set by the server
+	// the policy guards.
+	lstat func(namespace string, relativePath string) (os.FileInfo, error)
+}
+
+// LoadPolicy reads a policy file.
+func LoadPolicy(path string) (*Policy, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	policy := &Policy{}
+	if err := json.Unmarshal(content, policy); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %w", path, err)
+	}
+	for _, identity := range policy.Identities {
+		if identity.Token == "" && len(identity.Subjects) == 0 {
+			return nil, fmt.Errorf("identity %q of %s has neither a token nor a subject", identity.Name, path)
+		}
+		for _, rule := range identity.Rules {
+			for _, operation := range rule.Operations {
+				if !slices.Contains([]string{OpRead, OpWrite, OpMetadata, OpRename, OpDelete, OpSnapshot}, operation) {
+					return nil, fmt.Errorf("identity %q of %s has an unknown operation %q", identity.Name, path, operation)
+				}
+			}
+		}
+	}
+	return policy, nil
+}
+
+// authenticate finds the identity of the caller from its token, or else from
+// its verified client certificate.
+func (p *Policy) authenticate(ctx context.Context) (*Identity, error) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, value := range md.Get("authorization") {
+			token, found := strings.CutPrefix(value, "Bearer ")
+			if !found {
+				continue
+			}
+			for i, identity := range p.Identities {
+				if identity.Token != "" && subtle.ConstantTimeCompare([]byte(identity.Token), []byte(token)) == 1 {
+					return &p.Identities[i], nil
+				}
+			}
+			return nil, status.Error(codes.Unauthenticated, "unknown token")
+		}
+	}
+
+	if caller, ok := peer.FromContext(ctx); ok {
+		if tlsInfo, ok := caller.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.VerifiedChains) > 0 {
+			certificate := tlsInfo.State.VerifiedChains[0][0]
+			subjects := append([]string{certificate.Subject.CommonName}, certificate.DNSNames...)
+			for i, identity := range p.Identities {
+				for _, subject := range subjects {
+					if subject != "" && slices.Contains(identity.Subjects, subject) {
+						return &p.Identities[i], nil
+					}
+				}
+			}
+			return nil, status.Errorf(codes.Unauthenticated, "no identity for certificate %s", certificate.Subject.CommonName)
+		}
+	}
+	return nil, status.Error(codes.Unauthenticated, "no token or client certificate")
+}
+
+// allows tells whether a rule of the identity allows the operation on the path
+// of the namespace. Paths leaving the file root are never allowed.
+func (i *Identity) allows(namespace string, operation string, relativePath string) bool {
+	relativePath = path.Clean(relativePath)
+	if path.IsAbs(relativePath) || relativePath == ".." || strings.HasPrefix(relativePath, "../") {
+		return false
+	}
+	if relativePath == "." {
+		relativePath = ""
+	}
+	for _, rule := range i.Rules {
+		if rule.Namespace != namespace || !slices.Contains(rule.Operations, operation) {
+			continue
+		}
+		prefix := strings.Trim(path.Clean("/"+rule.Prefix), "/")
+		if prefix == "" || relativePath == prefix || strings.HasPrefix(relativePath, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// access lists the operations a request needs on which paths, and reports
+// false for the requests of no known call. A payload without data only needs
+// the metadata operation when it changes the mode or ownership of an existing
+// file, it needs to write when it creates the file or changes its size.
+// Listings and digests are filtered as they are sent.
+func (p *Policy) access(namespace string, fullMethod string, request any) (map[string][]string, bool) {
+	switch in := request.(type) {
+	case *replicator.DataPayload:
+		if in.DataChunk == nil && p.lstat != nil {
+			if stat, err := p.lstat(namespace, in.RelativeFilePath); err == nil && stat.Mode().IsRegular() && uint64(stat.Size()) == in.FileSize {
+				return map[string][]string{OpMetadata: {in.RelativeFilePath}}, true
+			}
+		}
+		return map[string][]string{OpWrite: {in.RelativeFilePath}}, true
+	case *replicator.FileVersion:
+		return map[string][]string{OpWrite: {in.RelativeFilePath}}, true
+	case *replicator.FileOps:
+		if strings.HasSuffix(fullMethod, "/Rename") {
+			return map[string][]string{OpRename: {in.RelativeFilePath, in.NewRelativeFilePath}}, true
+		}
+		return map[string][]string{OpDelete: {in.RelativeFilePath}}, true
+	case *replicator.DataSignature:
+		return map[string][]string{OpRead: {in.RelativeFilePath}}, true
+	case *replicator.BlockMapRequest:
+		return map[string][]string{OpRead: {in.RelativeFilePath}}, true
+	case *replicator.ReadRequest:
+		return map[string][]string{OpRead: {in.RelativeFilePath}}, true
+	case *replicator.SnapshotRequest:
+		return map[string][]string{OpSnapshot: {""}}, true
+	case *replicator.ListRequest, *replicator.DigestRequest, *replicator.PingPong:
+		return nil, true
+	}
+	return nil, false
+}
+
+func (p *Policy) authorize(identity *Identity, namespace string, fullMethod string, request any) error {
+	needs, known := p.access(namespace, fullMethod, request)
+	if !known {
+		serverlogger.Warn().Msgf("Denied the unknown request %T of %s to %s", request, fullMethod, identity.Name)
+		return status.Errorf(codes.PermissionDenied, "%s may not call %s", identity.Name, fullMethod)
+	}
+	for operation, paths := range needs {
+		for _, relativePath := range paths {
+			if !identity.allows(namespace, operation, relativePath) {
+				serverlogger.Warn().Msgf("Denied %s of %q in namespace %q to %s in %s", operation, relativePath, namespace, identity.Name, fullMethod)
+				return status.Errorf(codes.PermissionDenied, "%s may not %s %q", identity.Name, operation, relativePath)
+			}
+		}
+	}
+	return nil
+}
+
+// UnaryInterceptor authenticates every call and authorizes its paths. Calls
+// answered with a confirmation are denied with PERMISSION_DENIED, the others
+// with the PermissionDenied status.
+func (p *Policy) UnaryInterceptor(ctx context.Context, request any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	identity, err := p.authenticate(ctx)
+	if err != nil {
+		serverlogger.Warn().Err(err).Msgf("Refused unauthenticated call to %s", info.FullMethod)
+		return nil, err
+	}
+	if err := p.authorize(identity, namespaceOf(ctx), info.FullMethod, request); err != nil {
+		switch request.(type) {
+		case *replicator.DataPayload, *replicator.FileVersion, *replicator.FileOps, *replicator.DataSignature:
+			return &replicator.Confirmation{
+				Code: replicator.ConfirmationCode_PERMISSION_DENIED,
+			}, nil
+		}
+		return nil, err
+	}
+	return handler(ctx, request)
+}
+
+// StreamInterceptor authenticates every stream and authorizes the request
+// that opens it. Files the identity may not read are left out of the listings
+// and their digests are denied.
+func (p *Policy) StreamInterceptor(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	identity, err := p.authenticate(stream.Context())
+	if err != nil {
+		serverlogger.Warn().Err(err).Msgf("Refused unauthenticated call to %s", info.FullMethod)
+		return err
+	}
+	return handler(srv, &authorizedStream{
+		ServerStream: stream,
+		policy:       p,
+		identity:     identity,
+		namespace:    namespaceOf(stream.Context()),
+		method:       info.FullMethod,
+	})
+}
+
+type authorizedStream struct {
+	grpc.ServerStream
+	policy    *Policy
+	identity  *Identity
+	namespace string
+	method    string
+}
+
+func (s *authorizedStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.policy.authorize(s.identity, s.namespace, s.method, m)
+}
+
+func (s *authorizedStream) SendMsg(m any) error {
+	switch out := m.(type) {
+	case *replicator.FileInfo:
+		if !s.identity.allows(s.namespace, OpRead, out.RelativeFilePath) {
+			return nil
+		}
+	case *replicator.FileDigest:
+		if !s.identity.allows(s.namespace, OpRead, out.RelativeFilePath) {
+			serverlogger.Warn().Msgf("Denied the digest of %q to %s", out.RelativeFilePath, s.identity.Name)
+			m = &replicator.FileDigest{
+				RelativeFilePath: out.RelativeFilePath,
+				Code:             replicator.ConfirmationCode_PERMISSION_DENIED,
+			}
+		}
+	}
+	return s.ServerStream.SendMsg(m)
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kosalaat/file-replicator/replicator"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+var testPolicy = &Policy{Identities: []Identity{{
+	Name:  "site-a",
+	Token: "secret-a",
+	Rules: []Rule{
+		{Prefix: "site-a", Operations: []string{OpRead, OpWrite, OpMetadata}},
+		{Prefix: "site-a/scratch", Operations: []string{OpRename, OpDelete}},
+	},
+}}}
+
+func withToken(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+}
+
+func TestPolicy_UnaryInterceptor(t *testing.T) {
+	handled := func(ctx context.Context, request any) (any, error) {
+		return &replicator.Confirmation{Code: replicator.ConfirmationCode_OK}, nil
+	}
+	call := func(ctx context.Context, method string, request any) (replicator.ConfirmationCode, codes.Code) {
+		response, err := testPolicy.UnaryInterceptor(ctx, request, &grpc.UnaryServerInfo{FullMethod: "/replicator.FileReplicator/" + method}, handled)
+		if err != nil {
+			return 0, status.Code(err)
+		}
+		return response.(*replicator.Confirmation).Code, codes.OK
+	}
+
+	for _, test := range []struct {
+		name    string
+		ctx     context.Context
+		method  string
+		request any
+		code    replicator.ConfirmationCode
+		status  codes.Code
+	}{
+		{"write under the prefix", withToken("secret-a"), "Replicate", &replicator.DataPayload{RelativeFilePath: "site-a/x", DataChunk: []byte("x")}, replicator.ConfirmationCode_OK, codes.OK},
+		{"metadata under the prefix", withToken("secret-a"), "Replicate", &replicator.DataPayload{RelativeFilePath: "site-a/x"}, replicator.ConfirmationCode_OK, codes.OK},
+		{"write elsewhere", withToken("secret-a"), "Replicate", &replicator.DataPayload{RelativeFilePath: "site-b/x", DataChunk: []byte("x")}, replicator.ConfirmationCode_PERMISSION_DENIED, codes.OK},
+		{"prefix of another name", withToken("secret-a"), "Begin", &replicator.FileVersion{RelativeFilePath: "site-ab/x"}, replicator.ConfirmationCode_PERMISSION_DENIED, codes.OK},
+		{"traversal out of the prefix", withToken("secret-a"), "Replicate", &replicator.DataPayload{RelativeFilePath: "site-a/../site-b/x", DataChunk: []byte("x")}, replicator.ConfirmationCode_PERMISSION_DENIED, codes.OK},
+		{"traversal out of the root", withToken("secret-a"), "Replicate", &replicator.DataPayload{RelativeFilePath: "../site-a/x", DataChunk: []byte("x")}, replicator.ConfirmationCode_PERMISSION_DENIED, codes.OK},
+		{"delete without the operation", withToken("secret-a"), "Delete", &replicator.FileOps{RelativeFilePath: "site-a/x"}, replicator.ConfirmationCode_PERMISSION_DENIED, codes.OK},
+		{"delete with the operation", withToken("secret-a"), "Delete", &replicator.FileOps{RelativeFilePath: "site-a/scratch/x"}, replicator.ConfirmationCode_OK, codes.OK},
+		{"rename out of the prefix", withToken("secret-a"), "Rename", &replicator.FileOps{RelativeFilePath: "site-a/scratch/x", NewRelativeFilePath: "site-a/x"}, replicator.ConfirmationCode_PERMISSION_DENIED, codes.OK},
+		{"snapshot", withToken("secret-a"), "Snapshot", &replicator.SnapshotRequest{}, 0, codes.PermissionDenied},
+		{"unknown token", withToken("guess"), "Replicate", &replicator.DataPayload{RelativeFilePath: "site-a/x"}, 0, codes.Unauthenticated},
+		{"no token", context.Background(), "Ping", &replicator.PingPong{}, 0, codes.Unauthenticated},
+		{"ping", withToken("secret-a"), "Ping", &replicator.PingPong{}, replicator.ConfirmationCode_OK, codes.OK},
+		{"unknown request", withToken("secret-a"), "Unknown", &replicator.Confirmation{}, 0, codes.PermissionDenied},
+	} {
+		code, statusCode := call(test.ctx, test.method, test.request)
+		if code != test.code || statusCode != test.status {
+			t.Errorf("%s: expected %s, %s, got %s, %s", test.name, test.code, test.status, code, statusCode)
+		}
+	}
+}
+
+func TestPolicy_MetadataOnly(t *testing.T) {
+	s := NewReplicationServer()
+	s.FileRoot = t.TempDir()
+	os.MkdirAll(filepath.Join(s.FileRoot, "site-a"), 0755)
+	os.WriteFile(filepath.Join(s.FileRoot, "site-a/x"), []byte("data"), 0644)
+	policy := &Policy{Identities: []Identity{{
+		Name:  "chmod",
+		Token: "secret-m",
+		Rules: []Rule{{Prefix: "site-a", Operations: []string{OpMetadata}}},
+	}}}
+	policy.lstat = s.lstatIn
+
+	for _, test := range []struct {
+		name    string
+		payload *replicator.DataPayload
+		code    replicator.ConfirmationCode
+	}{
+		{"mode of an existing file", &replicator.DataPayload{RelativeFilePath: "site-a/x", FileSize: 4, FileMode: 0600}, replicator.ConfirmationCode_OK},
+		{"truncating the file", &replicator.DataPayload{RelativeFilePath: "site-a/x", FileSize: 0}, replicator.ConfirmationCode_PERMISSION_DENIED},
+		{"growing the file", &replicator.DataPayload{RelativeFilePath: "site-a/x", FileSize: 1 << 30}, replicator.ConfirmationCode_PERMISSION_DENIED},
+		{"creating a file", &replicator.DataPayload{RelativeFilePath: "site-a/new", FileSize: 0}, replicator.ConfirmationCode_PERMISSION_DENIED},
+	} {
+		response, err := policy.UnaryInterceptor(withToken("secret-m"), test.payload, &grpc.UnaryServerInfo{FullMethod: "/replicator.FileReplicator/Replicate"}, func(ctx context.Context, request any) (any, error) {
+			return &replicator.Confirmation{Code: replicator.ConfirmationCode_OK}, nil
+		})
+		if err != nil || response.(*replicator.Confirmation).Code != test.code {
+			t.Errorf("%s: expected %s, got %v, %v", test.name, test.code, response, err)
+		}
+	}
+}
+
+type recordingStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	request any
+	sent    []any
+}
+
+func (s *recordingStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *recordingStream) RecvMsg(m any) error {
+	proto.Merge(m.(proto.Message), s.request.(proto.Message))
+	return nil
+}
+
+func (s *recordingStream) SendMsg(m any) error {
+	s.sent = append(s.sent, m)
+	return nil
+}
+
+func TestPolicy_StreamInterceptor(t *testing.T) {
+	s := NewReplicationServer()
+	s.FileRoot = t.TempDir()
+	for _, name := range []string{"site-a/x", "site-b/y"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(s.FileRoot, name)), 0755)
+		os.WriteFile(filepath.Join(s.FileRoot, name), []byte("data"), 0644)
+	}
+
+	list := &recordingStream{ctx: withToken("secret-a")}
+	err := testPolicy.StreamInterceptor(s, list, &grpc.StreamServerInfo{FullMethod: "/replicator.FileReplicator/List"}, func(srv any, stream grpc.ServerStream) error {
+		return s.List(&replicator.ListRequest{}, &grpc.GenericServerStream[replicator.ListRequest, replicator.FileInfo]{ServerStream: stream})
+	})
+	if err != nil || len(list.sent) != 1 || list.sent[0].(*replicator.FileInfo).RelativeFilePath != "site-a/x" {
+		t.Errorf("Expected only the files of the identity to be listed, got %v, %v", list.sent, err)
+	}
+
+	read := &recordingStream{ctx: withToken("secret-a"), request: &replicator.ReadRequest{RelativeFilePath: "site-b/y", BlockSize: 4}}
+	err = testPolicy.StreamInterceptor(s, read, &grpc.StreamServerInfo{FullMethod: "/replicator.FileReplicator/Read"}, func(srv any, stream grpc.ServerStream) error {
+		request := &replicator.ReadRequest{}
+		if err := stream.RecvMsg(request); err != nil {
+			return err
+		}
+		return s.Read(request, &grpc.GenericServerStream[replicator.ReadRequest, replicator.DataPayload]{ServerStream: stream})
+	})
+	if status.Code(err) != codes.PermissionDenied || len(read.sent) != 0 {
+		t.Errorf("Expected reading a file of another identity to be denied, got %v, %d messages", err, len(read.sent))
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	policyFile := filepath.Join(t.TempDir(), "policy.json")
+	os.WriteFile(policyFile, []byte(`{"identities": [{"name": "site-a", "subjects": ["sender-a"], "rules": [{"prefix": "site-a", "operations": ["write"]}]}]}`), 0600)
+	if policy, err := LoadPolicy(policyFile); err != nil || len(policy.Identities) != 1 {
+		t.Errorf("Expected the policy to load, got %+v, %v", policy, err)
+	}
+
+	os.WriteFile(policyFile, []byte(`{"identities": [{"name": "site-a", "token": "t", "rules": [{"prefix": "site-a", "operations": ["chmod"]}]}]}`), 0600)
+	if _, err := LoadPolicy(policyFile); err == nil {
+		t.Errorf("Expected an unknown operation to be refused")
+	}
+	os.WriteFile(policyFile, []byte(`{"identities": [{"name": "anyone", "rules": []}]}`), 0600)
+	if _, err := LoadPolicy(policyFile); err == nil {
+		t.Errorf("Expected an identity without credentials to be refused")
+	}
+}
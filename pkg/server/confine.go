@@ -0,0 +1,157 @@
+package server
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/kosalaat/file-replicator/pkg/controller"
+	"github.com/kosalaat/file-replicator/replicator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// resolve returns the path of a file of the senders, confined to the file
+// root. Absolute paths, "..", NUL bytes, staging files, the root itself and the
+// folders the reciever keeps in it are refused, as are paths through a symlink
+// so nothing planted in the root can lead out of it. Every component is looked
+// up below the root, which refuses to leave it.
+func (s *ReplicationServer) resolve(relativePath string) (string, error) {
+	refuse := func(reason string) (string, error) {
+		serverlogger.Warn().Msgf("Refused the path %q: %s", relativePath, reason)
+		return "", status.Errorf(codes.InvalidArgument, "%q is refused: %s", relativePath, reason)
+	}
+	if strings.ContainsRune(relativePath, 0) {
+		return refuse("it contains a NUL byte")
+	}
+	if path.IsAbs(relativePath) {
+		return refuse("it is absolute")
+	}
+	for _, component := range strings.Split(relativePath, "/") {
+		if component == ".." {
+			return refuse("it climbs out of its folder")
+		}
+		if controller.IsStagingFile(component) {
+			return refuse("it is a staging file")
+		}
+	}
+	cleaned := path.Clean(relativePath)
+	if cleaned == "." {
+		return refuse("it is the file root")
+	}
+	for _, folder := range s.reservedFolders() {
+		if cleaned == folder || strings.HasPrefix(cleaned, folder+"/") {
+			return refuse("it is kept by the reciever")
+		}
+	}
+
+	root, err := os.OpenRoot(s.FileRoot)
+	if err != nil {
+		return "", err
+	}
+	defer root.Close()
+	walked := ""
+	for _, component := range strings.Split(cleaned, "/") {
+		walked = path.Join(walked, component)
+		stat, err := root.Lstat(walked)
+		if os.IsNotExist(err) {
+			// the rest of the path is yet to be created
+			break
+		} else if err != nil {
+			return refuse(err.Error())
+		}
+		if stat.Mode()&os.ModeSymlink != 0 {
+			return refuse(walked + " is a symlink")
+		}
+	}
+	return filepath.Join(s.FileRoot, cleaned), nil
+}
+
+// reservedFolders are the folders below the file root the senders can not
+// reach: the archive, the reverse deltas and the snapshots.
+func (s *ReplicationServer) reservedFolders() []string {
+	folders := []string{s.archive().Root}
+	if s.Deltas != nil {
+		folders = append(folders, s.Deltas.Root)
+	}
+	if s.Snapshots != nil {
+		folders = append(folders, s.Snapshots.Root)
+	}
+	reserved := make([]string, 0, len(folders))
+	for _, folder := range folders {
+		if relative, err := filepath.Rel(s.FileRoot, folder); err == nil && relative != "." && !strings.HasPrefix(relative, "..") {
+			reserved = append(reserved, filepath.ToSlash(relative))
+		}
+	}
+	return reserved
+}
+
+// openRoot opens the file root and returns the path of filePath below it, so
+// the file is reached through the root methods, which refuse to follow a
+// symlink out of it.
+func (s *ReplicationServer) openRoot(filePath string) (*os.Root, string, error) {
+	relativePath, err := filepath.Rel(s.FileRoot, filePath)
+	if err != nil {
+		return nil, "", err
+	}
+	root, err := os.OpenRoot(s.FileRoot)
+	if err != nil {
+		return nil, "", err
+	}
+	return root, relativePath, nil
+}
+
+// openFile opens a file resolved below the file root through the root.
+func (s *ReplicationServer) openFile(filePath string, flag int, perm os.FileMode) (*os.File, error) {
+	root, relativePath, err := s.openRoot(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	return root.OpenFile(relativePath, flag, perm)
+}
+
+// lstatFile stats a file resolved below the file root through the root.
+func (s *ReplicationServer) lstatFile(filePath string) (os.FileInfo, error) {
+	root, relativePath, err := s.openRoot(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	return root.Lstat(relativePath)
+}
+
+// removeFile removes a file resolved below the file root through the root.
+func (s *ReplicationServer) removeFile(filePath string) error {
+	root, relativePath, err := s.openRoot(filePath)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	return root.Remove(relativePath)
+}
+
+// renameFile renames a file resolved below the file root to another one,
+// creating the folders of the new path, all through the root.
+func (s *ReplicationServer) renameFile(oldPath string, newPath string) error {
+	root, oldName, err := s.openRoot(oldPath)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	newName, err := filepath.Rel(s.FileRoot, newPath)
+	if err != nil {
+		return err
+	}
+	if err := controller.MkdirAllInRoot(root, filepath.Dir(newName), 0750); err != nil {
+		return err
+	}
+	return controller.RenameInRoot(root, oldName, root, newName)
+}
+
+func refusedPath() *replicator.Confirmation {
+	return &replicator.Confirmation{
+		Code: replicator.ConfirmationCode_PERMISSION_DENIED,
+	}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kosalaat/file-replicator/pkg/controller"
+	"github.com/kosalaat/file-replicator/replicator"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestReplicate_Confined(t *testing.T) {
+	outside := t.TempDir()
+	s := NewReplicationServer()
+	s.FileRoot = t.TempDir()
+	os.Mkdir(filepath.Join(s.FileRoot, "data"), 0755)
+	os.Symlink(outside, filepath.Join(s.FileRoot, "escape"))
+	os.Symlink(filepath.Join(outside, "target"), filepath.Join(s.FileRoot, "data", "link"))
+	os.Symlink(filepath.Join(s.FileRoot, "data"), filepath.Join(s.FileRoot, "inside"))
+
+	for _, relativePath := range []string{
+		"../x",
+		"data/../../x",
+		"data/../x",
+		"/etc/cron.d/x",
+		filepath.Join(outside, "x"),
+		"escape/x",
+		"data/link",
+		"inside/x",
+		"",
+		".",
+		"data/.x" + controller.StagingSuffix,
+		".archive/x",
+		"data/x\x00y",
+	} {
+		confirmation, err := s.Replicate(context.Background(), &replicator.DataPayload{
+			DataChunk:        []byte("data"),
+			BlockSize:        4,
+			FileMode:         0644,
+			FileSize:         4,
+			RelativeFilePath: relativePath,
+		})
+		if err != nil || confirmation.Code != replicator.ConfirmationCode_PERMISSION_DENIED {
+			t.Errorf("Expected a write to %q to be refused, got %v, %v", relativePath, confirmation, err)
+		}
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("Expected nothing written outside the file root, got %v", entries)
+	}
+
+	confirmation, err := s.Replicate(context.Background(), &replicator.DataPayload{
+		DataChunk:        []byte("data"),
+		BlockSize:        4,
+		FileMode:         0644,
+		FileSize:         4,
+		RelativeFilePath: "data/.hidden..name",
+	})
+	if err != nil || confirmation.Code != replicator.ConfirmationCode_OK {
+		t.Errorf("Expected a write below the file root to be accepted, got %v, %v", confirmation, err)
+	}
+}
+
+func TestRenameDelete_Confined(t *testing.T) {
+	outside := t.TempDir()
+	s := NewReplicationServer()
+	s.FileRoot = t.TempDir()
+	os.WriteFile(filepath.Join(s.FileRoot, "file"), []byte("data"), 0644)
+	os.WriteFile(filepath.Join(outside, "victim"), []byte("data"), 0644)
+	os.Symlink(outside, filepath.Join(s.FileRoot, "escape"))
+
+	for _, in := range []*replicator.FileOps{
+		{RelativeFilePath: "file", NewRelativeFilePath: "../file"},
+		{RelativeFilePath: "file", NewRelativeFilePath: "escape/file"},
+		{RelativeFilePath: "escape/victim", NewRelativeFilePath: "stolen"},
+		{RelativeFilePath: "file", NewRelativeFilePath: ""},
+	} {
+		if confirmation, err := s.Rename(context.Background(), in); err != nil || confirmation.Code != replicator.ConfirmationCode_PERMISSION_DENIED {
+			t.Errorf("Expected the rename of %q to %q to be refused, got %v, %v", in.RelativeFilePath, in.NewRelativeFilePath, confirmation, err)
+		}
+	}
+	for _, relativePath := range []string{"escape/victim", "../" + filepath.Base(outside) + "/victim", "", ".archive"} {
+		if confirmation, err := s.Delete(context.Background(), &replicator.FileOps{RelativeFilePath: relativePath}); err != nil || confirmation.Code != replicator.ConfirmationCode_PERMISSION_DENIED {
+			t.Errorf("Expected the delete of %q to be refused, got %v, %v", relativePath, confirmation, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(outside, "victim")); err != nil {
+		t.Errorf("Expected the file outside the file root to be left alone: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.FileRoot, "file")); err != nil {
+		t.Errorf("Expected the file to be left in place: %v", err)
+	}
+}
+
+func TestSwappedSymlink_Confined(t *testing.T) {
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "victim"), []byte("data"), 0644)
+	s := NewReplicationServer()
+	s.FileRoot = t.TempDir()
+	os.Mkdir(filepath.Join(s.FileRoot, "data"), 0755)
+	os.WriteFile(filepath.Join(s.FileRoot, "file"), []byte("data"), 0644)
+
+	filePath, err := s.resolve("data/victim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the folder is swapped for a symlink after the path was checked
+	os.Remove(filepath.Join(s.FileRoot, "data"))
+	os.Symlink(outside, filepath.Join(s.FileRoot, "data"))
+
+	if _, err := s.openFile(filePath, os.O_RDONLY, 0); err == nil {
+		t.Error("Expected the open through the symlink to be refused")
+	}
+	if _, err := s.lstatFile(filePath); err == nil {
+		t.Error("Expected the stat through the symlink to be refused")
+	}
+	if err := s.removeFile(filePath); err == nil {
+		t.Error("Expected the remove through the symlink to be refused")
+	}
+	if err := s.renameFile(filePath, filepath.Join(s.FileRoot, "stolen")); err == nil {
+		t.Error("Expected the rename out of the symlink to be refused")
+	}
+	if err := s.renameFile(filepath.Join(s.FileRoot, "file"), filePath); err == nil {
+		t.Error("Expected the rename into the symlink to be refused")
+	}
+	root, name, _ := s.openRoot(filePath)
+	defer root.Close()
+	if _, err := s.archive().Store(root, name, "data/victim"); err == nil {
+		t.Error("Expected the archive of the symlinked file to be refused")
+	}
+
+	if data, err := os.ReadFile(filepath.Join(outside, "victim")); err != nil || string(data) != "data" {
+		t.Errorf("Expected the file outside the file root to be left alone: %v", err)
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 1 {
+		t.Errorf("Expected nothing moved outside the file root, got %v", entries)
+	}
+}
+
+func TestRead_ArchiveVersionConfined(t *testing.T) {
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600)
+	s := NewReplicationServer()
+	s.FileRoot = t.TempDir()
+	os.WriteFile(filepath.Join(s.FileRoot, "a"), []byte("data"), 0644)
+	if confirmation, err := s.Delete(context.Background(), &replicator.FileOps{RelativeFilePath: "a"}); err != nil || confirmation.Code != replicator.ConfirmationCode_OK {
+		t.Fatalf("Failed to archive: %v, %v", confirmation, err)
+	}
+
+	relativeOutside, _ := filepath.Rel(s.archive().Root, filepath.Join(outside, "secret"))
+	stream := &recordingStream{ctx: context.Background()}
+	err := s.Read(&replicator.ReadRequest{RelativeFilePath: "a", Archive: true, Version: "x/../" + relativeOutside, BlockSize: 4}, &grpc.GenericServerStream[replicator.ReadRequest, replicator.DataPayload]{ServerStream: stream})
+	if status.Code(err) != codes.InvalidArgument || len(stream.sent) != 0 {
+		t.Errorf("Expected a version leading out of the archive to be refused, got %v, %d messages", err, len(stream.sent))
+	}
+
+	stream = &recordingStream{ctx: context.Background()}
+	err = s.Read(&replicator.ReadRequest{RelativeFilePath: "a", Archive: true, BlockSize: 4}, &grpc.GenericServerStream[replicator.ReadRequest, replicator.DataPayload]{ServerStream: stream})
+	if err != nil || len(stream.sent) != 2 || string(stream.sent[0].(*replicator.DataPayload).DataChunk) != "data" {
+		t.Errorf("Expected the archived version to be read, got %v, %v", stream.sent, err)
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"os"
+	"path"
+)
+
+// preserve saves the range of the file about to be overwritten when reverse
+// deltas are kept.
+func (s *ReplicationServer) preserve(relativePath string, file *os.File, offset int64, length int64) error {
+	if s.Deltas == nil {
+		return nil
+	}
+	if err := s.Deltas.Preserve(path.Clean(relativePath), file, offset, length); err != nil {
+		serverlogger.Error().Err(err).Msgf("Failed to save the reverse delta of %s", relativePath)
+		return err
+	}
+	return nil
+}
+
+func (s *ReplicationServer) preserveMode(relativePath string, file *os.File) error {
+	if s.Deltas == nil {
+		return nil
+	}
+	return s.Deltas.PreserveMode(path.Clean(relativePath), file)
+}
+
+// preserveVersion saves what committing a staged version changes beyond its
+// chunks: the tail it truncates away and the mode. Both are read from the
+// staging file, which was seeded from the live one. A version creating the
+// file is recorded as such.
+func (s *ReplicationServer) preserveVersion(relativePath string, filePath string, fileSize int64, staging *os.File) error {
+	if s.Deltas == nil {
+		return nil
+	}
+	if _, err := s.lstatFile(filePath); os.IsNotExist(err) {
+		return s.Deltas.Created(path.Clean(relativePath))
+	}
+	stat, err := staging.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() > fileSize {
+		if err := s.preserve(relativePath, staging, fileSize, stat.Size()-fileSize); err != nil {
+			return err
+		}
+	}
+	return s.preserveMode(relativePath, staging)
+}
+
+// sealDelta ends the current batch of the file, the next change to it starts
+// a new one.
+func (s *ReplicationServer) sealDelta(relativePath string) {
+	if s.Deltas == nil {
+		return
+	}
+	if err := s.Deltas.Seal(path.Clean(relativePath)); err != nil {
+		serverlogger.Error().Err(err).Msgf("Failed to seal the reverse delta of %s", relativePath)
+	}
+}
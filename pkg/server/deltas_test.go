@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/kosalaat/file-replicator/pkg/archive"
+	"github.com/kosalaat/file-replicator/pkg/deltas"
+	"github.com/kosalaat/file-replicator/replicator"
+)
+
+func TestReplicate_ReverseDeltas(t *testing.T) {
+	s := NewReplicationServer()
+	s.FileRoot = t.TempDir()
+	s.Deltas = deltas.New(t.TempDir(), archive.Retention{})
+	ctx := context.Background()
+	filePath := filepath.Join(s.FileRoot, "test.txt")
+
+	replicate := func(chunkID uint64, data string, size uint64) {
+		t.Helper()
+		confirmation, err := s.Replicate(ctx, &replicator.DataPayload{
+			RelativeFilePath: "test.txt",
+			DataChunk:        []byte(data),
+			ChunkID:          chunkID,
+			BlockSize:        4,
+			FileSize:         size,
+			FileMode:         0640,
+		})
+		if err != nil || confirmation.Code != replicator.ConfirmationCode_OK {
+			t.Fatalf("Replicate failed: %v, %v", confirmation, err)
+		}
+	}
+	finish := func(size uint64, mode uint32) {
+		t.Helper()
+		stat, _ := os.Stat(filePath)
+		owner := stat.Sys().(*syscall.Stat_t)
+		if _, err := s.Replicate(ctx, &replicator.DataPayload{RelativeFilePath: "test.txt", FileSize: size, FileMode: mode, UID: owner.Uid, GID: owner.Gid}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the file is created, then overwritten by a smaller one with a new mode
+	replicate(0, "good", 8)
+	replicate(1, "data", 8)
+	finish(8, 0640)
+	replicate(0, "evil", 4)
+	finish(4, 0600)
+
+	batches, err := s.Deltas.List("")
+	if err != nil || len(batches) != 2 {
+		t.Fatalf("Expected a batch per replication, got %+v, %v", batches, err)
+	}
+	if batches[0].Existed || !batches[1].Existed {
+		t.Errorf("Expected only the first batch to create the file, got %+v", batches)
+	}
+
+	dest := filepath.Join(t.TempDir(), "before")
+	if err := s.Deltas.Reconstruct(filePath, "test.txt", batches[1].Version, dest); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := os.ReadFile(dest)
+	stat, _ := os.Stat(dest)
+	if string(content) != "gooddata" || stat.Mode().Perm() != 0640 {
+		t.Errorf("Expected the file before the overwrite, got %q with mode %v", content, stat.Mode().Perm())
+	}
+}
+
+func TestCommit_ReverseDeltas(t *testing.T) {
+	s := NewReplicationServer()
+	s.FileRoot = t.TempDir()
+	s.Deltas = deltas.New(t.TempDir(), archive.Retention{})
+	ctx := context.Background()
+	filePath := filepath.Join(s.FileRoot, "test.txt")
+	if err := os.WriteFile(filePath, []byte("gooddatatail"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	stat, _ := os.Stat(filePath)
+	owner := stat.Sys().(*syscall.Stat_t)
+
+	// a smaller version with a new mode overwrites the first block
+	version := &replicator.FileVersion{
+		RelativeFilePath: "test.txt",
+		Version:          1,
+		FileSize:         8,
+		FileMode:         0600,
+		UID:              owner.Uid,
+		GID:              owner.Gid,
+		FileHash:         xxhash.Sum64String("evildata"),
+		BlockSize:        4,
+		Chunks:           []uint64{0},
+	}
+	if confirmation, err := s.Begin(ctx, version); err != nil || confirmation.Code != replicator.ConfirmationCode_OK {
+		t.Fatalf("Begin failed: %v, %v", confirmation, err)
+	}
+	if confirmation, err := s.Replicate(ctx, &replicator.DataPayload{
+		RelativeFilePath: "test.txt",
+		DataChunk:        []byte("evil"),
+		BlockSize:        4,
+		FileSize:         8,
+		FileMode:         0600,
+		StagingVersion:   1,
+	}); err != nil || confirmation.Code != replicator.ConfirmationCode_OK {
+		t.Fatalf("Replicate failed: %v, %v", confirmation, err)
+	}
+	if confirmation, err := s.Commit(ctx, version); err != nil || confirmation.Code != replicator.ConfirmationCode_OK {
+		t.Fatalf("Commit failed: %v, %v", confirmation, err)
+	}
+	if content, _ := os.ReadFile(filePath); string(content) != "evildata" {
+		t.Fatalf("Expected the version to be committed, got %q", content)
+	}
+
+	batches, err := s.Deltas.List("")
+	if err != nil || len(batches) != 1 {
+		t.Fatalf("Expected a batch for the version, got %+v, %v", batches, err)
+	}
+	dest := filepath.Join(t.TempDir(), "before")
+	if err := s.Deltas.Reconstruct(filePath, "test.txt", batches[0].Version, dest); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := os.ReadFile(dest)
+	stat, _ = os.Stat(dest)
+	if string(content) != "gooddatatail" || stat.Mode().Perm() != 0640 {
+		t.Errorf("Expected the file before the version, got %q with mode %v", content, stat.Mode().Perm())
+	}
+}
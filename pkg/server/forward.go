@@ -0,0 +1,292 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kosalaat/file-replicator/replicator"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var forwardlogger = log.With().Str("component", "forwarder").Logger()
+
+var (
+	forwardInitialBackoff = 500 * time.Millisecond
+	forwardMaxBackoff     = time.Minute
+)
+
+const (
+	forwardMaxAttempts = 5
+	// DefaultForwardBuffer is the amount of chunk data held for the next hop
+	// before the server stops accepting new chunks.
+	DefaultForwardBuffer = 256 << 20
+)
+
+type forwardOp int
+
+const (
+	forwardReplicate forwardOp = iota
+	forwardRename
+	forwardDelete
+	forwardBegin
+	forwardCommit
+	forwardAbort
+)
+
+type forwardItem struct {
+	op       forwardOp
+	payload  *replicator.DataPayload
+	fileOps  *replicator.FileOps
+	version  *replicator.FileVersion
+	enqueued time.Time
+}
+
+func (i *forwardItem) path() string {
+	switch {
+	case i.payload != nil:
+		return i.payload.RelativeFilePath
+	case i.version != nil:
+		return i.version.RelativeFilePath
+	case i.fileOps != nil:
+		return i.fileOps.RelativeFilePath
+	}
+	return ""
+}
+
+func (i *forwardItem) size() int {
+	if i.payload != nil {
+		return len(i.payload.DataChunk)
+	}
+	return 0
+}
+
+// ForwarderStatus is the replication lag towards the next hop.
+type ForwarderStatus struct {
+	Pending      int     `json:"pending"`
+	PendingBytes int     `json:"pending_bytes"`
+	LagSeconds   float64 `json:"lag_seconds"`
+	Forwarded    uint64  `json:"forwarded"`
+	// Stalled is set while the next hop keeps rejecting the oldest change.
+	// Nothing after it is forwarded until it is accepted.
+	Stalled     bool      `json:"stalled"`
+	Retries     uint64    `json:"retries"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitempty"`
+}
+
+// Forwarder relays the changes committed by the ReplicationServer to a
+// downstream receiver, in the order they were applied, so a receiver can feed
+// the next site without rescanning its own FileRoot.
+type Forwarder struct {
+	client      replicator.FileReplicatorClient
+	MaxBuffered int
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queue    []*forwardItem
+	buffered int
+	closed   bool
+	status   ForwarderStatus
+}
+
+func NewForwarder(client replicator.FileReplicatorClient) *Forwarder {
+	f := &Forwarder{client: client, MaxBuffered: DefaultForwardBuffer}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *Forwarder) enqueue(item *forwardItem) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Hold back the upstream while the next hop is too far behind.
+	for f.buffered > 0 && f.buffered+item.size() > f.MaxBuffered && !f.closed {
+		f.cond.Wait()
+	}
+	if f.closed {
+		return
+	}
+	item.enqueued = time.Now()
+	f.queue = append(f.queue, item)
+	f.buffered += item.size()
+	f.cond.Broadcast()
+}
+
+func (f *Forwarder) Replicated(payload *replicator.DataPayload) {
+	f.enqueue(&forwardItem{op: forwardReplicate, payload: payload})
+}
+
+func (f *Forwarder) Begun(version *replicator.FileVersion) {
+	f.enqueue(&forwardItem{op: forwardBegin, version: version})
+}
+
+func (f *Forwarder) Committed(version *replicator.FileVersion) {
+	f.enqueue(&forwardItem{op: forwardCommit, version: version})
+}
+
+func (f *Forwarder) Aborted(version *replicator.FileVersion) {
+	f.enqueue(&forwardItem{op: forwardAbort, version: version})
+}
+
+func (f *Forwarder) Renamed(fileOps *replicator.FileOps) {
+	f.enqueue(&forwardItem{op: forwardRename, fileOps: fileOps})
+}
+
+func (f *Forwarder) Deleted(fileOps *replicator.FileOps) {
+	f.enqueue(&forwardItem{op: forwardDelete, fileOps: fileOps})
+}
+
+func (f *Forwarder) next() (*forwardItem, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.queue) == 0 && !f.closed {
+		f.cond.Wait()
+	}
+	if f.closed {
+		return nil, false
+	}
+	return f.queue[0], true
+}
+
+func (f *Forwarder) done(item *forwardItem) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queue = f.queue[1:]
+	f.buffered -= item.size()
+	f.status.Forwarded++
+	f.cond.Broadcast()
+}
+
+// stall marks the forwarding as held up by a change the next hop rejects,
+// reporting whether it was not already.
+func (f *Forwarder) stall(stalled bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	changed := f.status.Stalled != stalled
+	f.status.Stalled = stalled
+	return changed
+}
+
+func (f *Forwarder) send(ctx context.Context, item *forwardItem) error {
+	var confirmation *replicator.Confirmation
+	var err error
+	switch item.op {
+	case forwardReplicate:
+		confirmation, err = f.client.Replicate(ctx, item.payload)
+	case forwardBegin:
+		confirmation, err = f.client.Begin(ctx, item.version)
+	case forwardCommit:
+		confirmation, err = f.client.Commit(ctx, item.version)
+	case forwardAbort:
+		confirmation, err = f.client.Abort(ctx, item.version)
+	case forwardRename:
+		confirmation, err = f.client.Rename(ctx, item.fileOps)
+	case forwardDelete:
+		confirmation, err = f.client.Delete(ctx, item.fileOps)
+		if confirmation != nil && confirmation.Code == replicator.ConfirmationCode_FILE_NOT_FOUND {
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if confirmation.Code != replicator.ConfirmationCode_OK {
+		return status.Errorf(codes.Unknown, "next hop replied with %s", confirmation.Code)
+	}
+	return nil
+}
+
+// Run forwards the queued changes until the context is cancelled or the
+// forwarder is closed. A change is never skipped, the changes after it would
+// be applied to a file the next hop does not hold. Once the next hop rejected
+// it forwardMaxAttempts times the forwarding is reported stalled and the change
+// is retried at the longest backoff until it is accepted.
+func (f *Forwarder) Run(ctx context.Context) {
+	forwardlogger.Info().Msg("Forwarding applied changes to the next hop")
+	for {
+		item, ok := f.next()
+		if !ok {
+			return
+		}
+
+		backoff := forwardInitialBackoff
+		for attempt := 1; ; attempt++ {
+			err := f.send(ctx, item)
+			if err == nil {
+				if f.stall(false) {
+					forwardlogger.Info().Msg("Next hop accepted the change, forwarding resumed")
+				}
+				f.done(item)
+				break
+			}
+
+			f.mu.Lock()
+			f.status.LastError = err.Error()
+			f.status.LastErrorAt = time.Now()
+			f.mu.Unlock()
+
+			code := status.Code(err)
+			if code != codes.Unavailable && code != codes.DeadlineExceeded && attempt >= forwardMaxAttempts && f.stall(true) {
+				forwardlogger.Error().Err(err).Msgf("Next hop rejected the change to %s %d times, forwarding is stalled until it is accepted", item.path(), attempt)
+			}
+
+			f.mu.Lock()
+			f.status.Retries++
+			f.mu.Unlock()
+			forwardlogger.Warn().Err(err).Msgf("Failed to forward change, retrying in %v", backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, forwardMaxBackoff)
+		}
+	}
+}
+
+func (f *Forwarder) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	f.cond.Broadcast()
+}
+
+func (f *Forwarder) Status() ForwarderStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result := f.status
+	result.Pending = len(f.queue)
+	result.PendingBytes = f.buffered
+	if len(f.queue) > 0 {
+		result.LagSeconds = time.Since(f.queue[0].enqueued).Seconds()
+	}
+	return result
+}
+
+// Idle reports whether every applied change was forwarded.
+func (f *Forwarder) Idle() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.queue) == 0
+}
+
+// LogStatus logs the lag towards the next hop at the given interval.
+func (f *Forwarder) LogStatus(interval time.Duration) {
+	for range time.Tick(interval) {
+		status := f.Status()
+		forwardlogger.Info().
+			Int("pending", status.Pending).
+			Int("pending_bytes", status.PendingBytes).
+			Float64("lag_seconds", status.LagSeconds).
+			Uint64("forwarded", status.Forwarded).
+			Uint64("retries", status.Retries).
+			Bool("stalled", status.Stalled).
+			Msg("Forwarding status")
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/replicator"
+	"github.com/phayes/freeport"
+	"google.golang.org/grpc"
+)
+
+func TestForwarder_Cascade(t *testing.T) {
+	siteB := t.TempDir()
+	siteC := t.TempDir()
+
+	ports, err := freeport.GetFreePorts(2)
+	if err != nil {
+		t.Fatalf("Failed to get free ports: %v", err)
+	}
+	addressB := fmt.Sprintf("127.0.0.1:%d", ports[0])
+	addressC := fmt.Sprintf("127.0.0.1:%d", ports[1])
+
+	serverC := NewReplicationServer()
+	go func() {
+		serverC.StartListening(addressC, siteC)
+	}()
+	defer serverC.StopListening()
+
+	nextHop, err := client.NewReplicatorClient(addressC, siteB, 10)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	serverB := NewReplicationServer()
+	serverB.Forwarder = NewForwarder(nextHop.FileReplicatorClient)
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFunc()
+	go serverB.Forwarder.Run(ctx)
+	go func() {
+		serverB.StartListening(addressB, siteB)
+	}()
+	defer serverB.StopListening()
+
+	siteA, err := client.NewReplicatorClient(addressB, "/tmp", 10)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	for i, data := range []string{"abc1", "def2", "ghi3"} {
+		if _, err := siteA.FileReplicatorClient.Replicate(ctx, &replicator.DataPayload{
+			DataChunk:        []byte(data),
+			ChunkID:          uint64(i),
+			BlockSize:        4,
+			FileMode:         0644,
+			FileSize:         12,
+			RelativeFilePath: "test.txt",
+		}, grpc.WaitForReady(true)); err != nil {
+			t.Fatalf("Failed to replicate chunk %d: %v", i, err)
+		}
+	}
+	if _, err := siteA.RenameFile(ctx, "test.txt", "renamed.txt"); err != nil {
+		t.Fatalf("Failed to rename file: %v", err)
+	}
+
+	for !serverB.Forwarder.Idle() {
+		if ctx.Err() != nil {
+			t.Fatalf("Forwarder did not catch up: %+v", serverB.Forwarder.Status())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	content, err := os.ReadFile(filepath.Join(siteC, "renamed.txt"))
+	if err != nil {
+		t.Fatalf("Forwarded file does not exist on the next hop: %v", err)
+	}
+	if string(content) != "abc1def2ghi3" {
+		t.Fatalf("Expected forwarded content 'abc1def2ghi3', got '%s'", string(content))
+	}
+	if status := serverB.Forwarder.Status(); status.Forwarded != 4 || status.Pending != 0 {
+		t.Fatalf("Unexpected forwarder status: %+v", status)
+	}
+}
+
+type rejectingHop struct {
+	replicator.FileReplicatorClient
+	lock       sync.Mutex
+	rejections int
+	renamed    []string
+}
+
+func (r *rejectingHop) forwarded() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.renamed...)
+}
+
+func (r *rejectingHop) Rename(ctx context.Context, in *replicator.FileOps, opts ...grpc.CallOption) (*replicator.Confirmation, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if in.RelativeFilePath == "rejected" && r.rejections > 0 {
+		r.rejections--
+		return &replicator.Confirmation{Code: replicator.ConfirmationCode_FILE_NOT_FOUND}, nil
+	}
+	r.renamed = append(r.renamed, in.RelativeFilePath)
+	return &replicator.Confirmation{Code: replicator.ConfirmationCode_OK}, nil
+}
+
+func TestForwarder_StallsOnRejection(t *testing.T) {
+	forwardInitialBackoff, forwardMaxBackoff = time.Millisecond, 10*time.Millisecond
+	defer func() { forwardInitialBackoff, forwardMaxBackoff = 500*time.Millisecond, time.Minute }()
+
+	hop := &rejectingHop{rejections: 2 * forwardMaxAttempts}
+	forwarder := NewForwarder(hop)
+	forwarder.Renamed(&replicator.FileOps{RelativeFilePath: "rejected", NewRelativeFilePath: "a"})
+	forwarder.Renamed(&replicator.FileOps{RelativeFilePath: "next", NewRelativeFilePath: "b"})
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFunc()
+	go forwarder.Run(ctx)
+
+	stalled := false
+	for !forwarder.Idle() {
+		if ctx.Err() != nil {
+			t.Fatalf("Forwarder did not catch up: %+v", forwarder.Status())
+		}
+		status := forwarder.Status()
+		stalled = stalled || status.Stalled
+		if forwarded := hop.forwarded(); status.Stalled && len(forwarded) > 0 {
+			t.Fatalf("Expected nothing forwarded past the rejected change, got %v", forwarded)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !stalled {
+		t.Errorf("Expected the forwarding to be reported stalled")
+	}
+	if status, forwarded := forwarder.Status(), hop.forwarded(); status.Stalled || status.Forwarded != 2 || len(forwarded) != 2 || forwarded[0] != "rejected" {
+		t.Errorf("Expected both changes forwarded in order, got %+v, %v", status, forwarded)
+	}
+}
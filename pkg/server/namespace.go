@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/kosalaat/file-replicator/replicator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// namespaceOf returns the namespace the caller named in the "namespace"
+// metadata, empty for the default file root.
+func namespaceOf(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("namespace"); len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// NewNamespace returns a server for the files of a namespace, isolated in its
+// own file root with its own index cache, archive and quota. It accepts the
+// same block hashes as s and has a quota of the same limits. The version
+// store, reverse deltas, snapshots and forwarding of s are not carried over,
+// see CheckNamespaces.
+func (s *ReplicationServer) NewNamespace(fileRoot string) *ReplicationServer {
+	namespace := NewReplicationServer()
+	namespace.FileRoot = fileRoot
+	namespace.HashAlgorithms = s.HashAlgorithms
+	if s.Quota != nil {
+		quota := *s.Quota
+		namespace.Quota = &quota
+	}
+	return namespace
+}
+
+// CheckNamespaces refuses a server whose namespaces would not be isolated: they
+// need a policy keeping every sender to its own namespace, and the version
+// store, reverse deltas, snapshots and forwarding only cover the default file
+// root.
+func (s *ReplicationServer) CheckNamespaces() error {
+	if len(s.Namespaces) == 0 {
+		return nil
+	}
+	switch {
+	case s.Policy == nil:
+		return errors.New("namespaces need an authorization policy")
+	case s.Versions != nil:
+		return errors.New("version tracking does not cover namespaces")
+	case s.Deltas != nil:
+		return errors.New("reverse deltas do not cover namespaces")
+	case s.Snapshots != nil:
+		return errors.New("snapshots do not cover namespaces")
+	case s.Forwarder != nil:
+		return errors.New("forwarding does not cover namespaces")
+	}
+	return nil
+}
+
+// namespaceRouter serves every call from the server of the namespace it names.
+type namespaceRouter struct {
+	replicator.UnimplementedFileReplicatorServer
+	root *ReplicationServer
+}
+
+func (n *namespaceRouter) server(ctx context.Context) (*ReplicationServer, error) {
+	name := namespaceOf(ctx)
+	if name == "" {
+		return n.root, nil
+	}
+	if namespace, ok := n.root.Namespaces[name]; ok {
+		return namespace, nil
+	}
+	serverlogger.Warn().Msgf("Refused call to the unknown namespace %q", name)
+	return nil, status.Errorf(codes.NotFound, "unknown namespace %q", name)
+}
+
+func unknownNamespace() *replicator.Confirmation {
+	return &replicator.Confirmation{
+		Code: replicator.ConfirmationCode_UNKNOWN_NAMESPACE,
+	}
+}
+
+func (n *namespaceRouter) Replicate(ctx context.Context, in *replicator.DataPayload) (*replicator.Confirmation, error) {
+	if s, err := n.server(ctx); err != nil {
+		return unknownNamespace(), nil
+	} else {
+		return s.Replicate(ctx, in)
+	}
+}
+
+func (n *namespaceRouter) CheckDuplicates(ctx context.Context, in *replicator.DataSignature) (*replicator.Confirmation, error) {
+	if s, err := n.server(ctx); err != nil {
+		return unknownNamespace(), nil
+	} else {
+		return s.CheckDuplicates(ctx, in)
+	}
+}
+
+func (n *namespaceRouter) Rename(ctx context.Context, in *replicator.FileOps) (*replicator.Confirmation, error) {
+	if s, err := n.server(ctx); err != nil {
+		return unknownNamespace(), nil
+	} else {
+		return s.Rename(ctx, in)
+	}
+}
+
+func (n *namespaceRouter) Delete(ctx context.Context, in *replicator.FileOps) (*replicator.Confirmation, error) {
+	if s, err := n.server(ctx); err != nil {
+		return unknownNamespace(), nil
+	} else {
+		return s.Delete(ctx, in)
+	}
+}
+
+func (n *namespaceRouter) Begin(ctx context.Context, in *replicator.FileVersion) (*replicator.Confirmation, error) {
+	if s, err := n.server(ctx); err != nil {
+		return unknownNamespace(), nil
+	} else {
+		return s.Begin(ctx, in)
+	}
+}
+
+func (n *namespaceRouter) Commit(ctx context.Context, in *replicator.FileVersion) (*replicator.Confirmation, error) {
+	if s, err := n.server(ctx); err != nil {
+		return unknownNamespace(), nil
+	} else {
+		return s.Commit(ctx, in)
+	}
+}
+
+func (n *namespaceRouter) Abort(ctx context.Context, in *replicator.FileVersion) (*replicator.Confirmation, error) {
+	if s, err := n.server(ctx); err != nil {
+		return unknownNamespace(), nil
+	} else {
+		return s.Abort(ctx, in)
+	}
+}
+
+func (n *namespaceRouter) Ping(ctx context.Context, in *replicator.PingPong) (*replicator.PingPong, error) {
+	if s, err := n.server(ctx); err != nil {
+		return nil, err
+	} else {
+		return s.Ping(ctx, in)
+	}
+}
+
+func (n *namespaceRouter) BlockMap(ctx context.Context, in *replicator.BlockMapRequest) (*replicator.FileBlockMap, error) {
+	if s, err := n.server(ctx); err != nil {
+		return nil, err
+	} else {
+		return s.BlockMap(ctx, in)
+	}
+}
+
+func (n *namespaceRouter) Snapshot(ctx context.Context, in *replicator.SnapshotRequest) (*replicator.SnapshotInfo, error) {
+	if s, err := n.server(ctx); err != nil {
+		return nil, err
+	} else {
+		return s.Snapshot(ctx, in)
+	}
+}
+
+func (n *namespaceRouter) List(in *replicator.ListRequest, stream replicator.FileReplicator_ListServer) error {
+	if s, err := n.server(stream.Context()); err != nil {
+		return err
+	} else {
+		return s.List(in, stream)
+	}
+}
+
+func (n *namespaceRouter) Digest(in *replicator.DigestRequest, stream replicator.FileReplicator_DigestServer) error {
+	if s, err := n.server(stream.Context()); err != nil {
+		return err
+	} else {
+		return s.Digest(in, stream)
+	}
+}
+
+func (n *namespaceRouter) Read(in *replicator.ReadRequest, stream replicator.FileReplicator_ReadServer) error {
+	if s, err := n.server(stream.Context()); err != nil {
+		return err
+	} else {
+		return s.Read(in, stream)
+	}
+}
+
+// lstatIn returns the file at relativePath in the namespace.
+func (r *ReplicationServer) lstatIn(namespace string, relativePath string) (os.FileInfo, error) {
+	s := r
+	if namespace != "" {
+		if s = r.Namespaces[namespace]; s == nil {
+			return nil, os.ErrNotExist
+		}
+	}
+	filePath, err := s.resolve(relativePath)
+	if err != nil {
+		return nil, err
+	}
+	return s.lstatFile(filePath)
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/replicator"
+	"github.com/phayes/freeport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestNamespaces(t *testing.T) {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+
+	defaultRoot := t.TempDir()
+	s := NewReplicationServer()
+	s.Namespaces = map[string]*ReplicationServer{
+		"site-a": s.NewNamespace(t.TempDir()),
+		"site-b": s.NewNamespace(t.TempDir()),
+	}
+	go func() {
+		s.StartListening(address, defaultRoot)
+	}()
+	defer s.StopListening()
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFunc()
+	replicate := func(namespace string, data string) replicator.ConfirmationCode {
+		sender, err := client.NewReplicatorClient(address, "/tmp", 1, client.WithNamespace(namespace))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		confirmation, err := sender.FileReplicatorClient.Replicate(ctx, &replicator.DataPayload{
+			DataChunk:        []byte(data),
+			BlockSize:        4,
+			FileMode:         0644,
+			FileSize:         4,
+			RelativeFilePath: "test.txt",
+		}, grpc.WaitForReady(true))
+		if err != nil {
+			t.Fatalf("Failed to replicate into %q: %v", namespace, err)
+		}
+		return confirmation.Code
+	}
+
+	for namespace, data := range map[string]string{"site-a": "aaaa", "site-b": "bbbb", "": "cccc"} {
+		if code := replicate(namespace, data); code != replicator.ConfirmationCode_OK {
+			t.Fatalf("Expected the chunk of %q to be written, got %s", namespace, code)
+		}
+	}
+	for root, data := range map[string]string{
+		s.Namespaces["site-a"].FileRoot: "aaaa",
+		s.Namespaces["site-b"].FileRoot: "bbbb",
+		defaultRoot:                     "cccc",
+	} {
+		if content, err := os.ReadFile(filepath.Join(root, "test.txt")); err != nil || string(content) != data {
+			t.Errorf("Expected %q in %s, got %q, %v", data, root, content, err)
+		}
+	}
+
+	if code := replicate("site-c", "dddd"); code != replicator.ConfirmationCode_UNKNOWN_NAMESPACE {
+		t.Errorf("Expected an unknown namespace to be refused, got %s", code)
+	}
+}
+
+func TestPolicy_Namespaces(t *testing.T) {
+	policy := &Policy{Identities: []Identity{{
+		Name:  "site-a",
+		Token: "secret-a",
+		Rules: []Rule{{Namespace: "site-a", Operations: []string{OpWrite}}},
+	}}}
+	handled := func(ctx context.Context, request any) (any, error) {
+		return &replicator.Confirmation{Code: replicator.ConfirmationCode_OK}, nil
+	}
+	for namespace, expected := range map[string]replicator.ConfirmationCode{
+		"site-a": replicator.ConfirmationCode_OK,
+		"site-b": replicator.ConfirmationCode_PERMISSION_DENIED,
+		"":       replicator.ConfirmationCode_PERMISSION_DENIED,
+	} {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer secret-a", "namespace", namespace))
+		response, err := policy.UnaryInterceptor(ctx, &replicator.DataPayload{RelativeFilePath: "x", DataChunk: []byte("x")}, &grpc.UnaryServerInfo{FullMethod: "/replicator.FileReplicator/Replicate"}, handled)
+		if err != nil || response.(*replicator.Confirmation).Code != expected {
+			t.Errorf("Expected %s for namespace %q, got %v, %v", expected, namespace, response, err)
+		}
+	}
+}
+
+func TestCheckNamespaces(t *testing.T) {
+	s := NewReplicationServer()
+	if err := s.CheckNamespaces(); err != nil {
+		t.Errorf("Expected a server without namespaces to pass, got %v", err)
+	}
+	s.Namespaces = map[string]*ReplicationServer{"site-a": s.NewNamespace(t.TempDir())}
+	if err := s.CheckNamespaces(); err == nil {
+		t.Errorf("Expected namespaces without a policy to be refused")
+	}
+	s.Policy = &Policy{}
+	if err := s.CheckNamespaces(); err != nil {
+		t.Errorf("Expected namespaces with a policy to pass, got %v", err)
+	}
+	s.Forwarder = NewForwarder(nil)
+	if err := s.CheckNamespaces(); err == nil {
+		t.Errorf("Expected forwarding to be refused with namespaces")
+	}
+}
+
+func TestVerificationReport_Namespace(t *testing.T) {
+	report := &VerificationReport{Path: filepath.Join(t.TempDir(), "verify.jsonl")}
+	report.Namespace("site-a").record("x", 1, "sha256", []byte("a"), []byte("a"))
+	content, err := os.ReadFile(report.Path)
+	if err != nil || !strings.Contains(string(content), `"namespace":"site-a"`) {
+		t.Errorf("Expected the record to name its namespace, got %s, %v", content, err)
+	}
+}
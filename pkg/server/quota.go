@@ -0,0 +1,197 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/kosalaat/file-replicator/pkg/controller"
+	"github.com/kosalaat/file-replicator/replicator"
+)
+
+// Quota limits the storage the senders can use in the file root. A limit of 0
+// is not enforced.
+type Quota struct {
+	// MaxBytes is the total size of the files.
+	MaxBytes int64
+	// MaxFiles is the number of files.
+	MaxFiles int64
+	// MinFree is the space kept free on the volume of the file root.
+	MinFree int64
+}
+
+// usage is the size of every file in the file root, counted once and then
+// kept current by the writes.
+type usage struct {
+	lock  sync.Mutex
+	sizes map[string]int64
+	bytes int64
+	// reserved is the growth announced for the files being written, held
+	// until they are accounted or their version is dropped.
+	reserved      map[string]int64
+	reservedBytes int64
+}
+
+// reserve holds the growth of a file, replacing what it held before.
+func (u *usage) reserve(filePath string, growth int64) {
+	if u.reserved == nil {
+		u.reserved = make(map[string]int64)
+	}
+	u.reservedBytes += growth - u.reserved[filePath]
+	u.reserved[filePath] = growth
+}
+
+// unreserve releases the growth held for a file.
+func (u *usage) unreserve(filePath string) {
+	u.reservedBytes -= u.reserved[filePath]
+	delete(u.reserved, filePath)
+}
+
+// newFiles is the number of files other than filePath reserved but not
+// written yet.
+func (u *usage) newFiles(filePath string) int64 {
+	var files int64
+	for reserved := range u.reserved {
+		if _, exists := u.sizes[reserved]; !exists && reserved != filePath {
+			files++
+		}
+	}
+	return files
+}
+
+// count walks the file root the first time the usage is needed. The archive,
+// deltas, snapshots and staging files are left out.
+func (s *ReplicationServer) count() error {
+	if s.usage.sizes != nil {
+		return nil
+	}
+	reserved := make(map[string]bool)
+	for _, folder := range s.reservedFolders() {
+		reserved[filepath.Join(s.FileRoot, folder)] = true
+	}
+	sizes := make(map[string]int64)
+	var bytes int64
+	err := filepath.WalkDir(s.FileRoot, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() {
+			if reserved[filePath] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() || controller.IsStagingFile(filePath) {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			sizes[filePath] = info.Size()
+			bytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	serverlogger.Info().Msgf("Counted %d files of %d bytes in %s", len(sizes), bytes, s.FileRoot)
+	s.usage.sizes, s.usage.bytes = sizes, bytes
+	return nil
+}
+
+// preflight checks that a file can grow to the announced size, within the
+// quota and the free space of the volume, before it is written. previous is
+// the file as it is, nil when it does not exist yet. The growth is reserved
+// under the same lock, so files written at the same time can not overshoot
+// the quota together, until account or release gives it back.
+func (s *ReplicationServer) preflight(relativePath string, previous os.FileInfo, size uint64) replicator.ConfirmationCode {
+	filePath := filepath.Join(s.FileRoot, path.Clean(relativePath))
+	growth := int64(size)
+	if previous != nil {
+		growth -= previous.Size()
+		if growth <= 0 {
+			return replicator.ConfirmationCode_OK
+		}
+	}
+
+	var minFree, reserved int64
+	if s.Quota != nil {
+		minFree = s.Quota.MinFree
+		s.usage.lock.Lock()
+		defer s.usage.lock.Unlock()
+		err := s.count()
+		reserved = s.usage.reservedBytes - s.usage.reserved[filePath]
+		bytes := s.usage.bytes + reserved
+		files := int64(len(s.usage.sizes)) + s.usage.newFiles(filePath)
+		if err != nil {
+			serverlogger.Error().Err(err).Msgf("Failed to count the usage of %s", s.FileRoot)
+		} else if s.Quota.MaxBytes > 0 && bytes+growth > s.Quota.MaxBytes {
+			serverlogger.Warn().Msgf("Refusing %s of %d bytes, %d of %d bytes are used", relativePath, size, bytes, s.Quota.MaxBytes)
+			return replicator.ConfirmationCode_QUOTA_EXCEEDED
+		} else if s.Quota.MaxFiles > 0 && previous == nil && files >= s.Quota.MaxFiles {
+			serverlogger.Warn().Msgf("Refusing %s, %d of %d files are used", relativePath, files, s.Quota.MaxFiles)
+			return replicator.ConfirmationCode_QUOTA_EXCEEDED
+		}
+	}
+
+	var volume syscall.Statfs_t
+	if err := syscall.Statfs(s.FileRoot, &volume); err != nil {
+		serverlogger.Error().Err(err).Msgf("Failed to check the free space of %s", s.FileRoot)
+	} else if free := int64(volume.Bavail) * int64(volume.Bsize); free-reserved-growth < minFree {
+		serverlogger.Warn().Msgf("Refusing %s of %d bytes, %d bytes are free on the volume of %s", relativePath, size, free, s.FileRoot)
+		return replicator.ConfirmationCode_NO_SPACE
+	}
+	if s.Quota != nil && s.usage.sizes != nil {
+		s.usage.reserve(filePath, growth)
+	}
+	return replicator.ConfirmationCode_OK
+}
+
+// account updates the usage with the file as it is now and releases the
+// growth reserved for it.
+func (s *ReplicationServer) account(filePath string) {
+	if s.Quota == nil {
+		return
+	}
+	s.usage.lock.Lock()
+	defer s.usage.lock.Unlock()
+	s.usage.unreserve(filePath)
+	if s.usage.sizes == nil {
+		return
+	}
+	s.usage.bytes -= s.usage.sizes[filePath]
+	if current, err := s.lstatFile(filePath); err == nil {
+		s.usage.sizes[filePath] = current.Size()
+		s.usage.bytes += current.Size()
+	} else {
+		delete(s.usage.sizes, filePath)
+	}
+}
+
+// release gives back the growth reserved for a file that is not written after
+// all.
+func (s *ReplicationServer) release(filePath string) {
+	if s.Quota == nil {
+		return
+	}
+	s.usage.lock.Lock()
+	defer s.usage.lock.Unlock()
+	s.usage.unreserve(filePath)
+}
+
+// storageCode tells the sender the volume or its quota is full, rather than
+// failing the write with the code given.
+func storageCode(err error, code replicator.ConfirmationCode) replicator.ConfirmationCode {
+	if errors.Is(err, syscall.ENOSPC) {
+		return replicator.ConfirmationCode_NO_SPACE
+	} else if errors.Is(err, syscall.EDQUOT) {
+		return replicator.ConfirmationCode_QUOTA_EXCEEDED
+	}
+	return code
+}
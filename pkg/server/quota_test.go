@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kosalaat/file-replicator/replicator"
+)
+
+func replicateFile(s *ReplicationServer, relativePath string, data string) replicator.ConfirmationCode {
+	confirmation, _ := s.Replicate(context.Background(), &replicator.DataPayload{
+		DataChunk:        []byte(data),
+		BlockSize:        uint64(len(data)),
+		FileMode:         0644,
+		FileSize:         uint64(len(data)),
+		RelativeFilePath: relativePath,
+	})
+	return confirmation.Code
+}
+
+func TestQuota_Bytes(t *testing.T) {
+	s := NewReplicationServer()
+	s.FileRoot = t.TempDir()
+	os.WriteFile(filepath.Join(s.FileRoot, "existing"), []byte("12345678"), 0644)
+	s.Quota = &Quota{MaxBytes: 16}
+
+	if code := replicateFile(s, "a", "12345678"); code != replicator.ConfirmationCode_OK {
+		t.Fatalf("Expected a file within the quota to be written, got %s", code)
+	}
+	if code := replicateFile(s, "b", "1"); code != replicator.ConfirmationCode_QUOTA_EXCEEDED {
+		t.Errorf("Expected a file over the quota to be refused, got %s", code)
+	}
+	if _, err := os.Stat(filepath.Join(s.FileRoot, "b")); !os.IsNotExist(err) {
+		t.Errorf("Expected the refused file not to be created: %v", err)
+	}
+	if code := replicateFile(s, "a", "1234"); code != replicator.ConfirmationCode_OK {
+		t.Errorf("Expected a file shrinking to be written, got %s", code)
+	}
+	if code := replicateFile(s, "b", "1234"); code != replicator.ConfirmationCode_OK {
+		t.Errorf("Expected the space freed by the shrinking file to be used, got %s", code)
+	}
+
+	if confirmation, err := s.Delete(context.Background(), &replicator.FileOps{RelativeFilePath: "existing"}); err != nil || confirmation.Code != replicator.ConfirmationCode_OK {
+		t.Fatalf("Failed to delete: %v, %v", confirmation, err)
+	}
+	if code := replicateFile(s, "c", "12345678"); code != replicator.ConfirmationCode_OK {
+		t.Errorf("Expected the space of the deleted file to be used, got %s", code)
+	}
+}
+
+func TestQuota_Files(t *testing.T) {
+	s := NewReplicationServer()
+	s.FileRoot = t.TempDir()
+	s.Quota = &Quota{MaxFiles: 2}
+
+	for _, name := range []string{"a", "b"} {
+		if code := replicateFile(s, name, "data"); code != replicator.ConfirmationCode_OK {
+			t.Fatalf("Expected %s to be written, got %s", name, code)
+		}
+	}
+	if code := replicateFile(s, "c", "data"); code != replicator.ConfirmationCode_QUOTA_EXCEEDED {
+		t.Errorf("Expected a file over the quota to be refused, got %s", code)
+	}
+	if code := replicateFile(s, "a", "more data"); code != replicator.ConfirmationCode_OK {
+		t.Errorf("Expected an existing file to be updated, got %s", code)
+	}
+	if confirmation, err := s.Rename(context.Background(), &replicator.FileOps{RelativeFilePath: "a", NewRelativeFilePath: "b"}); err != nil || confirmation.Code != replicator.ConfirmationCode_OK {
+		t.Fatalf("Failed to rename: %v, %v", confirmation, err)
+	}
+	if code := replicateFile(s, "c", "data"); code != replicator.ConfirmationCode_OK {
+		t.Errorf("Expected the file replaced by the rename to be freed, got %s", code)
+	}
+}
+
+func TestQuota_NoSpace(t *testing.T) {
+	s := NewReplicationServer()
+	s.FileRoot = t.TempDir()
+	s.Quota = &Quota{MinFree: 1 << 62}
+
+	if code := replicateFile(s, "a", "data"); code != replicator.ConfirmationCode_NO_SPACE {
+		t.Errorf("Expected a file leaving too little free space to be refused, got %s", code)
+	}
+	confirmation, _ := s.Begin(context.Background(), &replicator.FileVersion{RelativeFilePath: "a", Version: 1, FileSize: 4})
+	if confirmation.Code != replicator.ConfirmationCode_NO_SPACE {
+		t.Errorf("Expected a version leaving too little free space to be refused, got %s", confirmation.Code)
+	}
+}
+
+func TestQuota_Reserved(t *testing.T) {
+	s := NewReplicationServer()
+	s.FileRoot = t.TempDir()
+	s.Quota = &Quota{MaxBytes: 8, MaxFiles: 2}
+	ctx := context.Background()
+
+	first := &replicator.FileVersion{RelativeFilePath: "a", Version: 1, FileSize: 6}
+	if confirmation, _ := s.Begin(ctx, first); confirmation.Code != replicator.ConfirmationCode_OK {
+		t.Fatalf("Expected a version within the quota to begin, got %s", confirmation.Code)
+	}
+	second := &replicator.FileVersion{RelativeFilePath: "b", Version: 1, FileSize: 6}
+	if confirmation, _ := s.Begin(ctx, second); confirmation.Code != replicator.ConfirmationCode_QUOTA_EXCEEDED {
+		t.Errorf("Expected the growth of the open version to be reserved, got %s", confirmation.Code)
+	}
+	if code := replicateFile(s, "c", "12"); code != replicator.ConfirmationCode_OK {
+		t.Fatalf("Expected a file within what is left to be written, got %s", code)
+	}
+	if code := replicateFile(s, "d", "1"); code != replicator.ConfirmationCode_QUOTA_EXCEEDED {
+		t.Errorf("Expected the reserved file to count against the files, got %s", code)
+	}
+
+	if _, err := s.Abort(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	if confirmation, _ := s.Begin(ctx, second); confirmation.Code != replicator.ConfirmationCode_OK {
+		t.Errorf("Expected the aborted version to release its growth, got %s", confirmation.Code)
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/kosalaat/file-replicator/pkg/archive"
+	"github.com/kosalaat/file-replicator/replicator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Read streams a file back to the sender for a restore. Only the blocks whose
+// hash differs from the ones the caller already has are sent, followed by a
+// payload without data carrying the size, mode and ownership of the file.
+func (s *ReplicationServer) Read(in *replicator.ReadRequest, stream replicator.FileReplicator_ReadServer) error {
+	filePath, err := s.resolve(in.RelativeFilePath)
+	if err != nil {
+		return err
+	}
+	if !validBlockSize(in.BlockSize) {
+		return status.Errorf(codes.InvalidArgument, "block size %d is not between 1 and %d bytes", in.BlockSize, MaxBlockSize)
+	}
+
+	var inFile *os.File
+	if in.Archive {
+		inFile, err = s.archive().Open(path.Clean(in.RelativeFilePath), in.Version)
+		if errors.Is(err, archive.ErrInvalidVersion) {
+			serverlogger.Warn().Err(err).Msgf("Refused archived version %q of %s", in.Version, in.RelativeFilePath)
+			return status.Errorf(codes.InvalidArgument, "%q is not an archived version", in.Version)
+		} else if err != nil {
+			serverlogger.Error().Err(err).Msgf("No archived version %q of %s", in.Version, in.RelativeFilePath)
+			return status.Errorf(codes.NotFound, "%s has no archived version %q", in.RelativeFilePath, in.Version)
+		}
+	} else {
+		inFile, err = s.openFile(filePath, os.O_RDONLY, 0)
+		if err != nil {
+			serverlogger.Error().Err(err).Msgf("Failed to open %s for reading", filePath)
+			if os.IsNotExist(err) {
+				return status.Errorf(codes.NotFound, "%s does not exist", in.RelativeFilePath)
+			}
+			return status.Errorf(codes.PermissionDenied, "%s is not readable", in.RelativeFilePath)
+		}
+	}
+	defer inFile.Close()
+
+	stat, err := inFile.Stat()
+	if err != nil {
+		return err
+	}
+	if !stat.Mode().IsRegular() {
+		return status.Errorf(codes.InvalidArgument, "%s is not a regular file", in.RelativeFilePath)
+	}
+
+	metadata := &replicator.DataPayload{
+		RelativeFilePath: in.RelativeFilePath,
+		BlockSize:        in.BlockSize,
+		FileMode:         uint32(stat.Mode()),
+		FileSize:         uint64(stat.Size()),
+	}
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+		metadata.UID = sys.Uid
+		metadata.GID = sys.Gid
+	}
+
+	have := make(map[uint64]uint64, len(in.Have))
+	for _, chunk := range in.Have {
+		have[chunk.ChunkID] = chunk.Hash
+	}
+
+	serverlogger.Info().Msgf("Reading %s for restore", inFile.Name())
+	buffer := make([]byte, in.BlockSize)
+	for chunkID := uint64(0); ; chunkID++ {
+		n, err := io.ReadFull(inFile, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			serverlogger.Error().Err(err).Msgf("Failed to read %s", inFile.Name())
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		if hash, ok := have[chunkID]; ok && hash == xxhash.Sum64(buffer[:n]) {
+			continue
+		}
+		if err := stream.Send(&replicator.DataPayload{
+			DataChunk:        append([]byte(nil), buffer[:n]...),
+			ChunkID:          chunkID,
+			Length:           uint64(n),
+			RelativeFilePath: in.RelativeFilePath,
+			BlockSize:        in.BlockSize,
+			FileMode:         metadata.FileMode,
+			FileSize:         metadata.FileSize,
+			UID:              metadata.UID,
+			GID:              metadata.GID,
+		}); err != nil {
+			return err
+		}
+	}
+	return stream.Send(metadata)
+}
@@ -1,37 +1,113 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"io/fs"
 	"net"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
+	"sync"
 	"syscall"
 
+	"github.com/kosalaat/file-replicator/pkg/archive"
 	"github.com/kosalaat/file-replicator/pkg/controller"
+	"github.com/kosalaat/file-replicator/pkg/deltas"
+	"github.com/kosalaat/file-replicator/pkg/snapshot"
+	"github.com/kosalaat/file-replicator/pkg/versions"
 	"github.com/kosalaat/file-replicator/replicator"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 var serverlogger = log.With().Str("component", "server").Logger()
 
+// MaxBlockSize is the largest block a request may name, a block has to fit in
+// a gRPC message of 4MB.
+const MaxBlockSize = 2 << 20
+
+// validBlockSize reports whether the block size of a request can be served.
+func validBlockSize(blockSize uint64) bool {
+	return blockSize > 0 && blockSize <= MaxBlockSize
+}
+
 type ReplicationServer struct {
 	replicator.UnimplementedFileReplicatorServer
-	FileRoot string
-	hashMap  map[string]controller.FileIndex
-	Server   *grpc.Server
+	FileRoot  string
+	hashMap   map[indexKey]controller.FileIndex
+	Server    *grpc.Server
+	Forwarder *Forwarder
+	Versions  *versions.Store
+	// Conflicts picks the winner of concurrent versions, by the default
+	// policy unless replaced before the server starts.
+	Conflicts *versions.Resolver
+	// Archive keeps deleted files, in .archive under the file root when nil.
+	Archive *archive.Archive
+	// Deltas keeps the overwritten blocks of every batch when set.
+	Deltas    *deltas.Journal
+	Snapshots *snapshot.Manager
+	// Verifications records the digest checks of the committed versions.
+	Verifications *VerificationReport
+	// HashAlgorithms are the block hashes accepted in signatures, any
+	// registered one when empty.
+	HashAlgorithms []string
+	// Credentials secure the connections of the senders, they are plain
+	// text when nil.
+	Credentials credentials.TransportCredentials
+	// Policy authenticates and authorizes the callers, anyone can call when
+	// nil.
+	Policy *Policy
+	// Namespaces are served from their own file roots to the senders naming
+	// them, the others are served from FileRoot.
+	Namespaces map[string]*ReplicationServer
+	// Quota limits the storage of the senders, only the free space of the
+	// volume is checked when nil.
+	Quota   *Quota
+	usage   usage
+	quiesce *quiescer
+	// snapshotLock lets one snapshot be taken at a time.
+	snapshotLock sync.Mutex
+	// pending are the versions accepted from the peer whose content is on
+	// the way, guarded by versionLock.
+	pending     map[string]*pendingVersion
+	versionLock sync.Mutex
+	// staged is the latest version begun for every file, guarded by
+	// stagingLock.
+	staged      map[string]*transaction
+	stagingLock sync.Mutex
+	indexLock   sync.Mutex
+	// writeLock serializes the writes while their reverse deltas are taken.
+	writeLock sync.Mutex
 }
 
 func NewReplicationServer() *ReplicationServer {
 	serverlogger.Info().Msg("Creating new ReplicationServer instance")
 	return &ReplicationServer{
-		hashMap: make(map[string]controller.FileIndex),
+		hashMap: make(map[indexKey]controller.FileIndex),
+		quiesce: newQuiescer(),
+		staged:  make(map[string]*transaction),
+		pending: make(map[string]*pendingVersion),
+
+		Conflicts: &versions.Resolver{},
 	}
 }
 
 func (r *ReplicationServer) StartListening(address string, FileRoot string) error {
-	server := grpc.NewServer()
+	var serverOptions []grpc.ServerOption
+	if r.Credentials != nil {
+		serverOptions = append(serverOptions, grpc.Creds(r.Credentials))
+	}
+	if r.Policy != nil {
+		r.Policy.lstat = r.lstatIn
+		serverOptions = append(serverOptions,
+			grpc.ChainUnaryInterceptor(r.Policy.UnaryInterceptor),
+			grpc.ChainStreamInterceptor(r.Policy.StreamInterceptor),
+		)
+	}
+	server := grpc.NewServer(serverOptions...)
 	r.Server = server
 
 	listener, err := net.Listen("tcp", address)
@@ -43,9 +119,22 @@ func (r *ReplicationServer) StartListening(address string, FileRoot string) erro
 	}
 	serverlogger.Info().Msgf("Listening on %s...", address)
 
-	replicator.RegisterFileReplicatorServer(server, r)
-
 	r.FileRoot = FileRoot
+	if len(r.Namespaces) > 0 {
+		replicator.RegisterFileReplicatorServer(server, &namespaceRouter{root: r})
+	} else {
+		replicator.RegisterFileReplicatorServer(server, r)
+	}
+
+	if err := r.CleanStaging(); err != nil {
+		serverlogger.Error().Err(err).Msg("Failed to remove the orphaned staging files")
+	}
+	for name, namespace := range r.Namespaces {
+		serverlogger.Info().Msgf("Serving namespace %s from %s", name, namespace.FileRoot)
+		if err := namespace.CleanStaging(); err != nil {
+			serverlogger.Error().Err(err).Msgf("Failed to remove the orphaned staging files of namespace %s", name)
+		}
+	}
 	serverlogger.Info().Msg("Ready to recieve files updates...")
 
 	err = server.Serve(listener)
@@ -58,6 +147,13 @@ func (r *ReplicationServer) StartListening(address string, FileRoot string) erro
 	return nil
 }
 
+func (s *ReplicationServer) archive() *archive.Archive {
+	if s.Archive != nil {
+		return s.Archive
+	}
+	return archive.New(path.Join(s.FileRoot, ".archive"), archive.Retention{})
+}
+
 func (r *ReplicationServer) StopListening() {
 	if r.Server != nil {
 		serverlogger.Info().Msg("gRPC Server Stopping...")
@@ -70,33 +166,56 @@ func (r *ReplicationServer) StopListening() {
 
 func (s *ReplicationServer) CheckDuplicates(ctx context.Context, in *replicator.DataSignature) (*replicator.Confirmation, error) {
 	serverlogger.Info().Msg("Calculating changed blocks...")
+	if _, err := s.resolve(in.RelativeFilePath); err != nil {
+		return refusedPath(), nil
+	}
+	if !validBlockSize(in.BlockSize) {
+		serverlogger.Warn().Msgf("Refusing signature of %s in blocks of %d bytes", in.RelativeFilePath, in.BlockSize)
+		return &replicator.Confirmation{
+			Code: replicator.ConfirmationCode_BLOCK_SIZE_ERROR,
+		}, nil
+	}
+	s.sealDelta(in.RelativeFilePath)
+
+	var accepted *versions.FileVersion
+	var mergedVector versions.VersionVector
+	if s.Versions != nil && in.SiteID != "" {
+		confirmation, version, err := s.checkVersion(in)
+		if confirmation != nil || err != nil {
+			return confirmation, err
+		}
+		accepted, mergedVector = &version, version.Vector
+	}
+
+	algorithm, confirm, ok := s.signatureHashes(in)
+	if !ok {
+		serverlogger.Warn().Msgf("Refusing signature of %s in %s", in.RelativeFilePath, in.HashAlgorithm)
+		return &replicator.Confirmation{
+			Code: replicator.ConfirmationCode_HASH_UNSUPPORTED,
+		}, nil
+	}
 
 	chunkOut := make([]*replicator.ChunkInfo, 0)
 
+	fIndex, err := s.fileIndex(in.RelativeFilePath, in.BlockSize, algorithm)
+	if err != nil {
+		return &replicator.Confirmation{
+			Code: replicator.ConfirmationCode_UNHANDLED_ERROR,
+		}, err
+	}
+
 	for _, chunk := range in.Chunk {
-		if _, exists := s.hashMap[in.RelativeFilePath]; !exists {
-			serverlogger.Info().Msgf("File index for %s does not exist, creating new index", in.RelativeFilePath)
-			fIndex := controller.NewFileIndex(s.FileRoot, in.RelativeFilePath, in.BlockSize)
-			if err := fIndex.RegenerateFileIndex(); err != nil {
-				serverlogger.Error().Err(err).Msgf("Failed to regenerate file index for %s", in.RelativeFilePath)
-				return &replicator.Confirmation{
-					Code: replicator.ConfirmationCode_UNHANDLED_ERROR,
-				}, err
-			}
-			serverlogger.Info().Msgf("Type %T, %v", s.hashMap, s.hashMap)
-			s.hashMap[in.RelativeFilePath] = fIndex
-		} else {
-			serverlogger.Info().Msgf("File index for %s exists, using cached index", in.RelativeFilePath)
+		expected := chunk.Digest
+		if len(expected) == 0 {
+			expected = controller.Uint64Hash(chunk.Hash)
 		}
-
-		fIndex := s.hashMap[in.RelativeFilePath]
-		cHash, ok := fIndex.LookupHashTable(chunk.ChunkID)
+		cHash, ok := fIndex.LookupDigest(chunk.ChunkID)
 		if ok {
-			if cHash == chunk.Hash {
+			if bytes.Equal(cHash, expected) && s.confirmChunk(&fIndex, chunk, confirm) {
 				serverlogger.Info().Msgf("Chunk %d is unchanged (from cache)", chunk.ChunkID)
 				continue
 			} else {
-				serverlogger.Info().Msgf("Chunk %d is changed (from cache), expected hash: %d, actual hash: %d", chunk.ChunkID, chunk.Hash, cHash)
+				serverlogger.Info().Msgf("Chunk %d is changed (from cache), expected hash: %x, actual hash: %x", chunk.ChunkID, expected, cHash)
 				chunkOut = append(chunkOut, chunk)
 			}
 		} else {
@@ -105,6 +224,10 @@ func (s *ReplicationServer) CheckDuplicates(ctx context.Context, in *replicator.
 		}
 	}
 
+	if accepted != nil {
+		s.expectVersion(in.RelativeFilePath, *accepted, chunkOut)
+	}
+
 	return &replicator.Confirmation{
 		Code: func() replicator.ConfirmationCode {
 			if len(chunkOut) > 0 {
@@ -113,17 +236,237 @@ func (s *ReplicationServer) CheckDuplicates(ctx context.Context, in *replicator.
 				return replicator.ConfirmationCode_CHANGES_NOT_FOUND
 			}
 		}(),
-		Chunk: chunkOut,
+		Chunk:         chunkOut,
+		VersionVector: mergedVector,
 	}, nil
 }
 
+// indexKey keeps one index of a file per hash algorithm.
+type indexKey struct {
+	path      string
+	algorithm string
+}
+
+// fileIndex returns the block hashes of a file, from the cache while the file
+// is unchanged on disk. A missing file has an empty index, so every chunk of
+// it is reported as changed.
+func (s *ReplicationServer) fileIndex(relativePath string, blockSize uint64, algorithm controller.HashAlgorithm) (controller.FileIndex, error) {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	key := indexKey{path: relativePath, algorithm: algorithm.Name}
+	if fIndex, exists := s.hashMap[key]; exists && fIndex.BlockSize() == blockSize && fIndex.IsCurrent() {
+		serverlogger.Info().Msgf("File index for %s exists, using cached index", relativePath)
+		return fIndex, nil
+	}
+
+	serverlogger.Info().Msgf("File index for %s does not exist or is outdated, creating new %s index", relativePath, algorithm.Name)
+	fIndex := controller.NewHashedFileIndex(s.FileRoot, relativePath, blockSize, algorithm)
+	if err := fIndex.RegenerateFileIndex(); err != nil {
+		if os.IsNotExist(err) {
+			serverlogger.Info().Msgf("File %s does not exist yet", relativePath)
+			delete(s.hashMap, key)
+			return fIndex, nil
+		}
+		serverlogger.Error().Err(err).Msgf("Failed to regenerate file index for %s", relativePath)
+		return fIndex, err
+	}
+	s.hashMap[key] = fIndex
+	return fIndex, nil
+}
+
+// acceptsHash reports whether signatures may use the algorithm.
+func (s *ReplicationServer) acceptsHash(name string) bool {
+	if _, err := controller.LookupHash(name); err != nil {
+		return false
+	}
+	if name == "" || len(s.HashAlgorithms) == 0 {
+		return true
+	}
+	return slices.Contains(s.HashAlgorithms, name)
+}
+
+// signatureHashes returns the block hash of the signature and the one
+// confirming its matches, if any, or false when either is not accepted.
+func (s *ReplicationServer) signatureHashes(in *replicator.DataSignature) (controller.HashAlgorithm, *controller.HashAlgorithm, bool) {
+	if !s.acceptsHash(in.HashAlgorithm) {
+		return controller.HashAlgorithm{}, nil, false
+	}
+	algorithm, _ := controller.LookupHash(in.HashAlgorithm)
+	if in.ConfirmAlgorithm == "" {
+		return algorithm, nil, true
+	}
+	if !s.acceptsHash(in.ConfirmAlgorithm) {
+		return controller.HashAlgorithm{}, nil, false
+	}
+	confirm, _ := controller.LookupHash(in.ConfirmAlgorithm)
+	return algorithm, &confirm, true
+}
+
+// confirmChunk rehashes a block that matched in the weak hash of the signature
+// with the confirming one. Without a confirming hash the match stands.
+func (s *ReplicationServer) confirmChunk(fIndex *controller.FileIndex, chunk *replicator.ChunkInfo, confirm *controller.HashAlgorithm) bool {
+	if confirm == nil {
+		return true
+	}
+	digest, err := fIndex.ConfirmChunk(chunk.ChunkID, *confirm)
+	if err != nil {
+		serverlogger.Error().Err(err).Msgf("Failed to confirm chunk %d", chunk.ChunkID)
+		return false
+	}
+	if !bytes.Equal(digest, chunk.Confirm) {
+		serverlogger.Warn().Msgf("Chunk %d matched in the block hash only", chunk.ChunkID)
+		return false
+	}
+	return true
+}
+
+// inflateChunk decompresses the data of the payload in place, so it is
+// verified, written and forwarded raw. The data may not inflate beyond the
+// block size.
+func (s *ReplicationServer) inflateChunk(in *replicator.DataPayload) replicator.ConfirmationCode {
+	if in.Compression == "" {
+		return replicator.ConfirmationCode_OK
+	}
+	compression, err := controller.LookupCompression(in.Compression)
+	if err != nil {
+		serverlogger.Warn().Err(err).Msgf("Refusing chunk %d of %s", in.ChunkID, in.RelativeFilePath)
+		return replicator.ConfirmationCode_COMPRESSION_UNSUPPORTED
+	}
+	data, err := compression.Decompress(in.DataChunk, in.BlockSize)
+	if err != nil {
+		serverlogger.Error().Err(err).Msgf("Failed to inflate chunk %d of %s", in.ChunkID, in.RelativeFilePath)
+		return replicator.ConfirmationCode_CHUNK_CORRUPTED
+	}
+	in.DataChunk = data
+	in.Compression = ""
+	return replicator.ConfirmationCode_OK
+}
+
+// verifyChunk hashes the data of the payload and checks it against the hash the
+// sender computed, when given.
+func (s *ReplicationServer) verifyChunk(in *replicator.DataPayload) (controller.HashAlgorithm, []byte, replicator.ConfirmationCode) {
+	if !s.acceptsHash(in.HashAlgorithm) {
+		serverlogger.Warn().Msgf("Refusing chunk %d of %s hashed with %s", in.ChunkID, in.RelativeFilePath, in.HashAlgorithm)
+		return controller.HashAlgorithm{}, nil, replicator.ConfirmationCode_HASH_UNSUPPORTED
+	}
+	algorithm, _ := controller.LookupHash(in.HashAlgorithm)
+	chunkHash := algorithm.Sum(in.DataChunk)
+	if len(in.Hash) > 0 && !bytes.Equal(chunkHash, in.Hash) {
+		serverlogger.Error().Msgf("Chunk %d of %s is corrupted, expected hash: %x, actual hash: %x", in.ChunkID, in.RelativeFilePath, in.Hash, chunkHash)
+		return algorithm, chunkHash, replicator.ConfirmationCode_CHUNK_CORRUPTED
+	}
+	return algorithm, chunkHash, replicator.ConfirmationCode_OK
+}
+
+// indexWritten updates the cached indexes of the file with the block just
+// written, so they stay current without rereading the file. An index that was
+// not current before the write, or whose block the write did not fully
+// replace, is dropped.
+func (s *ReplicationServer) indexWritten(in *replicator.DataPayload, before os.FileInfo, after os.FileInfo, algorithm controller.HashAlgorithm, chunkHash []byte) {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	wholeBlock := uint64(len(in.DataChunk)) == in.BlockSize || in.BlockSize*in.ChunkID+uint64(len(in.DataChunk)) >= uint64(after.Size())
+	for key, fIndex := range s.hashMap {
+		if key.path != in.RelativeFilePath {
+			continue
+		}
+		if before == nil || !wholeBlock || fIndex.BlockSize() != in.BlockSize || !fIndex.Matches(before) {
+			delete(s.hashMap, key)
+			continue
+		}
+		if key.algorithm == algorithm.Name {
+			fIndex.UpdateChunkDigest(in.ChunkID, chunkHash)
+		} else {
+			indexAlgorithm, _ := controller.LookupHash(key.algorithm)
+			fIndex.UpdateChunkDigest(in.ChunkID, indexAlgorithm.Sum(in.DataChunk))
+		}
+		fIndex.Refresh(after)
+		s.hashMap[key] = fIndex
+	}
+}
+
+// forgetIndex drops the cached indexes of the file.
+func (s *ReplicationServer) forgetIndex(relativePath string) {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+	for key := range s.hashMap {
+		if key.path == relativePath {
+			delete(s.hashMap, key)
+		}
+	}
+}
+
 func (s *ReplicationServer) Replicate(ctx context.Context, in *replicator.DataPayload) (*replicator.Confirmation, error) {
 
+	// the metadata payload is the last of a batch
+	s.beginWrite(in.RelativeFilePath)
+	defer s.endWrite(in.RelativeFilePath, in.DataChunk == nil)
+
+	filePath, err := s.resolve(in.RelativeFilePath)
+	if err != nil {
+		return refusedPath(), nil
+	}
+	previous, _ := s.lstatFile(filePath)
+	if code := s.preflight(in.RelativeFilePath, previous, in.FileSize); code != replicator.ConfirmationCode_OK {
+		return &replicator.Confirmation{
+			Code: code,
+		}, nil
+	}
+	if in.StagingVersion == 0 {
+		defer s.account(filePath)
+	}
+
+	var algorithm controller.HashAlgorithm
+	var chunkHash []byte
+	if in.DataChunk != nil {
+		if code := s.inflateChunk(in); code != replicator.ConfirmationCode_OK {
+			return &replicator.Confirmation{
+				Code: code,
+			}, nil
+		}
+		var code replicator.ConfirmationCode
+		if algorithm, chunkHash, code = s.verifyChunk(in); code != replicator.ConfirmationCode_OK {
+			return &replicator.Confirmation{
+				Code: code,
+			}, nil
+		}
+	}
+
+	openFlags := os.O_WRONLY | os.O_CREATE
+	if s.Deltas != nil {
+		// the overwritten ranges are read back for the reverse delta
+		openFlags = os.O_RDWR | os.O_CREATE
+		s.writeLock.Lock()
+		defer s.writeLock.Unlock()
+		if _, err := s.lstatFile(filePath); os.IsNotExist(err) {
+			if err := s.Deltas.Created(path.Clean(in.RelativeFilePath)); err != nil {
+				serverlogger.Error().Err(err).Msgf("Failed to start the reverse delta of %s", in.RelativeFilePath)
+				return &replicator.Confirmation{
+					Code: replicator.ConfirmationCode_UPDATE_ERROR,
+				}, err
+			}
+		}
+	}
+	if in.StagingVersion > 0 {
+		stagingPath, code, err := s.stage(filePath, in.RelativeFilePath, in.StagingVersion, in.ChunkID)
+		if code != replicator.ConfirmationCode_OK {
+			return &replicator.Confirmation{
+				Code: code,
+			}, err
+		}
+		filePath = stagingPath
+	}
+	// the cached indexes are kept current by the writes that do not resize the
+	// file
+	resized := false
+
 	// Implement the replication logic here
 	// For example, save the file to a specific location
-	outFile, err := os.OpenFile(
-		path.Join(s.FileRoot, in.RelativeFilePath),
-		os.O_WRONLY|os.O_CREATE,
+	outFile, err := s.openFile(
+		filePath,
+		openFlags,
 		os.FileMode(in.FileMode),
 	)
 	if err != nil {
@@ -133,8 +476,15 @@ func (s *ReplicationServer) Replicate(ctx context.Context, in *replicator.DataPa
 		}, err
 	} else {
 		defer outFile.Close()
-		if outStat, _ := outFile.Stat(); outStat.Size() > int64(in.FileSize) {
+		// a version is only truncated when it is committed
+		if outStat, _ := outFile.Stat(); in.StagingVersion == 0 && outStat.Size() > int64(in.FileSize) {
 			log.Info().Msgf("File size: %d, larger than expected: %d, truncating file", outStat.Size(), in.FileSize)
+			if err := s.preserve(in.RelativeFilePath, outFile, int64(in.FileSize), outStat.Size()-int64(in.FileSize)); err != nil {
+				return &replicator.Confirmation{
+					Code: replicator.ConfirmationCode_UPDATE_ERROR,
+				}, err
+			}
+			resized = true
 			err = outFile.Truncate(int64(in.FileSize))
 			if err != nil {
 				log.Error().Err(err).Msg("Failed to truncate file")
@@ -147,33 +497,66 @@ func (s *ReplicationServer) Replicate(ctx context.Context, in *replicator.DataPa
 	log.Info().Msgf("Replicating file %s...", outFile.Name())
 
 	if in.DataChunk != nil {
+		if s.Versions != nil {
+			s.Versions.Touch(in.RelativeFilePath)
+		}
 		offset := in.BlockSize * in.ChunkID
 		if outStat, _ := outFile.Stat(); outStat.Size() < int64(offset) {
 			log.Info().Msgf("File size: %d, smaller than offset: %d, truncating file", outStat.Size(), offset)
+			resized = true
 			err = outFile.Truncate(int64(offset))
 			if err != nil {
 				log.Error().Err(err).Msg("Failed to truncate file")
 				return &replicator.Confirmation{
-					Code: replicator.ConfirmationCode_FILE_NOT_WRITABLE,
+					Code: storageCode(err, replicator.ConfirmationCode_FILE_NOT_WRITABLE),
 				}, err
 			}
 		}
+		if err := s.preserve(in.RelativeFilePath, outFile, int64(offset), int64(len(in.DataChunk))); err != nil {
+			return &replicator.Confirmation{
+				Code: replicator.ConfirmationCode_UPDATE_ERROR,
+			}, err
+		}
+		before, _ := outFile.Stat()
 		outFile.Seek(int64(offset), 0)
 
 		_, err = outFile.Write(in.DataChunk)
 		if err != nil {
 			log.Error().Err(err).Msgf("Failed to write data chunk: %d", in.ChunkID)
 			return &replicator.Confirmation{
-				Code: replicator.ConfirmationCode_UPDATE_ERROR,
+				Code: storageCode(err, replicator.ConfirmationCode_UPDATE_ERROR),
 			}, err
 		}
 		log.Info().Msgf("Wrote chunk %d of size %d", in.ChunkID, len(in.DataChunk))
+		if in.StagingVersion > 0 {
+			s.received(in.RelativeFilePath, in.StagingVersion, in.ChunkID)
+		} else {
+			s.versionWritten(in.RelativeFilePath, in.ChunkID)
+		}
+		// a staged chunk leaves the live file as it is until the commit
+		if in.StagingVersion == 0 {
+			if after, err := outFile.Stat(); err == nil && !resized {
+				s.indexWritten(in, before, after, algorithm, chunkHash)
+			} else {
+				s.forgetIndex(in.RelativeFilePath)
+			}
+		}
+		s.Forwarder.Replicated(in)
+		written := &replicator.ChunkInfo{
+			Hash:      controller.HashUint64(chunkHash),
+			ChunkID:   in.ChunkID,
+			BlockSize: uint64(len(in.DataChunk)),
+		}
+		if algorithm.Name != controller.HashXXHash64 {
+			written.Digest = chunkHash
+		}
 		return &replicator.Confirmation{
-			Code: replicator.ConfirmationCode_OK,
+			Code:  replicator.ConfirmationCode_OK,
+			Chunk: []*replicator.ChunkInfo{written},
 		}, nil
 	} else {
 		log.Info().Msg("Processing owner/access change.")
-		outStat, err := os.Stat(outFile.Name())
+		outStat, err := outFile.Stat()
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to stat file")
 			return &replicator.Confirmation{
@@ -184,6 +567,12 @@ func (s *ReplicationServer) Replicate(ctx context.Context, in *replicator.DataPa
 				log.Info().Msg("File mode is already set, skipping...")
 			} else {
 				log.Info().Msgf("Setting file mode to %o", in.FileMode)
+				if err := s.preserveMode(in.RelativeFilePath, outFile); err != nil {
+					log.Error().Err(err).Msg("Failed to save the reverse delta")
+					return &replicator.Confirmation{
+						Code: replicator.ConfirmationCode_UPDATE_ERROR,
+					}, err
+				}
 				if err := outFile.Chmod(os.FileMode(in.FileMode)); err != nil {
 					log.Error().Err(err).Msg("Failed to change file mode")
 					return &replicator.Confirmation{
@@ -193,7 +582,7 @@ func (s *ReplicationServer) Replicate(ctx context.Context, in *replicator.DataPa
 			}
 			if stat, _ := outStat.Sys().(*syscall.Stat_t); in.UID != stat.Uid || in.GID != stat.Gid {
 				log.Info().Msgf("Setting file ownership to UID: %d, GID: %d", in.UID, in.GID)
-				if err := os.Chown(outFile.Name(), int(in.UID), int(in.GID)); err != nil {
+				if err := outFile.Chown(int(in.UID), int(in.GID)); err != nil {
 					log.Error().Err(err).Msg("Failed to change file ownership")
 					return &replicator.Confirmation{
 						Code: replicator.ConfirmationCode_FILE_NOT_WRITABLE,
@@ -203,6 +592,9 @@ func (s *ReplicationServer) Replicate(ctx context.Context, in *replicator.DataPa
 				log.Info().Msg("No ownership change requested, skipping...")
 			}
 		}
+		// the metadata payload ends the batch
+		s.sealDelta(in.RelativeFilePath)
+		s.Forwarder.Replicated(in)
 		return &replicator.Confirmation{
 			Code: replicator.ConfirmationCode_OK,
 		}, nil
@@ -210,17 +602,38 @@ func (s *ReplicationServer) Replicate(ctx context.Context, in *replicator.DataPa
 }
 
 func (s *ReplicationServer) Rename(ctx context.Context, in *replicator.FileOps) (*replicator.Confirmation, error) {
-	oldPath := path.Join(s.FileRoot, in.RelativeFilePath)
-	newPath := path.Join(s.FileRoot, in.NewRelativeFilePath)
+	oldPath, err := s.resolve(in.RelativeFilePath)
+	if err != nil {
+		return refusedPath(), nil
+	}
+	newPath, err := s.resolve(in.NewRelativeFilePath)
+	if err != nil {
+		return refusedPath(), nil
+	}
 
 	serverlogger.Info().Msgf("Renaming file from %s to %s", oldPath, newPath)
+	s.beginWrite(in.RelativeFilePath)
+	defer s.endWrite(in.RelativeFilePath, true)
 
-	if err := os.Rename(oldPath, newPath); err != nil {
+	defer s.account(newPath)
+	defer s.account(oldPath)
+	if err := s.renameFile(oldPath, newPath); err != nil {
 		serverlogger.Error().Err(err).Msg("Failed to rename file")
 		return &replicator.Confirmation{
 			Code: replicator.ConfirmationCode_UPDATE_ERROR,
 		}, err
 	}
+	s.renameStaging(in.RelativeFilePath, in.NewRelativeFilePath)
+	if s.Versions != nil {
+		s.renamePendingVersion(in.RelativeFilePath, in.NewRelativeFilePath)
+		s.Versions.Rename(in.RelativeFilePath, in.NewRelativeFilePath)
+	}
+	if s.Deltas != nil {
+		if err := s.Deltas.Rename(in.RelativeFilePath, in.NewRelativeFilePath); err != nil {
+			serverlogger.Error().Err(err).Msgf("Failed to move the reverse deltas of %s", in.RelativeFilePath)
+		}
+	}
+	s.Forwarder.Renamed(in)
 
 	return &replicator.Confirmation{
 		Code: replicator.ConfirmationCode_OK,
@@ -228,31 +641,33 @@ func (s *ReplicationServer) Rename(ctx context.Context, in *replicator.FileOps)
 }
 
 func (s *ReplicationServer) Delete(ctx context.Context, in *replicator.FileOps) (*replicator.Confirmation, error) {
-	filePath := path.Join(s.FileRoot, in.RelativeFilePath)
-	archiveFolder := path.Join(s.FileRoot, ".archive")
+	filePath, err := s.resolve(in.RelativeFilePath)
+	if err != nil {
+		return refusedPath(), nil
+	}
 
 	serverlogger.Info().Msgf("Deleting file %s", filePath)
+	s.beginWrite(in.RelativeFilePath)
+	defer s.endWrite(in.RelativeFilePath, true)
 
-	if _, err := os.Stat(archiveFolder); os.IsNotExist(err) {
-		serverlogger.Info().Msgf("Archive folder %s does not exist, creating...", archiveFolder)
-		if err := os.Mkdir(archiveFolder, 0755); err != nil {
-			serverlogger.Error().Err(err).Msgf("Failed to create archive folder %s", archiveFolder)
-			return &replicator.Confirmation{
-				Code: replicator.ConfirmationCode_UPDATE_ERROR,
-			}, err
+	if s.Versions != nil && in.SiteID != "" {
+		if confirmation := s.checkDelete(in); confirmation != nil {
+			return confirmation, nil
 		}
 	}
-	destPath := path.Join(archiveFolder, in.RelativeFilePath)
-	serverlogger.Info().Msgf("Creating the destination folder structure: %s", path.Dir(destPath))
-	if err := os.MkdirAll(path.Dir(destPath), 0750); err != nil {
-		serverlogger.Error().Err(err).Msgf("Failed to create destination archive directory %s", path.Dir(destPath))
+
+	s.discardStaging(in.RelativeFilePath)
+	defer s.account(filePath)
+	root, name, err := s.openRoot(filePath)
+	if err != nil {
+		serverlogger.Error().Err(err).Msg("Failed to open the file root")
 		return &replicator.Confirmation{
 			Code: replicator.ConfirmationCode_UPDATE_ERROR,
 		}, err
 	}
-
-	serverlogger.Info().Msgf("Moving file %s to archive %s", filePath, destPath)
-	if err := os.Rename(filePath, destPath); err != nil {
+	defer root.Close()
+	archived, err := s.archive().Store(root, name, in.RelativeFilePath)
+	if err != nil {
 		if os.IsNotExist(err) {
 			serverlogger.Warn().Msgf("File %s does not exist, nothing to delete", filePath)
 			return &replicator.Confirmation{
@@ -264,6 +679,12 @@ func (s *ReplicationServer) Delete(ctx context.Context, in *replicator.FileOps)
 			Code: replicator.ConfirmationCode_UPDATE_ERROR,
 		}, err
 	}
+	if s.Deltas != nil {
+		if err := s.Deltas.Retire(in.RelativeFilePath, archived); err != nil {
+			serverlogger.Error().Err(err).Msgf("Failed to move the reverse deltas of %s", in.RelativeFilePath)
+		}
+	}
+	s.Forwarder.Deleted(in)
 
 	return &replicator.Confirmation{
 		Code: replicator.ConfirmationCode_OK,
@@ -271,7 +692,202 @@ func (s *ReplicationServer) Delete(ctx context.Context, in *replicator.FileOps)
 }
 
 func (s *ReplicationServer) Ping(ctx context.Context, in *replicator.PingPong) (*replicator.PingPong, error) {
+	accepted := make([]string, 0)
+	for _, name := range controller.HashAlgorithms() {
+		if s.acceptsHash(name) {
+			accepted = append(accepted, name)
+		}
+	}
 	return &replicator.PingPong{
-		Val: in.Val,
+		Val:            in.Val,
+		HashAlgorithms: accepted,
+		Compressions:   controller.Compressions(),
 	}, nil
 }
+
+// List streams the regular files under the requested directory, leaving out
+// the archive.
+func (s *ReplicationServer) List(in *replicator.ListRequest, stream replicator.FileReplicator_ListServer) error {
+	if in.Archive {
+		return s.listArchive(in, stream)
+	}
+
+	listRoot := "."
+	if path.Clean(in.RelativePath) != "." {
+		if _, err := s.resolve(in.RelativePath); err != nil {
+			return err
+		}
+		listRoot = path.Clean(in.RelativePath)
+	}
+	reserved := s.reservedFolders()
+	root, err := os.OpenRoot(s.FileRoot)
+	if err != nil {
+		serverlogger.Error().Err(err).Msg("Failed to open the file root")
+		return err
+	}
+	defer root.Close()
+
+	serverlogger.Info().Msgf("Listing files under %s", listRoot)
+
+	return fs.WalkDir(root.FS(), listRoot, func(relativePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && relativePath == listRoot {
+				return nil
+			}
+			serverlogger.Error().Err(err).Msgf("Failed to list %s", relativePath)
+			return err
+		}
+		if entry.IsDir() {
+			if slices.Contains(reserved, relativePath) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() || controller.IsStagingFile(relativePath) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		return stream.Send(&replicator.FileInfo{
+			RelativeFilePath: filepath.FromSlash(relativePath),
+			FileSize:         uint64(info.Size()),
+			FileMode:         uint32(info.Mode()),
+			ModTime:          info.ModTime().UnixNano(),
+		})
+	})
+}
+
+// listArchive streams the latest archived version of every file under the
+// requested path.
+func (s *ReplicationServer) listArchive(in *replicator.ListRequest, stream replicator.FileReplicator_ListServer) error {
+	if path.Clean(in.RelativePath) != "." {
+		if _, err := s.resolve(in.RelativePath); err != nil {
+			return err
+		}
+	}
+	versions, err := s.archive().Latest(in.RelativePath)
+	if err != nil {
+		serverlogger.Error().Err(err).Msg("Failed to list the archive")
+		return err
+	}
+	for _, version := range versions {
+		if err := stream.Send(&replicator.FileInfo{
+			RelativeFilePath: version.Path,
+			FileSize:         uint64(version.Size),
+			ModTime:          version.ArchivedAt.UnixNano(),
+			Version:          version.Version,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Digest streams the strong hash and metadata of each requested file, in the
+// order requested.
+func (s *ReplicationServer) Digest(in *replicator.DigestRequest, stream replicator.FileReplicator_DigestServer) error {
+	for _, relativePath := range in.RelativeFilePath {
+		fileDigest := &replicator.FileDigest{RelativeFilePath: relativePath}
+
+		filePath, err := s.resolve(relativePath)
+		if err != nil {
+			fileDigest.Code = replicator.ConfirmationCode_PERMISSION_DENIED
+		} else {
+			s.digestFile(fileDigest, filePath, in.Algorithm)
+		}
+
+		if err := stream.Send(fileDigest); err != nil {
+			serverlogger.Error().Err(err).Msg("Failed to send digest")
+			return err
+		}
+	}
+	return nil
+}
+
+// digestFile fills in the digest and metadata of a file, reading it through
+// the file root.
+func (s *ReplicationServer) digestFile(fileDigest *replicator.FileDigest, filePath string, algorithm string) {
+	fileHandler, err := s.openFile(filePath, os.O_RDONLY, 0)
+	if err != nil {
+		serverlogger.Warn().Err(err).Msgf("Failed to open %s", filePath)
+		fileDigest.Code = replicator.ConfirmationCode_FILE_NOT_FOUND
+		if !os.IsNotExist(err) {
+			fileDigest.Code = replicator.ConfirmationCode_FILE_NOT_READABLE
+		}
+		return
+	}
+	defer fileHandler.Close()
+
+	stat, err := fileHandler.Stat()
+	if err != nil || !stat.Mode().IsRegular() {
+		serverlogger.Warn().Err(err).Msgf("Failed to stat %s", filePath)
+		fileDigest.Code = replicator.ConfirmationCode_FILE_NOT_READABLE
+		return
+	}
+	digest, algorithm, err := controller.ReaderDigest(fileHandler, algorithm)
+	fileDigest.Algorithm = algorithm
+	if err != nil {
+		fileDigest.Code = replicator.ConfirmationCode_FILE_NOT_READABLE
+		return
+	}
+	fileDigest.Code = replicator.ConfirmationCode_OK
+	fileDigest.Digest = digest
+	fileDigest.FileSize = uint64(stat.Size())
+	fileDigest.FileMode = uint32(stat.Mode())
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+		fileDigest.UID = sys.Uid
+		fileDigest.GID = sys.Gid
+	}
+}
+
+// BlockMap reports the block hashes of a file as computed from disk now and as
+// held in the cached index CheckDuplicates compares against, without updating
+// the cache.
+func (s *ReplicationServer) BlockMap(ctx context.Context, in *replicator.BlockMapRequest) (*replicator.FileBlockMap, error) {
+	blockMap := &replicator.FileBlockMap{
+		RelativeFilePath: in.RelativeFilePath,
+		BlockSize:        in.BlockSize,
+	}
+
+	s.indexLock.Lock()
+	if cached, exists := s.hashMap[indexKey{path: in.RelativeFilePath, algorithm: controller.DefaultHashAlgorithm}]; exists {
+		blockMap.Cached = true
+		blockMap.CachedBlockSize = cached.BlockSize()
+		blockMap.CacheCurrent = cached.IsCurrent()
+		blockMap.CachedHash = cached.Hashes()
+	}
+	s.indexLock.Unlock()
+
+	if !validBlockSize(in.BlockSize) {
+		serverlogger.Warn().Msgf("Refusing the block map of %s in blocks of %d bytes", in.RelativeFilePath, in.BlockSize)
+		blockMap.Code = replicator.ConfirmationCode_BLOCK_SIZE_ERROR
+		return blockMap, nil
+	}
+	filePath, err := s.resolve(in.RelativeFilePath)
+	if err != nil {
+		blockMap.Code = replicator.ConfirmationCode_PERMISSION_DENIED
+		return blockMap, nil
+	}
+
+	fIndex := controller.NewFileIndex(s.FileRoot, in.RelativeFilePath, in.BlockSize)
+	if err := fIndex.RegenerateFileIndex(); err != nil {
+		if os.IsNotExist(err) {
+			blockMap.Code = replicator.ConfirmationCode_FILE_NOT_FOUND
+			return blockMap, nil
+		}
+		serverlogger.Error().Err(err).Msgf("Failed to index %s", in.RelativeFilePath)
+		blockMap.Code = replicator.ConfirmationCode_FILE_NOT_READABLE
+		return blockMap, nil
+	}
+	if stat, err := s.lstatFile(filePath); err == nil {
+		blockMap.FileSize = uint64(stat.Size())
+	}
+	blockMap.DiskHash = fIndex.Hashes()
+	blockMap.Code = replicator.ConfirmationCode_OK
+	return blockMap, nil
+}
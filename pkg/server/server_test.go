@@ -3,11 +3,18 @@ package server
 import (
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
 
 	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/pkg/controller"
 	"github.com/kosalaat/file-replicator/replicator"
 	"github.com/phayes/freeport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestListen(t *testing.T) {
@@ -47,3 +54,169 @@ func TestListen(t *testing.T) {
 	// Additional checks can be added here to verify server functionality
 	t.Logf("Server started successfully on %s with file root %s", address, fileRoot)
 }
+
+func TestCheckDuplicates_HashAlgorithms(t *testing.T) {
+	s := NewReplicationServer()
+	s.FileRoot = t.TempDir()
+	s.HashAlgorithms = []string{controller.HashBLAKE3, controller.HashSHA256}
+	ctx := context.Background()
+	if err := os.WriteFile(filepath.Join(s.FileRoot, "test.txt"), []byte("datadata"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	blake3, _ := controller.LookupHash(controller.HashBLAKE3)
+	sha256, _ := controller.LookupHash(controller.HashSHA256)
+	signature := func(algorithm string, confirm string, confirmChunk1 []byte) *replicator.DataSignature {
+		return &replicator.DataSignature{
+			RelativeFilePath: "test.txt",
+			BlockSize:        4,
+			HashAlgorithm:    algorithm,
+			ConfirmAlgorithm: confirm,
+			Chunk: []*replicator.ChunkInfo{
+				{ChunkID: 0, BlockSize: 4, Digest: blake3.Sum([]byte("data")), Confirm: sha256.Sum([]byte("data"))},
+				{ChunkID: 1, BlockSize: 4, Digest: blake3.Sum([]byte("data")), Confirm: confirmChunk1},
+			},
+		}
+	}
+
+	pong, err := s.Ping(ctx, &replicator.PingPong{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(pong.HashAlgorithms, []string{controller.HashBLAKE3, controller.HashSHA256}) {
+		t.Errorf("Expected the accepted algorithms, got %v", pong.HashAlgorithms)
+	}
+
+	confirmation, err := s.CheckDuplicates(ctx, signature(controller.HashXXH3128, "", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confirmation.Code != replicator.ConfirmationCode_HASH_UNSUPPORTED {
+		t.Errorf("Expected a signature in an algorithm not accepted to be refused, got %s", confirmation.Code)
+	}
+
+	confirmation, err = s.CheckDuplicates(ctx, signature(controller.HashBLAKE3, "", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confirmation.Code != replicator.ConfirmationCode_CHANGES_NOT_FOUND {
+		t.Errorf("Expected the blocks to match in blake3, got %s", confirmation.Code)
+	}
+
+	// a block matching in the weak hash only is sent
+	confirmation, err = s.CheckDuplicates(ctx, signature(controller.HashBLAKE3, controller.HashSHA256, sha256.Sum([]byte("collision"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(confirmation.Chunk) != 1 || confirmation.Chunk[0].ChunkID != 1 {
+		t.Errorf("Expected the unconfirmed chunk to be reported, got %v", confirmation.Chunk)
+	}
+}
+
+func TestReplicate_ChunkHash(t *testing.T) {
+	s := NewReplicationServer()
+	s.FileRoot = t.TempDir()
+	ctx := context.Background()
+	filePath := filepath.Join(s.FileRoot, "test.txt")
+	if err := os.WriteFile(filePath, []byte("datadata"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	xxhash64, _ := controller.LookupHash(controller.HashXXHash64)
+	if _, err := s.CheckDuplicates(ctx, &replicator.DataSignature{RelativeFilePath: "test.txt", BlockSize: 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := &replicator.DataPayload{
+		RelativeFilePath: "test.txt",
+		DataChunk:        []byte("new!"),
+		Hash:             xxhash64.Sum([]byte("old!")),
+		ChunkID:          1,
+		BlockSize:        4,
+		FileSize:         8,
+		FileMode:         0640,
+	}
+	confirmation, err := s.Replicate(ctx, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confirmation.Code != replicator.ConfirmationCode_CHUNK_CORRUPTED {
+		t.Errorf("Expected the corrupted chunk to be refused, got %s", confirmation.Code)
+	}
+	if data, _ := os.ReadFile(filePath); string(data) != "datadata" {
+		t.Errorf("Expected the corrupted chunk not to be written, got %q", data)
+	}
+
+	payload.Hash = xxhash64.Sum([]byte("new!"))
+	confirmation, err = s.Replicate(ctx, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confirmation.Code != replicator.ConfirmationCode_OK || len(confirmation.Chunk) != 1 || confirmation.Chunk[0].Hash != controller.HashUint64(payload.Hash) {
+		t.Errorf("Expected the written hash to be echoed, got %v", confirmation)
+	}
+
+	// the cached index took the written block without rereading the file
+	fIndex, exists := s.hashMap[indexKey{path: "test.txt", algorithm: controller.HashXXHash64}]
+	if !exists || !fIndex.IsCurrent() {
+		t.Fatalf("Expected the cached index to stay current")
+	}
+	if hash, _ := fIndex.LookupDigest(1); !slices.Equal(hash, payload.Hash) {
+		t.Errorf("Expected the index to hold the written hash, got %x", hash)
+	}
+}
+
+func TestReplicate_Compression(t *testing.T) {
+	s := NewReplicationServer()
+	s.FileRoot = t.TempDir()
+	ctx := context.Background()
+	zstd, _ := controller.LookupCompression(controller.CompressionZstd)
+	data := []byte("datadatadatadata")
+	compressed, _ := zstd.Compress(data)
+
+	payload := &replicator.DataPayload{
+		RelativeFilePath: "test.txt",
+		DataChunk:        compressed,
+		Compression:      "lzma",
+		BlockSize:        16,
+		FileSize:         16,
+		FileMode:         0640,
+	}
+	confirmation, err := s.Replicate(ctx, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confirmation.Code != replicator.ConfirmationCode_COMPRESSION_UNSUPPORTED {
+		t.Errorf("Expected an unknown compression to be refused, got %s", confirmation.Code)
+	}
+
+	payload.Compression = controller.CompressionZstd
+	if confirmation, err = s.Replicate(ctx, payload); err != nil {
+		t.Fatal(err)
+	}
+	if confirmation.Code != replicator.ConfirmationCode_OK {
+		t.Errorf("Expected the compressed chunk to be written, got %s", confirmation.Code)
+	}
+	if content, _ := os.ReadFile(filepath.Join(s.FileRoot, "test.txt")); string(content) != string(data) {
+		t.Errorf("Expected the chunk to be written raw, got %q", content)
+	}
+}
+
+func TestBlockSize_Bounded(t *testing.T) {
+	s := NewReplicationServer()
+	s.FileRoot = t.TempDir()
+	os.WriteFile(filepath.Join(s.FileRoot, "file"), []byte("data"), 0644)
+
+	for _, blockSize := range []uint64{0, MaxBlockSize + 1, 1 << 62} {
+		if blockMap, err := s.BlockMap(context.Background(), &replicator.BlockMapRequest{RelativeFilePath: "file", BlockSize: blockSize}); err != nil || blockMap.Code != replicator.ConfirmationCode_BLOCK_SIZE_ERROR {
+			t.Errorf("Expected a block map in blocks of %d bytes to be refused, got %v, %v", blockSize, blockMap, err)
+		}
+		if confirmation, err := s.CheckDuplicates(context.Background(), &replicator.DataSignature{RelativeFilePath: "file", BlockSize: blockSize, FileSize: 4}); err != nil || confirmation.Code != replicator.ConfirmationCode_BLOCK_SIZE_ERROR {
+			t.Errorf("Expected a signature in blocks of %d bytes to be refused, got %v, %v", blockSize, confirmation, err)
+		}
+		stream := &recordingStream{ctx: context.Background()}
+		err := s.Read(&replicator.ReadRequest{RelativeFilePath: "file", BlockSize: blockSize}, &grpc.GenericServerStream[replicator.ReadRequest, replicator.DataPayload]{ServerStream: stream})
+		if status.Code(err) != codes.InvalidArgument || len(stream.sent) != 0 {
+			t.Errorf("Expected a read in blocks of %d bytes to be refused, got %v", blockSize, err)
+		}
+	}
+}
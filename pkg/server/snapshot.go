@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/snapshot"
+	"github.com/kosalaat/file-replicator/replicator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// settleTime is how long a file counts as part of a batch in flight after its
+// last write, as the sender does not always end a batch explicitly.
+const settleTime = 2 * time.Second
+
+// DefaultQuiesceTimeout is how long a snapshot waits for the batches in flight
+// before it fails.
+const DefaultQuiesceTimeout = 30 * time.Second
+
+// quiescer holds new batches back while a snapshot is taken. The batches
+// already in flight are let through until they are done.
+type quiescer struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	paused   bool
+	frozen   bool
+	active   int
+	inflight map[string]time.Time
+}
+
+func newQuiescer() *quiescer {
+	q := &quiescer{inflight: make(map[string]time.Time)}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// inFlight reports whether the file is in the middle of a batch. Must be
+// called with the lock held.
+func (q *quiescer) inFlight(relativePath string) bool {
+	lastWrite, ok := q.inflight[relativePath]
+	return ok && time.Since(lastWrite) < settleTime
+}
+
+// beginWrite waits while a snapshot is taken, unless the write belongs to a
+// batch in flight.
+func (q *quiescer) beginWrite(relativePath string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.frozen || (q.paused && !q.inFlight(relativePath)) {
+		q.cond.Wait()
+	}
+	q.active++
+	q.inflight[relativePath] = time.Now()
+}
+
+// endWrite ends a write, lastWrite marks the end of the batch of the file.
+func (q *quiescer) endWrite(relativePath string, lastWrite bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.active--
+	if lastWrite {
+		delete(q.inflight, relativePath)
+	} else {
+		q.inflight[relativePath] = time.Now()
+	}
+	q.cond.Broadcast()
+}
+
+// pause stops new batches and waits for the ones in flight to finish, then
+// holds all writes until resume. It reports false when batches are still in
+// flight after the timeout, new batches wait until resume either way.
+func (q *quiescer) pause(timeout time.Duration) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.paused = true
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				q.cond.Broadcast()
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		for relativePath, lastWrite := range q.inflight {
+			if time.Since(lastWrite) >= settleTime {
+				delete(q.inflight, relativePath)
+			}
+		}
+		if q.active == 0 && len(q.inflight) == 0 {
+			q.frozen = true
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		q.cond.Wait()
+	}
+}
+
+func (q *quiescer) resume() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.paused = false
+	q.frozen = false
+	q.cond.Broadcast()
+}
+
+// TakeSnapshot waits for a point between batches and snapshots the file root.
+// It fails with Aborted when no such point came within the timeout, rather
+// than snapshot a batch halfway.
+func (s *ReplicationServer) TakeSnapshot(label string, timeout time.Duration) (*snapshot.Snapshot, error) {
+	if s.Snapshots == nil {
+		return nil, status.Error(codes.FailedPrecondition, "snapshots are not enabled on the reciever")
+	}
+	if timeout <= 0 {
+		timeout = DefaultQuiesceTimeout
+	}
+	s.snapshotLock.Lock()
+	defer s.snapshotLock.Unlock()
+
+	serverlogger.Info().Msg("Waiting for the batches in flight before the snapshot")
+	quiescent := s.quiesce.pause(timeout)
+	defer s.quiesce.resume()
+	if !quiescent {
+		serverlogger.Warn().Msgf("Batches still in flight after %v, not taking the snapshot", timeout)
+		return nil, status.Errorf(codes.Aborted, "batches were still in flight after %v, try again later", timeout)
+	}
+
+	s.Snapshots.Exclude = []string{filepath.Clean(s.archive().Root)}
+	if s.Deltas != nil {
+		s.Snapshots.Exclude = append(s.Snapshots.Exclude, filepath.Clean(s.Deltas.Root))
+	}
+	return s.Snapshots.Take(label, true)
+}
+
+func (s *ReplicationServer) Snapshot(ctx context.Context, in *replicator.SnapshotRequest) (*replicator.SnapshotInfo, error) {
+	taken, err := s.TakeSnapshot(in.Label, time.Duration(in.QuiesceTimeout)*time.Millisecond)
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		serverlogger.Error().Err(err).Msg("Failed to take the snapshot")
+		return &replicator.SnapshotInfo{
+			Code: replicator.ConfirmationCode_UPDATE_ERROR,
+		}, err
+	}
+	return &replicator.SnapshotInfo{
+		Code:      replicator.ConfirmationCode_OK,
+		Name:      taken.Name,
+		CreatedAt: taken.CreatedAt.UnixNano(),
+		Quiescent: taken.Quiescent,
+		Files:     uint64(taken.Files),
+		Linked:    uint64(taken.Linked),
+		Copied:    uint64(taken.Copied),
+		Bytes:     taken.Bytes,
+	}, nil
+}
+
+// beginWrite and endWrite bracket every change to the file root.
+func (s *ReplicationServer) beginWrite(relativePath string) {
+	s.quiesce.beginWrite(path.Clean(relativePath))
+}
+
+func (s *ReplicationServer) endWrite(relativePath string, lastWrite bool) {
+	s.quiesce.endWrite(path.Clean(relativePath), lastWrite)
+}
+
+// RunSnapshots takes a snapshot at the given interval and prunes the old ones.
+func (s *ReplicationServer) RunSnapshots(ctx context.Context, interval time.Duration) {
+	s.Snapshots.Run(ctx, interval, func(label string) (*snapshot.Snapshot, error) {
+		return s.TakeSnapshot(label, 0)
+	})
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/archive"
+	"github.com/kosalaat/file-replicator/pkg/snapshot"
+	"github.com/kosalaat/file-replicator/replicator"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestQuiescerWaitsForBatchesInFlight(t *testing.T) {
+	q := newQuiescer()
+	q.beginWrite("a")
+	q.endWrite("a", false)
+
+	paused := make(chan bool)
+	go func() { paused <- q.pause(time.Minute) }()
+	for {
+		q.mu.Lock()
+		started := q.paused
+		q.mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the batch of a goes on, others wait
+	blocked := make(chan struct{})
+	go func() {
+		q.beginWrite("b")
+		close(blocked)
+		q.endWrite("b", true)
+	}()
+	q.beginWrite("a")
+	q.endWrite("a", true)
+
+	if quiescent := <-paused; !quiescent {
+		t.Errorf("Expected the pause to be quiescent once the batch of a ended")
+	}
+	select {
+	case <-blocked:
+		t.Fatalf("Expected the write to b to wait for the snapshot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.resume()
+	<-blocked
+}
+
+func TestQuiescerTimeout(t *testing.T) {
+	q := newQuiescer()
+	q.beginWrite("a")
+	q.endWrite("a", false)
+	if q.pause(10 * time.Millisecond) {
+		t.Errorf("Expected the pause to time out with a batch in flight")
+	}
+	q.resume()
+}
+
+func TestSnapshot_NotQuiescent(t *testing.T) {
+	s := NewReplicationServer()
+	s.FileRoot = t.TempDir()
+	s.Snapshots = snapshot.New(filepath.Join(s.FileRoot, ".snapshots"), s.FileRoot, archive.Retention{})
+	s.beginWrite("a")
+	s.endWrite("a", false)
+
+	if _, err := s.TakeSnapshot("", 10*time.Millisecond); status.Code(err) != codes.Aborted {
+		t.Errorf("Expected the snapshot to fail with a batch in flight, got %v", err)
+	}
+	if snapshots, _ := s.Snapshots.List(); len(snapshots) != 0 {
+		t.Errorf("Expected no snapshot taken, got %v", snapshots)
+	}
+	if code := replicateFile(s, "b", "data"); code != replicator.ConfirmationCode_OK {
+		t.Errorf("Expected writes to go on after the failed snapshot, got %s", code)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	s := NewReplicationServer()
+	s.FileRoot = t.TempDir()
+	ctx := context.Background()
+
+	if _, err := s.Snapshot(ctx, &replicator.SnapshotRequest{}); err == nil {
+		t.Fatalf("Expected snapshots to be refused when not enabled")
+	}
+
+	s.Snapshots = snapshot.New(filepath.Join(s.FileRoot, ".snapshots"), s.FileRoot, archive.Retention{})
+	os.WriteFile(filepath.Join(s.FileRoot, "test.txt"), []byte("data"), 0640)
+	if _, err := s.Delete(ctx, &replicator.FileOps{RelativeFilePath: "test.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(s.FileRoot, "live.txt"), []byte("live"), 0640)
+
+	info, err := s.Snapshot(ctx, &replicator.SnapshotRequest{Label: "manual"})
+	if err != nil || info.Code != replicator.ConfirmationCode_OK {
+		t.Fatalf("Snapshot failed: %v, %v", info, err)
+	}
+	if !info.Quiescent || info.Files != 1 {
+		t.Errorf("Expected a quiescent snapshot of live.txt only, got %v", info)
+	}
+	if content, _ := os.ReadFile(filepath.Join(s.FileRoot, ".snapshots", info.Name, "live.txt")); string(content) != "live" {
+		t.Errorf("Expected live.txt in the snapshot, got %q", content)
+	}
+
+	files := make(map[string]bool)
+	stream := &listStream{ctx: ctx, send: func(info *replicator.FileInfo) { files[info.RelativeFilePath] = true }}
+	if err := s.List(&replicator.ListRequest{}, stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || !files["live.txt"] {
+		t.Errorf("Expected the snapshots left out of the listing, got %v", files)
+	}
+}
+
+type listStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	send func(*replicator.FileInfo)
+}
+
+func (l *listStream) Send(info *replicator.FileInfo) error {
+	l.send(info)
+	return nil
+}
+
+func (l *listStream) Context() context.Context {
+	return l.ctx
+}
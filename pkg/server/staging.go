@@ -0,0 +1,424 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/kosalaat/file-replicator/pkg/controller"
+	"github.com/kosalaat/file-replicator/replicator"
+)
+
+// transaction is a version of a file assembled in its staging file. It stays
+// known after it was committed or aborted, so stray chunks of it are refused.
+type transaction struct {
+	*replicator.FileVersion
+	// chunks holds the announced chunks, true once written.
+	chunks map[uint64]bool
+	open   bool
+}
+
+func (t *transaction) missing() int {
+	missing := 0
+	for _, written := range t.chunks {
+		if !written {
+			missing++
+		}
+	}
+	return missing
+}
+
+// Begin opens a new version of the file. Its staging file is seeded from the
+// live file, an older version still open is dropped.
+func (s *ReplicationServer) Begin(ctx context.Context, in *replicator.FileVersion) (*replicator.Confirmation, error) {
+	s.beginWrite(in.RelativeFilePath)
+	defer s.endWrite(in.RelativeFilePath, false)
+
+	filePath, err := s.resolve(in.RelativeFilePath)
+	if err != nil {
+		return refusedPath(), nil
+	}
+	stagingPath := controller.StagingPath(filePath)
+	relativePath := path.Clean(in.RelativeFilePath)
+
+	s.stagingLock.Lock()
+	defer s.stagingLock.Unlock()
+
+	current := s.staged[relativePath]
+	if current != nil && in.Version <= current.Version {
+		if in.Version == current.Version && current.open {
+			// the reply to the first Begin was lost
+			return &replicator.Confirmation{
+				Code: replicator.ConfirmationCode_OK,
+			}, nil
+		}
+		serverlogger.Warn().Msgf("Refusing version %d of %s, version %d was begun", in.Version, relativePath, current.Version)
+		return &replicator.Confirmation{
+			Code: replicator.ConfirmationCode_VERSION_OUTDATED,
+		}, nil
+	}
+
+	previous, _ := s.lstatFile(filePath)
+	if code := s.preflight(relativePath, previous, in.FileSize); code != replicator.ConfirmationCode_OK {
+		return &replicator.Confirmation{
+			Code: code,
+		}, nil
+	}
+
+	serverlogger.Info().Msgf("Beginning version %d of %s in %s", in.Version, relativePath, stagingPath)
+	if err := s.seedStaging(filePath, stagingPath); err != nil {
+		serverlogger.Error().Err(err).Msgf("Failed to seed the staging file of %s", relativePath)
+		s.release(filePath)
+		return &replicator.Confirmation{
+			Code: replicator.ConfirmationCode_FILE_NOT_WRITABLE,
+		}, err
+	}
+	if current != nil && current.open {
+		s.sealDelta(relativePath)
+	}
+	t := &transaction{FileVersion: in, chunks: make(map[uint64]bool, len(in.Chunks)), open: true}
+	for _, chunkID := range in.Chunks {
+		t.chunks[chunkID] = false
+	}
+	s.staged[relativePath] = t
+	s.Forwarder.Begun(in)
+	return &replicator.Confirmation{
+		Code: replicator.ConfirmationCode_OK,
+	}, nil
+}
+
+// stage returns the staging file the chunk goes to. Only the announced chunks
+// of the open version are accepted.
+func (s *ReplicationServer) stage(filePath string, relativePath string, version uint64, chunkID uint64) (string, replicator.ConfirmationCode, error) {
+	s.stagingLock.Lock()
+	defer s.stagingLock.Unlock()
+
+	relativePath = path.Clean(relativePath)
+	t, code := s.openTransaction(relativePath, version)
+	if code != replicator.ConfirmationCode_OK {
+		serverlogger.Warn().Msgf("Dropping chunk of version %d of %s: %s", version, relativePath, code)
+		return "", code, nil
+	}
+	if _, ok := t.chunks[chunkID]; !ok {
+		serverlogger.Warn().Msgf("Dropping chunk %d of %s, it is not part of version %d", chunkID, relativePath, version)
+		return "", replicator.ConfirmationCode_OFFSET_ERROR, nil
+	}
+	return controller.StagingPath(filePath), replicator.ConfirmationCode_OK, nil
+}
+
+// received marks the chunk as written to the staging file.
+func (s *ReplicationServer) received(relativePath string, version uint64, chunkID uint64) {
+	s.stagingLock.Lock()
+	defer s.stagingLock.Unlock()
+	if t := s.staged[path.Clean(relativePath)]; t != nil && t.Version == version {
+		t.chunks[chunkID] = true
+	}
+}
+
+// openTransaction returns the open transaction of the version, or the code to
+// refuse the request with: versions never begun are not found, the ones
+// superseded, committed or aborted are outdated. Must be called with
+// stagingLock held.
+func (s *ReplicationServer) openTransaction(relativePath string, version uint64) (*transaction, replicator.ConfirmationCode) {
+	t := s.staged[relativePath]
+	switch {
+	case t == nil || version > t.Version:
+		return nil, replicator.ConfirmationCode_FILE_NOT_FOUND
+	case version < t.Version || !t.open:
+		return nil, replicator.ConfirmationCode_VERSION_OUTDATED
+	}
+	return t, replicator.ConfirmationCode_OK
+}
+
+// Commit makes a version live once all its chunks arrived and the staging
+// file hashes to the content the sender read. The sender hashes the file while
+// it reads the chunks, so the hashes come with the commit rather than Begin.
+// The size and metadata given to Begin are applied, then the file is synced
+// and renamed over the target, so readers see either the old or the new
+// version.
+func (s *ReplicationServer) Commit(ctx context.Context, in *replicator.FileVersion) (*replicator.Confirmation, error) {
+	s.beginWrite(in.RelativeFilePath)
+	defer s.endWrite(in.RelativeFilePath, true)
+
+	filePath, err := s.resolve(in.RelativeFilePath)
+	if err != nil {
+		return refusedPath(), nil
+	}
+	stagingPath := controller.StagingPath(filePath)
+	relativePath := path.Clean(in.RelativeFilePath)
+
+	if s.Deltas != nil {
+		// taken before the staging lock, as Replicate does
+		s.writeLock.Lock()
+		defer s.writeLock.Unlock()
+	}
+	s.stagingLock.Lock()
+	defer s.stagingLock.Unlock()
+
+	t, code := s.openTransaction(relativePath, in.Version)
+	if code != replicator.ConfirmationCode_OK {
+		serverlogger.Warn().Msgf("Can not commit version %d of %s: %s", in.Version, relativePath, code)
+		return &replicator.Confirmation{
+			Code: code,
+		}, nil
+	}
+	if in.FileHash != 0 || len(in.Digest) > 0 {
+		t.FileHash, t.Digest, t.DigestAlgorithm = in.FileHash, in.Digest, in.DigestAlgorithm
+	}
+	if missing := t.missing(); missing > 0 {
+		serverlogger.Warn().Msgf("Version %d of %s is missing %d chunks", in.Version, relativePath, missing)
+		return &replicator.Confirmation{
+			Code: replicator.ConfirmationCode_VERSION_INCOMPLETE,
+		}, nil
+	}
+
+	staging, err := s.openFile(stagingPath, os.O_RDWR, 0)
+	if err != nil {
+		serverlogger.Error().Err(err).Msgf("Failed to open the staging file of %s", relativePath)
+		t.open = false
+		s.release(filePath)
+		return &replicator.Confirmation{
+			Code: replicator.ConfirmationCode_FILE_NOT_FOUND,
+		}, nil
+	}
+	defer staging.Close()
+
+	if err := s.preserveVersion(relativePath, filePath, int64(t.FileSize), staging); err != nil {
+		serverlogger.Error().Err(err).Msgf("Failed to save the reverse delta of %s", relativePath)
+		return &replicator.Confirmation{
+			Code: replicator.ConfirmationCode_UPDATE_ERROR,
+		}, err
+	}
+	if err := staging.Truncate(int64(t.FileSize)); err != nil {
+		return &replicator.Confirmation{
+			Code: replicator.ConfirmationCode_FILE_NOT_WRITABLE,
+		}, err
+	}
+	if matches, err := s.verify(relativePath, t, staging); err != nil {
+		serverlogger.Error().Err(err).Msgf("Failed to hash the staging file of %s", relativePath)
+		return &replicator.Confirmation{
+			Code: replicator.ConfirmationCode_FILE_NOT_READABLE,
+		}, err
+	} else if !matches {
+		serverlogger.Error().Msgf("Version %d of %s does not match the sender, discarding it", in.Version, relativePath)
+		t.open = false
+		s.release(filePath)
+		s.removeFile(stagingPath)
+		s.sealDelta(relativePath)
+		return &replicator.Confirmation{
+			Code: replicator.ConfirmationCode_CHECKSUM_MISMATCH,
+		}, nil
+	}
+	if err := staging.Chmod(os.FileMode(t.FileMode).Perm()); err != nil {
+		return &replicator.Confirmation{
+			Code: replicator.ConfirmationCode_FILE_NOT_WRITABLE,
+		}, err
+	}
+	if stat, err := staging.Stat(); err == nil {
+		if owner, ok := stat.Sys().(*syscall.Stat_t); ok && (owner.Uid != t.UID || owner.Gid != t.GID) {
+			if err := staging.Chown(int(t.UID), int(t.GID)); err != nil {
+				serverlogger.Error().Err(err).Msg("Failed to change file ownership")
+				return &replicator.Confirmation{
+					Code: replicator.ConfirmationCode_FILE_NOT_WRITABLE,
+				}, err
+			}
+		}
+	}
+	if err := staging.Sync(); err != nil {
+		serverlogger.Error().Err(err).Msgf("Failed to sync the staging file of %s", relativePath)
+		return &replicator.Confirmation{
+			Code: replicator.ConfirmationCode_UPDATE_ERROR,
+		}, err
+	}
+
+	defer s.account(filePath)
+	if err := s.renameFile(stagingPath, filePath); err != nil {
+		serverlogger.Error().Err(err).Msgf("Failed to commit %s", relativePath)
+		return &replicator.Confirmation{
+			Code: replicator.ConfirmationCode_UPDATE_ERROR,
+		}, err
+	}
+	t.open = false
+	s.forgetIndex(relativePath)
+	s.syncDir(filepath.Dir(filePath))
+	serverlogger.Info().Msgf("Committed version %d of %s", in.Version, relativePath)
+	s.versionCommitted(relativePath)
+
+	s.sealDelta(in.RelativeFilePath)
+	s.Forwarder.Committed(in)
+	return &replicator.Confirmation{
+		Code: replicator.ConfirmationCode_OK,
+	}, nil
+}
+
+// verify hashes the assembled version with xxhash64 and the strong digest of
+// the sender, in one read. The digest check is recorded in the verification
+// report.
+func (s *ReplicationServer) verify(relativePath string, t *transaction, staging *os.File) (bool, error) {
+	if t.FileHash == 0 && len(t.Digest) == 0 {
+		return true, nil
+	}
+	fileHash := xxhash.New()
+	writers := []io.Writer{fileHash}
+	var digest hash.Hash
+	if len(t.Digest) > 0 {
+		var err error
+		if digest, _, err = controller.NewDigest(t.DigestAlgorithm); err != nil {
+			return false, err
+		}
+		writers = append(writers, digest)
+	}
+	if _, err := staging.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), staging); err != nil {
+		return false, err
+	}
+
+	matches := t.FileHash == 0 || fileHash.Sum64() == t.FileHash
+	if digest != nil {
+		actual := digest.Sum(nil)
+		s.Verifications.record(relativePath, t.Version, t.DigestAlgorithm, t.Digest, actual)
+		matches = matches && bytes.Equal(actual, t.Digest)
+	}
+	return matches, nil
+}
+
+// Abort drops a version, the live file is left as it is and the chunks of the
+// version still on the way are refused.
+func (s *ReplicationServer) Abort(ctx context.Context, in *replicator.FileVersion) (*replicator.Confirmation, error) {
+	s.beginWrite(in.RelativeFilePath)
+	defer s.endWrite(in.RelativeFilePath, true)
+
+	filePath, err := s.resolve(in.RelativeFilePath)
+	if err != nil {
+		return refusedPath(), nil
+	}
+	relativePath := path.Clean(in.RelativeFilePath)
+
+	s.stagingLock.Lock()
+	defer s.stagingLock.Unlock()
+
+	t, code := s.openTransaction(relativePath, in.Version)
+	if code != replicator.ConfirmationCode_OK {
+		// nothing left to abort
+		return &replicator.Confirmation{
+			Code: replicator.ConfirmationCode_OK,
+		}, nil
+	}
+	serverlogger.Info().Msgf("Aborting version %d of %s", in.Version, relativePath)
+	t.open = false
+	s.release(filePath)
+	if err := s.removeFile(controller.StagingPath(filePath)); err != nil && !os.IsNotExist(err) {
+		serverlogger.Error().Err(err).Msgf("Failed to remove the staging file of %s", relativePath)
+	}
+	s.sealDelta(in.RelativeFilePath)
+	s.Forwarder.Aborted(in)
+	return &replicator.Confirmation{
+		Code: replicator.ConfirmationCode_OK,
+	}, nil
+}
+
+// seedStaging seeds the staging file of a version through the file root.
+func (s *ReplicationServer) seedStaging(filePath string, stagingPath string) error {
+	root, liveName, err := s.openRoot(filePath)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	stagingName, err := filepath.Rel(s.FileRoot, stagingPath)
+	if err != nil {
+		return err
+	}
+	return controller.SeedStaging(root, liveName, stagingName)
+}
+
+// syncDir makes a rename in the directory durable.
+func (s *ReplicationServer) syncDir(dirPath string) {
+	dir, err := s.openFile(dirPath, os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		serverlogger.Warn().Err(err).Msgf("Failed to sync directory %s", dirPath)
+	}
+}
+
+// CleanStaging removes the staging files a previous run left behind, their
+// versions can not be committed anymore.
+func (s *ReplicationServer) CleanStaging() error {
+	s.stagingLock.Lock()
+	defer s.stagingLock.Unlock()
+	s.staged = make(map[string]*transaction)
+
+	root, err := os.OpenRoot(s.FileRoot)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer root.Close()
+	return fs.WalkDir(root.FS(), ".", func(relativePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() && controller.IsStagingFile(relativePath) {
+			serverlogger.Info().Msgf("Removing orphaned staging file %s", relativePath)
+			if err := root.Remove(relativePath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// renameStaging moves the open version along with its file, the chunks still
+// queued on the sender follow the rename.
+func (s *ReplicationServer) renameStaging(oldRelativePath string, newRelativePath string) {
+	s.stagingLock.Lock()
+	defer s.stagingLock.Unlock()
+
+	oldRelativePath, newRelativePath = path.Clean(oldRelativePath), path.Clean(newRelativePath)
+	t, ok := s.staged[oldRelativePath]
+	if !ok {
+		return
+	}
+	delete(s.staged, oldRelativePath)
+	if t.open {
+		oldStaging := controller.StagingPath(path.Join(s.FileRoot, oldRelativePath))
+		newStaging := controller.StagingPath(path.Join(s.FileRoot, newRelativePath))
+		if err := s.renameFile(oldStaging, newStaging); err != nil {
+			serverlogger.Error().Err(err).Msgf("Failed to move the staging file of %s", oldRelativePath)
+			return
+		}
+	}
+	s.staged[newRelativePath] = t
+}
+
+// discardStaging drops the open version of a deleted file.
+func (s *ReplicationServer) discardStaging(relativePath string) {
+	s.stagingLock.Lock()
+	defer s.stagingLock.Unlock()
+
+	relativePath = path.Clean(relativePath)
+	t, ok := s.staged[relativePath]
+	if !ok {
+		return
+	}
+	delete(s.staged, relativePath)
+	if !t.open {
+		return
+	}
+	stagingPath := controller.StagingPath(path.Join(s.FileRoot, relativePath))
+	if err := s.removeFile(stagingPath); err != nil && !os.IsNotExist(err) {
+		serverlogger.Error().Err(err).Msgf("Failed to remove the staging file of %s", relativePath)
+	}
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/kosalaat/file-replicator/pkg/controller"
+	"github.com/kosalaat/file-replicator/replicator"
+)
+
+func TestFileVersion(t *testing.T) {
+	s := NewReplicationServer()
+	s.FileRoot = t.TempDir()
+	ctx := context.Background()
+	filePath := filepath.Join(s.FileRoot, "test.txt")
+	if err := os.WriteFile(filePath, []byte("old data tail"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	stat, _ := os.Stat(filePath)
+	owner := stat.Sys().(*syscall.Stat_t)
+
+	fileVersion := func(version uint64, content string) *replicator.FileVersion {
+		return &replicator.FileVersion{
+			RelativeFilePath: "test.txt",
+			Version:          version,
+			FileSize:         uint64(len(content)),
+			FileMode:         0600,
+			UID:              owner.Uid,
+			GID:              owner.Gid,
+			FileHash:         xxhash.Sum64String(content),
+			BlockSize:        4,
+			Chunks:           []uint64{1},
+		}
+	}
+	begin := func(version *replicator.FileVersion) replicator.ConfirmationCode {
+		t.Helper()
+		confirmation, err := s.Begin(ctx, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return confirmation.Code
+	}
+	replicate := func(version uint64, chunkID uint64, data string) replicator.ConfirmationCode {
+		t.Helper()
+		confirmation, err := s.Replicate(ctx, &replicator.DataPayload{
+			RelativeFilePath: "test.txt",
+			DataChunk:        []byte(data),
+			ChunkID:          chunkID,
+			BlockSize:        4,
+			FileSize:         8,
+			FileMode:         0640,
+			StagingVersion:   version,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return confirmation.Code
+	}
+	commit := func(version *replicator.FileVersion) replicator.ConfirmationCode {
+		t.Helper()
+		confirmation, err := s.Commit(ctx, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return confirmation.Code
+	}
+
+	if code := replicate(1, 1, "data"); code != replicator.ConfirmationCode_FILE_NOT_FOUND {
+		t.Errorf("Expected a chunk of a version not begun to be refused, got %s", code)
+	}
+
+	// the first version is aborted, its late chunks are refused
+	first := fileVersion(1, "old datahalf")
+	if code := begin(first); code != replicator.ConfirmationCode_OK {
+		t.Fatalf("Expected the version to begin, got %s", code)
+	}
+	if code := commit(first); code != replicator.ConfirmationCode_VERSION_INCOMPLETE {
+		t.Errorf("Expected the commit without the chunks to be refused, got %s", code)
+	}
+	if _, err := s.Abort(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	if code := replicate(1, 1, "half"); code != replicator.ConfirmationCode_VERSION_OUTDATED {
+		t.Errorf("Expected a chunk of the aborted version to be refused, got %s", code)
+	}
+	if _, err := os.Stat(controller.StagingPath(filePath)); !os.IsNotExist(err) {
+		t.Errorf("Expected the staging file to be removed on abort, got %v", err)
+	}
+
+	second := fileVersion(2, "old new!")
+	if code := begin(second); code != replicator.ConfirmationCode_OK {
+		t.Fatalf("Expected the version to begin, got %s", code)
+	}
+	if code := replicate(2, 2, "tail"); code != replicator.ConfirmationCode_OFFSET_ERROR {
+		t.Errorf("Expected a chunk not announced to be refused, got %s", code)
+	}
+	if code := replicate(2, 1, "new!"); code != replicator.ConfirmationCode_OK {
+		t.Fatalf("Expected the chunk to be staged, got %s", code)
+	}
+	if data, _ := os.ReadFile(filePath); string(data) != "old data tail" {
+		t.Errorf("Expected the live file to be unchanged before the commit, got %q", data)
+	}
+	if code := begin(first); code != replicator.ConfirmationCode_VERSION_OUTDATED {
+		t.Errorf("Expected an older version to be refused, got %s", code)
+	}
+
+	// truncation and metadata are applied once, on commit
+	if code := commit(second); code != replicator.ConfirmationCode_OK {
+		t.Fatalf("Expected the commit to succeed, got %s", code)
+	}
+	if data, _ := os.ReadFile(filePath); string(data) != "old new!" {
+		t.Errorf("Expected the committed version, got %q", data)
+	}
+	if stat, _ := os.Stat(filePath); stat.Mode().Perm() != 0600 {
+		t.Errorf("Expected the mode of the version, got %v", stat.Mode())
+	}
+	if code := commit(second); code != replicator.ConfirmationCode_VERSION_OUTDATED {
+		t.Errorf("Expected a second commit to be refused, got %s", code)
+	}
+
+	// a version not matching its hash is discarded
+	third := fileVersion(3, "old nope")
+	begin(third)
+	replicate(3, 1, "new?")
+	if code := commit(third); code != replicator.ConfirmationCode_CHECKSUM_MISMATCH {
+		t.Errorf("Expected the commit to be refused on a hash mismatch, got %s", code)
+	}
+	if data, _ := os.ReadFile(filePath); string(data) != "old new!" {
+		t.Errorf("Expected the live file to be kept, got %q", data)
+	}
+}
+
+func TestCleanStaging(t *testing.T) {
+	s := NewReplicationServer()
+	s.FileRoot = t.TempDir()
+	orphan := controller.StagingPath(filepath.Join(s.FileRoot, "dir", "test.txt"))
+	if err := os.MkdirAll(filepath.Dir(orphan), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(orphan, []byte("torn"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	kept := filepath.Join(s.FileRoot, "dir", "test.txt")
+	if err := os.WriteFile(kept, []byte("data"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.CleanStaging(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("Expected the orphaned staging file to be removed, got %v", err)
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Errorf("Expected the file to be kept, got %v", err)
+	}
+}
+
+func TestFileVersion_Digest(t *testing.T) {
+	s := NewReplicationServer()
+	s.FileRoot = t.TempDir()
+	s.Verifications = &VerificationReport{Path: filepath.Join(t.TempDir(), "verify.jsonl")}
+	ctx := context.Background()
+	owner := os.Getuid()
+
+	commit := func(version uint64, content string, expected string) replicator.ConfirmationCode {
+		t.Helper()
+		digest := sha256.Sum256([]byte(expected))
+		fileVersion := &replicator.FileVersion{
+			RelativeFilePath: "test.txt",
+			Version:          version,
+			FileSize:         uint64(len(content)),
+			FileMode:         0640,
+			UID:              uint32(owner),
+			GID:              uint32(os.Getgid()),
+			BlockSize:        8,
+			Chunks:           []uint64{0},
+			Digest:           digest[:],
+			DigestAlgorithm:  "sha256",
+		}
+		if _, err := s.Begin(ctx, fileVersion); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Replicate(ctx, &replicator.DataPayload{
+			RelativeFilePath: "test.txt",
+			DataChunk:        []byte(content),
+			BlockSize:        8,
+			FileSize:         uint64(len(content)),
+			FileMode:         0640,
+			StagingVersion:   version,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		confirmation, err := s.Commit(ctx, fileVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return confirmation.Code
+	}
+
+	if code := commit(1, "corrupt", "content"); code != replicator.ConfirmationCode_CHECKSUM_MISMATCH {
+		t.Errorf("Expected the digest mismatch to be reported, got %s", code)
+	}
+	if _, err := os.Stat(filepath.Join(s.FileRoot, "test.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected the version not to be committed, got %v", err)
+	}
+	if code := commit(2, "content", "content"); code != replicator.ConfirmationCode_OK {
+		t.Errorf("Expected the verified version to be committed, got %s", code)
+	}
+
+	report, err := os.ReadFile(s.Verifications.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []VerificationRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(report)), "\n") {
+		var record VerificationRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 || records[0].Verified || !records[1].Verified || records[1].Version != 2 {
+		t.Errorf("Expected a failed and a passed verification, got %+v", records)
+	}
+}
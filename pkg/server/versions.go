@@ -0,0 +1,214 @@
+package server
+
+import (
+	"io"
+	"os"
+	"path"
+
+	"github.com/kosalaat/file-replicator/pkg/versions"
+	"github.com/kosalaat/file-replicator/replicator"
+)
+
+// pendingVersion is a version of a file accepted from a peer while its
+// content is on the way. It is recorded in the version store once the changed
+// chunks were written, or its staged version was committed, so a transfer
+// that fails halfway is offered again rather than taken for applied.
+type pendingVersion struct {
+	versions.FileVersion
+	// chunks holds the changed chunks still to be written.
+	chunks map[uint64]bool
+}
+
+// checkVersion compares the version vector of an incoming file version with
+// the local one. It returns a confirmation when the version is rejected,
+// otherwise the version to accept once its content arrived, with the merged
+// vector.
+func (s *ReplicationServer) checkVersion(in *replicator.DataSignature) (*replicator.Confirmation, versions.FileVersion, error) {
+	remote := versions.FileVersion{
+		Vector:  versions.VersionVector(in.VersionVector),
+		Hash:    in.FileHash,
+		ModTime: in.ModTime,
+		Site:    in.SiteID,
+	}
+
+	local, exists := s.Versions.Get(in.RelativeFilePath)
+	if !exists {
+		return nil, remote, nil
+	}
+
+	switch remote.Vector.Compare(local.Vector) {
+	case versions.Before:
+		serverlogger.Info().Msgf("Version of %s from %s is outdated, keeping the local one", in.RelativeFilePath, in.SiteID)
+		return &replicator.Confirmation{
+			Code:          replicator.ConfirmationCode_VERSION_OUTDATED,
+			VersionVector: local.Vector,
+		}, remote, nil
+	case versions.Concurrent:
+		if local.Deleted {
+			serverlogger.Info().Msgf("%s was deleted here and changed by %s, the change wins", in.RelativeFilePath, in.SiteID)
+			break
+		}
+		resolution, conflictCopy := s.Conflicts.Resolve(in.RelativeFilePath, local, remote)
+		if resolution == versions.KeepLocal {
+			return &replicator.Confirmation{
+				Code:          replicator.ConfirmationCode_CONFLICT,
+				VersionVector: local.Vector,
+			}, remote, nil
+		}
+		// the copy of an earlier attempt at this version holds the local
+		// content, the live file may be partly overwritten since
+		if pending, ok := s.pendingVersion(in.RelativeFilePath); conflictCopy != "" && !(ok && pending.Compare(remote.Vector.Merge(local.Vector)) == versions.Equal) {
+			serverlogger.Info().Msgf("Keeping the local version of %s as %s", in.RelativeFilePath, conflictCopy)
+			if err := s.copyFile(in.RelativeFilePath, conflictCopy); err != nil && !os.IsNotExist(err) {
+				serverlogger.Error().Err(err).Msgf("Failed to keep conflicting copy of %s", in.RelativeFilePath)
+				return &replicator.Confirmation{
+					Code: storageCode(err, replicator.ConfirmationCode_UPDATE_ERROR),
+				}, remote, err
+			}
+		}
+	}
+
+	remote.Vector = remote.Vector.Merge(local.Vector)
+	return nil, remote, nil
+}
+
+// copyFile copies a file of the file root to another path in it, the new file
+// is accounted for in the quota.
+func (s *ReplicationServer) copyFile(relativePath string, copyPath string) error {
+	copyFilePath, err := s.resolve(copyPath)
+	if err != nil {
+		return err
+	}
+	filePath, err := s.resolve(relativePath)
+	if err != nil {
+		return err
+	}
+	source, err := s.openFile(filePath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	stat, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	defer s.account(copyFilePath)
+	dest, err := s.openFile(copyFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, stat.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	if _, err := io.Copy(dest, source); err != nil {
+		return err
+	}
+	return dest.Sync()
+}
+
+// expectVersion holds the accepted version until the changed chunks were
+// written. Writes to the file are treated as echoes meanwhile. A version with
+// nothing to write is recorded right away.
+func (s *ReplicationServer) expectVersion(relativePath string, version versions.FileVersion, chunks []*replicator.ChunkInfo) {
+	relativePath = path.Clean(relativePath)
+	if len(chunks) == 0 {
+		s.dropPendingVersion(relativePath)
+		s.Versions.Accept(relativePath, version)
+		return
+	}
+	pending := &pendingVersion{FileVersion: version, chunks: make(map[uint64]bool, len(chunks))}
+	for _, chunk := range chunks {
+		pending.chunks[chunk.ChunkID] = true
+	}
+	s.versionLock.Lock()
+	s.pending[relativePath] = pending
+	s.versionLock.Unlock()
+	s.Versions.Expect(relativePath, version.Hash)
+}
+
+// versionWritten records the pending version of the file once the last of its
+// changed chunks was written.
+func (s *ReplicationServer) versionWritten(relativePath string, chunkID uint64) {
+	if s.Versions == nil {
+		return
+	}
+	relativePath = path.Clean(relativePath)
+	s.versionLock.Lock()
+	pending, ok := s.pending[relativePath]
+	if ok {
+		delete(pending.chunks, chunkID)
+		if len(pending.chunks) > 0 {
+			ok = false
+		} else {
+			delete(s.pending, relativePath)
+		}
+	}
+	s.versionLock.Unlock()
+	if ok {
+		serverlogger.Info().Msgf("Version %v of %s arrived", pending.Vector, relativePath)
+		s.Versions.Accept(relativePath, pending.FileVersion)
+	}
+}
+
+// versionCommitted records the pending version of the file, its content was
+// made live by the commit.
+func (s *ReplicationServer) versionCommitted(relativePath string) {
+	if s.Versions == nil {
+		return
+	}
+	relativePath = path.Clean(relativePath)
+	if pending, ok := s.dropPendingVersion(relativePath); ok {
+		serverlogger.Info().Msgf("Version %v of %s was committed", pending.Vector, relativePath)
+		s.Versions.Accept(relativePath, pending.FileVersion)
+	}
+}
+
+// pendingVersion returns the vector of the version of the file on the way.
+func (s *ReplicationServer) pendingVersion(relativePath string) (versions.VersionVector, bool) {
+	s.versionLock.Lock()
+	defer s.versionLock.Unlock()
+	if pending, ok := s.pending[path.Clean(relativePath)]; ok {
+		return pending.Vector, true
+	}
+	return nil, false
+}
+
+func (s *ReplicationServer) dropPendingVersion(relativePath string) (*pendingVersion, bool) {
+	s.versionLock.Lock()
+	defer s.versionLock.Unlock()
+	pending, ok := s.pending[relativePath]
+	delete(s.pending, relativePath)
+	return pending, ok
+}
+
+// renamePendingVersion moves the version on the way along with its file.
+func (s *ReplicationServer) renamePendingVersion(oldRelativePath string, newRelativePath string) {
+	s.versionLock.Lock()
+	defer s.versionLock.Unlock()
+	oldRelativePath, newRelativePath = path.Clean(oldRelativePath), path.Clean(newRelativePath)
+	if pending, ok := s.pending[oldRelativePath]; ok {
+		delete(s.pending, oldRelativePath)
+		s.pending[newRelativePath] = pending
+	}
+}
+
+// checkDelete only lets a delete through when the local copy has no changes
+// the deleting site has not seen; otherwise the edit wins over the delete.
+func (s *ReplicationServer) checkDelete(in *replicator.FileOps) *replicator.Confirmation {
+	remote := versions.VersionVector(in.VersionVector)
+	local, exists := s.Versions.Get(in.RelativeFilePath)
+	if exists && !local.Deleted {
+		if ordering := remote.Compare(local.Vector); ordering == versions.Before || ordering == versions.Concurrent {
+			serverlogger.Warn().Msgf("Ignoring delete of %s from %s, the file was changed locally", in.RelativeFilePath, in.SiteID)
+			return &replicator.Confirmation{
+				Code:          replicator.ConfirmationCode_CONFLICT,
+				VersionVector: local.Vector,
+			}
+		}
+	}
+	s.dropPendingVersion(path.Clean(in.RelativeFilePath))
+	s.Versions.Accept(in.RelativeFilePath, versions.FileVersion{
+		Vector:  remote.Merge(local.Vector),
+		Site:    in.SiteID,
+		Deleted: true,
+	})
+	return nil
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kosalaat/file-replicator/pkg/versions"
+	"github.com/kosalaat/file-replicator/replicator"
+)
+
+func newVersionedServer(t *testing.T, policy versions.Policy) *ReplicationServer {
+	store, err := versions.NewStore("b", "")
+	if err != nil {
+		t.Fatalf("Failed to create version store: %v", err)
+	}
+	s := NewReplicationServer()
+	s.FileRoot = t.TempDir()
+	s.Versions = store
+	s.Conflicts = &versions.Resolver{Policy: policy}
+	return s
+}
+
+func TestCheckDuplicates_Versions(t *testing.T) {
+	s := newVersionedServer(t, versions.NewestWins)
+	ctx := context.Background()
+
+	signature := &replicator.DataSignature{
+		RelativeFilePath: "test.txt",
+		BlockSize:        4,
+		FileSize:         4,
+		Chunk:            []*replicator.ChunkInfo{{ChunkID: 0, Hash: 1}},
+		VersionVector:    map[string]uint64{"a": 1},
+		SiteID:           "a",
+		ModTime:          100,
+	}
+	confirmation, err := s.CheckDuplicates(ctx, signature)
+	if err != nil || confirmation.Code != replicator.ConfirmationCode_CHANGES_REPORTED {
+		t.Fatalf("Expected new file to be accepted, got %v, %v", confirmation, err)
+	}
+	if code := replicateFile(s, "test.txt", "data"); code != replicator.ConfirmationCode_OK {
+		t.Fatalf("Failed to replicate the file: %s", code)
+	}
+
+	signature.VersionVector = map[string]uint64{"a": 0}
+	if confirmation, _ := s.CheckDuplicates(ctx, signature); confirmation.Code != replicator.ConfirmationCode_VERSION_OUTDATED {
+		t.Fatalf("Expected outdated version to be rejected, got %s", confirmation.Code)
+	}
+
+	// the received content lands, then gets edited locally, concurrently with
+	// an older edit from a
+	s.Versions.LocalChange("test.txt", 0, 100)
+	s.Versions.LocalChange("test.txt", 2, 300)
+	signature.VersionVector = map[string]uint64{"a": 2}
+	signature.ModTime = 200
+	if confirmation, _ := s.CheckDuplicates(ctx, signature); confirmation.Code != replicator.ConfirmationCode_CONFLICT {
+		t.Fatalf("Expected the newer local edit to win, got %s", confirmation.Code)
+	}
+
+	// concurrent newer edit from a
+	signature.ModTime = 400
+	confirmation, _ = s.CheckDuplicates(ctx, signature)
+	if confirmation.Code != replicator.ConfirmationCode_CHANGES_REPORTED {
+		t.Fatalf("Expected the newer remote edit to win, got %s", confirmation.Code)
+	}
+	if vector := versions.VersionVector(confirmation.VersionVector); vector["a"] != 2 || vector["b"] != 1 {
+		t.Fatalf("Expected merged vector, got %v", vector)
+	}
+}
+
+func TestCheckDuplicates_KeepBoth(t *testing.T) {
+	s := newVersionedServer(t, versions.KeepBoth)
+	ctx := context.Background()
+
+	if err := os.WriteFile(filepath.Join(s.FileRoot, "test.txt"), []byte("local"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	s.Versions.LocalChange("test.txt", 1, 100)
+
+	confirmation, err := s.CheckDuplicates(ctx, &replicator.DataSignature{
+		RelativeFilePath: "test.txt",
+		BlockSize:        4,
+		FileSize:         6,
+		Chunk:            []*replicator.ChunkInfo{{ChunkID: 0, Hash: 1}, {ChunkID: 1, Hash: 2}},
+		VersionVector:    map[string]uint64{"a": 1},
+		SiteID:           "a",
+		ModTime:          200,
+	})
+	if err != nil || confirmation.Code != replicator.ConfirmationCode_CHANGES_REPORTED {
+		t.Fatalf("Expected the remote edit to be accepted, got %v, %v", confirmation, err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(s.FileRoot, versions.ConflictPath("test.txt", "b")))
+	if err != nil || string(content) != "local" {
+		t.Fatalf("Expected the local copy to be kept, got %q, %v", content, err)
+	}
+}
+
+func TestDelete_Versions(t *testing.T) {
+	s := newVersionedServer(t, versions.NewestWins)
+	ctx := context.Background()
+
+	if err := os.WriteFile(filepath.Join(s.FileRoot, "test.txt"), []byte("local"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	s.Versions.LocalChange("test.txt", 1, 100)
+
+	confirmation, err := s.Delete(ctx, &replicator.FileOps{
+		RelativeFilePath: "test.txt",
+		VersionVector:    map[string]uint64{"a": 1},
+		SiteID:           "a",
+	})
+	if err != nil || confirmation.Code != replicator.ConfirmationCode_CONFLICT {
+		t.Fatalf("Expected the local edit to win over the delete, got %v, %v", confirmation, err)
+	}
+	if _, err := os.Stat(filepath.Join(s.FileRoot, "test.txt")); err != nil {
+		t.Fatalf("File should not have been deleted: %v", err)
+	}
+
+	confirmation, err = s.Delete(ctx, &replicator.FileOps{
+		RelativeFilePath: "test.txt",
+		VersionVector:    map[string]uint64{"a": 1, "b": 1},
+		SiteID:           "a",
+	})
+	if err != nil || confirmation.Code != replicator.ConfirmationCode_OK {
+		t.Fatalf("Expected the delete to be applied, got %v, %v", confirmation, err)
+	}
+	if version, _ := s.Versions.Get("test.txt"); !version.Deleted {
+		t.Fatalf("Expected a tombstone, got %+v", version)
+	}
+}
+
+func TestCheckDuplicates_VersionAcceptedOnceWritten(t *testing.T) {
+	s := newVersionedServer(t, versions.KeepBoth)
+	ctx := context.Background()
+
+	if err := os.WriteFile(filepath.Join(s.FileRoot, "test.txt"), []byte("local"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	s.Versions.LocalChange("test.txt", 1, 100)
+	signature := &replicator.DataSignature{
+		RelativeFilePath: "test.txt",
+		BlockSize:        4,
+		FileSize:         8,
+		Chunk:            []*replicator.ChunkInfo{{ChunkID: 0, Hash: 1}, {ChunkID: 1, Hash: 2}},
+		VersionVector:    map[string]uint64{"a": 1},
+		SiteID:           "a",
+		ModTime:          200,
+	}
+	if confirmation, err := s.CheckDuplicates(ctx, signature); err != nil || confirmation.Code != replicator.ConfirmationCode_CHANGES_REPORTED {
+		t.Fatalf("Expected the remote edit to be accepted, got %v, %v", confirmation, err)
+	}
+	if content, err := os.ReadFile(filepath.Join(s.FileRoot, "test.txt")); err != nil || string(content) != "local" {
+		t.Fatalf("Expected the local file to stay until the content arrives, got %q, %v", content, err)
+	}
+
+	// the transfer fails after the first chunk
+	s.Replicate(ctx, &replicator.DataPayload{DataChunk: []byte("remo"), BlockSize: 4, FileMode: 0644, FileSize: 8, RelativeFilePath: "test.txt"})
+	if version, _ := s.Versions.Get("test.txt"); version.Vector["a"] != 0 {
+		t.Fatalf("Expected the remote version not to be recorded before its content arrived, got %v", version.Vector)
+	}
+
+	if confirmation, _ := s.CheckDuplicates(ctx, signature); confirmation.Code != replicator.ConfirmationCode_CHANGES_REPORTED {
+		t.Fatalf("Expected the retried edit to be accepted, got %s", confirmation.Code)
+	}
+	for chunkID, data := range []string{"remo", "te!!"} {
+		s.Replicate(ctx, &replicator.DataPayload{DataChunk: []byte(data), ChunkID: uint64(chunkID), BlockSize: 4, FileMode: 0644, FileSize: 8, RelativeFilePath: "test.txt"})
+	}
+	if version, _ := s.Versions.Get("test.txt"); version.Vector["a"] != 1 || version.Vector["b"] != 1 {
+		t.Fatalf("Expected the remote version to be recorded once written, got %v", version.Vector)
+	}
+	if content, err := os.ReadFile(filepath.Join(s.FileRoot, versions.ConflictPath("test.txt", "b"))); err != nil || string(content) != "local" {
+		t.Fatalf("Expected the local copy to be kept across the retry, got %q, %v", content, err)
+	}
+}
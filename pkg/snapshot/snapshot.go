@@ -0,0 +1,400 @@
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/archive"
+	"github.com/kosalaat/file-replicator/pkg/controller"
+	"github.com/rs/zerolog/log"
+)
+
+var snapshotlogger = log.With().Str("component", "snapshot").Logger()
+
+// partialSuffix marks a snapshot that is still being taken.
+const partialSuffix = ".partial"
+
+// Snapshot describes a point-in-time copy of the file root. The copy itself is
+// a plain directory, <root>/<name>, that can be read or bind mounted as is.
+type Snapshot struct {
+	Name      string    `json:"name"`
+	Label     string    `json:"label,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// Quiescent is false when the snapshot was taken while a batch was still
+	// being applied.
+	Quiescent bool   `json:"quiescent"`
+	Files     int    `json:"files"`
+	Linked    int    `json:"linked"`
+	Copied    int    `json:"copied"`
+	Bytes     uint64 `json:"bytes"`
+	Path      string `json:"path"`
+}
+
+// Manager takes snapshots of FileRoot into Root. Unchanged files are hard
+// links into the previous snapshot, changed ones are copied, so the live files
+// the reciever writes in place are never shared with a snapshot.
+type Manager struct {
+	Root      string
+	FileRoot  string
+	Retention archive.Retention
+	// Exclude are the directories left out, like the archive when it sits
+	// under the file root.
+	Exclude []string
+
+	now func() time.Time
+}
+
+func New(root string, fileRoot string, retention archive.Retention) *Manager {
+	return &Manager{
+		Root:      root,
+		FileRoot:  fileRoot,
+		Retention: retention,
+		now:       time.Now,
+	}
+}
+
+func (m *Manager) metadataPath(name string) string {
+	return filepath.Join(m.Root, name+".json")
+}
+
+// Take copies the file root into a new snapshot. The caller makes sure no
+// batch is being applied meanwhile.
+func (m *Manager) Take(label string, quiescent bool) (*Snapshot, error) {
+	createdAt := m.now().UTC()
+	snapshot := &Snapshot{Label: label, CreatedAt: createdAt, Quiescent: quiescent}
+	for {
+		snapshot.Name = createdAt.Format(archive.VersionFormat)
+		if _, err := os.Lstat(filepath.Join(m.Root, snapshot.Name)); os.IsNotExist(err) {
+			break
+		}
+		createdAt = createdAt.Add(time.Nanosecond)
+		snapshot.CreatedAt = createdAt
+	}
+	snapshot.Path = filepath.Join(m.Root, snapshot.Name)
+
+	previous := ""
+	if snapshots, err := m.List(); err == nil && len(snapshots) > 0 {
+		previous = snapshots[len(snapshots)-1].Path
+	}
+
+	partial := snapshot.Path + partialSuffix
+	if err := os.MkdirAll(partial, 0750); err != nil {
+		snapshotlogger.Error().Err(err).Msgf("Failed to create snapshot directory %s", partial)
+		return nil, err
+	}
+
+	excluded := make(map[string]bool)
+	for _, dir := range append([]string{m.Root}, m.Exclude...) {
+		excluded[filepath.Clean(dir)] = true
+	}
+
+	snapshotlogger.Info().Msgf("Taking snapshot %s of %s", snapshot.Name, m.FileRoot)
+	err := filepath.WalkDir(m.FileRoot, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(m.FileRoot, filePath)
+		if err != nil {
+			return err
+		}
+		destPath := filepath.Join(partial, relativePath)
+
+		if entry.IsDir() {
+			if excluded[filepath.Clean(filePath)] {
+				return filepath.SkipDir
+			}
+			if relativePath == "." {
+				return nil
+			}
+			return os.Mkdir(destPath, 0750)
+		}
+		if !entry.Type().IsRegular() || controller.IsStagingFile(filePath) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		snapshot.Files++
+		snapshot.Bytes += uint64(info.Size())
+		if previous != "" && linkUnchanged(filepath.Join(previous, relativePath), destPath, info) {
+			snapshot.Linked++
+			return nil
+		}
+		if err := copyFile(filePath, destPath, info); err != nil {
+			snapshotlogger.Error().Err(err).Msgf("Failed to copy %s into the snapshot", filePath)
+			return err
+		}
+		snapshot.Copied++
+		return nil
+	})
+	if err == nil {
+		err = copyDirModes(m.FileRoot, partial)
+	}
+	if err != nil {
+		os.RemoveAll(partial)
+		return nil, err
+	}
+
+	content, _ := json.MarshalIndent(snapshot, "", "  ")
+	if err := os.WriteFile(m.metadataPath(snapshot.Name), content, 0640); err != nil {
+		os.RemoveAll(partial)
+		return nil, err
+	}
+	if err := os.Rename(partial, snapshot.Path); err != nil {
+		os.Remove(m.metadataPath(snapshot.Name))
+		os.RemoveAll(partial)
+		return nil, err
+	}
+	snapshotlogger.Info().Msgf("Snapshot %s done: %d files, %d linked, %d copied", snapshot.Name, snapshot.Files, snapshot.Linked, snapshot.Copied)
+	return snapshot, nil
+}
+
+// linkUnchanged hard links the file from the previous snapshot when it has the
+// same size, modification time, mode and owner as the live one.
+func linkUnchanged(previousPath string, destPath string, info fs.FileInfo) bool {
+	previous, err := os.Lstat(previousPath)
+	if err != nil || !previous.Mode().IsRegular() {
+		return false
+	}
+	if previous.Size() != info.Size() || !previous.ModTime().Equal(info.ModTime()) || previous.Mode() != info.Mode() {
+		return false
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if previousStat, ok := previous.Sys().(*syscall.Stat_t); !ok || previousStat.Uid != stat.Uid || previousStat.Gid != stat.Gid {
+			return false
+		}
+	}
+	return os.Link(previousPath, destPath) == nil
+}
+
+// copyFile copies the content, mode, owner and modification time of the file.
+func copyFile(sourcePath string, destPath string, info fs.FileInfo) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	dest, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dest, source); err != nil {
+		dest.Close()
+		return err
+	}
+	if err := dest.Chmod(info.Mode().Perm()); err != nil {
+		dest.Close()
+		return err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := dest.Chown(int(stat.Uid), int(stat.Gid)); err != nil {
+			snapshotlogger.Warn().Err(err).Msgf("Failed to keep the ownership of %s", sourcePath)
+		}
+	}
+	if err := dest.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(destPath, info.ModTime(), info.ModTime())
+}
+
+// copyDirModes applies the modes of the source directories once their content
+// is in place, so read-only directories do not stop the copy.
+func copyDirModes(sourceRoot string, destRoot string) error {
+	dirs := make([]string, 0)
+	err := filepath.WalkDir(destRoot, func(destPath string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() || destPath == destRoot {
+			return err
+		}
+		dirs = append(dirs, destPath)
+		return nil
+	})
+	// the deepest directories first
+	for i := len(dirs) - 1; i >= 0; i-- {
+		relativePath, _ := filepath.Rel(destRoot, dirs[i])
+		if info, statErr := os.Stat(filepath.Join(sourceRoot, relativePath)); statErr == nil {
+			os.Chmod(dirs[i], info.Mode().Perm())
+		}
+	}
+	return err
+}
+
+// List returns the complete snapshots, oldest first.
+func (m *Manager) List() ([]Snapshot, error) {
+	entries, err := os.ReadDir(m.Root)
+	if os.IsNotExist(err) {
+		return []Snapshot{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]Snapshot, 0)
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		snapshot, err := m.Get(name)
+		if err != nil {
+			snapshotlogger.Warn().Err(err).Msgf("Skipping snapshot %s", name)
+			continue
+		}
+		snapshots = append(snapshots, *snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.Before(snapshots[j].CreatedAt)
+	})
+	return snapshots, nil
+}
+
+// Get returns a complete snapshot by name.
+func (m *Manager) Get(name string) (*Snapshot, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("invalid snapshot name %q", name)
+	}
+	content, err := os.ReadFile(m.metadataPath(name))
+	if err != nil {
+		return nil, err
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(content, &snapshot); err != nil {
+		return nil, err
+	}
+	snapshot.Path = filepath.Join(m.Root, name)
+	if stat, err := os.Stat(snapshot.Path); err != nil || !stat.IsDir() {
+		return nil, &fs.PathError{Op: "snapshot", Path: snapshot.Path, Err: fs.ErrNotExist}
+	}
+	return &snapshot, nil
+}
+
+// Delete removes a snapshot. The files it shares with other snapshots stay.
+func (m *Manager) Delete(name string) error {
+	snapshot, err := m.Get(name)
+	if err != nil {
+		return err
+	}
+	// read-only directories would stop the removal
+	filepath.WalkDir(snapshot.Path, func(dirPath string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.IsDir() {
+			os.Chmod(dirPath, 0750)
+		}
+		return nil
+	})
+	if err := os.Remove(m.metadataPath(name)); err != nil {
+		return err
+	}
+	snapshotlogger.Info().Msgf("Removing snapshot %s", name)
+	return os.RemoveAll(snapshot.Path)
+}
+
+// Prune removes the snapshots past the retention rules, oldest first. The
+// size limit is not applied, as snapshots share most of their files.
+func (m *Manager) Prune() ([]string, error) {
+	snapshots, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+	removed := make([]string, 0)
+	cutoff := m.now().Add(-m.Retention.MaxAge)
+	for i, snapshot := range snapshots {
+		keep := len(snapshots) - i
+		expired := m.Retention.MaxAge > 0 && snapshot.CreatedAt.Before(cutoff)
+		if !expired && (m.Retention.KeepVersions == 0 || keep <= m.Retention.KeepVersions) {
+			continue
+		}
+		// the newest snapshot is kept whatever its age
+		if keep == 1 {
+			break
+		}
+		if err := m.Delete(snapshot.Name); err != nil {
+			return removed, err
+		}
+		removed = append(removed, snapshot.Name)
+	}
+	return removed, nil
+}
+
+// Restore copies the files under the given paths of a snapshot, everything
+// when none are given, into target. The copies do not share their inodes with
+// the snapshot.
+func (m *Manager) Restore(name string, paths []string, target string) (int, error) {
+	snapshot, err := m.Get(name)
+	if err != nil {
+		return 0, err
+	}
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	restored := 0
+	for _, relativePath := range paths {
+		relativePath = filepath.Clean(relativePath)
+		if relativePath == ".." || strings.HasPrefix(relativePath, "../") || filepath.IsAbs(relativePath) {
+			return restored, fmt.Errorf("invalid path %q", relativePath)
+		}
+		sourceRoot := filepath.Join(snapshot.Path, relativePath)
+		err := filepath.WalkDir(sourceRoot, func(sourcePath string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			snapshotRelative, _ := filepath.Rel(snapshot.Path, sourcePath)
+			destPath := filepath.Join(target, snapshotRelative)
+			if entry.IsDir() {
+				return os.MkdirAll(destPath, 0750)
+			}
+			if !entry.Type().IsRegular() {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(destPath), 0750); err != nil {
+				return err
+			}
+			if err := copyFile(sourcePath, destPath, info); err != nil {
+				return err
+			}
+			restored++
+			return nil
+		})
+		if err != nil {
+			return restored, err
+		}
+	}
+	snapshotlogger.Info().Msgf("Restored %d files from snapshot %s into %s", restored, name, target)
+	return restored, nil
+}
+
+// Run takes a snapshot with take at the given interval and prunes the old
+// ones, until the context is cancelled.
+func (m *Manager) Run(ctx context.Context, interval time.Duration, take func(label string) (*Snapshot, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := take("scheduled"); err != nil {
+			snapshotlogger.Error().Err(err).Msg("Failed to take the scheduled snapshot")
+		}
+		if _, err := m.Prune(); err != nil {
+			snapshotlogger.Error().Err(err).Msg("Failed to prune the snapshots")
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package snapshot
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/archive"
+)
+
+func clock(start time.Time, step time.Duration) func() time.Time {
+	current := start
+	return func() time.Time {
+		now := current
+		current = current.Add(step)
+		return now
+	}
+}
+
+func inode(t *testing.T, filePath string) uint64 {
+	t.Helper()
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stat.Sys().(*syscall.Stat_t).Ino
+}
+
+func newManager(t *testing.T, retention archive.Retention) (*Manager, string) {
+	fileRoot := t.TempDir()
+	m := New(filepath.Join(fileRoot, ".snapshots"), fileRoot, retention)
+	m.Exclude = []string{filepath.Join(fileRoot, ".archive")}
+	m.now = clock(time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC), time.Hour)
+	return m, fileRoot
+}
+
+func TestTakeLinksUnchangedFiles(t *testing.T) {
+	m, fileRoot := newManager(t, archive.Retention{})
+	os.MkdirAll(filepath.Join(fileRoot, "dir"), 0750)
+	os.MkdirAll(filepath.Join(fileRoot, ".archive"), 0750)
+	os.WriteFile(filepath.Join(fileRoot, "dir/same.txt"), []byte("same"), 0640)
+	os.WriteFile(filepath.Join(fileRoot, "changed.txt"), []byte("v1"), 0600)
+	os.WriteFile(filepath.Join(fileRoot, ".archive/old.txt~x"), []byte("old"), 0600)
+
+	first, err := m.Take("first", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Files != 2 || first.Copied != 2 {
+		t.Errorf("Expected 2 files copied, got %+v", first)
+	}
+	if _, err := os.Stat(filepath.Join(first.Path, ".archive")); !os.IsNotExist(err) {
+		t.Errorf("Expected the archive to be left out, got %v", err)
+	}
+	if inode(t, filepath.Join(first.Path, "changed.txt")) == inode(t, filepath.Join(fileRoot, "changed.txt")) {
+		t.Errorf("Expected the live file to be copied, not linked")
+	}
+
+	os.WriteFile(filepath.Join(fileRoot, "changed.txt"), []byte("v2 longer"), 0600)
+	second, err := m.Take("second", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Linked != 1 || second.Copied != 1 {
+		t.Errorf("Expected 1 file linked and 1 copied, got %+v", second)
+	}
+	if inode(t, filepath.Join(first.Path, "dir/same.txt")) != inode(t, filepath.Join(second.Path, "dir/same.txt")) {
+		t.Errorf("Expected the unchanged file to be shared between the snapshots")
+	}
+	if content, _ := os.ReadFile(filepath.Join(first.Path, "changed.txt")); string(content) != "v1" {
+		t.Errorf("Expected the first snapshot to keep v1, got %q", content)
+	}
+
+	snapshots, err := m.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 || snapshots[0].Label != "first" || snapshots[1].Name != second.Name {
+		t.Errorf("Unexpected snapshots %+v", snapshots)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	m, fileRoot := newManager(t, archive.Retention{})
+	os.MkdirAll(filepath.Join(fileRoot, "dir"), 0750)
+	os.WriteFile(filepath.Join(fileRoot, "dir/a.txt"), []byte("a"), 0640)
+	os.WriteFile(filepath.Join(fileRoot, "b.txt"), []byte("b"), 0640)
+	taken, err := m.Take("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(filepath.Join(fileRoot, "dir/a.txt"), []byte("encrypted"), 0640)
+	os.Remove(filepath.Join(fileRoot, "b.txt"))
+
+	restored, err := m.Restore(taken.Name, []string{"dir"}, fileRoot)
+	if err != nil || restored != 1 {
+		t.Fatalf("Expected 1 file restored, got %d, %v", restored, err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(fileRoot, "dir/a.txt")); string(content) != "a" {
+		t.Errorf("Expected dir/a.txt restored, got %q", content)
+	}
+	if _, err := os.Stat(filepath.Join(fileRoot, "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected b.txt to stay deleted, got %v", err)
+	}
+	if inode(t, filepath.Join(fileRoot, "dir/a.txt")) == inode(t, filepath.Join(taken.Path, "dir/a.txt")) {
+		t.Errorf("Expected the restored file not to share the snapshot inode")
+	}
+
+	target := t.TempDir()
+	if restored, err := m.Restore(taken.Name, nil, target); err != nil || restored != 2 {
+		t.Errorf("Expected everything restored into the target, got %d, %v", restored, err)
+	}
+	if _, err := m.Restore(taken.Name, []string{"../etc"}, target); err == nil {
+		t.Errorf("Expected a path outside the snapshot to be refused")
+	}
+	if _, err := m.Restore("../x", nil, target); err == nil {
+		t.Errorf("Expected an invalid snapshot name to be refused")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	m, fileRoot := newManager(t, archive.Retention{KeepVersions: 2})
+	os.WriteFile(filepath.Join(fileRoot, "a.txt"), []byte("a"), 0640)
+	for i := 0; i < 3; i++ {
+		if _, err := m.Take("", true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := m.Prune()
+	if err != nil || len(removed) != 1 {
+		t.Fatalf("Expected 1 snapshot pruned, got %v, %v", removed, err)
+	}
+	snapshots, _ := m.List()
+	if len(snapshots) != 2 || snapshots[0].Name == removed[0] {
+		t.Errorf("Expected the oldest snapshot removed, got %+v", snapshots)
+	}
+
+	// the newest snapshot is kept, even when past its age
+	m.Retention = archive.Retention{MaxAge: time.Minute}
+	removed, err = m.Prune()
+	if err != nil || len(removed) != 1 {
+		t.Fatalf("Expected 1 snapshot pruned, got %v, %v", removed, err)
+	}
+	if snapshots, _ := m.List(); len(snapshots) != 1 {
+		t.Errorf("Expected the newest snapshot kept, got %+v", snapshots)
+	}
+}
@@ -0,0 +1,211 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/credentials"
+)
+
+var transportlogger = log.With().Str("component", "transport").Logger()
+
+// Config locates the certificates of the gRPC channel.
+type Config struct {
+	// CertFile and KeyFile are the certificate presented to the peer: the
+	// server certificate on the reciever, the client certificate on the
+	// sender.
+	CertFile string
+	KeyFile  string
+	// CAFile verifies the peer. On the reciever it makes a client certificate
+	// signed by it mandatory, on the sender it replaces the system roots.
+	CAFile string
+	// ServerName is checked against the reciever's certificate instead of the
+	// host of its address.
+	ServerName string
+}
+
+// ServerCredentials serves TLS with the certificate of the config, and
+// requires client certificates when it has a CA. The files are read again
+// whenever they change, so rotated certificates are picked up by the next
+// connection.
+func ServerCredentials(config Config) (credentials.TransportCredentials, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("the reciever needs a certificate and a key")
+	}
+	keyPair, err := newReloading(keyPairLoader(config.CertFile, config.KeyFile), config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	var clientCAs *reloading[*x509.CertPool]
+	if config.CAFile != "" {
+		if clientCAs, err = newReloading(poolLoader(config.CAFile), config.CAFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return &reloadingCredentials{build: func() *tls.Config {
+		tlsConfig := &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{*keyPair.get()},
+		}
+		if clientCAs != nil {
+			tlsConfig.ClientCAs = clientCAs.get()
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		return tlsConfig
+	}}, nil
+}
+
+// ClientCredentials connects with TLS, presenting the certificate of the
+// config when it has one. Like ServerCredentials, the files are read again
+// whenever they change.
+func ClientCredentials(config Config) (credentials.TransportCredentials, error) {
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, errors.New("a client certificate needs both the certificate and the key")
+	}
+	var keyPair *reloading[*tls.Certificate]
+	var rootCAs *reloading[*x509.CertPool]
+	var err error
+	if config.CertFile != "" {
+		if keyPair, err = newReloading(keyPairLoader(config.CertFile, config.KeyFile), config.CertFile, config.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+	if config.CAFile != "" {
+		if rootCAs, err = newReloading(poolLoader(config.CAFile), config.CAFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return &reloadingCredentials{serverName: config.ServerName, build: func() *tls.Config {
+		tlsConfig := &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ServerName: config.ServerName,
+		}
+		if keyPair != nil {
+			tlsConfig.Certificates = []tls.Certificate{*keyPair.get()}
+		}
+		if rootCAs != nil {
+			tlsConfig.RootCAs = rootCAs.get()
+		}
+		return tlsConfig
+	}}, nil
+}
+
+// reloadingCredentials hands every handshake to the TLS credentials of the
+// current certificates.
+type reloadingCredentials struct {
+	serverName string
+	build      func() *tls.Config
+}
+
+func (c *reloadingCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return credentials.NewTLS(c.build()).ClientHandshake(ctx, authority, conn)
+}
+
+func (c *reloadingCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return credentials.NewTLS(c.build()).ServerHandshake(conn)
+}
+
+func (c *reloadingCredentials) Info() credentials.ProtocolInfo {
+	return credentials.NewTLS(&tls.Config{ServerName: c.serverName}).Info()
+}
+
+func (c *reloadingCredentials) Clone() credentials.TransportCredentials {
+	return &reloadingCredentials{serverName: c.serverName, build: c.build}
+}
+
+func (c *reloadingCredentials) OverrideServerName(serverName string) error {
+	c.serverName = serverName
+	return nil
+}
+
+func keyPairLoader(certFile string, keyFile string) func() (*tls.Certificate, error) {
+	return func() (*tls.Certificate, error) {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &certificate, nil
+	}
+}
+
+func poolLoader(caFile string) func() (*x509.CertPool, error) {
+	return func() (*x509.CertPool, error) {
+		content, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+		return pool, nil
+	}
+}
+
+// reloading holds what was loaded from files, and loads it again when any of
+// them changed. While a rotation is half written the previous value is kept.
+type reloading[T any] struct {
+	files    []string
+	load     func() (T, error)
+	mu       sync.Mutex
+	value    T
+	modTimes []time.Time
+}
+
+func newReloading[T any](load func() (T, error), files ...string) (*reloading[T], error) {
+	r := &reloading[T]{files: files, load: load}
+	modTimes, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	if r.value, err = load(); err != nil {
+		return nil, err
+	}
+	r.modTimes = modTimes
+	return r, nil
+}
+
+func (r *reloading[T]) stat() ([]time.Time, error) {
+	modTimes := make([]time.Time, 0, len(r.files))
+	for _, file := range r.files {
+		stat, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, stat.ModTime())
+	}
+	return modTimes, nil
+}
+
+func (r *reloading[T]) get() T {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTimes, err := r.stat()
+	if err != nil {
+		transportlogger.Warn().Err(err).Msgf("Failed to check %v for changes, keeping the loaded one", r.files)
+		return r.value
+	}
+	if slices.EqualFunc(modTimes, r.modTimes, time.Time.Equal) {
+		return r.value
+	}
+	if value, err := r.load(); err != nil {
+		transportlogger.Warn().Err(err).Msgf("Failed to reload %v, keeping the loaded one", r.files)
+	} else {
+		transportlogger.Info().Msgf("Reloaded %v", r.files)
+		r.value = value
+		r.modTimes = modTimes
+	}
+	return r.value
+}
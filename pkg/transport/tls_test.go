@@ -0,0 +1,167 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kosalaat/file-replicator/pkg/client"
+	"github.com/kosalaat/file-replicator/pkg/server"
+	"github.com/kosalaat/file-replicator/replicator"
+	"github.com/phayes/freeport"
+)
+
+type testCA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	file        string
+}
+
+func newTestCA(t *testing.T, dir string, name string) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	ca := &testCA{certificate: certificate, key: key, file: filepath.Join(dir, name+".pem")}
+	writePEM(t, ca.file, "CERTIFICATE", der)
+	return ca
+}
+
+// issue writes a certificate for 127.0.0.1 signed by the CA.
+func (ca *testCA) issue(t *testing.T, certFile string, keyFile string) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "replicator"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+	writePEM(t, certFile, "CERTIFICATE", der)
+}
+
+func writePEM(t *testing.T, file string, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func startServer(t *testing.T, config Config) string {
+	t.Helper()
+	credentials, err := ServerCredentials(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	replicationServer := server.NewReplicationServer()
+	replicationServer.Credentials = credentials
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	go func() {
+		replicationServer.StartListening(address, t.TempDir())
+	}()
+	t.Cleanup(replicationServer.StopListening)
+	time.Sleep(100 * time.Millisecond)
+	return address
+}
+
+func ping(t *testing.T, address string, config Config) bool {
+	t.Helper()
+	credentials, err := ClientCredentials(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replicationClient, err := client.NewReplicatorClient(address, "", 1, client.WithTransportCredentials(credentials))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+	return replicationClient.Ping(ctx, &replicator.PingPong{}) != nil
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	other := newTestCA(t, dir, "other")
+	ca.issue(t, filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"))
+	ca.issue(t, filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key"))
+	other.issue(t, filepath.Join(dir, "stranger.pem"), filepath.Join(dir, "stranger.key"))
+
+	address := startServer(t, Config{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server.key"),
+		CAFile:   ca.file,
+	})
+
+	if !ping(t, address, Config{CertFile: filepath.Join(dir, "client.pem"), KeyFile: filepath.Join(dir, "client.key"), CAFile: ca.file}) {
+		t.Errorf("Expected a client certificate of the CA to be accepted")
+	}
+	if ping(t, address, Config{CAFile: ca.file}) {
+		t.Errorf("Expected a client without a certificate to be refused")
+	}
+	if ping(t, address, Config{CertFile: filepath.Join(dir, "stranger.pem"), KeyFile: filepath.Join(dir, "stranger.key"), CAFile: ca.file}) {
+		t.Errorf("Expected a client certificate of another CA to be refused")
+	}
+	if ping(t, address, Config{CertFile: filepath.Join(dir, "client.pem"), KeyFile: filepath.Join(dir, "client.key"), CAFile: other.file}) {
+		t.Errorf("Expected a reciever certificate of an untrusted CA to be refused")
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	rotated := newTestCA(t, dir, "rotated")
+	serverCert, serverKey := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	ca.issue(t, serverCert, serverKey)
+
+	address := startServer(t, Config{CertFile: serverCert, KeyFile: serverKey})
+	if !ping(t, address, Config{CAFile: ca.file}) {
+		t.Fatalf("Expected the reciever certificate to be accepted")
+	}
+
+	// the modification times have to differ from the loaded ones
+	time.Sleep(10 * time.Millisecond)
+	rotated.issue(t, serverCert, serverKey)
+	if !ping(t, address, Config{CAFile: rotated.file}) {
+		t.Errorf("Expected the rotated reciever certificate to be served without a restart")
+	}
+	if ping(t, address, Config{CAFile: ca.file}) {
+		t.Errorf("Expected the previous reciever certificate to be replaced")
+	}
+}
@@ -0,0 +1,164 @@
+package versions
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Policy int
+
+const (
+	// NewestWins keeps the version with the latest modification time.
+	NewestWins Policy = iota
+	// KeepBoth keeps the newest version under the original name and the
+	// other one next to it with a .conflict suffix.
+	KeepBoth
+	// PreferSite keeps the version last written by the preferred site.
+	PreferSite
+)
+
+func (p Policy) String() string {
+	switch p {
+	case NewestWins:
+		return "newest"
+	case KeepBoth:
+		return "keep-both"
+	case PreferSite:
+		return "prefer-site"
+	}
+	return fmt.Sprintf("policy(%d)", int(p))
+}
+
+func ParsePolicy(policy string) (Policy, error) {
+	switch strings.ToLower(policy) {
+	case "newest", "newest-wins":
+		return NewestWins, nil
+	case "keep-both":
+		return KeepBoth, nil
+	case "prefer-site":
+		return PreferSite, nil
+	}
+	return 0, fmt.Errorf("unknown conflict policy %q", policy)
+}
+
+type Resolution int
+
+const (
+	KeepLocal Resolution = iota
+	AcceptRemote
+)
+
+func (r Resolution) String() string {
+	if r == AcceptRemote {
+		return "accept-remote"
+	}
+	return "keep-local"
+}
+
+// ConflictRecord is a line of the conflict report.
+type ConflictRecord struct {
+	Time         time.Time     `json:"time"`
+	Path         string        `json:"path"`
+	Policy       string        `json:"policy"`
+	Resolution   string        `json:"resolution"`
+	LocalSite    string        `json:"local_site"`
+	LocalVector  VersionVector `json:"local_vector"`
+	RemoteSite   string        `json:"remote_site"`
+	RemoteVector VersionVector `json:"remote_vector"`
+	ConflictCopy string        `json:"conflict_copy,omitempty"`
+}
+
+// Resolver picks the surviving version of concurrently edited files. Both
+// sites have to pick the same winner, so the decision only depends on the two
+// versions and never on which side evaluates it.
+type Resolver struct {
+	Policy        Policy
+	PreferredSite string
+	ReportPath    string
+
+	mu sync.Mutex
+}
+
+func (r *Resolver) winner(local FileVersion, remote FileVersion) Resolution {
+	if r.Policy == PreferSite {
+		if local.Site == r.PreferredSite && remote.Site != r.PreferredSite {
+			return KeepLocal
+		}
+		if remote.Site == r.PreferredSite && local.Site != r.PreferredSite {
+			return AcceptRemote
+		}
+	}
+	if remote.ModTime != local.ModTime {
+		if remote.ModTime > local.ModTime {
+			return AcceptRemote
+		}
+		return KeepLocal
+	}
+	if remote.Site > local.Site {
+		return AcceptRemote
+	}
+	return KeepLocal
+}
+
+// Resolve decides the conflict and records it in the report. With KeepBoth
+// the returned path is where the losing local copy has to be kept.
+func (r *Resolver) Resolve(relativePath string, local FileVersion, remote FileVersion) (Resolution, string) {
+	resolution := r.winner(local, remote)
+
+	conflictCopy := ""
+	if r.Policy == KeepBoth && resolution == AcceptRemote && !local.Deleted {
+		conflictCopy = ConflictPath(relativePath, local.Site)
+	}
+
+	r.record(ConflictRecord{
+		Time:         time.Now(),
+		Path:         relativePath,
+		Policy:       r.Policy.String(),
+		Resolution:   resolution.String(),
+		LocalSite:    local.Site,
+		LocalVector:  local.Vector,
+		RemoteSite:   remote.Site,
+		RemoteVector: remote.Vector,
+		ConflictCopy: conflictCopy,
+	})
+	return resolution, conflictCopy
+}
+
+// ConflictPath is the name the losing copy of a file is kept under.
+func ConflictPath(relativePath string, site string) string {
+	return fmt.Sprintf("%s.%s.conflict", relativePath, site)
+}
+
+func (r *Resolver) record(record ConflictRecord) {
+	versionslogger.Warn().Msgf("Conflicting edits of %s between %s and %s, resolved as %s", record.Path, record.LocalSite, record.RemoteSite, record.Resolution)
+	if r.ReportPath == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		versionslogger.Error().Err(err).Msg("Failed to encode conflict record")
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(r.ReportPath), 0750); err != nil {
+		versionslogger.Error().Err(err).Msgf("Failed to create conflict report directory")
+		return
+	}
+	report, err := os.OpenFile(r.ReportPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		versionslogger.Error().Err(err).Msgf("Failed to open conflict report %s", r.ReportPath)
+		return
+	}
+	defer report.Close()
+	if _, err := report.Write(append(line, '\n')); err != nil {
+		versionslogger.Error().Err(err).Msgf("Failed to write conflict report %s", r.ReportPath)
+	}
+}
@@ -0,0 +1,72 @@
+package versions
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolver_Resolve(t *testing.T) {
+	older := FileVersion{Vector: VersionVector{"a": 1}, ModTime: 100, Site: "a"}
+	newer := FileVersion{Vector: VersionVector{"b": 1}, ModTime: 200, Site: "b"}
+
+	tests := []struct {
+		name         string
+		resolver     *Resolver
+		local        FileVersion
+		remote       FileVersion
+		expected     Resolution
+		conflictCopy string
+	}{
+		{"newest remote", &Resolver{Policy: NewestWins}, older, newer, AcceptRemote, ""},
+		{"newest local", &Resolver{Policy: NewestWins}, newer, older, KeepLocal, ""},
+		{"keep both", &Resolver{Policy: KeepBoth}, older, newer, AcceptRemote, "file.txt.a.conflict"},
+		{"keep both local wins", &Resolver{Policy: KeepBoth}, newer, older, KeepLocal, ""},
+		{"prefer site", &Resolver{Policy: PreferSite, PreferredSite: "a"}, older, newer, KeepLocal, ""},
+		{"prefer remote site", &Resolver{Policy: PreferSite, PreferredSite: "a"}, FileVersion{Site: "b", ModTime: 300}, older, AcceptRemote, ""},
+		{"same time", &Resolver{}, FileVersion{Site: "a"}, FileVersion{Site: "b"}, AcceptRemote, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolution, conflictCopy := tt.resolver.Resolve("file.txt", tt.local, tt.remote)
+			if resolution != tt.expected || conflictCopy != tt.conflictCopy {
+				t.Errorf("Resolve() = %s, %q, expected %s, %q", resolution, conflictCopy, tt.expected, tt.conflictCopy)
+			}
+			// the other site has to come to the same conclusion
+			if reverse, _ := tt.resolver.Resolve("file.txt", tt.remote, tt.local); reverse == resolution {
+				t.Errorf("Sites disagree on the winner: both resolved as %s", resolution)
+			}
+		})
+	}
+}
+
+func TestResolver_Report(t *testing.T) {
+	reportPath := filepath.Join(t.TempDir(), "conflicts.jsonl")
+	resolver := &Resolver{Policy: KeepBoth, ReportPath: reportPath}
+
+	resolver.Resolve("file.txt",
+		FileVersion{Vector: VersionVector{"a": 1}, ModTime: 100, Site: "a"},
+		FileVersion{Vector: VersionVector{"b": 1}, ModTime: 200, Site: "b"},
+	)
+
+	report, err := os.Open(reportPath)
+	if err != nil {
+		t.Fatalf("Failed to open report: %v", err)
+	}
+	defer report.Close()
+
+	scanner := bufio.NewScanner(report)
+	if !scanner.Scan() {
+		t.Fatalf("Report is empty")
+	}
+	var record ConflictRecord
+	if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+		t.Fatalf("Failed to parse report line: %v", err)
+	}
+	if record.Path != "file.txt" || record.Resolution != "accept-remote" || record.ConflictCopy != "file.txt.a.conflict" || record.Policy != "keep-both" {
+		t.Fatalf("Unexpected conflict record: %+v", record)
+	}
+}
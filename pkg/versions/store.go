@@ -0,0 +1,257 @@
+package versions
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var versionslogger = log.With().Str("component", "versions").Logger()
+
+// inboundTimeout is how long local events for a file are treated as echoes of
+// a change received from the peer after its last chunk arrived.
+const inboundTimeout = 30 * time.Second
+
+// FileVersion is the last known version of a file at this site.
+type FileVersion struct {
+	Vector  VersionVector `json:"vector"`
+	Hash    uint64        `json:"hash"`
+	ModTime int64         `json:"mod_time"`
+	Site    string        `json:"site"`
+	Deleted bool          `json:"deleted,omitempty"`
+}
+
+type inbound struct {
+	hash    uint64
+	expires time.Time
+}
+
+// Store keeps the version vector of every file at this site. The sender asks
+// it whether a local event is a new edit or an echo of a change the receiver
+// just applied, and the receiver uses it to detect concurrent edits.
+type Store struct {
+	SiteID string
+
+	mu      sync.Mutex
+	path    string
+	files   map[string]*FileVersion
+	inbound map[string]inbound
+	dirty   bool
+	now     func() time.Time
+}
+
+// NewStore loads the state from statePath. With an empty statePath the
+// versions are only kept in memory.
+func NewStore(siteID string, statePath string) (*Store, error) {
+	s := &Store{
+		SiteID:  siteID,
+		path:    statePath,
+		files:   make(map[string]*FileVersion),
+		inbound: make(map[string]inbound),
+		now:     time.Now,
+	}
+	if statePath == "" {
+		return s, nil
+	}
+
+	content, err := os.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		versionslogger.Info().Msgf("No version state at %s, starting empty", statePath)
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &s.files); err != nil {
+		versionslogger.Error().Err(err).Msgf("Failed to parse version state %s", statePath)
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) Get(relativePath string) (FileVersion, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	version, ok := s.files[relativePath]
+	if !ok {
+		return FileVersion{}, false
+	}
+	result := *version
+	result.Vector = version.Vector.Copy()
+	return result, true
+}
+
+// expectingInbound reports whether the file is being written by the receiver.
+// It has to be called with the lock held.
+func (s *Store) expectingInbound(relativePath string, hash uint64) bool {
+	pending, ok := s.inbound[relativePath]
+	if !ok {
+		return false
+	}
+	if pending.hash == hash || s.now().After(pending.expires) {
+		delete(s.inbound, relativePath)
+		return pending.hash == hash
+	}
+	return true
+}
+
+// LocalChange records an edit seen by the sender and returns the new vector.
+// It returns false when the content is what the store already knows about,
+// i.e. the event is an echo of a change received from the peer.
+func (s *Store) LocalChange(relativePath string, hash uint64, modTime int64) (VersionVector, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expectingInbound(relativePath, hash) {
+		versionslogger.Info().Msgf("Suppressing echo of received change to %s", relativePath)
+		return nil, false
+	}
+
+	version, ok := s.files[relativePath]
+	if ok && !version.Deleted && version.Hash == hash {
+		return version.Vector.Copy(), false
+	}
+	if !ok {
+		version = &FileVersion{Vector: VersionVector{}}
+		s.files[relativePath] = version
+	}
+	version.Vector = version.Vector.Increment(s.SiteID)
+	version.Hash = hash
+	version.ModTime = modTime
+	version.Site = s.SiteID
+	version.Deleted = false
+	s.dirty = true
+	return version.Vector.Copy(), true
+}
+
+// LocalDelete records a delete seen by the sender. It returns false when the
+// file was already deleted, e.g. by the receiver.
+func (s *Store) LocalDelete(relativePath string) (VersionVector, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	version, ok := s.files[relativePath]
+	if ok && version.Deleted {
+		return version.Vector.Copy(), false
+	}
+	if !ok {
+		version = &FileVersion{Vector: VersionVector{}}
+		s.files[relativePath] = version
+	}
+	version.Vector = version.Vector.Increment(s.SiteID)
+	version.Site = s.SiteID
+	version.Deleted = true
+	s.dirty = true
+	return version.Vector.Copy(), true
+}
+
+// Accept records a version received from the peer. Writes to the file are
+// treated as echoes until its content hashes to the accepted version.
+func (s *Store) Accept(relativePath string, version FileVersion) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := version
+	stored.Vector = version.Vector.Copy()
+	s.files[relativePath] = &stored
+	if !version.Deleted {
+		s.inbound[relativePath] = inbound{hash: version.Hash, expires: s.now().Add(inboundTimeout)}
+	}
+	s.dirty = true
+}
+
+// Expect treats writes to the file as echoes until its content hashes to the
+// version on the way, which is accepted once it arrived.
+func (s *Store) Expect(relativePath string, hash uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inbound[relativePath] = inbound{hash: hash, expires: s.now().Add(inboundTimeout)}
+}
+
+// Touch extends the echo suppression of a file while its chunks arrive.
+func (s *Store) Touch(relativePath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pending, ok := s.inbound[relativePath]; ok {
+		pending.expires = s.now().Add(inboundTimeout)
+		s.inbound[relativePath] = pending
+	}
+}
+
+// Merge folds the vector the peer replied with into the local one, so the
+// next local edit is not mistaken for a concurrent one.
+func (s *Store) Merge(relativePath string, vector VersionVector) {
+	if len(vector) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if version, ok := s.files[relativePath]; ok {
+		version.Vector = version.Vector.Merge(vector)
+		s.dirty = true
+	}
+}
+
+func (s *Store) Rename(relativePath string, newRelativePath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if version, ok := s.files[relativePath]; ok {
+		delete(s.files, relativePath)
+		s.files[newRelativePath] = version
+		s.inbound[newRelativePath] = inbound{hash: version.Hash, expires: s.now().Add(inboundTimeout)}
+		s.dirty = true
+	}
+}
+
+func (s *Store) Forget(relativePath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, relativePath)
+	delete(s.inbound, relativePath)
+	s.dirty = true
+}
+
+func (s *Store) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" || !s.dirty {
+		return nil
+	}
+
+	content, err := json.Marshal(s.files)
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp")
+	if err := os.WriteFile(tmpPath, content, 0600); err != nil {
+		versionslogger.Error().Err(err).Msgf("Failed to write version state %s", tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		versionslogger.Error().Err(err).Msgf("Failed to replace version state %s", s.path)
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Run saves the state at the given interval until the context is cancelled.
+func (s *Store) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.Save()
+			return
+		case <-ticker.C:
+			if err := s.Save(); err != nil {
+				versionslogger.Error().Err(err).Msg("Failed to save version state")
+			}
+		}
+	}
+}
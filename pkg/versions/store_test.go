@@ -0,0 +1,92 @@
+package versions
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore_LocalChange(t *testing.T) {
+	store, _ := NewStore("a", "")
+
+	vector, changed := store.LocalChange("file.txt", 1, 100)
+	if !changed || vector["a"] != 1 {
+		t.Fatalf("Expected a new version, got %v changed=%v", vector, changed)
+	}
+
+	vector, changed = store.LocalChange("file.txt", 1, 101)
+	if changed || vector["a"] != 1 {
+		t.Fatalf("Same content should not be a change, got %v changed=%v", vector, changed)
+	}
+
+	vector, changed = store.LocalChange("file.txt", 2, 102)
+	if !changed || vector["a"] != 2 {
+		t.Fatalf("Expected the counter to move on, got %v changed=%v", vector, changed)
+	}
+}
+
+func TestStore_EchoSuppression(t *testing.T) {
+	store, _ := NewStore("a", "")
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	store.Accept("file.txt", FileVersion{Vector: VersionVector{"b": 1}, Hash: 42, Site: "b"})
+
+	// partially written file
+	if vector, changed := store.LocalChange("file.txt", 7, 100); vector != nil || changed {
+		t.Fatalf("Write in progress should be suppressed, got %v changed=%v", vector, changed)
+	}
+	// fully written file
+	if vector, changed := store.LocalChange("file.txt", 42, 100); vector != nil || changed {
+		t.Fatalf("Echo should be suppressed, got %v changed=%v", vector, changed)
+	}
+	// later local edit
+	vector, changed := store.LocalChange("file.txt", 43, 100)
+	if !changed || vector["a"] != 1 || vector["b"] != 1 {
+		t.Fatalf("Expected a local edit on top of the received version, got %v changed=%v", vector, changed)
+	}
+
+	store.Accept("other.txt", FileVersion{Vector: VersionVector{"b": 1}, Hash: 42, Site: "b"})
+	now = now.Add(inboundTimeout + time.Second)
+	if _, changed := store.LocalChange("other.txt", 7, 100); !changed {
+		t.Fatalf("Expected the echo suppression to expire")
+	}
+}
+
+func TestStore_LocalDelete(t *testing.T) {
+	store, _ := NewStore("a", "")
+	store.LocalChange("file.txt", 1, 100)
+
+	vector, changed := store.LocalDelete("file.txt")
+	if !changed || vector["a"] != 2 {
+		t.Fatalf("Expected the delete to be a new version, got %v changed=%v", vector, changed)
+	}
+	if _, changed := store.LocalDelete("file.txt"); changed {
+		t.Fatalf("Deleting twice should not be a change")
+	}
+}
+
+func TestStore_SaveLoad(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	store, err := NewStore("a", statePath)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	store.LocalChange("file.txt", 1, 100)
+	store.Rename("file.txt", "renamed.txt")
+	if err := store.Save(); err != nil {
+		t.Fatalf("Failed to save store: %v", err)
+	}
+
+	loaded, err := NewStore("a", statePath)
+	if err != nil {
+		t.Fatalf("Failed to load store: %v", err)
+	}
+	if _, ok := loaded.Get("file.txt"); ok {
+		t.Fatalf("Renamed file should be gone")
+	}
+	version, ok := loaded.Get("renamed.txt")
+	if !ok || version.Hash != 1 || version.Vector["a"] != 1 {
+		t.Fatalf("Unexpected loaded version: %+v", version)
+	}
+}
@@ -0,0 +1,80 @@
+package versions
+
+// VersionVector counts the changes each site made to a file. Comparing the
+// vectors of two copies tells whether one has seen every change of the other
+// or whether they were edited concurrently.
+type VersionVector map[string]uint64
+
+type Ordering int
+
+const (
+	Equal Ordering = iota
+	// Before means the vector is dominated by the other one.
+	Before
+	// After means the vector dominates the other one.
+	After
+	Concurrent
+)
+
+func (o Ordering) String() string {
+	switch o {
+	case Equal:
+		return "equal"
+	case Before:
+		return "before"
+	case After:
+		return "after"
+	}
+	return "concurrent"
+}
+
+func (v VersionVector) Compare(other VersionVector) Ordering {
+	less, greater := false, false
+	for site, counter := range v {
+		if counter > other[site] {
+			greater = true
+		} else if counter < other[site] {
+			less = true
+		}
+	}
+	for site, counter := range other {
+		if _, ok := v[site]; !ok && counter > 0 {
+			less = true
+		}
+	}
+
+	switch {
+	case less && greater:
+		return Concurrent
+	case less:
+		return Before
+	case greater:
+		return After
+	}
+	return Equal
+}
+
+func (v VersionVector) Copy() VersionVector {
+	result := make(VersionVector, len(v))
+	for site, counter := range v {
+		result[site] = counter
+	}
+	return result
+}
+
+// Merge returns the element-wise maximum of both vectors.
+func (v VersionVector) Merge(other VersionVector) VersionVector {
+	result := v.Copy()
+	for site, counter := range other {
+		if counter > result[site] {
+			result[site] = counter
+		}
+	}
+	return result
+}
+
+func (v VersionVector) Increment(site string) VersionVector {
+	result := v.Copy()
+	result[site]++
+	return result
+}
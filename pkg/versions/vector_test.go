@@ -0,0 +1,48 @@
+package versions
+
+import "testing"
+
+func TestVersionVector_Compare(t *testing.T) {
+	tests := []struct {
+		name     string
+		v        VersionVector
+		other    VersionVector
+		expected Ordering
+	}{
+		{"both empty", VersionVector{}, VersionVector{}, Equal},
+		{"equal", VersionVector{"a": 1, "b": 2}, VersionVector{"a": 1, "b": 2}, Equal},
+		{"missing site counts as zero", VersionVector{"a": 1, "b": 0}, VersionVector{"a": 1}, Equal},
+		{"before", VersionVector{"a": 1}, VersionVector{"a": 2}, Before},
+		{"before with new site", VersionVector{"a": 1}, VersionVector{"a": 1, "b": 1}, Before},
+		{"after", VersionVector{"a": 2, "b": 1}, VersionVector{"a": 1}, After},
+		{"concurrent", VersionVector{"a": 2, "b": 1}, VersionVector{"a": 1, "b": 2}, Concurrent},
+		{"concurrent disjoint", VersionVector{"a": 1}, VersionVector{"b": 1}, Concurrent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.v.Compare(tt.other); got != tt.expected {
+				t.Errorf("Compare() = %s, expected %s", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestVersionVector_MergeIncrement(t *testing.T) {
+	v := VersionVector{"a": 2, "b": 1}
+	merged := v.Merge(VersionVector{"b": 3, "c": 1})
+	if merged["a"] != 2 || merged["b"] != 3 || merged["c"] != 1 {
+		t.Fatalf("Unexpected merge result: %v", merged)
+	}
+	if v["b"] != 1 {
+		t.Fatalf("Merge modified the receiver: %v", v)
+	}
+
+	incremented := merged.Increment("a")
+	if incremented["a"] != 3 || merged["a"] != 2 {
+		t.Fatalf("Unexpected increment result: %v from %v", incremented, merged)
+	}
+	if incremented.Compare(merged) != After {
+		t.Fatalf("Incremented vector should dominate the original")
+	}
+}
@@ -24,17 +24,28 @@ const (
 type ConfirmationCode int32
 
 const (
-	ConfirmationCode_OK                ConfirmationCode = 0
-	ConfirmationCode_UPDATE_ERROR      ConfirmationCode = 1
-	ConfirmationCode_FILE_NOT_FOUND    ConfirmationCode = 2
-	ConfirmationCode_FILE_NOT_READABLE ConfirmationCode = 3
-	ConfirmationCode_FILE_NOT_WRITABLE ConfirmationCode = 4
-	ConfirmationCode_OFFSET_ERROR      ConfirmationCode = 5
-	ConfirmationCode_BLOCK_SIZE_ERROR  ConfirmationCode = 6
-	ConfirmationCode_CHANGES_NOT_FOUND ConfirmationCode = 7
-	ConfirmationCode_CHANGES_REPORTED  ConfirmationCode = 8
-	ConfirmationCode_UNHANDLED_ERROR   ConfirmationCode = 254
-	ConfirmationCode_DUPLICATE         ConfirmationCode = 255
+	ConfirmationCode_OK                      ConfirmationCode = 0
+	ConfirmationCode_UPDATE_ERROR            ConfirmationCode = 1
+	ConfirmationCode_FILE_NOT_FOUND          ConfirmationCode = 2
+	ConfirmationCode_FILE_NOT_READABLE       ConfirmationCode = 3
+	ConfirmationCode_FILE_NOT_WRITABLE       ConfirmationCode = 4
+	ConfirmationCode_OFFSET_ERROR            ConfirmationCode = 5
+	ConfirmationCode_BLOCK_SIZE_ERROR        ConfirmationCode = 6
+	ConfirmationCode_CHANGES_NOT_FOUND       ConfirmationCode = 7
+	ConfirmationCode_CHANGES_REPORTED        ConfirmationCode = 8
+	ConfirmationCode_CONFLICT                ConfirmationCode = 9
+	ConfirmationCode_VERSION_OUTDATED        ConfirmationCode = 10
+	ConfirmationCode_VERSION_INCOMPLETE      ConfirmationCode = 11
+	ConfirmationCode_CHECKSUM_MISMATCH       ConfirmationCode = 12
+	ConfirmationCode_HASH_UNSUPPORTED        ConfirmationCode = 13
+	ConfirmationCode_CHUNK_CORRUPTED         ConfirmationCode = 14
+	ConfirmationCode_COMPRESSION_UNSUPPORTED ConfirmationCode = 15
+	ConfirmationCode_PERMISSION_DENIED       ConfirmationCode = 16
+	ConfirmationCode_UNKNOWN_NAMESPACE       ConfirmationCode = 17
+	ConfirmationCode_QUOTA_EXCEEDED          ConfirmationCode = 18
+	ConfirmationCode_NO_SPACE                ConfirmationCode = 19
+	ConfirmationCode_UNHANDLED_ERROR         ConfirmationCode = 254
+	ConfirmationCode_DUPLICATE               ConfirmationCode = 255
 )
 
 // Enum value maps for ConfirmationCode.
@@ -49,21 +60,43 @@ var (
 		6:   "BLOCK_SIZE_ERROR",
 		7:   "CHANGES_NOT_FOUND",
 		8:   "CHANGES_REPORTED",
+		9:   "CONFLICT",
+		10:  "VERSION_OUTDATED",
+		11:  "VERSION_INCOMPLETE",
+		12:  "CHECKSUM_MISMATCH",
+		13:  "HASH_UNSUPPORTED",
+		14:  "CHUNK_CORRUPTED",
+		15:  "COMPRESSION_UNSUPPORTED",
+		16:  "PERMISSION_DENIED",
+		17:  "UNKNOWN_NAMESPACE",
+		18:  "QUOTA_EXCEEDED",
+		19:  "NO_SPACE",
 		254: "UNHANDLED_ERROR",
 		255: "DUPLICATE",
 	}
 	ConfirmationCode_value = map[string]int32{
-		"OK":                0,
-		"UPDATE_ERROR":      1,
-		"FILE_NOT_FOUND":    2,
-		"FILE_NOT_READABLE": 3,
-		"FILE_NOT_WRITABLE": 4,
-		"OFFSET_ERROR":      5,
-		"BLOCK_SIZE_ERROR":  6,
-		"CHANGES_NOT_FOUND": 7,
-		"CHANGES_REPORTED":  8,
-		"UNHANDLED_ERROR":   254,
-		"DUPLICATE":         255,
+		"OK":                      0,
+		"UPDATE_ERROR":            1,
+		"FILE_NOT_FOUND":          2,
+		"FILE_NOT_READABLE":       3,
+		"FILE_NOT_WRITABLE":       4,
+		"OFFSET_ERROR":            5,
+		"BLOCK_SIZE_ERROR":        6,
+		"CHANGES_NOT_FOUND":       7,
+		"CHANGES_REPORTED":        8,
+		"CONFLICT":                9,
+		"VERSION_OUTDATED":        10,
+		"VERSION_INCOMPLETE":      11,
+		"CHECKSUM_MISMATCH":       12,
+		"HASH_UNSUPPORTED":        13,
+		"CHUNK_CORRUPTED":         14,
+		"COMPRESSION_UNSUPPORTED": 15,
+		"PERMISSION_DENIED":       16,
+		"UNKNOWN_NAMESPACE":       17,
+		"QUOTA_EXCEEDED":          18,
+		"NO_SPACE":                19,
+		"UNHANDLED_ERROR":         254,
+		"DUPLICATE":               255,
 	}
 )
 
@@ -107,8 +140,17 @@ type DataPayload struct {
 	FileSize         uint64                 `protobuf:"varint,9,opt,name=FileSize,proto3" json:"FileSize,omitempty"`
 	UID              uint32                 `protobuf:"varint,10,opt,name=UID,proto3" json:"UID,omitempty"`
 	GID              uint32                 `protobuf:"varint,11,opt,name=GID,proto3" json:"GID,omitempty"`
-	unknownFields    protoimpl.UnknownFields
-	sizeCache        protoimpl.SizeCache
+	// when set, the chunk belongs to this version of the file, opened by
+	// Begin and assembled in a staging file until Commit.
+	StagingVersion uint64 `protobuf:"varint,12,opt,name=StagingVersion,proto3" json:"StagingVersion,omitempty"`
+	// Hash is the hash of DataChunk in this algorithm, xxhash64 when empty.
+	// The reciever refuses the chunk when it does not match.
+	HashAlgorithm string `protobuf:"bytes,13,opt,name=HashAlgorithm,proto3" json:"HashAlgorithm,omitempty"`
+	// DataChunk is compressed with this compression, sent raw when empty.
+	// Hash is the hash of the raw data.
+	Compression   string `protobuf:"bytes,14,opt,name=Compression,proto3" json:"Compression,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
 }
 
 func (x *DataPayload) Reset() {
@@ -218,17 +260,168 @@ func (x *DataPayload) GetGID() uint32 {
 	return 0
 }
 
+func (x *DataPayload) GetStagingVersion() uint64 {
+	if x != nil {
+		return x.StagingVersion
+	}
+	return 0
+}
+
+func (x *DataPayload) GetHashAlgorithm() string {
+	if x != nil {
+		return x.HashAlgorithm
+	}
+	return ""
+}
+
+func (x *DataPayload) GetCompression() string {
+	if x != nil {
+		return x.Compression
+	}
+	return ""
+}
+
+// FileVersion is a transaction replacing the content of a file. Begin announces
+// the chunks that will be sent and the size, metadata, xxhash64 and strong
+// digest of the whole new content, which Commit checks before the version goes
+// live.
+type FileVersion struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	RelativeFilePath string                 `protobuf:"bytes,1,opt,name=RelativeFilePath,proto3" json:"RelativeFilePath,omitempty"`
+	Version          uint64                 `protobuf:"varint,2,opt,name=Version,proto3" json:"Version,omitempty"`
+	FileSize         uint64                 `protobuf:"varint,3,opt,name=FileSize,proto3" json:"FileSize,omitempty"`
+	FileMode         uint32                 `protobuf:"varint,4,opt,name=FileMode,proto3" json:"FileMode,omitempty"`
+	UID              uint32                 `protobuf:"varint,5,opt,name=UID,proto3" json:"UID,omitempty"`
+	GID              uint32                 `protobuf:"varint,6,opt,name=GID,proto3" json:"GID,omitempty"`
+	FileHash         uint64                 `protobuf:"varint,7,opt,name=FileHash,proto3" json:"FileHash,omitempty"`
+	BlockSize        uint64                 `protobuf:"varint,8,opt,name=BlockSize,proto3" json:"BlockSize,omitempty"`
+	Chunks           []uint64               `protobuf:"varint,9,rep,packed,name=Chunks,proto3" json:"Chunks,omitempty"`
+	Digest           []byte                 `protobuf:"bytes,10,opt,name=Digest,proto3" json:"Digest,omitempty"`
+	DigestAlgorithm  string                 `protobuf:"bytes,11,opt,name=DigestAlgorithm,proto3" json:"DigestAlgorithm,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *FileVersion) Reset() {
+	*x = FileVersion{}
+	mi := &file_replicator_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FileVersion) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FileVersion) ProtoMessage() {}
+
+func (x *FileVersion) ProtoReflect() protoreflect.Message {
+	mi := &file_replicator_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FileVersion.ProtoReflect.Descriptor instead.
+func (*FileVersion) Descriptor() ([]byte, []int) {
+	return file_replicator_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *FileVersion) GetRelativeFilePath() string {
+	if x != nil {
+		return x.RelativeFilePath
+	}
+	return ""
+}
+
+func (x *FileVersion) GetVersion() uint64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *FileVersion) GetFileSize() uint64 {
+	if x != nil {
+		return x.FileSize
+	}
+	return 0
+}
+
+func (x *FileVersion) GetFileMode() uint32 {
+	if x != nil {
+		return x.FileMode
+	}
+	return 0
+}
+
+func (x *FileVersion) GetUID() uint32 {
+	if x != nil {
+		return x.UID
+	}
+	return 0
+}
+
+func (x *FileVersion) GetGID() uint32 {
+	if x != nil {
+		return x.GID
+	}
+	return 0
+}
+
+func (x *FileVersion) GetFileHash() uint64 {
+	if x != nil {
+		return x.FileHash
+	}
+	return 0
+}
+
+func (x *FileVersion) GetBlockSize() uint64 {
+	if x != nil {
+		return x.BlockSize
+	}
+	return 0
+}
+
+func (x *FileVersion) GetChunks() []uint64 {
+	if x != nil {
+		return x.Chunks
+	}
+	return nil
+}
+
+func (x *FileVersion) GetDigest() []byte {
+	if x != nil {
+		return x.Digest
+	}
+	return nil
+}
+
+func (x *FileVersion) GetDigestAlgorithm() string {
+	if x != nil {
+		return x.DigestAlgorithm
+	}
+	return ""
+}
+
 type FileOps struct {
 	state               protoimpl.MessageState `protogen:"open.v1"`
 	RelativeFilePath    string                 `protobuf:"bytes,1,opt,name=RelativeFilePath,proto3" json:"RelativeFilePath,omitempty"`
 	NewRelativeFilePath string                 `protobuf:"bytes,2,opt,name=NewRelativeFilePath,proto3" json:"NewRelativeFilePath,omitempty"`
+	VersionVector       map[string]uint64      `protobuf:"bytes,3,rep,name=VersionVector,proto3" json:"VersionVector,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	SiteID              string                 `protobuf:"bytes,4,opt,name=SiteID,proto3" json:"SiteID,omitempty"`
 	unknownFields       protoimpl.UnknownFields
 	sizeCache           protoimpl.SizeCache
 }
 
 func (x *FileOps) Reset() {
 	*x = FileOps{}
-	mi := &file_replicator_proto_msgTypes[1]
+	mi := &file_replicator_proto_msgTypes[2]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -240,7 +433,7 @@ func (x *FileOps) String() string {
 func (*FileOps) ProtoMessage() {}
 
 func (x *FileOps) ProtoReflect() protoreflect.Message {
-	mi := &file_replicator_proto_msgTypes[1]
+	mi := &file_replicator_proto_msgTypes[2]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -253,7 +446,7 @@ func (x *FileOps) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use FileOps.ProtoReflect.Descriptor instead.
 func (*FileOps) Descriptor() ([]byte, []int) {
-	return file_replicator_proto_rawDescGZIP(), []int{1}
+	return file_replicator_proto_rawDescGZIP(), []int{2}
 }
 
 func (x *FileOps) GetRelativeFilePath() string {
@@ -270,18 +463,37 @@ func (x *FileOps) GetNewRelativeFilePath() string {
 	return ""
 }
 
+func (x *FileOps) GetVersionVector() map[string]uint64 {
+	if x != nil {
+		return x.VersionVector
+	}
+	return nil
+}
+
+func (x *FileOps) GetSiteID() string {
+	if x != nil {
+		return x.SiteID
+	}
+	return ""
+}
+
 type ChunkInfo struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Hash          uint64                 `protobuf:"varint,1,opt,name=Hash,proto3" json:"Hash,omitempty"`
-	ChunkID       uint64                 `protobuf:"varint,2,opt,name=ChunkID,proto3" json:"ChunkID,omitempty"`
-	BlockSize     uint64                 `protobuf:"varint,3,opt,name=BlockSize,proto3" json:"BlockSize,omitempty"`
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	Hash      uint64                 `protobuf:"varint,1,opt,name=Hash,proto3" json:"Hash,omitempty"`
+	ChunkID   uint64                 `protobuf:"varint,2,opt,name=ChunkID,proto3" json:"ChunkID,omitempty"`
+	BlockSize uint64                 `protobuf:"varint,3,opt,name=BlockSize,proto3" json:"BlockSize,omitempty"`
+	// the block hash when the signature is not in xxhash64, Hash then holds
+	// its first 8 bytes.
+	Digest []byte `protobuf:"bytes,4,opt,name=Digest,proto3" json:"Digest,omitempty"`
+	// the block hash in the ConfirmAlgorithm of the signature.
+	Confirm       []byte `protobuf:"bytes,5,opt,name=Confirm,proto3" json:"Confirm,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *ChunkInfo) Reset() {
 	*x = ChunkInfo{}
-	mi := &file_replicator_proto_msgTypes[2]
+	mi := &file_replicator_proto_msgTypes[3]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -293,7 +505,7 @@ func (x *ChunkInfo) String() string {
 func (*ChunkInfo) ProtoMessage() {}
 
 func (x *ChunkInfo) ProtoReflect() protoreflect.Message {
-	mi := &file_replicator_proto_msgTypes[2]
+	mi := &file_replicator_proto_msgTypes[3]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -306,7 +518,7 @@ func (x *ChunkInfo) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ChunkInfo.ProtoReflect.Descriptor instead.
 func (*ChunkInfo) Descriptor() ([]byte, []int) {
-	return file_replicator_proto_rawDescGZIP(), []int{2}
+	return file_replicator_proto_rawDescGZIP(), []int{3}
 }
 
 func (x *ChunkInfo) GetHash() uint64 {
@@ -330,6 +542,20 @@ func (x *ChunkInfo) GetBlockSize() uint64 {
 	return 0
 }
 
+func (x *ChunkInfo) GetDigest() []byte {
+	if x != nil {
+		return x.Digest
+	}
+	return nil
+}
+
+func (x *ChunkInfo) GetConfirm() []byte {
+	if x != nil {
+		return x.Confirm
+	}
+	return nil
+}
+
 type DataSignature struct {
 	state            protoimpl.MessageState `protogen:"open.v1"`
 	Chunk            []*ChunkInfo           `protobuf:"bytes,1,rep,name=Chunk,proto3" json:"Chunk,omitempty"`
@@ -340,13 +566,20 @@ type DataSignature struct {
 	FileMode         uint32                 `protobuf:"varint,6,opt,name=FileMode,proto3" json:"FileMode,omitempty"`
 	UID              uint32                 `protobuf:"varint,7,opt,name=UID,proto3" json:"UID,omitempty"`
 	GID              uint32                 `protobuf:"varint,8,opt,name=GID,proto3" json:"GID,omitempty"`
+	VersionVector    map[string]uint64      `protobuf:"bytes,9,rep,name=VersionVector,proto3" json:"VersionVector,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	SiteID           string                 `protobuf:"bytes,10,opt,name=SiteID,proto3" json:"SiteID,omitempty"`
+	ModTime          int64                  `protobuf:"varint,11,opt,name=ModTime,proto3" json:"ModTime,omitempty"`
+	FileHash         uint64                 `protobuf:"varint,12,opt,name=FileHash,proto3" json:"FileHash,omitempty"`
+	// when set, a block matching in HashAlgorithm is only skipped when it
+	// matches in this algorithm too.
+	ConfirmAlgorithm string `protobuf:"bytes,13,opt,name=ConfirmAlgorithm,proto3" json:"ConfirmAlgorithm,omitempty"`
 	unknownFields    protoimpl.UnknownFields
 	sizeCache        protoimpl.SizeCache
 }
 
 func (x *DataSignature) Reset() {
 	*x = DataSignature{}
-	mi := &file_replicator_proto_msgTypes[3]
+	mi := &file_replicator_proto_msgTypes[4]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -358,7 +591,7 @@ func (x *DataSignature) String() string {
 func (*DataSignature) ProtoMessage() {}
 
 func (x *DataSignature) ProtoReflect() protoreflect.Message {
-	mi := &file_replicator_proto_msgTypes[3]
+	mi := &file_replicator_proto_msgTypes[4]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -371,7 +604,7 @@ func (x *DataSignature) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use DataSignature.ProtoReflect.Descriptor instead.
 func (*DataSignature) Descriptor() ([]byte, []int) {
-	return file_replicator_proto_rawDescGZIP(), []int{3}
+	return file_replicator_proto_rawDescGZIP(), []int{4}
 }
 
 func (x *DataSignature) GetChunk() []*ChunkInfo {
@@ -430,17 +663,53 @@ func (x *DataSignature) GetGID() uint32 {
 	return 0
 }
 
+func (x *DataSignature) GetVersionVector() map[string]uint64 {
+	if x != nil {
+		return x.VersionVector
+	}
+	return nil
+}
+
+func (x *DataSignature) GetSiteID() string {
+	if x != nil {
+		return x.SiteID
+	}
+	return ""
+}
+
+func (x *DataSignature) GetModTime() int64 {
+	if x != nil {
+		return x.ModTime
+	}
+	return 0
+}
+
+func (x *DataSignature) GetFileHash() uint64 {
+	if x != nil {
+		return x.FileHash
+	}
+	return 0
+}
+
+func (x *DataSignature) GetConfirmAlgorithm() string {
+	if x != nil {
+		return x.ConfirmAlgorithm
+	}
+	return ""
+}
+
 type Confirmation struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Code          ConfirmationCode       `protobuf:"varint,1,opt,name=Code,proto3,enum=proto.ConfirmationCode" json:"Code,omitempty"`
 	Chunk         []*ChunkInfo           `protobuf:"bytes,2,rep,name=Chunk,proto3" json:"Chunk,omitempty"`
+	VersionVector map[string]uint64      `protobuf:"bytes,3,rep,name=VersionVector,proto3" json:"VersionVector,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *Confirmation) Reset() {
 	*x = Confirmation{}
-	mi := &file_replicator_proto_msgTypes[4]
+	mi := &file_replicator_proto_msgTypes[5]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -452,7 +721,7 @@ func (x *Confirmation) String() string {
 func (*Confirmation) ProtoMessage() {}
 
 func (x *Confirmation) ProtoReflect() protoreflect.Message {
-	mi := &file_replicator_proto_msgTypes[4]
+	mi := &file_replicator_proto_msgTypes[5]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -465,7 +734,7 @@ func (x *Confirmation) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Confirmation.ProtoReflect.Descriptor instead.
 func (*Confirmation) Descriptor() ([]byte, []int) {
-	return file_replicator_proto_rawDescGZIP(), []int{4}
+	return file_replicator_proto_rawDescGZIP(), []int{5}
 }
 
 func (x *Confirmation) GetCode() ConfirmationCode {
@@ -482,28 +751,36 @@ func (x *Confirmation) GetChunk() []*ChunkInfo {
 	return nil
 }
 
-type PingPong struct {
+func (x *Confirmation) GetVersionVector() map[string]uint64 {
+	if x != nil {
+		return x.VersionVector
+	}
+	return nil
+}
+
+type ListRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
-	Val           string                 `protobuf:"bytes,1,opt,name=val,proto3" json:"val,omitempty"`
+	RelativePath  string                 `protobuf:"bytes,1,opt,name=RelativePath,proto3" json:"RelativePath,omitempty"`
+	Archive       bool                   `protobuf:"varint,2,opt,name=Archive,proto3" json:"Archive,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *PingPong) Reset() {
-	*x = PingPong{}
-	mi := &file_replicator_proto_msgTypes[5]
+func (x *ListRequest) Reset() {
+	*x = ListRequest{}
+	mi := &file_replicator_proto_msgTypes[6]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *PingPong) String() string {
+func (x *ListRequest) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*PingPong) ProtoMessage() {}
+func (*ListRequest) ProtoMessage() {}
 
-func (x *PingPong) ProtoReflect() protoreflect.Message {
-	mi := &file_replicator_proto_msgTypes[5]
+func (x *ListRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_replicator_proto_msgTypes[6]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -514,57 +791,837 @@ func (x *PingPong) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use PingPong.ProtoReflect.Descriptor instead.
-func (*PingPong) Descriptor() ([]byte, []int) {
-	return file_replicator_proto_rawDescGZIP(), []int{5}
+// Deprecated: Use ListRequest.ProtoReflect.Descriptor instead.
+func (*ListRequest) Descriptor() ([]byte, []int) {
+	return file_replicator_proto_rawDescGZIP(), []int{6}
 }
 
-func (x *PingPong) GetVal() string {
+func (x *ListRequest) GetRelativePath() string {
 	if x != nil {
-		return x.Val
+		return x.RelativePath
 	}
 	return ""
 }
 
-var File_replicator_proto protoreflect.FileDescriptor
+func (x *ListRequest) GetArchive() bool {
+	if x != nil {
+		return x.Archive
+	}
+	return false
+}
 
-const file_replicator_proto_rawDesc = "" +
-	"\n" +
-	"\x10replicator.proto\x12\x05proto\"\xbd\x02\n" +
-	"\vDataPayload\x12\x12\n" +
-	"\x04Hash\x18\x01 \x01(\fR\x04Hash\x12\x16\n" +
-	"\x06length\x18\x02 \x01(\x04R\x06length\x12\x1c\n" +
-	"\tDataChunk\x18\x03 \x01(\fR\tDataChunk\x12\x18\n" +
-	"\aChunkID\x18\x04 \x01(\x04R\aChunkID\x12$\n" +
-	"\rParentChunkID\x18\x05 \x01(\x04R\rParentChunkID\x12*\n" +
-	"\x10RelativeFilePath\x18\x06 \x01(\tR\x10RelativeFilePath\x12\x1c\n" +
-	"\tBlockSize\x18\a \x01(\x04R\tBlockSize\x12\x1a\n" +
-	"\bFileMode\x18\b \x01(\rR\bFileMode\x12\x1a\n" +
-	"\bFileSize\x18\t \x01(\x04R\bFileSize\x12\x10\n" +
-	"\x03UID\x18\n" +
-	" \x01(\rR\x03UID\x12\x10\n" +
-	"\x03GID\x18\v \x01(\rR\x03GID\"g\n" +
-	"\aFileOps\x12*\n" +
-	"\x10RelativeFilePath\x18\x01 \x01(\tR\x10RelativeFilePath\x120\n" +
-	"\x13NewRelativeFilePath\x18\x02 \x01(\tR\x13NewRelativeFilePath\"W\n" +
-	"\tChunkInfo\x12\x12\n" +
-	"\x04Hash\x18\x01 \x01(\x04R\x04Hash\x12\x18\n" +
-	"\aChunkID\x18\x02 \x01(\x04R\aChunkID\x12\x1c\n" +
-	"\tBlockSize\x18\x03 \x01(\x04R\tBlockSize\"\x83\x02\n" +
-	"\rDataSignature\x12&\n" +
-	"\x05Chunk\x18\x01 \x03(\v2\x10.proto.ChunkInfoR\x05Chunk\x12*\n" +
-	"\x10RelativeFilePath\x18\x02 \x01(\tR\x10RelativeFilePath\x12\x1c\n" +
-	"\tBlockSize\x18\x03 \x01(\x04R\tBlockSize\x12$\n" +
-	"\rHashAlgorithm\x18\x04 \x01(\tR\rHashAlgorithm\x12\x1a\n" +
-	"\bFileSize\x18\x05 \x01(\x04R\bFileSize\x12\x1a\n" +
-	"\bFileMode\x18\x06 \x01(\rR\bFileMode\x12\x10\n" +
-	"\x03UID\x18\a \x01(\rR\x03UID\x12\x10\n" +
-	"\x03GID\x18\b \x01(\rR\x03GID\"c\n" +
-	"\fConfirmation\x12+\n" +
-	"\x04Code\x18\x01 \x01(\x0e2\x17.proto.ConfirmationCodeR\x04Code\x12&\n" +
-	"\x05Chunk\x18\x02 \x03(\v2\x10.proto.ChunkInfoR\x05Chunk\"\x1c\n" +
+type FileInfo struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	RelativeFilePath string                 `protobuf:"bytes,1,opt,name=RelativeFilePath,proto3" json:"RelativeFilePath,omitempty"`
+	FileSize         uint64                 `protobuf:"varint,2,opt,name=FileSize,proto3" json:"FileSize,omitempty"`
+	FileMode         uint32                 `protobuf:"varint,3,opt,name=FileMode,proto3" json:"FileMode,omitempty"`
+	ModTime          int64                  `protobuf:"varint,4,opt,name=ModTime,proto3" json:"ModTime,omitempty"`
+	Version          string                 `protobuf:"bytes,5,opt,name=Version,proto3" json:"Version,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *FileInfo) Reset() {
+	*x = FileInfo{}
+	mi := &file_replicator_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FileInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FileInfo) ProtoMessage() {}
+
+func (x *FileInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_replicator_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FileInfo.ProtoReflect.Descriptor instead.
+func (*FileInfo) Descriptor() ([]byte, []int) {
+	return file_replicator_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *FileInfo) GetRelativeFilePath() string {
+	if x != nil {
+		return x.RelativeFilePath
+	}
+	return ""
+}
+
+func (x *FileInfo) GetFileSize() uint64 {
+	if x != nil {
+		return x.FileSize
+	}
+	return 0
+}
+
+func (x *FileInfo) GetFileMode() uint32 {
+	if x != nil {
+		return x.FileMode
+	}
+	return 0
+}
+
+func (x *FileInfo) GetModTime() int64 {
+	if x != nil {
+		return x.ModTime
+	}
+	return 0
+}
+
+func (x *FileInfo) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+type DigestRequest struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	RelativeFilePath []string               `protobuf:"bytes,1,rep,name=RelativeFilePath,proto3" json:"RelativeFilePath,omitempty"`
+	Algorithm        string                 `protobuf:"bytes,2,opt,name=Algorithm,proto3" json:"Algorithm,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *DigestRequest) Reset() {
+	*x = DigestRequest{}
+	mi := &file_replicator_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DigestRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DigestRequest) ProtoMessage() {}
+
+func (x *DigestRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_replicator_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DigestRequest.ProtoReflect.Descriptor instead.
+func (*DigestRequest) Descriptor() ([]byte, []int) {
+	return file_replicator_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *DigestRequest) GetRelativeFilePath() []string {
+	if x != nil {
+		return x.RelativeFilePath
+	}
+	return nil
+}
+
+func (x *DigestRequest) GetAlgorithm() string {
+	if x != nil {
+		return x.Algorithm
+	}
+	return ""
+}
+
+type FileDigest struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	RelativeFilePath string                 `protobuf:"bytes,1,opt,name=RelativeFilePath,proto3" json:"RelativeFilePath,omitempty"`
+	Code             ConfirmationCode       `protobuf:"varint,2,opt,name=Code,proto3,enum=proto.ConfirmationCode" json:"Code,omitempty"`
+	Algorithm        string                 `protobuf:"bytes,3,opt,name=Algorithm,proto3" json:"Algorithm,omitempty"`
+	Digest           []byte                 `protobuf:"bytes,4,opt,name=Digest,proto3" json:"Digest,omitempty"`
+	FileSize         uint64                 `protobuf:"varint,5,opt,name=FileSize,proto3" json:"FileSize,omitempty"`
+	FileMode         uint32                 `protobuf:"varint,6,opt,name=FileMode,proto3" json:"FileMode,omitempty"`
+	UID              uint32                 `protobuf:"varint,7,opt,name=UID,proto3" json:"UID,omitempty"`
+	GID              uint32                 `protobuf:"varint,8,opt,name=GID,proto3" json:"GID,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *FileDigest) Reset() {
+	*x = FileDigest{}
+	mi := &file_replicator_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FileDigest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FileDigest) ProtoMessage() {}
+
+func (x *FileDigest) ProtoReflect() protoreflect.Message {
+	mi := &file_replicator_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FileDigest.ProtoReflect.Descriptor instead.
+func (*FileDigest) Descriptor() ([]byte, []int) {
+	return file_replicator_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *FileDigest) GetRelativeFilePath() string {
+	if x != nil {
+		return x.RelativeFilePath
+	}
+	return ""
+}
+
+func (x *FileDigest) GetCode() ConfirmationCode {
+	if x != nil {
+		return x.Code
+	}
+	return ConfirmationCode_OK
+}
+
+func (x *FileDigest) GetAlgorithm() string {
+	if x != nil {
+		return x.Algorithm
+	}
+	return ""
+}
+
+func (x *FileDigest) GetDigest() []byte {
+	if x != nil {
+		return x.Digest
+	}
+	return nil
+}
+
+func (x *FileDigest) GetFileSize() uint64 {
+	if x != nil {
+		return x.FileSize
+	}
+	return 0
+}
+
+func (x *FileDigest) GetFileMode() uint32 {
+	if x != nil {
+		return x.FileMode
+	}
+	return 0
+}
+
+func (x *FileDigest) GetUID() uint32 {
+	if x != nil {
+		return x.UID
+	}
+	return 0
+}
+
+func (x *FileDigest) GetGID() uint32 {
+	if x != nil {
+		return x.GID
+	}
+	return 0
+}
+
+type BlockMapRequest struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	RelativeFilePath string                 `protobuf:"bytes,1,opt,name=RelativeFilePath,proto3" json:"RelativeFilePath,omitempty"`
+	BlockSize        uint64                 `protobuf:"varint,2,opt,name=BlockSize,proto3" json:"BlockSize,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *BlockMapRequest) Reset() {
+	*x = BlockMapRequest{}
+	mi := &file_replicator_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BlockMapRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BlockMapRequest) ProtoMessage() {}
+
+func (x *BlockMapRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_replicator_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BlockMapRequest.ProtoReflect.Descriptor instead.
+func (*BlockMapRequest) Descriptor() ([]byte, []int) {
+	return file_replicator_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *BlockMapRequest) GetRelativeFilePath() string {
+	if x != nil {
+		return x.RelativeFilePath
+	}
+	return ""
+}
+
+func (x *BlockMapRequest) GetBlockSize() uint64 {
+	if x != nil {
+		return x.BlockSize
+	}
+	return 0
+}
+
+type FileBlockMap struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	Code             ConfirmationCode       `protobuf:"varint,1,opt,name=Code,proto3,enum=proto.ConfirmationCode" json:"Code,omitempty"`
+	RelativeFilePath string                 `protobuf:"bytes,2,opt,name=RelativeFilePath,proto3" json:"RelativeFilePath,omitempty"`
+	BlockSize        uint64                 `protobuf:"varint,3,opt,name=BlockSize,proto3" json:"BlockSize,omitempty"`
+	FileSize         uint64                 `protobuf:"varint,4,opt,name=FileSize,proto3" json:"FileSize,omitempty"`
+	DiskHash         []uint64               `protobuf:"varint,5,rep,packed,name=DiskHash,proto3" json:"DiskHash,omitempty"`
+	Cached           bool                   `protobuf:"varint,6,opt,name=Cached,proto3" json:"Cached,omitempty"`
+	CachedBlockSize  uint64                 `protobuf:"varint,7,opt,name=CachedBlockSize,proto3" json:"CachedBlockSize,omitempty"`
+	CacheCurrent     bool                   `protobuf:"varint,8,opt,name=CacheCurrent,proto3" json:"CacheCurrent,omitempty"`
+	CachedHash       []uint64               `protobuf:"varint,9,rep,packed,name=CachedHash,proto3" json:"CachedHash,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *FileBlockMap) Reset() {
+	*x = FileBlockMap{}
+	mi := &file_replicator_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FileBlockMap) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FileBlockMap) ProtoMessage() {}
+
+func (x *FileBlockMap) ProtoReflect() protoreflect.Message {
+	mi := &file_replicator_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FileBlockMap.ProtoReflect.Descriptor instead.
+func (*FileBlockMap) Descriptor() ([]byte, []int) {
+	return file_replicator_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *FileBlockMap) GetCode() ConfirmationCode {
+	if x != nil {
+		return x.Code
+	}
+	return ConfirmationCode_OK
+}
+
+func (x *FileBlockMap) GetRelativeFilePath() string {
+	if x != nil {
+		return x.RelativeFilePath
+	}
+	return ""
+}
+
+func (x *FileBlockMap) GetBlockSize() uint64 {
+	if x != nil {
+		return x.BlockSize
+	}
+	return 0
+}
+
+func (x *FileBlockMap) GetFileSize() uint64 {
+	if x != nil {
+		return x.FileSize
+	}
+	return 0
+}
+
+func (x *FileBlockMap) GetDiskHash() []uint64 {
+	if x != nil {
+		return x.DiskHash
+	}
+	return nil
+}
+
+func (x *FileBlockMap) GetCached() bool {
+	if x != nil {
+		return x.Cached
+	}
+	return false
+}
+
+func (x *FileBlockMap) GetCachedBlockSize() uint64 {
+	if x != nil {
+		return x.CachedBlockSize
+	}
+	return 0
+}
+
+func (x *FileBlockMap) GetCacheCurrent() bool {
+	if x != nil {
+		return x.CacheCurrent
+	}
+	return false
+}
+
+func (x *FileBlockMap) GetCachedHash() []uint64 {
+	if x != nil {
+		return x.CachedHash
+	}
+	return nil
+}
+
+type ReadRequest struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	RelativeFilePath string                 `protobuf:"bytes,1,opt,name=RelativeFilePath,proto3" json:"RelativeFilePath,omitempty"`
+	BlockSize        uint64                 `protobuf:"varint,2,opt,name=BlockSize,proto3" json:"BlockSize,omitempty"`
+	Have             []*ChunkInfo           `protobuf:"bytes,3,rep,name=Have,proto3" json:"Have,omitempty"`
+	Archive          bool                   `protobuf:"varint,4,opt,name=Archive,proto3" json:"Archive,omitempty"`
+	Version          string                 `protobuf:"bytes,5,opt,name=Version,proto3" json:"Version,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *ReadRequest) Reset() {
+	*x = ReadRequest{}
+	mi := &file_replicator_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ReadRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReadRequest) ProtoMessage() {}
+
+func (x *ReadRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_replicator_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReadRequest.ProtoReflect.Descriptor instead.
+func (*ReadRequest) Descriptor() ([]byte, []int) {
+	return file_replicator_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *ReadRequest) GetRelativeFilePath() string {
+	if x != nil {
+		return x.RelativeFilePath
+	}
+	return ""
+}
+
+func (x *ReadRequest) GetBlockSize() uint64 {
+	if x != nil {
+		return x.BlockSize
+	}
+	return 0
+}
+
+func (x *ReadRequest) GetHave() []*ChunkInfo {
+	if x != nil {
+		return x.Have
+	}
+	return nil
+}
+
+func (x *ReadRequest) GetArchive() bool {
+	if x != nil {
+		return x.Archive
+	}
+	return false
+}
+
+func (x *ReadRequest) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+type SnapshotRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Label string                 `protobuf:"bytes,1,opt,name=Label,proto3" json:"Label,omitempty"`
+	// milliseconds to wait for the batches in flight, the server default when 0
+	QuiesceTimeout int64 `protobuf:"varint,2,opt,name=QuiesceTimeout,proto3" json:"QuiesceTimeout,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *SnapshotRequest) Reset() {
+	*x = SnapshotRequest{}
+	mi := &file_replicator_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SnapshotRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SnapshotRequest) ProtoMessage() {}
+
+func (x *SnapshotRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_replicator_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SnapshotRequest.ProtoReflect.Descriptor instead.
+func (*SnapshotRequest) Descriptor() ([]byte, []int) {
+	return file_replicator_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *SnapshotRequest) GetLabel() string {
+	if x != nil {
+		return x.Label
+	}
+	return ""
+}
+
+func (x *SnapshotRequest) GetQuiesceTimeout() int64 {
+	if x != nil {
+		return x.QuiesceTimeout
+	}
+	return 0
+}
+
+type SnapshotInfo struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Code          ConfirmationCode       `protobuf:"varint,1,opt,name=Code,proto3,enum=proto.ConfirmationCode" json:"Code,omitempty"`
+	Name          string                 `protobuf:"bytes,2,opt,name=Name,proto3" json:"Name,omitempty"`
+	CreatedAt     int64                  `protobuf:"varint,3,opt,name=CreatedAt,proto3" json:"CreatedAt,omitempty"`
+	Quiescent     bool                   `protobuf:"varint,4,opt,name=Quiescent,proto3" json:"Quiescent,omitempty"`
+	Files         uint64                 `protobuf:"varint,5,opt,name=Files,proto3" json:"Files,omitempty"`
+	Linked        uint64                 `protobuf:"varint,6,opt,name=Linked,proto3" json:"Linked,omitempty"`
+	Copied        uint64                 `protobuf:"varint,7,opt,name=Copied,proto3" json:"Copied,omitempty"`
+	Bytes         uint64                 `protobuf:"varint,8,opt,name=Bytes,proto3" json:"Bytes,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SnapshotInfo) Reset() {
+	*x = SnapshotInfo{}
+	mi := &file_replicator_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SnapshotInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SnapshotInfo) ProtoMessage() {}
+
+func (x *SnapshotInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_replicator_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SnapshotInfo.ProtoReflect.Descriptor instead.
+func (*SnapshotInfo) Descriptor() ([]byte, []int) {
+	return file_replicator_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *SnapshotInfo) GetCode() ConfirmationCode {
+	if x != nil {
+		return x.Code
+	}
+	return ConfirmationCode_OK
+}
+
+func (x *SnapshotInfo) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *SnapshotInfo) GetCreatedAt() int64 {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return 0
+}
+
+func (x *SnapshotInfo) GetQuiescent() bool {
+	if x != nil {
+		return x.Quiescent
+	}
+	return false
+}
+
+func (x *SnapshotInfo) GetFiles() uint64 {
+	if x != nil {
+		return x.Files
+	}
+	return 0
+}
+
+func (x *SnapshotInfo) GetLinked() uint64 {
+	if x != nil {
+		return x.Linked
+	}
+	return 0
+}
+
+func (x *SnapshotInfo) GetCopied() uint64 {
+	if x != nil {
+		return x.Copied
+	}
+	return 0
+}
+
+func (x *SnapshotInfo) GetBytes() uint64 {
+	if x != nil {
+		return x.Bytes
+	}
+	return 0
+}
+
+type PingPong struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Val   string                 `protobuf:"bytes,1,opt,name=val,proto3" json:"val,omitempty"`
+	// the hash algorithms wanted by the sender, answered with the ones the
+	// reciever accepts.
+	HashAlgorithms []string `protobuf:"bytes,2,rep,name=HashAlgorithms,proto3" json:"HashAlgorithms,omitempty"`
+	// the chunk compressions the reciever can inflate.
+	Compressions  []string `protobuf:"bytes,3,rep,name=Compressions,proto3" json:"Compressions,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PingPong) Reset() {
+	*x = PingPong{}
+	mi := &file_replicator_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PingPong) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PingPong) ProtoMessage() {}
+
+func (x *PingPong) ProtoReflect() protoreflect.Message {
+	mi := &file_replicator_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PingPong.ProtoReflect.Descriptor instead.
+func (*PingPong) Descriptor() ([]byte, []int) {
+	return file_replicator_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *PingPong) GetVal() string {
+	if x != nil {
+		return x.Val
+	}
+	return ""
+}
+
+func (x *PingPong) GetHashAlgorithms() []string {
+	if x != nil {
+		return x.HashAlgorithms
+	}
+	return nil
+}
+
+func (x *PingPong) GetCompressions() []string {
+	if x != nil {
+		return x.Compressions
+	}
+	return nil
+}
+
+var File_replicator_proto protoreflect.FileDescriptor
+
+const file_replicator_proto_rawDesc = "" +
+	"\n" +
+	"\x10replicator.proto\x12\x05proto\"\xad\x03\n" +
+	"\vDataPayload\x12\x12\n" +
+	"\x04Hash\x18\x01 \x01(\fR\x04Hash\x12\x16\n" +
+	"\x06length\x18\x02 \x01(\x04R\x06length\x12\x1c\n" +
+	"\tDataChunk\x18\x03 \x01(\fR\tDataChunk\x12\x18\n" +
+	"\aChunkID\x18\x04 \x01(\x04R\aChunkID\x12$\n" +
+	"\rParentChunkID\x18\x05 \x01(\x04R\rParentChunkID\x12*\n" +
+	"\x10RelativeFilePath\x18\x06 \x01(\tR\x10RelativeFilePath\x12\x1c\n" +
+	"\tBlockSize\x18\a \x01(\x04R\tBlockSize\x12\x1a\n" +
+	"\bFileMode\x18\b \x01(\rR\bFileMode\x12\x1a\n" +
+	"\bFileSize\x18\t \x01(\x04R\bFileSize\x12\x10\n" +
+	"\x03UID\x18\n" +
+	" \x01(\rR\x03UID\x12\x10\n" +
+	"\x03GID\x18\v \x01(\rR\x03GID\x12&\n" +
+	"\x0eStagingVersion\x18\f \x01(\x04R\x0eStagingVersion\x12$\n" +
+	"\rHashAlgorithm\x18\r \x01(\tR\rHashAlgorithm\x12 \n" +
+	"\vCompression\x18\x0e \x01(\tR\vCompression\"\xc3\x02\n" +
+	"\vFileVersion\x12*\n" +
+	"\x10RelativeFilePath\x18\x01 \x01(\tR\x10RelativeFilePath\x12\x18\n" +
+	"\aVersion\x18\x02 \x01(\x04R\aVersion\x12\x1a\n" +
+	"\bFileSize\x18\x03 \x01(\x04R\bFileSize\x12\x1a\n" +
+	"\bFileMode\x18\x04 \x01(\rR\bFileMode\x12\x10\n" +
+	"\x03UID\x18\x05 \x01(\rR\x03UID\x12\x10\n" +
+	"\x03GID\x18\x06 \x01(\rR\x03GID\x12\x1a\n" +
+	"\bFileHash\x18\a \x01(\x04R\bFileHash\x12\x1c\n" +
+	"\tBlockSize\x18\b \x01(\x04R\tBlockSize\x12\x16\n" +
+	"\x06Chunks\x18\t \x03(\x04R\x06Chunks\x12\x16\n" +
+	"\x06Digest\x18\n" +
+	" \x01(\fR\x06Digest\x12(\n" +
+	"\x0fDigestAlgorithm\x18\v \x01(\tR\x0fDigestAlgorithm\"\x8a\x02\n" +
+	"\aFileOps\x12*\n" +
+	"\x10RelativeFilePath\x18\x01 \x01(\tR\x10RelativeFilePath\x120\n" +
+	"\x13NewRelativeFilePath\x18\x02 \x01(\tR\x13NewRelativeFilePath\x12G\n" +
+	"\rVersionVector\x18\x03 \x03(\v2!.proto.FileOps.VersionVectorEntryR\rVersionVector\x12\x16\n" +
+	"\x06SiteID\x18\x04 \x01(\tR\x06SiteID\x1a@\n" +
+	"\x12VersionVectorEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x04R\x05value:\x028\x01\"\x89\x01\n" +
+	"\tChunkInfo\x12\x12\n" +
+	"\x04Hash\x18\x01 \x01(\x04R\x04Hash\x12\x18\n" +
+	"\aChunkID\x18\x02 \x01(\x04R\aChunkID\x12\x1c\n" +
+	"\tBlockSize\x18\x03 \x01(\x04R\tBlockSize\x12\x16\n" +
+	"\x06Digest\x18\x04 \x01(\fR\x06Digest\x12\x18\n" +
+	"\aConfirm\x18\x05 \x01(\fR\aConfirm\"\x8e\x04\n" +
+	"\rDataSignature\x12&\n" +
+	"\x05Chunk\x18\x01 \x03(\v2\x10.proto.ChunkInfoR\x05Chunk\x12*\n" +
+	"\x10RelativeFilePath\x18\x02 \x01(\tR\x10RelativeFilePath\x12\x1c\n" +
+	"\tBlockSize\x18\x03 \x01(\x04R\tBlockSize\x12$\n" +
+	"\rHashAlgorithm\x18\x04 \x01(\tR\rHashAlgorithm\x12\x1a\n" +
+	"\bFileSize\x18\x05 \x01(\x04R\bFileSize\x12\x1a\n" +
+	"\bFileMode\x18\x06 \x01(\rR\bFileMode\x12\x10\n" +
+	"\x03UID\x18\a \x01(\rR\x03UID\x12\x10\n" +
+	"\x03GID\x18\b \x01(\rR\x03GID\x12M\n" +
+	"\rVersionVector\x18\t \x03(\v2'.proto.DataSignature.VersionVectorEntryR\rVersionVector\x12\x16\n" +
+	"\x06SiteID\x18\n" +
+	" \x01(\tR\x06SiteID\x12\x18\n" +
+	"\aModTime\x18\v \x01(\x03R\aModTime\x12\x1a\n" +
+	"\bFileHash\x18\f \x01(\x04R\bFileHash\x12*\n" +
+	"\x10ConfirmAlgorithm\x18\r \x01(\tR\x10ConfirmAlgorithm\x1a@\n" +
+	"\x12VersionVectorEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x04R\x05value:\x028\x01\"\xf3\x01\n" +
+	"\fConfirmation\x12+\n" +
+	"\x04Code\x18\x01 \x01(\x0e2\x17.proto.ConfirmationCodeR\x04Code\x12&\n" +
+	"\x05Chunk\x18\x02 \x03(\v2\x10.proto.ChunkInfoR\x05Chunk\x12L\n" +
+	"\rVersionVector\x18\x03 \x03(\v2&.proto.Confirmation.VersionVectorEntryR\rVersionVector\x1a@\n" +
+	"\x12VersionVectorEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x04R\x05value:\x028\x01\"K\n" +
+	"\vListRequest\x12\"\n" +
+	"\fRelativePath\x18\x01 \x01(\tR\fRelativePath\x12\x18\n" +
+	"\aArchive\x18\x02 \x01(\bR\aArchive\"\xa2\x01\n" +
+	"\bFileInfo\x12*\n" +
+	"\x10RelativeFilePath\x18\x01 \x01(\tR\x10RelativeFilePath\x12\x1a\n" +
+	"\bFileSize\x18\x02 \x01(\x04R\bFileSize\x12\x1a\n" +
+	"\bFileMode\x18\x03 \x01(\rR\bFileMode\x12\x18\n" +
+	"\aModTime\x18\x04 \x01(\x03R\aModTime\x12\x18\n" +
+	"\aVersion\x18\x05 \x01(\tR\aVersion\"Y\n" +
+	"\rDigestRequest\x12*\n" +
+	"\x10RelativeFilePath\x18\x01 \x03(\tR\x10RelativeFilePath\x12\x1c\n" +
+	"\tAlgorithm\x18\x02 \x01(\tR\tAlgorithm\"\xf7\x01\n" +
+	"\n" +
+	"FileDigest\x12*\n" +
+	"\x10RelativeFilePath\x18\x01 \x01(\tR\x10RelativeFilePath\x12+\n" +
+	"\x04Code\x18\x02 \x01(\x0e2\x17.proto.ConfirmationCodeR\x04Code\x12\x1c\n" +
+	"\tAlgorithm\x18\x03 \x01(\tR\tAlgorithm\x12\x16\n" +
+	"\x06Digest\x18\x04 \x01(\fR\x06Digest\x12\x1a\n" +
+	"\bFileSize\x18\x05 \x01(\x04R\bFileSize\x12\x1a\n" +
+	"\bFileMode\x18\x06 \x01(\rR\bFileMode\x12\x10\n" +
+	"\x03UID\x18\a \x01(\rR\x03UID\x12\x10\n" +
+	"\x03GID\x18\b \x01(\rR\x03GID\"[\n" +
+	"\x0fBlockMapRequest\x12*\n" +
+	"\x10RelativeFilePath\x18\x01 \x01(\tR\x10RelativeFilePath\x12\x1c\n" +
+	"\tBlockSize\x18\x02 \x01(\x04R\tBlockSize\"\xc3\x02\n" +
+	"\fFileBlockMap\x12+\n" +
+	"\x04Code\x18\x01 \x01(\x0e2\x17.proto.ConfirmationCodeR\x04Code\x12*\n" +
+	"\x10RelativeFilePath\x18\x02 \x01(\tR\x10RelativeFilePath\x12\x1c\n" +
+	"\tBlockSize\x18\x03 \x01(\x04R\tBlockSize\x12\x1a\n" +
+	"\bFileSize\x18\x04 \x01(\x04R\bFileSize\x12\x1a\n" +
+	"\bDiskHash\x18\x05 \x03(\x04R\bDiskHash\x12\x16\n" +
+	"\x06Cached\x18\x06 \x01(\bR\x06Cached\x12(\n" +
+	"\x0fCachedBlockSize\x18\a \x01(\x04R\x0fCachedBlockSize\x12\"\n" +
+	"\fCacheCurrent\x18\b \x01(\bR\fCacheCurrent\x12\x1e\n" +
+	"\n" +
+	"CachedHash\x18\t \x03(\x04R\n" +
+	"CachedHash\"\xb1\x01\n" +
+	"\vReadRequest\x12*\n" +
+	"\x10RelativeFilePath\x18\x01 \x01(\tR\x10RelativeFilePath\x12\x1c\n" +
+	"\tBlockSize\x18\x02 \x01(\x04R\tBlockSize\x12$\n" +
+	"\x04Have\x18\x03 \x03(\v2\x10.proto.ChunkInfoR\x04Have\x12\x18\n" +
+	"\aArchive\x18\x04 \x01(\bR\aArchive\x12\x18\n" +
+	"\aVersion\x18\x05 \x01(\tR\aVersion\"O\n" +
+	"\x0fSnapshotRequest\x12\x14\n" +
+	"\x05Label\x18\x01 \x01(\tR\x05Label\x12&\n" +
+	"\x0eQuiesceTimeout\x18\x02 \x01(\x03R\x0eQuiesceTimeout\"\xe7\x01\n" +
+	"\fSnapshotInfo\x12+\n" +
+	"\x04Code\x18\x01 \x01(\x0e2\x17.proto.ConfirmationCodeR\x04Code\x12\x12\n" +
+	"\x04Name\x18\x02 \x01(\tR\x04Name\x12\x1c\n" +
+	"\tCreatedAt\x18\x03 \x01(\x03R\tCreatedAt\x12\x1c\n" +
+	"\tQuiescent\x18\x04 \x01(\bR\tQuiescent\x12\x14\n" +
+	"\x05Files\x18\x05 \x01(\x04R\x05Files\x12\x16\n" +
+	"\x06Linked\x18\x06 \x01(\x04R\x06Linked\x12\x16\n" +
+	"\x06Copied\x18\a \x01(\x04R\x06Copied\x12\x14\n" +
+	"\x05Bytes\x18\b \x01(\x04R\x05Bytes\"h\n" +
 	"\bPingPong\x12\x10\n" +
-	"\x03val\x18\x01 \x01(\tR\x03val*\xe9\x01\n" +
+	"\x03val\x18\x01 \x01(\tR\x03val\x12&\n" +
+	"\x0eHashAlgorithms\x18\x02 \x03(\tR\x0eHashAlgorithms\x12\"\n" +
+	"\fCompressions\x18\x03 \x03(\tR\fCompressions*\xd4\x03\n" +
 	"\x10ConfirmationCode\x12\x06\n" +
 	"\x02OK\x10\x00\x12\x10\n" +
 	"\fUPDATE_ERROR\x10\x01\x12\x12\n" +
@@ -574,15 +1631,35 @@ const file_replicator_proto_rawDesc = "" +
 	"\fOFFSET_ERROR\x10\x05\x12\x14\n" +
 	"\x10BLOCK_SIZE_ERROR\x10\x06\x12\x15\n" +
 	"\x11CHANGES_NOT_FOUND\x10\a\x12\x14\n" +
-	"\x10CHANGES_REPORTED\x10\b\x12\x14\n" +
+	"\x10CHANGES_REPORTED\x10\b\x12\f\n" +
+	"\bCONFLICT\x10\t\x12\x14\n" +
+	"\x10VERSION_OUTDATED\x10\n" +
+	"\x12\x16\n" +
+	"\x12VERSION_INCOMPLETE\x10\v\x12\x15\n" +
+	"\x11CHECKSUM_MISMATCH\x10\f\x12\x14\n" +
+	"\x10HASH_UNSUPPORTED\x10\r\x12\x13\n" +
+	"\x0fCHUNK_CORRUPTED\x10\x0e\x12\x1b\n" +
+	"\x17COMPRESSION_UNSUPPORTED\x10\x0f\x12\x15\n" +
+	"\x11PERMISSION_DENIED\x10\x10\x12\x15\n" +
+	"\x11UNKNOWN_NAMESPACE\x10\x11\x12\x12\n" +
+	"\x0eQUOTA_EXCEEDED\x10\x12\x12\f\n" +
+	"\bNO_SPACE\x10\x13\x12\x14\n" +
 	"\x0fUNHANDLED_ERROR\x10\xfe\x01\x12\x0e\n" +
-	"\tDUPLICATE\x10\xff\x012\x8c\x02\n" +
+	"\tDUPLICATE\x10\xff\x012\xab\x05\n" +
 	"\x0eFileReplicator\x124\n" +
 	"\tReplicate\x12\x12.proto.DataPayload\x1a\x13.proto.Confirmation\x12<\n" +
 	"\x0fCheckDuplicates\x12\x14.proto.DataSignature\x1a\x13.proto.Confirmation\x12-\n" +
 	"\x06Rename\x12\x0e.proto.FileOps\x1a\x13.proto.Confirmation\x12-\n" +
 	"\x06Delete\x12\x0e.proto.FileOps\x1a\x13.proto.Confirmation\x12(\n" +
-	"\x04Ping\x12\x0f.proto.PingPong\x1a\x0f.proto.PingPongB\x0fZ\r./;replicatorb\x06proto3"
+	"\x04Ping\x12\x0f.proto.PingPong\x1a\x0f.proto.PingPong\x12-\n" +
+	"\x04List\x12\x12.proto.ListRequest\x1a\x0f.proto.FileInfo0\x01\x123\n" +
+	"\x06Digest\x12\x14.proto.DigestRequest\x1a\x11.proto.FileDigest0\x01\x127\n" +
+	"\bBlockMap\x12\x16.proto.BlockMapRequest\x1a\x13.proto.FileBlockMap\x120\n" +
+	"\x04Read\x12\x12.proto.ReadRequest\x1a\x12.proto.DataPayload0\x01\x127\n" +
+	"\bSnapshot\x12\x16.proto.SnapshotRequest\x1a\x13.proto.SnapshotInfo\x120\n" +
+	"\x05Begin\x12\x12.proto.FileVersion\x1a\x13.proto.Confirmation\x121\n" +
+	"\x06Commit\x12\x12.proto.FileVersion\x1a\x13.proto.Confirmation\x120\n" +
+	"\x05Abort\x12\x12.proto.FileVersion\x1a\x13.proto.ConfirmationB\x0fZ\r./;replicatorb\x06proto3"
 
 var (
 	file_replicator_proto_rawDescOnce sync.Once
@@ -597,35 +1674,71 @@ func file_replicator_proto_rawDescGZIP() []byte {
 }
 
 var file_replicator_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
-var file_replicator_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_replicator_proto_msgTypes = make([]protoimpl.MessageInfo, 19)
 var file_replicator_proto_goTypes = []any{
-	(ConfirmationCode)(0), // 0: proto.ConfirmationCode
-	(*DataPayload)(nil),   // 1: proto.DataPayload
-	(*FileOps)(nil),       // 2: proto.FileOps
-	(*ChunkInfo)(nil),     // 3: proto.ChunkInfo
-	(*DataSignature)(nil), // 4: proto.DataSignature
-	(*Confirmation)(nil),  // 5: proto.Confirmation
-	(*PingPong)(nil),      // 6: proto.PingPong
+	(ConfirmationCode)(0),   // 0: proto.ConfirmationCode
+	(*DataPayload)(nil),     // 1: proto.DataPayload
+	(*FileVersion)(nil),     // 2: proto.FileVersion
+	(*FileOps)(nil),         // 3: proto.FileOps
+	(*ChunkInfo)(nil),       // 4: proto.ChunkInfo
+	(*DataSignature)(nil),   // 5: proto.DataSignature
+	(*Confirmation)(nil),    // 6: proto.Confirmation
+	(*ListRequest)(nil),     // 7: proto.ListRequest
+	(*FileInfo)(nil),        // 8: proto.FileInfo
+	(*DigestRequest)(nil),   // 9: proto.DigestRequest
+	(*FileDigest)(nil),      // 10: proto.FileDigest
+	(*BlockMapRequest)(nil), // 11: proto.BlockMapRequest
+	(*FileBlockMap)(nil),    // 12: proto.FileBlockMap
+	(*ReadRequest)(nil),     // 13: proto.ReadRequest
+	(*SnapshotRequest)(nil), // 14: proto.SnapshotRequest
+	(*SnapshotInfo)(nil),    // 15: proto.SnapshotInfo
+	(*PingPong)(nil),        // 16: proto.PingPong
+	nil,                     // 17: proto.FileOps.VersionVectorEntry
+	nil,                     // 18: proto.DataSignature.VersionVectorEntry
+	nil,                     // 19: proto.Confirmation.VersionVectorEntry
 }
 var file_replicator_proto_depIdxs = []int32{
-	3, // 0: proto.DataSignature.Chunk:type_name -> proto.ChunkInfo
-	0, // 1: proto.Confirmation.Code:type_name -> proto.ConfirmationCode
-	3, // 2: proto.Confirmation.Chunk:type_name -> proto.ChunkInfo
-	1, // 3: proto.FileReplicator.Replicate:input_type -> proto.DataPayload
-	4, // 4: proto.FileReplicator.CheckDuplicates:input_type -> proto.DataSignature
-	2, // 5: proto.FileReplicator.Rename:input_type -> proto.FileOps
-	2, // 6: proto.FileReplicator.Delete:input_type -> proto.FileOps
-	6, // 7: proto.FileReplicator.Ping:input_type -> proto.PingPong
-	5, // 8: proto.FileReplicator.Replicate:output_type -> proto.Confirmation
-	5, // 9: proto.FileReplicator.CheckDuplicates:output_type -> proto.Confirmation
-	5, // 10: proto.FileReplicator.Rename:output_type -> proto.Confirmation
-	5, // 11: proto.FileReplicator.Delete:output_type -> proto.Confirmation
-	6, // 12: proto.FileReplicator.Ping:output_type -> proto.PingPong
-	8, // [8:13] is the sub-list for method output_type
-	3, // [3:8] is the sub-list for method input_type
-	3, // [3:3] is the sub-list for extension type_name
-	3, // [3:3] is the sub-list for extension extendee
-	0, // [0:3] is the sub-list for field type_name
+	17, // 0: proto.FileOps.VersionVector:type_name -> proto.FileOps.VersionVectorEntry
+	4,  // 1: proto.DataSignature.Chunk:type_name -> proto.ChunkInfo
+	18, // 2: proto.DataSignature.VersionVector:type_name -> proto.DataSignature.VersionVectorEntry
+	0,  // 3: proto.Confirmation.Code:type_name -> proto.ConfirmationCode
+	4,  // 4: proto.Confirmation.Chunk:type_name -> proto.ChunkInfo
+	19, // 5: proto.Confirmation.VersionVector:type_name -> proto.Confirmation.VersionVectorEntry
+	0,  // 6: proto.FileDigest.Code:type_name -> proto.ConfirmationCode
+	0,  // 7: proto.FileBlockMap.Code:type_name -> proto.ConfirmationCode
+	4,  // 8: proto.ReadRequest.Have:type_name -> proto.ChunkInfo
+	0,  // 9: proto.SnapshotInfo.Code:type_name -> proto.ConfirmationCode
+	1,  // 10: proto.FileReplicator.Replicate:input_type -> proto.DataPayload
+	5,  // 11: proto.FileReplicator.CheckDuplicates:input_type -> proto.DataSignature
+	3,  // 12: proto.FileReplicator.Rename:input_type -> proto.FileOps
+	3,  // 13: proto.FileReplicator.Delete:input_type -> proto.FileOps
+	16, // 14: proto.FileReplicator.Ping:input_type -> proto.PingPong
+	7,  // 15: proto.FileReplicator.List:input_type -> proto.ListRequest
+	9,  // 16: proto.FileReplicator.Digest:input_type -> proto.DigestRequest
+	11, // 17: proto.FileReplicator.BlockMap:input_type -> proto.BlockMapRequest
+	13, // 18: proto.FileReplicator.Read:input_type -> proto.ReadRequest
+	14, // 19: proto.FileReplicator.Snapshot:input_type -> proto.SnapshotRequest
+	2,  // 20: proto.FileReplicator.Begin:input_type -> proto.FileVersion
+	2,  // 21: proto.FileReplicator.Commit:input_type -> proto.FileVersion
+	2,  // 22: proto.FileReplicator.Abort:input_type -> proto.FileVersion
+	6,  // 23: proto.FileReplicator.Replicate:output_type -> proto.Confirmation
+	6,  // 24: proto.FileReplicator.CheckDuplicates:output_type -> proto.Confirmation
+	6,  // 25: proto.FileReplicator.Rename:output_type -> proto.Confirmation
+	6,  // 26: proto.FileReplicator.Delete:output_type -> proto.Confirmation
+	16, // 27: proto.FileReplicator.Ping:output_type -> proto.PingPong
+	8,  // 28: proto.FileReplicator.List:output_type -> proto.FileInfo
+	10, // 29: proto.FileReplicator.Digest:output_type -> proto.FileDigest
+	12, // 30: proto.FileReplicator.BlockMap:output_type -> proto.FileBlockMap
+	1,  // 31: proto.FileReplicator.Read:output_type -> proto.DataPayload
+	15, // 32: proto.FileReplicator.Snapshot:output_type -> proto.SnapshotInfo
+	6,  // 33: proto.FileReplicator.Begin:output_type -> proto.Confirmation
+	6,  // 34: proto.FileReplicator.Commit:output_type -> proto.Confirmation
+	6,  // 35: proto.FileReplicator.Abort:output_type -> proto.Confirmation
+	23, // [23:36] is the sub-list for method output_type
+	10, // [10:23] is the sub-list for method input_type
+	10, // [10:10] is the sub-list for extension type_name
+	10, // [10:10] is the sub-list for extension extendee
+	0,  // [0:10] is the sub-list for field type_name
 }
 
 func init() { file_replicator_proto_init() }
@@ -639,7 +1752,7 @@ func file_replicator_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_replicator_proto_rawDesc), len(file_replicator_proto_rawDesc)),
 			NumEnums:      1,
-			NumMessages:   6,
+			NumMessages:   19,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
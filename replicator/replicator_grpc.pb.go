@@ -24,6 +24,14 @@ const (
 	FileReplicator_Rename_FullMethodName          = "/proto.FileReplicator/Rename"
 	FileReplicator_Delete_FullMethodName          = "/proto.FileReplicator/Delete"
 	FileReplicator_Ping_FullMethodName            = "/proto.FileReplicator/Ping"
+	FileReplicator_List_FullMethodName            = "/proto.FileReplicator/List"
+	FileReplicator_Digest_FullMethodName          = "/proto.FileReplicator/Digest"
+	FileReplicator_BlockMap_FullMethodName        = "/proto.FileReplicator/BlockMap"
+	FileReplicator_Read_FullMethodName            = "/proto.FileReplicator/Read"
+	FileReplicator_Snapshot_FullMethodName        = "/proto.FileReplicator/Snapshot"
+	FileReplicator_Begin_FullMethodName           = "/proto.FileReplicator/Begin"
+	FileReplicator_Commit_FullMethodName          = "/proto.FileReplicator/Commit"
+	FileReplicator_Abort_FullMethodName           = "/proto.FileReplicator/Abort"
 )
 
 // FileReplicatorClient is the client API for FileReplicator service.
@@ -35,6 +43,14 @@ type FileReplicatorClient interface {
 	Rename(ctx context.Context, in *FileOps, opts ...grpc.CallOption) (*Confirmation, error)
 	Delete(ctx context.Context, in *FileOps, opts ...grpc.CallOption) (*Confirmation, error)
 	Ping(ctx context.Context, in *PingPong, opts ...grpc.CallOption) (*PingPong, error)
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[FileInfo], error)
+	Digest(ctx context.Context, in *DigestRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[FileDigest], error)
+	BlockMap(ctx context.Context, in *BlockMapRequest, opts ...grpc.CallOption) (*FileBlockMap, error)
+	Read(ctx context.Context, in *ReadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[DataPayload], error)
+	Snapshot(ctx context.Context, in *SnapshotRequest, opts ...grpc.CallOption) (*SnapshotInfo, error)
+	Begin(ctx context.Context, in *FileVersion, opts ...grpc.CallOption) (*Confirmation, error)
+	Commit(ctx context.Context, in *FileVersion, opts ...grpc.CallOption) (*Confirmation, error)
+	Abort(ctx context.Context, in *FileVersion, opts ...grpc.CallOption) (*Confirmation, error)
 }
 
 type fileReplicatorClient struct {
@@ -95,6 +111,113 @@ func (c *fileReplicatorClient) Ping(ctx context.Context, in *PingPong, opts ...g
 	return out, nil
 }
 
+func (c *fileReplicatorClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[FileInfo], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &FileReplicator_ServiceDesc.Streams[0], FileReplicator_List_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ListRequest, FileInfo]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileReplicator_ListClient = grpc.ServerStreamingClient[FileInfo]
+
+func (c *fileReplicatorClient) Digest(ctx context.Context, in *DigestRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[FileDigest], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &FileReplicator_ServiceDesc.Streams[1], FileReplicator_Digest_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[DigestRequest, FileDigest]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileReplicator_DigestClient = grpc.ServerStreamingClient[FileDigest]
+
+func (c *fileReplicatorClient) BlockMap(ctx context.Context, in *BlockMapRequest, opts ...grpc.CallOption) (*FileBlockMap, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(FileBlockMap)
+	err := c.cc.Invoke(ctx, FileReplicator_BlockMap_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fileReplicatorClient) Read(ctx context.Context, in *ReadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[DataPayload], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &FileReplicator_ServiceDesc.Streams[2], FileReplicator_Read_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ReadRequest, DataPayload]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileReplicator_ReadClient = grpc.ServerStreamingClient[DataPayload]
+
+func (c *fileReplicatorClient) Snapshot(ctx context.Context, in *SnapshotRequest, opts ...grpc.CallOption) (*SnapshotInfo, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SnapshotInfo)
+	err := c.cc.Invoke(ctx, FileReplicator_Snapshot_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fileReplicatorClient) Begin(ctx context.Context, in *FileVersion, opts ...grpc.CallOption) (*Confirmation, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Confirmation)
+	err := c.cc.Invoke(ctx, FileReplicator_Begin_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fileReplicatorClient) Commit(ctx context.Context, in *FileVersion, opts ...grpc.CallOption) (*Confirmation, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Confirmation)
+	err := c.cc.Invoke(ctx, FileReplicator_Commit_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fileReplicatorClient) Abort(ctx context.Context, in *FileVersion, opts ...grpc.CallOption) (*Confirmation, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Confirmation)
+	err := c.cc.Invoke(ctx, FileReplicator_Abort_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // FileReplicatorServer is the server API for FileReplicator service.
 // All implementations must embed UnimplementedFileReplicatorServer
 // for forward compatibility.
@@ -104,6 +227,14 @@ type FileReplicatorServer interface {
 	Rename(context.Context, *FileOps) (*Confirmation, error)
 	Delete(context.Context, *FileOps) (*Confirmation, error)
 	Ping(context.Context, *PingPong) (*PingPong, error)
+	List(*ListRequest, grpc.ServerStreamingServer[FileInfo]) error
+	Digest(*DigestRequest, grpc.ServerStreamingServer[FileDigest]) error
+	BlockMap(context.Context, *BlockMapRequest) (*FileBlockMap, error)
+	Read(*ReadRequest, grpc.ServerStreamingServer[DataPayload]) error
+	Snapshot(context.Context, *SnapshotRequest) (*SnapshotInfo, error)
+	Begin(context.Context, *FileVersion) (*Confirmation, error)
+	Commit(context.Context, *FileVersion) (*Confirmation, error)
+	Abort(context.Context, *FileVersion) (*Confirmation, error)
 	mustEmbedUnimplementedFileReplicatorServer()
 }
 
@@ -129,6 +260,30 @@ func (UnimplementedFileReplicatorServer) Delete(context.Context, *FileOps) (*Con
 func (UnimplementedFileReplicatorServer) Ping(context.Context, *PingPong) (*PingPong, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Ping not implemented")
 }
+func (UnimplementedFileReplicatorServer) List(*ListRequest, grpc.ServerStreamingServer[FileInfo]) error {
+	return status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedFileReplicatorServer) Digest(*DigestRequest, grpc.ServerStreamingServer[FileDigest]) error {
+	return status.Errorf(codes.Unimplemented, "method Digest not implemented")
+}
+func (UnimplementedFileReplicatorServer) BlockMap(context.Context, *BlockMapRequest) (*FileBlockMap, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BlockMap not implemented")
+}
+func (UnimplementedFileReplicatorServer) Read(*ReadRequest, grpc.ServerStreamingServer[DataPayload]) error {
+	return status.Errorf(codes.Unimplemented, "method Read not implemented")
+}
+func (UnimplementedFileReplicatorServer) Snapshot(context.Context, *SnapshotRequest) (*SnapshotInfo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Snapshot not implemented")
+}
+func (UnimplementedFileReplicatorServer) Begin(context.Context, *FileVersion) (*Confirmation, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Begin not implemented")
+}
+func (UnimplementedFileReplicatorServer) Commit(context.Context, *FileVersion) (*Confirmation, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Commit not implemented")
+}
+func (UnimplementedFileReplicatorServer) Abort(context.Context, *FileVersion) (*Confirmation, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Abort not implemented")
+}
 func (UnimplementedFileReplicatorServer) mustEmbedUnimplementedFileReplicatorServer() {}
 func (UnimplementedFileReplicatorServer) testEmbeddedByValue()                        {}
 
@@ -240,6 +395,129 @@ func _FileReplicator_Ping_Handler(srv interface{}, ctx context.Context, dec func
 	return interceptor(ctx, in, info, handler)
 }
 
+func _FileReplicator_List_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FileReplicatorServer).List(m, &grpc.GenericServerStream[ListRequest, FileInfo]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileReplicator_ListServer = grpc.ServerStreamingServer[FileInfo]
+
+func _FileReplicator_Digest_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(DigestRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FileReplicatorServer).Digest(m, &grpc.GenericServerStream[DigestRequest, FileDigest]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileReplicator_DigestServer = grpc.ServerStreamingServer[FileDigest]
+
+func _FileReplicator_BlockMap_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockMapRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileReplicatorServer).BlockMap(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FileReplicator_BlockMap_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileReplicatorServer).BlockMap(ctx, req.(*BlockMapRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileReplicator_Read_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ReadRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FileReplicatorServer).Read(m, &grpc.GenericServerStream[ReadRequest, DataPayload]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileReplicator_ReadServer = grpc.ServerStreamingServer[DataPayload]
+
+func _FileReplicator_Snapshot_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SnapshotRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileReplicatorServer).Snapshot(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FileReplicator_Snapshot_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileReplicatorServer).Snapshot(ctx, req.(*SnapshotRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileReplicator_Begin_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileVersion)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileReplicatorServer).Begin(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FileReplicator_Begin_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileReplicatorServer).Begin(ctx, req.(*FileVersion))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileReplicator_Commit_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileVersion)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileReplicatorServer).Commit(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FileReplicator_Commit_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileReplicatorServer).Commit(ctx, req.(*FileVersion))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileReplicator_Abort_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileVersion)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileReplicatorServer).Abort(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FileReplicator_Abort_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileReplicatorServer).Abort(ctx, req.(*FileVersion))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // FileReplicator_ServiceDesc is the grpc.ServiceDesc for FileReplicator service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -267,7 +545,43 @@ var FileReplicator_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Ping",
 			Handler:    _FileReplicator_Ping_Handler,
 		},
+		{
+			MethodName: "BlockMap",
+			Handler:    _FileReplicator_BlockMap_Handler,
+		},
+		{
+			MethodName: "Snapshot",
+			Handler:    _FileReplicator_Snapshot_Handler,
+		},
+		{
+			MethodName: "Begin",
+			Handler:    _FileReplicator_Begin_Handler,
+		},
+		{
+			MethodName: "Commit",
+			Handler:    _FileReplicator_Commit_Handler,
+		},
+		{
+			MethodName: "Abort",
+			Handler:    _FileReplicator_Abort_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "List",
+			Handler:       _FileReplicator_List_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Digest",
+			Handler:       _FileReplicator_Digest_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Read",
+			Handler:       _FileReplicator_Read_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "replicator.proto",
 }